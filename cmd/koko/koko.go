@@ -54,6 +54,9 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(koko.RunVerify(os.Args[2:]))
+	}
 	flag.Parse()
 	if infoFlag {
 		fmt.Printf("Version:             %s\n", koko.Version)
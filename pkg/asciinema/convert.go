@@ -0,0 +1,269 @@
+package asciinema
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// WriteTranscript 将录像转换为纯文本记录, 包括滚出屏幕的内容和最后一屏
+func WriteTranscript(r *Reader, w io.Writer) error {
+	header := r.Header()
+	bw := bufio.NewWriter(w)
+	term := NewTerminal(header.Width, header.Height)
+	term.OnScroll = func(line []Cell) {
+		_, _ = bw.WriteString(LineText(line))
+		_ = bw.WriteByte('\n')
+	}
+	for {
+		event, err := r.ReadEvent()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if event.Type == EventOutput {
+			_, _ = term.Write([]byte(event.Data))
+		}
+	}
+	lines := term.Lines()
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i := range lines {
+		_, _ = bw.WriteString(lines[i])
+		_ = bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+type SVGOptions struct {
+	// IdleTimeLimit 超过该时长(秒)的空闲时间被压缩
+	IdleTimeLimit float64
+	// FrameInterval 两帧之间的最小间隔(秒)
+	FrameInterval float64
+	// MaxFrames 最多生成的帧数, 超过后的内容被忽略
+	MaxFrames int
+}
+
+const (
+	svgFontSize   = 14
+	svgCellWidth  = 8.4
+	svgCellHeight = 18
+	svgPadding    = 10
+	svgHoldTime   = 2.0
+
+	svgDefaultFg = "#d4d4d4"
+	svgDefaultBg = "#1e1e1e"
+)
+
+type svgFrame struct {
+	time float64
+	rows []int
+}
+
+/*
+	WriteSVG 将录像转换为 SVG 动画:
+	所有帧纵向排列, 通过 CSS 动画按时间平移显示对应的帧,
+	相同内容的行只定义一次, 帧中通过 use 引用。
+*/
+
+func WriteSVG(r *Reader, w io.Writer, opts SVGOptions) error {
+	if opts.IdleTimeLimit <= 0 {
+		opts.IdleTimeLimit = 2
+	}
+	if opts.FrameInterval <= 0 {
+		opts.FrameInterval = 0.1
+	}
+	if opts.MaxFrames <= 0 {
+		opts.MaxFrames = 3000
+	}
+	header := r.Header()
+	term := NewTerminal(header.Width, header.Height)
+	rowIDs := map[string]int{"": -1}
+	var rowDefs []string
+	capture := func(frameTime float64) svgFrame {
+		frame := svgFrame{time: frameTime, rows: make([]int, term.Height)}
+		for i, line := range term.lines {
+			content := renderSVGRow(line)
+			id, ok := rowIDs[content]
+			if !ok {
+				id = len(rowDefs)
+				rowIDs[content] = id
+				rowDefs = append(rowDefs, content)
+			}
+			frame.rows[i] = id
+		}
+		return frame
+	}
+	frames := []svgFrame{capture(0)}
+	var (
+		playTime  float64
+		lastTime  float64
+		dirty     bool
+		dirtyTime float64
+	)
+	for len(frames) < opts.MaxFrames {
+		event, err := r.ReadEvent()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if event.Type != EventOutput {
+			continue
+		}
+		delta := event.Time - lastTime
+		if delta < 0 {
+			delta = 0
+		}
+		if delta > opts.IdleTimeLimit {
+			delta = opts.IdleTimeLimit
+		}
+		lastTime = event.Time
+		playTime += delta
+		lastFrame := frames[len(frames)-1]
+		if dirty && playTime-lastFrame.time >= opts.FrameInterval {
+			frames = appendSVGFrame(frames, capture(dirtyTime))
+			dirty = false
+		}
+		_, _ = term.Write([]byte(event.Data))
+		if !dirty {
+			dirty = true
+			dirtyTime = playTime
+		}
+	}
+	if dirty && len(frames) < opts.MaxFrames {
+		frames = appendSVGFrame(frames, capture(dirtyTime))
+	}
+	total := frames[len(frames)-1].time + svgHoldTime
+	return writeSVGDocument(w, term.Width, term.Height, rowDefs, frames, total)
+}
+
+// appendSVGFrame 时间相同的帧只保留最新的
+func appendSVGFrame(frames []svgFrame, frame svgFrame) []svgFrame {
+	if last := frames[len(frames)-1]; frame.time <= last.time {
+		frames[len(frames)-1].rows = frame.rows
+		return frames
+	}
+	return append(frames, frame)
+}
+
+func writeSVGDocument(w io.Writer, width, height int, rowDefs []string, frames []svgFrame, total float64) error {
+	bw := bufio.NewWriter(w)
+	screenWidth := float64(width) * svgCellWidth
+	screenHeight := float64(height * svgCellHeight)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" `+
+		`width="%s" height="%s">`, formatFloat(screenWidth+2*svgPadding), formatFloat(screenHeight+2*svgPadding))
+	bw.WriteString("<style>")
+	fmt.Fprintf(bw, "text{font-family:Menlo,Monaco,Consolas,'Courier New',monospace;font-size:%dpx;white-space:pre}", svgFontSize)
+	fmt.Fprintf(bw, ".b{font-weight:bold}.u{text-decoration:underline}")
+	fmt.Fprintf(bw, ".frames{animation:play %ss steps(1,end) infinite}", formatFloat(total))
+	bw.WriteString("@keyframes play{")
+	for i, frame := range frames {
+		fmt.Fprintf(bw, "%s%%{transform:translateY(%spx)}",
+			strconv.FormatFloat(frame.time/total*100, 'f', 4, 64), formatFloat(-float64(i)*screenHeight))
+	}
+	bw.WriteString("}</style>")
+	fmt.Fprintf(bw, `<rect width="100%%" height="100%%" fill="%s"/>`, svgDefaultBg)
+	bw.WriteString("<defs>")
+	for i, def := range rowDefs {
+		fmt.Fprintf(bw, `<g id="r%d">%s</g>`, i, def)
+	}
+	bw.WriteString("</defs>")
+	fmt.Fprintf(bw, `<svg x="%d" y="%d" width="%s" height="%s"><g class="frames">`,
+		svgPadding, svgPadding, formatFloat(screenWidth), formatFloat(screenHeight))
+	for i, frame := range frames {
+		offset := float64(i) * screenHeight
+		for row, id := range frame.rows {
+			if id < 0 {
+				continue
+			}
+			fmt.Fprintf(bw, `<use xlink:href="#r%d" y="%s"/>`, id, formatFloat(offset+float64(row*svgCellHeight)))
+		}
+	}
+	bw.WriteString("</g></svg></svg>")
+	return bw.Flush()
+}
+
+func cellColors(style Style) (fg, bg string) {
+	fg, bg = style.Fg, style.Bg
+	if style.Inverse {
+		fg, bg = bg, fg
+		if fg == "" {
+			fg = svgDefaultBg
+		}
+		if bg == "" {
+			bg = svgDefaultFg
+		}
+	}
+	return fg, bg
+}
+
+// renderSVGRow 渲染一行, 空行返回空字符串
+func renderSVGRow(line []Cell) string {
+	var buf strings.Builder
+	// 背景色
+	for i := 0; i < len(line); {
+		_, bg := cellColors(line[i].Style)
+		j := i + 1
+		for j < len(line) {
+			if _, next := cellColors(line[j].Style); next != bg {
+				break
+			}
+			j++
+		}
+		if bg != "" {
+			fmt.Fprintf(&buf, `<rect x="%s" width="%s" height="%d" fill="%s"/>`,
+				formatFloat(float64(i)*svgCellWidth), formatFloat(float64(j-i)*svgCellWidth), svgCellHeight, bg)
+		}
+		i = j
+	}
+	// 文字
+	for i := 0; i < len(line); {
+		style := line[i].Style
+		j := i + 1
+		for j < len(line) && line[j].Style == style {
+			j++
+		}
+		if text := LineText(line[i:j]); text != "" {
+			fg, _ := cellColors(style)
+			if fg == "" {
+				fg = svgDefaultFg
+			}
+			fmt.Fprintf(&buf, `<text x="%s" y="%s" fill="%s"`,
+				formatFloat(float64(i)*svgCellWidth), formatFloat(svgCellHeight*0.75), fg)
+			var class []string
+			if style.Bold {
+				class = append(class, "b")
+			}
+			if style.Underline {
+				class = append(class, "u")
+			}
+			if len(class) > 0 {
+				fmt.Fprintf(&buf, ` class="%s"`, strings.Join(class, " "))
+			}
+			// 固定文字宽度, 避免字体中宽字符的宽度不是两列导致错位
+			fmt.Fprintf(&buf, ` textLength="%s" lengthAdjust="spacingAndGlyphs">`,
+				formatFloat(float64(runewidth.StringWidth(text))*svgCellWidth))
+			_ = xml.EscapeText(&buf, []byte(text))
+			buf.WriteString("</text>")
+		}
+		i = j
+	}
+	return buf.String()
+}
+
+func formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
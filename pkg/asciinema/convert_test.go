@@ -0,0 +1,77 @@
+package asciinema
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCast(t *testing.T, width, height int, outputs ...string) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WithWidth(width), WithHeight(height), WithTimestamp(time.Unix(0, 0)))
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for i, output := range outputs {
+		if err := w.WriteStdout(float64(i)*0.5, []byte(output)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestTerminal(t *testing.T) {
+	term := NewTerminal(10, 3)
+	var scrolled []string
+	term.OnScroll = func(line []Cell) {
+		scrolled = append(scrolled, LineText(line))
+	}
+	_, _ = term.Write([]byte("abc\x1b[31mdef\x1b[0m\b\b\bXY\r\nline2\r\n中文\xe4"))
+	_, _ = term.Write([]byte("\xb8\x80\r\n\x1b[2Klast\x1b[1;3H\x1b[K"))
+	if lines := term.Lines(); strings.Join(lines, "|") != "li|中文一|last" {
+		t.Fatalf("unexpected screen %q", lines)
+	}
+	if strings.Join(scrolled, "|") != "abcXYf" {
+		t.Fatalf("unexpected scrolled lines %q", scrolled)
+	}
+	// 备用屏幕的内容不影响主屏幕
+	_, _ = term.Write([]byte("\x1b[?1049h\x1b[2J\x1b[Hvim\x1b[?1049l"))
+	if lines := term.Lines(); lines[2] != "last" {
+		t.Fatalf("main screen not restored: %q", lines)
+	}
+}
+
+func TestWriteTranscript(t *testing.T) {
+	cast := newTestCast(t, 20, 2, "$ ls\r\n", "a.txt  b.txt\r\n", "$ pw\x08\x08pwd\r\n/root\r\n$ ")
+	r, err := NewReader(bytes.NewReader(cast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = WriteTranscript(r, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "$ ls\na.txt  b.txt\n$ pwd\n/root\n$\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestWriteSVG(t *testing.T) {
+	cast := newTestCast(t, 20, 2, "\x1b[1;32mhello\x1b[0m", " <world>", "\r\n")
+	r, err := NewReader(bytes.NewReader(cast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = WriteSVG(r, &out, SVGOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svg := out.String()
+	for _, expected := range []string{"<svg ", `fill="#0dbc79"`, "&lt;world&gt;", "@keyframes play", "</svg></svg>"} {
+		if !strings.Contains(svg, expected) {
+			t.Errorf("svg missing %q", expected)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package asciinema
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+)
+
+type Event struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{reader: bufio.NewReaderSize(r, 64*1024)}
+	line, err := reader.readLine()
+	if err != nil {
+		return nil, fmt.Errorf("read asciicast header: %w", err)
+	}
+	if err = json.Unmarshal(line, &reader.header); err != nil {
+		return nil, fmt.Errorf("invalid asciicast header: %w", err)
+	}
+	if reader.header.Version != version {
+		return nil, fmt.Errorf("unsupported asciicast version %d", reader.header.Version)
+	}
+	return reader, nil
+}
+
+type Reader struct {
+	header Header
+	reader *bufio.Reader
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// ReadEvent 读取下一条事件, 结束时返回 io.EOF
+func (r *Reader) ReadEvent() (event Event, err error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return event, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var row []interface{}
+		if err = json.Unmarshal(line, &row); err != nil {
+			// 录像异常中断时最后一行可能不完整
+			if errors.Is(err, io.ErrUnexpectedEOF) || isSyntaxError(err) {
+				return event, io.EOF
+			}
+			return event, err
+		}
+		if len(row) < 3 {
+			continue
+		}
+		ts, ok1 := row[0].(float64)
+		tp, ok2 := row[1].(string)
+		data, ok3 := row[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+		return Event{Time: ts, Type: tp, Data: data}, nil
+	}
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadBytes('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return line, nil
+		}
+		return nil, err
+	}
+	return line, nil
+}
+
+func isSyntaxError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &syntaxErr)
+}
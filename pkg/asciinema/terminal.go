@@ -0,0 +1,621 @@
+package asciinema
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+/*
+	Terminal 是用于回放录像的简易虚拟终端,
+	支持常用的光标移动、擦除、滚动区域、备用屏幕和 SGR 颜色,
+	足够将录像转换为文本记录或 SVG 动画。
+*/
+
+type Style struct {
+	Fg        string
+	Bg        string
+	Bold      bool
+	Underline bool
+	Inverse   bool
+}
+
+type Cell struct {
+	Char rune
+	// 宽字符占两列, 第二列的 Width 为 0
+	Width int
+	Style Style
+}
+
+const (
+	stateGround = iota
+	stateEscape
+	stateCSI
+	stateOSC
+	stateString
+	stateCharset
+)
+
+func NewTerminal(width, height int) *Terminal {
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = 24
+	}
+	t := &Terminal{Width: width, Height: height}
+	t.lines = t.newLines(height)
+	t.scrollBottom = height - 1
+	return t
+}
+
+type Terminal struct {
+	Width  int
+	Height int
+
+	// OnScroll 主屏幕的行滚出屏幕顶部时调用
+	OnScroll func(line []Cell)
+
+	lines [][]Cell
+	x, y  int
+	style Style
+
+	savedX, savedY int
+	wrapPending    bool
+
+	scrollTop    int
+	scrollBottom int
+
+	altScreen  bool
+	mainLines  [][]Cell
+	mainSavedX int
+	mainSavedY int
+
+	state    int
+	params   []byte
+	utf8Buf  []byte
+	escState bool
+}
+
+func (t *Terminal) newLines(n int) [][]Cell {
+	lines := make([][]Cell, n)
+	for i := range lines {
+		lines[i] = t.newLine()
+	}
+	return lines
+}
+
+func (t *Terminal) newLine() []Cell {
+	line := make([]Cell, t.Width)
+	for i := range line {
+		line[i] = Cell{Char: ' ', Width: 1, Style: t.blankStyle()}
+	}
+	return line
+}
+
+// 擦除时使用当前的背景色
+func (t *Terminal) blankStyle() Style {
+	return Style{Bg: t.style.Bg}
+}
+
+func (t *Terminal) Write(p []byte) (int, error) {
+	data := p
+	if len(t.utf8Buf) > 0 {
+		data = append(t.utf8Buf, p...)
+		t.utf8Buf = nil
+	}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(data) {
+			// 不完整的 UTF-8 字符留到下次
+			t.utf8Buf = append(t.utf8Buf[:0], data...)
+			break
+		}
+		data = data[size:]
+		t.handleRune(r)
+	}
+	return len(p), nil
+}
+
+func (t *Terminal) handleRune(r rune) {
+	switch t.state {
+	case stateEscape:
+		t.handleEscape(r)
+		return
+	case stateCSI:
+		t.handleCSI(r)
+		return
+	case stateOSC, stateString:
+		// OSC 以 BEL 或 ST(ESC \) 结束
+		switch {
+		case r == 0x07 && t.state == stateOSC:
+			t.state = stateGround
+		case r == 0x1b:
+			t.escState = true
+		case t.escState:
+			t.escState = false
+			if r == '\\' {
+				t.state = stateGround
+			}
+		}
+		return
+	case stateCharset:
+		t.state = stateGround
+		return
+	}
+	switch r {
+	case 0x1b:
+		t.state = stateEscape
+	case '\r':
+		t.x = 0
+		t.wrapPending = false
+	case '\n', '\v', '\f':
+		t.lineFeed()
+	case '\b':
+		if t.x > 0 {
+			t.x--
+		}
+		t.wrapPending = false
+	case '\t':
+		t.x = (t.x/8 + 1) * 8
+		if t.x >= t.Width {
+			t.x = t.Width - 1
+		}
+	case 0x07, 0x0e, 0x0f, 0x7f:
+	default:
+		if r < 0x20 || (r >= 0x80 && r < 0xa0) {
+			return
+		}
+		t.putChar(r)
+	}
+}
+
+func (t *Terminal) putChar(r rune) {
+	width := runewidth.RuneWidth(r)
+	if width == 0 {
+		return
+	}
+	if t.wrapPending || t.x+width > t.Width {
+		t.x = 0
+		t.lineFeed()
+	}
+	line := t.lines[t.y]
+	line[t.x] = Cell{Char: r, Width: width, Style: t.style}
+	if width == 2 && t.x+1 < t.Width {
+		line[t.x+1] = Cell{Char: ' ', Width: 0, Style: t.style}
+	}
+	t.x += width
+	if t.x >= t.Width {
+		t.x = t.Width - 1
+		t.wrapPending = true
+	}
+}
+
+func (t *Terminal) lineFeed() {
+	t.wrapPending = false
+	if t.y == t.scrollBottom {
+		t.scrollUp(1)
+		return
+	}
+	if t.y < t.Height-1 {
+		t.y++
+	}
+}
+
+func (t *Terminal) reverseIndex() {
+	if t.y == t.scrollTop {
+		t.scrollDown(1)
+		return
+	}
+	if t.y > 0 {
+		t.y--
+	}
+}
+
+func (t *Terminal) scrollUp(n int) {
+	for i := 0; i < n; i++ {
+		if t.OnScroll != nil && !t.altScreen && t.scrollTop == 0 {
+			t.OnScroll(t.lines[t.scrollTop])
+		}
+		copy(t.lines[t.scrollTop:t.scrollBottom], t.lines[t.scrollTop+1:t.scrollBottom+1])
+		t.lines[t.scrollBottom] = t.newLine()
+	}
+}
+
+func (t *Terminal) scrollDown(n int) {
+	for i := 0; i < n; i++ {
+		copy(t.lines[t.scrollTop+1:t.scrollBottom+1], t.lines[t.scrollTop:t.scrollBottom])
+		t.lines[t.scrollTop] = t.newLine()
+	}
+}
+
+func (t *Terminal) handleEscape(r rune) {
+	t.state = stateGround
+	switch r {
+	case '[':
+		t.state = stateCSI
+		t.params = t.params[:0]
+	case ']':
+		t.state = stateOSC
+	case 'P', 'X', '^', '_':
+		t.state = stateString
+	case '(', ')', '*', '+', '#', '%':
+		t.state = stateCharset
+	case '7':
+		t.savedX, t.savedY = t.x, t.y
+	case '8':
+		t.x, t.y = t.savedX, t.savedY
+		t.wrapPending = false
+	case 'D':
+		t.lineFeed()
+	case 'E':
+		t.x = 0
+		t.lineFeed()
+	case 'M':
+		t.reverseIndex()
+	case 'c':
+		t.reset()
+	}
+}
+
+func (t *Terminal) reset() {
+	t.style = Style{}
+	t.lines = t.newLines(t.Height)
+	t.x, t.y = 0, 0
+	t.scrollTop, t.scrollBottom = 0, t.Height-1
+	t.altScreen = false
+	t.mainLines = nil
+	t.wrapPending = false
+}
+
+func (t *Terminal) handleCSI(r rune) {
+	if r >= 0x20 && r <= 0x3f {
+		t.params = append(t.params, byte(r))
+		if len(t.params) > 256 {
+			t.state = stateGround
+		}
+		return
+	}
+	t.state = stateGround
+	if r < 0x40 || r > 0x7e {
+		return
+	}
+	raw := string(t.params)
+	private := strings.HasPrefix(raw, "?")
+	if private || strings.HasPrefix(raw, ">") || strings.HasPrefix(raw, "=") {
+		raw = raw[1:]
+	}
+	// 忽略带中间字符的序列, 如 CSI Ps SP q
+	if strings.ContainsAny(raw, " !\"#$%&'()*+,-./") {
+		return
+	}
+	params := parseParams(raw)
+	param := func(i, def int) int {
+		if i < len(params) && params[i] > 0 {
+			return params[i]
+		}
+		return def
+	}
+	if private {
+		switch r {
+		case 'h':
+			t.setPrivateModes(params, true)
+		case 'l':
+			t.setPrivateModes(params, false)
+		}
+		return
+	}
+	t.wrapPending = false
+	switch r {
+	case 'A':
+		t.y = maxInt(t.y-param(0, 1), 0)
+	case 'B', 'e':
+		t.y = minInt(t.y+param(0, 1), t.Height-1)
+	case 'C', 'a':
+		t.x = minInt(t.x+param(0, 1), t.Width-1)
+	case 'D':
+		t.x = maxInt(t.x-param(0, 1), 0)
+	case 'E':
+		t.x = 0
+		t.y = minInt(t.y+param(0, 1), t.Height-1)
+	case 'F':
+		t.x = 0
+		t.y = maxInt(t.y-param(0, 1), 0)
+	case 'G', '`':
+		t.x = clampInt(param(0, 1)-1, 0, t.Width-1)
+	case 'd':
+		t.y = clampInt(param(0, 1)-1, 0, t.Height-1)
+	case 'H', 'f':
+		t.y = clampInt(param(0, 1)-1, 0, t.Height-1)
+		t.x = clampInt(param(1, 1)-1, 0, t.Width-1)
+	case 'J':
+		t.eraseDisplay(param(0, 0))
+	case 'K':
+		t.eraseLine(param(0, 0))
+	case 'L':
+		if t.y >= t.scrollTop && t.y <= t.scrollBottom {
+			top := t.scrollTop
+			t.scrollTop = t.y
+			t.scrollDown(minInt(param(0, 1), t.scrollBottom-t.y+1))
+			t.scrollTop = top
+		}
+	case 'M':
+		if t.y >= t.scrollTop && t.y <= t.scrollBottom {
+			top := t.scrollTop
+			t.scrollTop = t.y
+			// 删除行不是滚出屏幕, 不记录
+			onScroll := t.OnScroll
+			t.OnScroll = nil
+			t.scrollUp(minInt(param(0, 1), t.scrollBottom-t.y+1))
+			t.OnScroll = onScroll
+			t.scrollTop = top
+		}
+	case 'P':
+		t.deleteChars(param(0, 1))
+	case '@':
+		t.insertChars(param(0, 1))
+	case 'X':
+		line := t.lines[t.y]
+		for i := t.x; i < minInt(t.x+param(0, 1), t.Width); i++ {
+			line[i] = Cell{Char: ' ', Width: 1, Style: t.blankStyle()}
+		}
+	case 'S':
+		t.scrollUp(param(0, 1))
+	case 'T':
+		t.scrollDown(param(0, 1))
+	case 'r':
+		top := param(0, 1) - 1
+		bottom := param(1, t.Height) - 1
+		if top < bottom && bottom < t.Height {
+			t.scrollTop, t.scrollBottom = top, bottom
+			t.x, t.y = 0, 0
+		}
+	case 's':
+		t.savedX, t.savedY = t.x, t.y
+	case 'u':
+		t.x, t.y = t.savedX, t.savedY
+	case 'm':
+		t.setGraphics(params)
+	}
+}
+
+func (t *Terminal) setPrivateModes(params []int, enable bool) {
+	for _, mode := range params {
+		switch mode {
+		case 47, 1047, 1049:
+			t.switchScreen(enable, mode == 1049)
+		}
+	}
+}
+
+func (t *Terminal) switchScreen(alt, saveCursor bool) {
+	if alt == t.altScreen {
+		return
+	}
+	t.altScreen = alt
+	if alt {
+		t.mainLines = t.lines
+		t.mainSavedX, t.mainSavedY = t.x, t.y
+		t.lines = t.newLines(t.Height)
+		return
+	}
+	if t.mainLines != nil {
+		t.lines = t.mainLines
+		t.mainLines = nil
+	}
+	if saveCursor {
+		t.x, t.y = t.mainSavedX, t.mainSavedY
+	}
+}
+
+func (t *Terminal) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		t.eraseLine(0)
+		for i := t.y + 1; i < t.Height; i++ {
+			t.lines[i] = t.newLine()
+		}
+	case 1:
+		t.eraseLine(1)
+		for i := 0; i < t.y; i++ {
+			t.lines[i] = t.newLine()
+		}
+	case 2, 3:
+		for i := range t.lines {
+			t.lines[i] = t.newLine()
+		}
+	}
+}
+
+func (t *Terminal) eraseLine(mode int) {
+	start, end := 0, t.Width
+	switch mode {
+	case 0:
+		start = t.x
+	case 1:
+		end = minInt(t.x+1, t.Width)
+	}
+	line := t.lines[t.y]
+	for i := start; i < end; i++ {
+		line[i] = Cell{Char: ' ', Width: 1, Style: t.blankStyle()}
+	}
+}
+
+func (t *Terminal) deleteChars(n int) {
+	line := t.lines[t.y]
+	n = minInt(n, t.Width-t.x)
+	copy(line[t.x:], line[t.x+n:])
+	for i := t.Width - n; i < t.Width; i++ {
+		line[i] = Cell{Char: ' ', Width: 1, Style: t.blankStyle()}
+	}
+}
+
+func (t *Terminal) insertChars(n int) {
+	line := t.lines[t.y]
+	n = minInt(n, t.Width-t.x)
+	copy(line[t.x+n:], line[t.x:t.Width-n])
+	for i := t.x; i < t.x+n; i++ {
+		line[i] = Cell{Char: ' ', Width: 1, Style: t.blankStyle()}
+	}
+}
+
+func (t *Terminal) setGraphics(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			t.style = Style{}
+		case p == 1:
+			t.style.Bold = true
+		case p == 4:
+			t.style.Underline = true
+		case p == 7:
+			t.style.Inverse = true
+		case p == 22:
+			t.style.Bold = false
+		case p == 24:
+			t.style.Underline = false
+		case p == 27:
+			t.style.Inverse = false
+		case p >= 30 && p <= 37:
+			t.style.Fg = ansiColor(p - 30)
+		case p >= 90 && p <= 97:
+			t.style.Fg = ansiColor(p - 90 + 8)
+		case p == 39:
+			t.style.Fg = ""
+		case p >= 40 && p <= 47:
+			t.style.Bg = ansiColor(p - 40)
+		case p >= 100 && p <= 107:
+			t.style.Bg = ansiColor(p - 100 + 8)
+		case p == 49:
+			t.style.Bg = ""
+		case p == 38 || p == 48:
+			color, n := extendedColor(params[i+1:])
+			i += n
+			if p == 38 {
+				t.style.Fg = color
+			} else {
+				t.style.Bg = color
+			}
+		}
+	}
+}
+
+// Lines 返回当前屏幕去掉行尾空白后的文本
+func (t *Terminal) Lines() []string {
+	result := make([]string, len(t.lines))
+	for i := range t.lines {
+		result[i] = LineText(t.lines[i])
+	}
+	return result
+}
+
+// Screen 返回当前屏幕内容的拷贝
+func (t *Terminal) Screen() [][]Cell {
+	screen := make([][]Cell, len(t.lines))
+	for i := range t.lines {
+		screen[i] = append([]Cell(nil), t.lines[i]...)
+	}
+	return screen
+}
+
+func LineText(line []Cell) string {
+	var buf strings.Builder
+	for _, cell := range line {
+		if cell.Width == 0 {
+			continue
+		}
+		buf.WriteRune(cell.Char)
+	}
+	return strings.TrimRight(buf.String(), " ")
+}
+
+func parseParams(raw string) []int {
+	if raw == "" {
+		return nil
+	}
+	// 颜色参数可能使用 ':' 分隔
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ';' || r == ':'
+	})
+	if strings.HasPrefix(raw, ";") {
+		fields = append([]string{""}, fields...)
+	}
+	params := make([]int, len(fields))
+	for i := range fields {
+		params[i], _ = strconv.Atoi(fields[i])
+	}
+	return params
+}
+
+var ansiPalette = [16]string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+func ansiColor(n int) string {
+	if n >= 0 && n < len(ansiPalette) {
+		return ansiPalette[n]
+	}
+	return ""
+}
+
+// extendedColor 解析 5;n 和 2;r;g;b 格式的颜色, 返回颜色和使用的参数个数
+func extendedColor(params []int) (string, int) {
+	if len(params) >= 2 && params[0] == 5 {
+		return xterm256Color(params[1]), 2
+	}
+	if len(params) >= 4 && params[0] == 2 {
+		return rgbColor(params[1], params[2], params[3]), 4
+	}
+	return "", len(params)
+}
+
+func xterm256Color(n int) string {
+	switch {
+	case n < 16:
+		return ansiColor(n)
+	case n < 232:
+		n -= 16
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+		return rgbColor(levels[n/36], levels[n/6%6], levels[n%6])
+	case n < 256:
+		level := 8 + (n-232)*10
+		return rgbColor(level, level, level)
+	}
+	return ""
+}
+
+func rgbColor(r, g, b int) string {
+	const hex = "0123456789abcdef"
+	buf := []byte{'#', 0, 0, 0, 0, 0, 0}
+	for i, v := range [3]int{r, g, b} {
+		v = clampInt(v, 0, 255)
+		buf[1+i*2] = hex[v>>4]
+		buf[2+i*2] = hex[v&0x0f]
+	}
+	return string(buf)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clampInt(v, low, high int) int {
+	return maxInt(low, minInt(v, high))
+}
@@ -0,0 +1,373 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	防篡改的审计日志:
+	会话的命令和生命周期事件按顺序追加到 {dir}/audit-{date}.log (JSON Lines), 每条记录同时属于两条哈希链:
+	会话链 session_hash = sha256(session_prev_hash, type, content), 可以单独验证一个会话的记录;
+	终端链 hash = sha256(prev_hash, seq, session_hash), 覆盖终端上的所有记录, 日期文件之间连续。
+	命令的会话链序号和哈希写回 model.Command, 随命令推送到 core 和 ES, 导出后也能验证。
+	定期使用终端的 SSH host key 对终端链头签名, 追加为 head 记录。
+*/
+
+const (
+	EventCommand          = "command"
+	EventSessionStart     = "session_start"
+	EventSessionEnd       = "session_end"
+	EventSessionTerminate = "session_terminate"
+	EventSessionPause     = "session_pause"
+	EventSessionResume    = "session_resume"
+	EventSessionReadonly  = "session_readonly"
+	EventAgentSign        = "agent_sign"
+	EventAgentDisabled    = "agent_forwarding_disabled"
+	EventPortForward      = "port_forward"
+	EventHead             = "head"
+
+	logFilePrefix  = "audit-"
+	logFileSuffix  = ".log"
+	logDateFormat  = "2006-01-02"
+	maxRecordBytes = 1024 * 1024
+)
+
+type Record struct {
+	Seq             uint64          `json:"seq"`
+	PrevHash        string          `json:"prev_hash"`
+	Hash            string          `json:"hash"`
+	SessionID       string          `json:"session,omitempty"`
+	SessionSeq      uint64          `json:"session_seq,omitempty"`
+	SessionPrevHash string          `json:"session_prev_hash,omitempty"`
+	SessionHash     string          `json:"session_hash"`
+	Type            string          `json:"type"`
+	Time            int64           `json:"timestamp"`
+	Content         json.RawMessage `json:"content"`
+	// head 记录对 Hash 的签名, 不参与哈希计算
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+type Signature struct {
+	Format    string `json:"format"`
+	Blob      []byte `json:"blob"`
+	PublicKey string `json:"public_key"`
+}
+
+// HeadContent 是 head 记录的内容, 签名时终端链的最后一条记录
+type HeadContent struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// commandContent 是命令参与哈希计算的字段, 不包括审计字段和由 timestamp 生成的 @timestamp
+type commandContent struct {
+	SessionID  string `json:"session"`
+	OrgID      string `json:"org_id"`
+	Input      string `json:"input"`
+	Output     string `json:"output"`
+	User       string `json:"user"`
+	Server     string `json:"asset"`
+	SystemUser string `json:"system_user"`
+	Timestamp  int64  `json:"timestamp"`
+	RiskLevel  int64  `json:"risk_level"`
+}
+
+func CommandContent(cmd *model.Command) []byte {
+	content, _ := json.Marshal(commandContent{
+		SessionID:  cmd.SessionID,
+		OrgID:      cmd.OrgID,
+		Input:      cmd.Input,
+		Output:     cmd.Output,
+		User:       cmd.User,
+		Server:     cmd.Server,
+		SystemUser: cmd.SystemUser,
+		Timestamp:  cmd.Timestamp,
+		RiskLevel:  cmd.RiskLevel,
+	})
+	return content
+}
+
+func SessionHash(prevHash, eventType string, content []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(eventType))
+	h.Write([]byte{'\n'})
+	h.Write(compactJSON(content))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func ChainHash(prevHash string, seq uint64, sessionHash string) string {
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(strconv.FormatUint(seq, 10)))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(sessionHash))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// compactJSON 去掉导出或存储时可能加入的空白, 保证哈希只和内容有关
+func compactJSON(content []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, content); err != nil {
+		return content
+	}
+	return buf.Bytes()
+}
+
+type chainState struct {
+	seq  uint64
+	hash string
+}
+
+type Log struct {
+	dir string
+
+	lock     sync.Mutex
+	file     *os.File
+	fileDate string
+	terminal chainState
+	sessions map[string]*chainState
+	headSeq  uint64
+}
+
+var defaultLog *Log
+
+// Setup 启用审计日志, 从最近的日志文件恢复终端链
+func Setup(dir string) (*Log, error) {
+	auditLog, err := Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defaultLog = auditLog
+	return auditLog, nil
+}
+
+// Default 返回全局的审计日志, 未启用时为 nil
+func Default() *Log {
+	return defaultLog
+}
+
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, sessions: make(map[string]*chainState)}
+	files, err := LogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if err = l.recover(files[len(files)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// LogFiles 按日期顺序返回目录中的审计日志文件
+func LogFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, logFilePrefix+"*"+logFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// recover 从最近的日志文件恢复终端链和未结束的会话链
+func (l *Log) recover(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record Record
+		if err = json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		l.terminal = chainState{seq: record.Seq, hash: record.Hash}
+		switch {
+		case record.Type == EventHead:
+			l.headSeq = record.Seq
+		case record.Type == EventSessionEnd:
+			delete(l.sessions, record.SessionID)
+		case record.SessionID != "":
+			l.sessions[record.SessionID] = &chainState{seq: record.SessionSeq, hash: record.SessionHash}
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *Log) append(sid, eventType string, content []byte, end bool) (Record, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	session := &chainState{}
+	if sid != "" {
+		if state, ok := l.sessions[sid]; ok {
+			session = state
+		}
+	}
+	now := time.Now()
+	record := Record{
+		Seq:             l.terminal.seq + 1,
+		PrevHash:        l.terminal.hash,
+		SessionID:       sid,
+		SessionPrevHash: session.hash,
+		Type:            eventType,
+		Time:            now.Unix(),
+		Content:         compactJSON(content),
+	}
+	if sid != "" {
+		record.SessionSeq = session.seq + 1
+	}
+	record.SessionHash = SessionHash(record.SessionPrevHash, eventType, record.Content)
+	record.Hash = ChainHash(record.PrevHash, record.Seq, record.SessionHash)
+	if err := l.write(now, &record); err != nil {
+		return record, err
+	}
+	l.terminal = chainState{seq: record.Seq, hash: record.Hash}
+	if sid != "" {
+		if end {
+			delete(l.sessions, sid)
+		} else {
+			l.sessions[sid] = &chainState{seq: record.SessionSeq, hash: record.SessionHash}
+		}
+	}
+	return record, nil
+}
+
+func (l *Log) write(now time.Time, record *Record) error {
+	date := now.UTC().Format(logDateFormat)
+	if l.file == nil || l.fileDate != date {
+		if l.file != nil {
+			_ = l.file.Close()
+		}
+		path := filepath.Join(l.dir, logFilePrefix+date+logFileSuffix)
+		fd, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			l.file = nil
+			return err
+		}
+		l.file = fd
+		l.fileDate = date
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// RecordCommand 把命令加入会话链, 并写回命令的审计字段
+func (l *Log) RecordCommand(cmd *model.Command) error {
+	record, err := l.append(cmd.SessionID, EventCommand, CommandContent(cmd), false)
+	if err != nil {
+		return err
+	}
+	cmd.AuditSeq = record.SessionSeq
+	cmd.AuditPrevHash = record.SessionPrevHash
+	cmd.AuditHash = record.SessionHash
+	return nil
+}
+
+// RecordSessionEvent 记录会话生命周期事件, session_end 之后会话链结束
+func (l *Log) RecordSessionEvent(sid, eventType string, content interface{}) error {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	_, err = l.append(sid, eventType, data, eventType == EventSessionEnd)
+	return err
+}
+
+// SignHead 使用 signer 对终端链头签名, 上次签名之后没有新记录时跳过
+func (l *Log) SignHead(signer gossh.Signer) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.terminal.seq == l.headSeq {
+		return nil
+	}
+	content, _ := json.Marshal(HeadContent{Seq: l.terminal.seq, Hash: l.terminal.hash})
+	now := time.Now()
+	record := Record{
+		Seq:      l.terminal.seq + 1,
+		PrevHash: l.terminal.hash,
+		Type:     EventHead,
+		Time:     now.Unix(),
+		Content:  content,
+	}
+	record.SessionHash = SessionHash("", EventHead, record.Content)
+	record.Hash = ChainHash(record.PrevHash, record.Seq, record.SessionHash)
+	sig, err := signer.Sign(rand.Reader, []byte(record.Hash))
+	if err != nil {
+		return err
+	}
+	record.Signature = &Signature{
+		Format:    sig.Format,
+		Blob:      sig.Blob,
+		PublicKey: strings.TrimSpace(string(gossh.MarshalAuthorizedKey(signer.PublicKey()))),
+	}
+	if err = l.write(now, &record); err != nil {
+		return err
+	}
+	l.terminal = chainState{seq: record.Seq, hash: record.Hash}
+	l.headSeq = record.Seq
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// RecordCommand 未启用审计日志时不记录
+func RecordCommand(cmd *model.Command) {
+	if defaultLog == nil {
+		return
+	}
+	if err := defaultLog.RecordCommand(cmd); err != nil {
+		logger.Errorf("Session %s: audit log record command err: %s", cmd.SessionID, err)
+	}
+}
+
+func RecordSessionEvent(sid, eventType string, content interface{}) {
+	if defaultLog == nil {
+		return
+	}
+	if err := defaultLog.RecordSessionEvent(sid, eventType, content); err != nil {
+		logger.Errorf("Session %s: audit log record %s err: %s", sid, eventType, err)
+	}
+}
@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+const testSid = "0b6f3c2e-6a4b-4c3e-9d2a-1f5e8a7b9c0d"
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func writeTestLog(t *testing.T, dir string, signer gossh.Signer) []*model.Command {
+	auditLog, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []*model.Command
+	_ = auditLog.RecordSessionEvent(testSid, EventSessionStart, map[string]string{"user": "admin"})
+	for _, input := range []string{"ls", "pwd"} {
+		cmd := &model.Command{SessionID: testSid, Input: input, Output: "ok", Timestamp: 1609459200}
+		if err = auditLog.RecordCommand(cmd); err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, cmd)
+	}
+	if err = auditLog.SignHead(signer); err != nil {
+		t.Fatal(err)
+	}
+	_ = auditLog.Close()
+
+	// 重新打开后终端链和未结束的会话链继续
+	auditLog, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = auditLog.RecordSessionEvent(testSid, EventSessionPause, map[string]string{"user": "auditor"})
+	_ = auditLog.RecordSessionEvent(testSid, EventSessionEnd, map[string]string{})
+	if err = auditLog.SignHead(signer); err != nil {
+		t.Fatal(err)
+	}
+	_ = auditLog.Close()
+	return commands
+}
+
+func TestVerifyLog(t *testing.T) {
+	dir := t.TempDir()
+	signer := newTestSigner(t)
+	commands := writeTestLog(t, dir, signer)
+	if commands[1].AuditSeq != 3 || commands[1].AuditPrevHash != commands[0].AuditHash {
+		t.Fatalf("unexpected command chain %+v", commands[1])
+	}
+	files, err := LogFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected log files %v: %v", files, err)
+	}
+
+	verifier := NewVerifier(signer.PublicKey())
+	if err = verifier.VerifyLogFiles(files...); err != nil {
+		t.Fatal(err)
+	}
+	verifier.VerifyCommands(commands)
+	report := verifier.Report()
+	if !report.OK() || report.Records != 7 || report.Heads != 2 || report.Commands != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// 修改命令内容
+	data, _ := ioutil.ReadFile(files[0])
+	tampered := strings.Replace(string(data), `"input":"pwd"`, `"input":"id"`, 1)
+	if err = ioutil.WriteFile(files[0], []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier = NewVerifier(signer.PublicKey())
+	_ = verifier.VerifyLogFiles(files...)
+	if verifier.Report().OK() {
+		t.Fatal("modified record should be reported")
+	}
+
+	// 删除一行
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	deleted := strings.Join(append(lines[:1:1], lines[2:]...), "\n")
+	_ = ioutil.WriteFile(files[0], []byte(deleted), 0600)
+	verifier = NewVerifier(signer.PublicKey())
+	_ = verifier.VerifyLogFiles(files...)
+	if verifier.Report().OK() {
+		t.Fatal("deleted record should be reported")
+	}
+
+	// 其他密钥签名
+	_ = ioutil.WriteFile(files[0], data, 0600)
+	verifier = NewVerifier(newTestSigner(t).PublicKey())
+	_ = verifier.VerifyLogFiles(files...)
+	if verifier.Report().OK() {
+		t.Fatal("head signed by another key should be reported")
+	}
+}
+
+func TestVerifyCommands(t *testing.T) {
+	dir := t.TempDir()
+	signer := newTestSigner(t)
+	commands := writeTestLog(t, dir, signer)
+	files, _ := LogFiles(dir)
+
+	modified := *commands[1]
+	modified.Output = "changed"
+	verifier := NewVerifier(nil)
+	verifier.VerifyCommands([]*model.Command{commands[0], &modified})
+	if verifier.Report().OK() {
+		t.Fatal("modified command should be reported")
+	}
+
+	// 没有日志时只能确认剩下的命令未被修改
+	verifier = NewVerifier(nil)
+	verifier.VerifyCommands(commands[:1])
+	if !verifier.Report().OK() {
+		t.Fatal("unmodified command should pass")
+	}
+
+	verifier = NewVerifier(nil)
+	_ = verifier.VerifyLogFiles(files...)
+	verifier.VerifyCommands(commands[:1])
+	if verifier.Report().OK() {
+		t.Fatal("command missing from storage should be reported")
+	}
+}
@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v6"
+	"github.com/elastic/go-elasticsearch/v6/esapi"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+const (
+	esScrollTimeout = time.Minute
+	esScrollSize    = 500
+)
+
+type ESSource struct {
+	Hosts     []string
+	Index     string
+	SessionID string
+
+	InsecureSkipVerify bool
+}
+
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Source model.Command `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// FetchCommands 使用 scroll 读取 ES 索引中的命令, SessionID 不为空时只读取该会话的命令
+func (es ESSource) FetchCommands() ([]*model.Command, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: es.InsecureSkipVerify}
+	esClient, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: es.Hosts,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	query := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if es.SessionID != "" {
+		query = map[string]interface{}{
+			"match_phrase": map[string]interface{}{"session": es.SessionID},
+		}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"query": query})
+	response, err := esClient.Search(
+		esClient.Search.WithIndex(es.Index),
+		esClient.Search.WithBody(bytes.NewReader(body)),
+		esClient.Search.WithScroll(esScrollTimeout),
+		esClient.Search.WithSize(esScrollSize),
+		esClient.Search.WithSort("_doc"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var commands []*model.Command
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			if res, err := esClient.ClearScroll(esClient.ClearScroll.WithScrollID(scrollID)); err == nil {
+				_ = res.Body.Close()
+			}
+		}
+	}()
+	for {
+		var result esSearchResponse
+		if err = decodeESResponse(response, &result); err != nil {
+			return nil, err
+		}
+		scrollID = result.ScrollID
+		if len(result.Hits.Hits) == 0 {
+			return commands, nil
+		}
+		for i := range result.Hits.Hits {
+			cmd := result.Hits.Hits[i].Source
+			// match_phrase 可能匹配到相似的会话 ID
+			if es.SessionID != "" && cmd.SessionID != es.SessionID {
+				continue
+			}
+			commands = append(commands, &cmd)
+		}
+		response, err = esClient.Scroll(
+			esClient.Scroll.WithScrollID(scrollID),
+			esClient.Scroll.WithScroll(esScrollTimeout),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func decodeESResponse(response *esapi.Response, v interface{}) error {
+	defer response.Body.Close()
+	if response.IsError() {
+		msg, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("es search failed: [%d] %s", response.StatusCode, msg)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
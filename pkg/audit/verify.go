@@ -0,0 +1,275 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+type Report struct {
+	Records  int
+	Commands int
+	Heads    int
+	Problems []string
+	Warnings []string
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problemf(format string, a ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+func (r *Report) warnf(format string, a ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, a...))
+}
+
+/*
+	Verifier 按顺序校验审计日志的终端链、会话链和 head 签名,
+	再用日志中的命令记录核对 ES 等存储中导出的命令。
+	pubKey 为空时使用 head 记录中附带的公钥校验签名, 只能发现签名之后的修改。
+*/
+
+type Verifier struct {
+	pubKey gossh.PublicKey
+	report Report
+
+	started  bool
+	terminal chainState
+	headSeq  uint64
+	sessions map[string]*chainState
+	// 日志中每个会话的命令 session_seq -> session_hash
+	commands map[string]map[uint64]string
+}
+
+func NewVerifier(pubKey gossh.PublicKey) *Verifier {
+	return &Verifier{
+		pubKey:   pubKey,
+		sessions: make(map[string]*chainState),
+		commands: make(map[string]map[uint64]string),
+	}
+}
+
+// VerifyLogFiles 按参数顺序校验日志文件, 同一终端的文件应按日期排序
+func (v *Verifier) VerifyLogFiles(paths ...string) error {
+	for _, path := range paths {
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = v.VerifyLog(fd, path)
+		_ = fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *Verifier) VerifyLog(r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(data, &record); err != nil {
+			v.report.problemf("%s:%d: invalid record: %s", name, line, err)
+			continue
+		}
+		v.verifyRecord(fmt.Sprintf("%s:%d", name, line), &record)
+	}
+	return scanner.Err()
+}
+
+func (v *Verifier) verifyRecord(where string, record *Record) {
+	v.report.Records++
+	if !v.started {
+		v.started = true
+		if record.Seq != 1 {
+			v.report.warnf("%s: log starts at seq %d, earlier records are not verified", where, record.Seq)
+		}
+	} else {
+		switch {
+		case record.Seq > v.terminal.seq+1:
+			v.report.problemf("%s: records %d-%d are missing", where, v.terminal.seq+1, record.Seq-1)
+		case record.Seq <= v.terminal.seq:
+			v.report.problemf("%s: seq %d is duplicated or out of order", where, record.Seq)
+		}
+		if record.PrevHash != v.terminal.hash {
+			v.report.problemf("%s: seq %d prev_hash does not match the previous record", where, record.Seq)
+		}
+	}
+	v.terminal = chainState{seq: record.Seq, hash: record.Hash}
+
+	sessionHash := SessionHash(record.SessionPrevHash, record.Type, record.Content)
+	if sessionHash != record.SessionHash {
+		v.report.problemf("%s: seq %d %s content has been modified", where, record.Seq, record.Type)
+	}
+	if ChainHash(record.PrevHash, record.Seq, record.SessionHash) != record.Hash {
+		v.report.problemf("%s: seq %d hash has been modified", where, record.Seq)
+	}
+
+	if record.Type == EventHead {
+		v.verifyHead(where, record)
+		return
+	}
+	if record.SessionID == "" {
+		return
+	}
+	state, ok := v.sessions[record.SessionID]
+	switch {
+	case ok && record.SessionSeq != state.seq+1:
+		v.report.problemf("%s: session %s records %d-%d are missing",
+			where, record.SessionID, state.seq+1, record.SessionSeq-1)
+	case ok && record.SessionPrevHash != state.hash:
+		v.report.problemf("%s: session %s seq %d session_prev_hash does not match",
+			where, record.SessionID, record.SessionSeq)
+	case !ok && record.SessionSeq != 1:
+		v.report.warnf("%s: session %s starts at seq %d in this log", where, record.SessionID, record.SessionSeq)
+	}
+	if record.Type == EventSessionEnd {
+		delete(v.sessions, record.SessionID)
+	} else {
+		v.sessions[record.SessionID] = &chainState{seq: record.SessionSeq, hash: record.SessionHash}
+	}
+	if record.Type == EventCommand {
+		if v.commands[record.SessionID] == nil {
+			v.commands[record.SessionID] = make(map[uint64]string)
+		}
+		v.commands[record.SessionID][record.SessionSeq] = record.SessionHash
+	}
+}
+
+func (v *Verifier) verifyHead(where string, record *Record) {
+	v.report.Heads++
+	var head HeadContent
+	if err := json.Unmarshal(record.Content, &head); err != nil ||
+		head.Seq != record.Seq-1 || head.Hash != record.PrevHash {
+		v.report.problemf("%s: head %d does not match the previous record", where, record.Seq)
+	}
+	if record.Signature == nil {
+		v.report.problemf("%s: head %d is not signed", where, record.Seq)
+		return
+	}
+	pubKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(record.Signature.PublicKey))
+	if err != nil {
+		v.report.problemf("%s: head %d has invalid public key: %s", where, record.Seq, err)
+		return
+	}
+	if v.pubKey != nil && !bytes.Equal(pubKey.Marshal(), v.pubKey.Marshal()) {
+		v.report.problemf("%s: head %d is signed by another key %s",
+			where, record.Seq, gossh.FingerprintSHA256(pubKey))
+		return
+	}
+	sig := &gossh.Signature{Format: record.Signature.Format, Blob: record.Signature.Blob}
+	if err = pubKey.Verify([]byte(record.Hash), sig); err != nil {
+		v.report.problemf("%s: head %d signature is invalid: %s", where, record.Seq, err)
+		return
+	}
+	v.headSeq = record.Seq
+}
+
+/*
+	VerifyCommands 校验导出的命令: 重新计算每条命令的会话链哈希, 检查相邻序号的链接。
+	命令之间的会话事件只保存在审计日志中, 没有日志时序号间隔只能作为警告;
+	校验过日志时, 日志中的会话逐条核对命令, 缺失或多出的命令都是问题。
+*/
+
+func (v *Verifier) VerifyCommands(commands []*model.Command) {
+	sessions := make(map[string][]*model.Command)
+	unchained := 0
+	for _, cmd := range commands {
+		if cmd.AuditHash == "" {
+			unchained++
+			continue
+		}
+		sessions[cmd.SessionID] = append(sessions[cmd.SessionID], cmd)
+	}
+	if unchained > 0 {
+		v.report.warnf("%d commands are not chained", unchained)
+	}
+	sids := make([]string, 0, len(sessions))
+	for sid := range sessions {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	for _, sid := range sids {
+		v.verifySessionCommands(sid, sessions[sid])
+	}
+}
+
+func (v *Verifier) verifySessionCommands(sid string, commands []*model.Command) {
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].AuditSeq < commands[j].AuditSeq
+	})
+	logged, hasLog := v.commands[sid]
+	seen := make(map[uint64]bool, len(commands))
+	for i, cmd := range commands {
+		v.report.Commands++
+		if SessionHash(cmd.AuditPrevHash, EventCommand, CommandContent(cmd)) != cmd.AuditHash {
+			v.report.problemf("session %s: command %d has been modified", sid, cmd.AuditSeq)
+		}
+		if seen[cmd.AuditSeq] {
+			v.report.problemf("session %s: command %d is duplicated", sid, cmd.AuditSeq)
+		}
+		seen[cmd.AuditSeq] = true
+		if i > 0 {
+			prev := commands[i-1]
+			switch {
+			case cmd.AuditSeq == prev.AuditSeq+1 && cmd.AuditPrevHash != prev.AuditHash:
+				v.report.problemf("session %s: command %d does not link to command %d", sid, cmd.AuditSeq, prev.AuditSeq)
+			case cmd.AuditSeq > prev.AuditSeq+1 && !hasLog:
+				v.report.warnf("session %s: seq %d-%d are not commands or are missing",
+					sid, prev.AuditSeq+1, cmd.AuditSeq-1)
+			}
+		}
+		if hasLog {
+			hash, ok := logged[cmd.AuditSeq]
+			switch {
+			case !ok:
+				v.report.problemf("session %s: command %d is not in the audit log", sid, cmd.AuditSeq)
+			case hash != cmd.AuditHash:
+				v.report.problemf("session %s: command %d does not match the audit log", sid, cmd.AuditSeq)
+			}
+		}
+	}
+	if !hasLog {
+		return
+	}
+	missing := make([]uint64, 0)
+	for seq := range logged {
+		if !seen[seq] {
+			missing = append(missing, seq)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	for _, seq := range missing {
+		v.report.problemf("session %s: command %d is missing", sid, seq)
+	}
+}
+
+// Report 结束校验, 返回校验结果
+func (v *Verifier) Report() *Report {
+	if v.started && v.terminal.seq > v.headSeq {
+		v.report.warnf("%d records after the last signed head", v.terminal.seq-v.headSeq)
+	}
+	if v.pubKey == nil && v.report.Heads > 0 {
+		v.report.warnf("head signatures are verified with the embedded public key")
+	}
+	return &v.report
+}
@@ -1,11 +1,14 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
@@ -34,6 +37,76 @@ func HTTPMiddleSessionAuth(jmsService *service.JMService) gin.HandlerFunc {
 	}
 }
 
+/*
+	HTTPMiddleReplayAuth 查看录像的认证:
+	请求头 Authorization: Bearer {REPLAY_VIEW_TOKEN} 不依赖 core, 用于 core 不可用时审计;
+	否则使用 core 的会话 cookie 认证, 并且只允许管理员和审计员查看
+*/
+
+func HTTPMiddleReplayAuth(jmsService *service.JMService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if token := config.GetConf().ReplayViewToken; token != "" {
+			authHeader := ctx.GetHeader("Authorization")
+			if strings.HasPrefix(authHeader, "Bearer ") && subtle.ConstantTimeCompare(
+				[]byte(strings.TrimPrefix(authHeader, "Bearer ")), []byte(token)) == 1 {
+				return
+			}
+		}
+		var cookies = make(map[string]string)
+		for _, cookie := range ctx.Request.Cookies() {
+			cookies[cookie.Name] = cookie.Value
+		}
+		user, err := jmsService.CheckUserCookie(cookies)
+		if err != nil {
+			logger.Errorf("Replay check user cookie failed from ip %s: %s", ctx.ClientIP(), err)
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		switch strings.ToLower(user.Role) {
+		case "admin", "auditor":
+		default:
+			logger.Errorf("User %s has no permission to view replay", user)
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		ctx.Set(ContextKeyUser, user)
+	}
+}
+
+// HTTPMiddleMetricsAuth 配置了 METRICS_TOKEN 时使用 Bearer Token 认证, 否则只允许本机访问
+func HTTPMiddleMetricsAuth() gin.HandlerFunc {
+	return httpMiddleTokenAuth(func() string {
+		return config.GetConf().MetricsToken
+	})
+}
+
+// HTTPMiddleAdminAuth 管理接口的认证, 配置了 ADMIN_TOKEN 时使用 Bearer Token 认证, 否则只允许本机访问
+func HTTPMiddleAdminAuth() gin.HandlerFunc {
+	return httpMiddleTokenAuth(func() string {
+		return config.GetConf().AdminToken
+	})
+}
+
+func httpMiddleTokenAuth(getToken func() string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := getToken()
+		if token == "" {
+			switch ctx.ClientIP() {
+			case "127.0.0.1", "::1", "localhost":
+				return
+			}
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		authHeader := ctx.GetHeader("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") || subtle.ConstantTimeCompare(
+			[]byte(strings.TrimPrefix(authHeader, "Bearer ")), []byte(token)) != 1 {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+	}
+}
+
 func HTTPMiddleDebugAuth() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		switch ctx.ClientIP() {
@@ -2,11 +2,14 @@ package auth
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/httplib"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/offline"
 )
 
 type connectionConfirmOption struct {
@@ -51,8 +54,14 @@ func (c *LoginConfirmService) CheckIsNeedLoginConfirm() (bool, error) {
 		res, err := c.jmsService.CheckIfNeedAssetLoginConfirm(userID, targetID,
 			systemUserID, systemUsername)
 		if err != nil {
+			if httplib.IsUnreachable(err) && c.loadNoConfirmCache() {
+				logger.Warnf("Core unreachable, user %s login asset %s without confirm by offline cache",
+					c.option.user.String(), targetID)
+				return false, nil
+			}
 			return false, err
 		}
+		c.saveNoConfirmCache(!res.NeedConfirm)
 		c.ticketId = res.TicketId
 		c.reviewers = res.Reviewers
 		c.checkReqInfo = res.CheckConfirmStatus
@@ -62,6 +71,38 @@ func (c *LoginConfirmService) CheckIsNeedLoginConfirm() (bool, error) {
 	}
 }
 
+/*
+	只缓存"不需要复核"的结果, core 不可达时需要复核的连接仍然拒绝
+*/
+
+func (c *LoginConfirmService) noConfirmCacheKey() string {
+	return fmt.Sprintf("login_confirm:%s:%s:%s", c.option.user.ID,
+		c.option.targetID, c.option.systemUser.ID)
+}
+
+func (c *LoginConfirmService) saveNoConfirmCache(noConfirm bool) {
+	cache := offline.Default()
+	if cache == nil {
+		return
+	}
+	if !noConfirm {
+		cache.Delete(c.noConfirmCacheKey())
+		return
+	}
+	if err := cache.Save(c.noConfirmCacheKey(), true); err != nil {
+		logger.Errorf("Save login confirm offline cache err: %s", err)
+	}
+}
+
+func (c *LoginConfirmService) loadNoConfirmCache() bool {
+	cache := offline.Default()
+	if cache == nil {
+		return false
+	}
+	var noConfirm bool
+	return cache.Load(c.noConfirmCacheKey(), &noConfirm) && noConfirm
+}
+
 func (c *LoginConfirmService) WaitLoginConfirm(ctx context.Context) Status {
 	return c.waitConfirmFinish(ctx)
 }
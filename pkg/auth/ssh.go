@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"strings"
 
@@ -8,9 +10,12 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/sshca"
 	"github.com/jumpserver/koko/pkg/sshd"
+	"github.com/jumpserver/koko/pkg/tracing"
 )
 
 type SSHAuthFunc func(ctx ssh.Context, password, publicKey string) (res sshd.AuthStatus)
@@ -43,6 +48,17 @@ func SSHPasswordAndPublicKeyAuth(jmsService *service.JMService) SSHAuthFunc {
 		}
 		userAuthClient.SetOption(service.UserClientPassword(password),
 			service.UserClientPublicKey(publicKey))
+		traceCtx, span := tracing.Start(ctx, "ssh.auth",
+			tracing.String("enduser.id", username),
+			tracing.String("koko.auth_method", authMethod))
+		defer func() {
+			span.SetAttributes(tracing.String("koko.auth_action", action))
+			if res == sshd.AuthFailed {
+				span.SetStatus(tracing.StatusError, action)
+			}
+			span.End()
+		}()
+		userAuthClient.SetContext(tracing.Detach(traceCtx))
 		logger.Infof("SSH conn[%s] authenticating user %s %s", ctx.SessionID(), username, authMethod)
 		user, authStatus := userAuthClient.Authenticate(ctx)
 		switch authStatus {
@@ -66,6 +82,77 @@ func SSHPasswordAndPublicKeyAuth(jmsService *service.JMService) SSHAuthFunc {
 	}
 }
 
+/*
+	SSHCertificateAuth 使用 OpenSSH 用户证书认证, 证书由配置的 CA 签发时信任 CA 的身份校验,
+	登录用户名需要在证书的 principals 中并且对应一个有效的 JumpServer 用户。
+	证书不经过 core 的认证接口, 开启了 MFA 或存在拒绝、复核登录 ACL 的用户不能使用证书登录,
+	需要使用密码或公钥通过 core 认证
+*/
+
+func SSHCertificateAuth(jmsService *service.JMService, checker *sshca.UserChecker) func(ctx ssh.Context,
+	cert *gossh.Certificate) sshd.AuthStatus {
+	return func(ctx ssh.Context, cert *gossh.Certificate) (res sshd.AuthStatus) {
+		username := GetUsernameFromSSHCtx(ctx)
+		action := actionAccepted
+		res = sshd.AuthFailed
+		_, span := tracing.Start(ctx, "ssh.auth",
+			tracing.String("enduser.id", username),
+			tracing.String("koko.auth_method", "certificate"))
+		defer func() {
+			span.SetAttributes(tracing.String("koko.auth_action", action))
+			if res == sshd.AuthFailed {
+				span.SetStatus(tracing.StatusError, action)
+			}
+			span.End()
+		}()
+		remoteAddr, _, _ := net.SplitHostPort(ctx.RemoteAddr().String())
+		if err := checker.Check(username, cert, ctx.RemoteAddr()); err != nil {
+			action = actionFailed
+			logger.Errorf("SSH conn[%s] %s certificate(%s) for %s from %s: %s", ctx.SessionID(),
+				action, cert.KeyId, username, remoteAddr, err)
+			return
+		}
+		user, err := jmsService.GetUserByUsername(username)
+		if err != nil || !user.IsValid || !user.IsActive {
+			action = actionFailed
+			logger.Errorf("SSH conn[%s] %s certificate(%s) for %s from %s: invalid user %v",
+				ctx.SessionID(), action, cert.KeyId, username, remoteAddr, err)
+			return
+		}
+		if err = checkCertificateLoginAllowed(jmsService, &user); err != nil {
+			action = actionFailed
+			logger.Errorf("SSH conn[%s] %s certificate(%s) for %s from %s: %s",
+				ctx.SessionID(), action, cert.KeyId, username, remoteAddr, err)
+			return
+		}
+		ctx.SetValue(ContextKeyUser, &user)
+		logger.Infof("SSH conn[%s] %s certificate(%s serial %d) for %s from %s", ctx.SessionID(),
+			action, cert.KeyId, cert.Serial, username, remoteAddr)
+		return sshd.AuthSuccessful
+	}
+}
+
+/*
+	checkCertificateLoginAllowed 证书登录无法完成 core 的 MFA 和登录复核:
+	用户开启 MFA, 或存在启用的拒绝、复核登录 ACL 时拒绝, 获取 ACL 失败时同样拒绝
+*/
+
+func checkCertificateLoginAllowed(jmsService *service.JMService, user *model.User) error {
+	if user.OTPLevel > 0 {
+		return errors.New("user requires MFA")
+	}
+	acls, err := jmsService.GetUserLoginACLs(user.ID)
+	if err != nil {
+		return fmt.Errorf("get login acls err: %w", err)
+	}
+	for i := range acls {
+		if acls[i].IsActive && acls[i].Action != model.LoginACLActionAllow {
+			return fmt.Errorf("login acl %s requires %s", acls[i].Name, acls[i].Action)
+		}
+	}
+	return nil
+}
+
 func SSHKeyboardInteractiveAuth(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) (res sshd.AuthStatus) {
 	if value, ok := ctx.Value(ContextKeyAuthFailed).(*bool); ok && *value {
 		return sshd.AuthFailed
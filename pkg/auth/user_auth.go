@@ -11,9 +11,11 @@ import (
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/httplib"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/offline"
 )
 
 type authOptions struct {
@@ -38,6 +40,9 @@ func (u *UserAuthClient) Authenticate(ctx context.Context) (user model.User, aut
 	resp, err := u.UserClient.GetAPIToken()
 	if err != nil {
 		logger.Errorf("User %s Authenticate err: %s", u.Opts.Username, err)
+		if httplib.IsUnreachable(err) {
+			return u.authenticateOffline()
+		}
 		return
 	}
 	if resp.Err != "" {
@@ -45,7 +50,9 @@ func (u *UserAuthClient) Authenticate(ctx context.Context) (user model.User, aut
 		case ErrLoginConfirmWait:
 			logger.Infof("User %s login need confirmation", u.Opts.Username)
 			authStatus = authConfirmRequired
+			u.forgetOfflineCredential()
 		case ErrMFARequired:
+			u.forgetOfflineCredential()
 			u.mfaTypes = nil
 			for _, choiceType := range resp.Data.Choices {
 				u.authOptions[choiceType] = authOptions{
@@ -62,11 +69,39 @@ func (u *UserAuthClient) Authenticate(ctx context.Context) (user model.User, aut
 		return
 	}
 	if resp.Token != "" {
+		if cache := offline.Default(); cache != nil {
+			if err = cache.SaveUser(resp.User, u.Opts.Password, u.Opts.PublicKey); err != nil {
+				logger.Errorf("User %s save offline credential err: %s", u.Opts.Username, err)
+			}
+		}
 		return resp.User, authSuccess
 	}
 	return
 }
 
+// forgetOfflineCredential 需要 MFA 或登录复核的用户不能离线登录
+func (u *UserAuthClient) forgetOfflineCredential() {
+	if cache := offline.Default(); cache != nil {
+		cache.DeleteUser(u.Opts.Username)
+	}
+}
+
+// authenticateOffline core 不可达时使用降级缓存中的凭据认证
+func (u *UserAuthClient) authenticateOffline() (user model.User, authStatus StatusAuth) {
+	authStatus = authFailed
+	cache := offline.Default()
+	if cache == nil {
+		return
+	}
+	user, ok := cache.VerifyUser(u.Opts.Username, u.Opts.Password, u.Opts.PublicKey)
+	if !ok {
+		logger.Errorf("User %s offline authenticate failed", u.Opts.Username)
+		return
+	}
+	logger.Warnf("Core unreachable, user %s authenticated by offline cache", u.Opts.Username)
+	return user, authSuccess
+}
+
 func (u *UserAuthClient) CheckUserOTP(ctx context.Context, MFAType string, code string) (user model.User, authStatus StatusAuth) {
 	authStatus = authFailed
 	authData, ok := u.authOptions[MFAType]
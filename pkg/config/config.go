@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/spf13/viper"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 )
 
 var (
@@ -45,8 +47,52 @@ type Config struct {
 	RedisDBIndex  int      `mapstructure:"REDIS_DB_ROOM"`
 	RedisClusters []string `mapstructure:"REDIS_CLUSTERS"`
 
-	EnableLocalPortForward bool `mapstructure:"ENABLE_LOCAL_PORT_FORWARD"`
-	EnableVscodeSupport    bool `mapstructure:"ENABLE_VSCODE_SUPPORT"`
+	EnableLocalPortForward  bool  `mapstructure:"ENABLE_LOCAL_PORT_FORWARD"`
+	EnablePortForward       bool  `mapstructure:"ENABLE_PORT_FORWARD"`
+	EnableRemotePortForward bool  `mapstructure:"ENABLE_REMOTE_PORT_FORWARD"`
+	EnableVscodeSupport     bool  `mapstructure:"ENABLE_VSCODE_SUPPORT"`
+	PortForwardAllowedPorts []int `mapstructure:"PORT_FORWARD_ALLOWED_PORTS"`
+
+	// 多个 koko 共用录像存储时, 只需要一个节点开启
+	EnableReplayRetention bool `mapstructure:"ENABLE_REPLAY_RETENTION"`
+
+	ReplayViewToken string `mapstructure:"REPLAY_VIEW_TOKEN"`
+	MetricsToken    string `mapstructure:"METRICS_TOKEN"`
+	AdminToken      string `mapstructure:"ADMIN_TOKEN"`
+
+	OutputMaskRules []model.OutputMaskRule `mapstructure:"OUTPUT_MASK_RULES"`
+
+	TraceExporter     string `mapstructure:"TRACE_EXPORTER"`
+	TraceOTLPEndpoint string `mapstructure:"TRACE_OTLP_ENDPOINT"`
+	TraceOTLPHeaders  string `mapstructure:"TRACE_OTLP_HEADERS"`
+	TraceFilePath     string `mapstructure:"TRACE_FILE_PATH"`
+
+	DegradedModeEnabled bool   `mapstructure:"DEGRADED_MODE_ENABLED"`
+	DegradedCacheTTL    int    `mapstructure:"DEGRADED_CACHE_TTL"` // 分钟
+	DegradedCacheKey    string `mapstructure:"DEGRADED_CACHE_KEY"`
+
+	ReplaySegmentDuration int `mapstructure:"REPLAY_SEGMENT_DURATION"` // 分钟
+	ReplaySegmentSize     int `mapstructure:"REPLAY_SEGMENT_SIZE"`     // MB
+
+	ReplayEncryption        string `mapstructure:"REPLAY_ENCRYPTION"` // local, kms
+	ReplayEncryptionKeyFile string `mapstructure:"REPLAY_ENCRYPTION_KEY_FILE"`
+	ReplayKMSEndpoint       string `mapstructure:"REPLAY_KMS_ENDPOINT"`
+	ReplayKMSKeyID          string `mapstructure:"REPLAY_KMS_KEY_ID"`
+	ReplayKMSToken          string `mapstructure:"REPLAY_KMS_TOKEN"`
+
+	AuditChainEnabled bool `mapstructure:"AUDIT_CHAIN_ENABLED"`
+	AuditHeadInterval int  `mapstructure:"AUDIT_HEAD_INTERVAL"` // 分钟
+
+	FileRecordEnabled bool `mapstructure:"FILE_RECORD_ENABLED"`
+	FileRecordMaxSize int  `mapstructure:"FILE_RECORD_MAX_SIZE"` // MB
+
+	HostKeyVerify       string   `mapstructure:"HOST_KEY_VERIFY"` // off, tofu, strict
+	HostKeyStrictAssets []string `mapstructure:"HOST_KEY_STRICT_ASSETS"`
+
+	UserCAKeysFile        string `mapstructure:"USER_CA_KEYS_FILE"`
+	TargetCAKeyFile       string `mapstructure:"TARGET_CA_KEY_FILE"`
+	TargetCAKeyPassphrase string `mapstructure:"TARGET_CA_KEY_PASSPHRASE"`
+	TargetCertTTL         int    `mapstructure:"TARGET_CERT_TTL"` // 分钟
 
 	RootPath          string
 	DataFolderPath    string
@@ -125,8 +171,25 @@ func getDefaultConfig() Config {
 		RedisPort:           "6379",
 		RedisPassword:       "",
 
-		EnableLocalPortForward: false,
-		EnableVscodeSupport:    false,
+		EnableLocalPortForward:  false,
+		EnablePortForward:       false,
+		EnableRemotePortForward: false,
+		EnableVscodeSupport:     false,
+
+		EnableReplayRetention: false,
+
+		DegradedModeEnabled: false,
+		DegradedCacheTTL:    720,
+
+		AuditChainEnabled: false,
+		AuditHeadInterval: 5,
+
+		FileRecordEnabled: false,
+		FileRecordMaxSize: 0,
+
+		HostKeyVerify: "off",
+
+		TargetCertTTL: 5,
 	}
 
 }
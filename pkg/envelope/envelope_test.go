@@ -0,0 +1,160 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{1}, DataKeySize)
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil || buf.Len() != 0 {
+		t.Fatalf("empty stream should write nothing, got %d bytes", buf.Len())
+	}
+	if writer, err = NewWriter(&buf, dataKey); err != nil {
+		t.Fatal(err)
+	}
+	rows := []string{"hello\n", "world\n", string(bytes.Repeat([]byte{'x'}, maxFrameSize+10))}
+	for _, row := range rows {
+		if _, err = writer.Write([]byte(row)); err != nil {
+			t.Fatal(err)
+		}
+		if err = writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hello")) {
+		t.Fatal("stream is not encrypted")
+	}
+	// 没有结束帧时流被截断
+	flushed := buf.Len()
+	reader, err := NewReader(bytes.NewReader(buf.Bytes()), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader); err != ErrTruncatedStream {
+		t.Fatalf("read stream without final frame got %v", err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write([]byte("after close")); err == nil {
+		t.Fatal("write after close should fail")
+	}
+	expected := rows[0] + rows[1] + rows[2]
+	reader, err = NewReader(bytes.NewReader(buf.Bytes()), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(reader); err != nil || string(data) != expected {
+		t.Fatalf("decrypt stream failed: %v", err)
+	}
+
+	// 在帧边界截断和在帧中间截断都能发现
+	for _, size := range []int{flushed, buf.Len() - 5} {
+		reader, _ = NewReader(bytes.NewReader(buf.Bytes()[:size]), dataKey)
+		if _, err = ioutil.ReadAll(reader); err != ErrTruncatedStream {
+			t.Fatalf("read stream truncated at %d got %v", size, err)
+		}
+	}
+	// 结束帧之后不能再有数据
+	reader, _ = NewReader(bytes.NewReader(append(append([]byte{}, buf.Bytes()...), 0, 0, 0, 1)), dataKey)
+	if _, err = ioutil.ReadAll(reader); err != ErrInvalidStream {
+		t.Fatalf("read data after final frame got %v", err)
+	}
+
+	// 恢复本地文件时, 最后一帧不完整时读取到上一帧为止
+	reader, _ = NewRecoveryReader(bytes.NewReader(buf.Bytes()[:flushed-5]), dataKey)
+	if data, err := ioutil.ReadAll(reader); err != nil || string(data) != rows[0]+rows[1]+rows[2][:maxFrameSize] {
+		t.Fatalf("read truncated stream got %d bytes: %v", len(data), err)
+	}
+
+	otherKey := bytes.Repeat([]byte{2}, DataKeySize)
+	reader, _ = NewReader(bytes.NewReader(buf.Bytes()), otherKey)
+	if _, err = ioutil.ReadAll(reader); err != ErrInvalidStream {
+		t.Fatalf("decrypt with wrong key got %v", err)
+	}
+}
+
+func TestLocalKeyWrapper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "master.key")
+	wrapper, err := NewLocalKeyWrapper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, info, err := GenerateDataKey(wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewLocalKeyWrapper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := info.Unwrap(reloaded); err != nil || !bytes.Equal(key, dataKey) {
+		t.Fatalf("unwrap data key failed: %v", err)
+	}
+	other, err := NewLocalKeyWrapper(filepath.Join(t.TempDir(), "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = info.Unwrap(other); err == nil {
+		t.Fatal("unwrap with another master key should fail")
+	}
+}
+
+func TestKMSKeyWrapper(t *testing.T) {
+	// 用本地密钥模拟 KMS
+	local, err := NewLocalKeyWrapper(filepath.Join(t.TempDir(), "kms.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req kmsRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var res kmsResponse
+		switch r.URL.Path {
+		case "/encrypt":
+			_, res.Ciphertext, err = local.Wrap(req.Plaintext)
+			res.KeyID = req.KeyID
+		case "/decrypt":
+			res.Plaintext, err = local.Unwrap(local.keyID, req.Ciphertext)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	wrapper := NewKMSKeyWrapper(srv.URL+"/", "replay", "token")
+	dataKey, info, err := GenerateDataKey(wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Provider != ProviderKMS || info.KeyID != "replay" {
+		t.Fatalf("unexpected key info %+v", info)
+	}
+	if key, err := info.Unwrap(wrapper); err != nil || !bytes.Equal(key, dataKey) {
+		t.Fatalf("unwrap data key failed: %v", err)
+	}
+	if _, err = info.Unwrap(local); err == nil {
+		t.Fatal("unwrap with another provider should fail")
+	}
+	if _, _, err = NewKMSKeyWrapper(srv.URL, "replay", "bad").Wrap(dataKey); err == nil {
+		t.Fatal("wrap with bad token should fail")
+	}
+}
@@ -0,0 +1,253 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	信封加密:
+	每个会话生成随机的数据密钥加密录像, 数据密钥由主密钥加密(wrap)后和录像保存在一起,
+	主密钥保存在本地密钥文件或 KMS 中, 不和录像存放在一起。
+*/
+
+const (
+	ProviderLocal = "local"
+	ProviderKMS   = "kms"
+
+	keyInfoVersion = 1
+	algorithm      = "AES-256-GCM"
+)
+
+var ErrProviderMismatch = errors.New("data key wrapped by another provider")
+
+// KeyWrapper 使用主密钥加密和解密数据密钥
+type KeyWrapper interface {
+	Provider() string
+	Wrap(dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyInfo 是和录像保存在一起的数据密钥信息
+type KeyInfo struct {
+	Version    int       `json:"version"`
+	Algorithm  string    `json:"algorithm"`
+	Provider   string    `json:"provider"`
+	KeyID      string    `json:"key_id"`
+	WrappedKey []byte    `json:"wrapped_key"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GenerateDataKey 生成随机数据密钥, 返回明文密钥和加密后的密钥信息
+func GenerateDataKey(wrapper KeyWrapper) ([]byte, KeyInfo, error) {
+	dataKey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, KeyInfo{}, err
+	}
+	keyID, wrapped, err := wrapper.Wrap(dataKey)
+	if err != nil {
+		return nil, KeyInfo{}, err
+	}
+	info := KeyInfo{
+		Version:    keyInfoVersion,
+		Algorithm:  algorithm,
+		Provider:   wrapper.Provider(),
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		CreatedAt:  time.Now().UTC(),
+	}
+	return dataKey, info, nil
+}
+
+func (k KeyInfo) Unwrap(wrapper KeyWrapper) ([]byte, error) {
+	if k.Provider != wrapper.Provider() {
+		return nil, fmt.Errorf("%w: %s", ErrProviderMismatch, k.Provider)
+	}
+	dataKey, err := wrapper.Unwrap(k.KeyID, k.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKey) != DataKeySize {
+		return nil, ErrInvalidDataKey
+	}
+	return dataKey, nil
+}
+
+var defaultWrapper KeyWrapper
+
+// Setup 设置全局的主密钥, 为 nil 时不加密录像
+func Setup(wrapper KeyWrapper) {
+	defaultWrapper = wrapper
+}
+
+// Default 返回全局的主密钥, 未启用加密时为 nil
+func Default() KeyWrapper {
+	return defaultWrapper
+}
+
+/*
+	LocalKeyWrapper 使用本地密钥文件中的主密钥(32 字节的 hex 编码)加密数据密钥,
+	key id 是主密钥的指纹, 更换主密钥后可以区分数据密钥由哪个主密钥加密
+*/
+
+type LocalKeyWrapper struct {
+	keyID string
+	key   []byte
+}
+
+// NewLocalKeyWrapper 读取主密钥文件, 文件不存在时生成新的主密钥
+func NewLocalKeyWrapper(path string) (*LocalKeyWrapper, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, DataKeySize)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		data = []byte(hex.EncodeToString(key))
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		logger.Warnf("Generate replay master key %s, please back it up, replays cannot be decrypted without it", path)
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != DataKeySize {
+		return nil, fmt.Errorf("invalid master key file %s", path)
+	}
+	sum := sha256.Sum256(key)
+	return &LocalKeyWrapper{keyID: hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+func (l *LocalKeyWrapper) Provider() string {
+	return ProviderLocal
+}
+
+func (l *LocalKeyWrapper) Wrap(dataKey []byte) (string, []byte, error) {
+	aead, err := newAEAD(l.key)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return l.keyID, aead.Seal(nonce, nonce, dataKey, []byte(l.keyID)), nil
+}
+
+func (l *LocalKeyWrapper) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != l.keyID {
+		return nil, fmt.Errorf("unknown master key %s", keyID)
+	}
+	aead, err := newAEAD(l.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalidDataKey
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+/*
+	KMSKeyWrapper 通过 HTTP API 加密数据密钥, 接口:
+	POST {endpoint}/encrypt {"key_id": "...", "plaintext": "<base64>"} 返回 {"key_id": "...", "ciphertext": "<base64>"}
+	POST {endpoint}/decrypt {"key_id": "...", "ciphertext": "<base64>"} 返回 {"plaintext": "<base64>"}
+	token 不为空时使用 Authorization: Bearer 认证
+*/
+
+type KMSKeyWrapper struct {
+	endpoint string
+	keyID    string
+	token    string
+	client   *http.Client
+}
+
+func NewKMSKeyWrapper(endpoint, keyID, token string) *KMSKeyWrapper {
+	return &KMSKeyWrapper{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		keyID:    keyID,
+		token:    token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type kmsRequest struct {
+	KeyID      string `json:"key_id"`
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+type kmsResponse struct {
+	KeyID      string `json:"key_id"`
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (k *KMSKeyWrapper) Provider() string {
+	return ProviderKMS
+}
+
+func (k *KMSKeyWrapper) Wrap(dataKey []byte) (string, []byte, error) {
+	res, err := k.call("encrypt", kmsRequest{KeyID: k.keyID, Plaintext: dataKey})
+	if err != nil {
+		return "", nil, err
+	}
+	keyID := res.KeyID
+	if keyID == "" {
+		keyID = k.keyID
+	}
+	return keyID, res.Ciphertext, nil
+}
+
+func (k *KMSKeyWrapper) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	res, err := k.call("decrypt", kmsRequest{KeyID: keyID, Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
+
+func (k *KMSKeyWrapper) call(action string, reqBody kmsRequest) (res kmsResponse, err error) {
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return res, err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.endpoint+"/"+action, bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return res, fmt.Errorf("kms %s failed: %s %s", action, resp.Status, bytes.TrimSpace(msg))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
@@ -0,0 +1,231 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+/*
+	加密流格式:
+	magic "KKENC1" 和 4 字节随机 nonce 前缀, 之后是若干帧, 每帧是 4 字节大端长度和 AES-256-GCM 密文,
+	帧的 nonce 是前缀加 8 字节帧序号, 帧的顺序不能调整。
+	写入方每次 Flush 生成一帧, Close 生成以 finalFrameAD 为附加数据的结束帧, 第一帧之前才写入头部,
+	没有写入数据的流是空文件。读取时没有结束帧说明流被截断, 返回 ErrTruncatedStream;
+	只有异常中断后恢复本地文件时使用 NewRecoveryReader, 忽略不完整的最后一帧。
+*/
+
+const (
+	streamMagic     = "KKENC1"
+	noncePrefixSize = 4
+	maxFrameSize    = 64 * 1024
+
+	DataKeySize = 32
+)
+
+var (
+	ErrInvalidStream   = errors.New("invalid encrypted stream")
+	ErrTruncatedStream = errors.New("encrypted stream is truncated")
+	ErrInvalidDataKey  = errors.New("invalid data key")
+	errStreamClosed    = errors.New("encrypted stream is closed")
+
+	finalFrameAD = []byte("final")
+)
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != DataKeySize {
+		return nil, ErrInvalidDataKey
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	seq    uint64
+	buf    []byte
+	header []byte
+	closed bool
+}
+
+// NewWriter 返回加密写入流, 写入的数据在 Flush 时加密为一帧
+func NewWriter(w io.Writer, dataKey []byte) (*Writer, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce[:noncePrefixSize]); err != nil {
+		return nil, err
+	}
+	header := append([]byte(streamMagic), nonce[:noncePrefixSize]...)
+	return &Writer{w: w, aead: aead, nonce: nonce, header: header}, nil
+}
+
+func (s *Writer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errStreamClosed
+	}
+	n := len(p)
+	for len(p) > 0 {
+		size := maxFrameSize - len(s.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		s.buf = append(s.buf, p[:size]...)
+		p = p[size:]
+		if len(s.buf) >= maxFrameSize {
+			if err := s.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *Writer) Flush() error {
+	if len(s.buf) == 0 || s.closed {
+		return nil
+	}
+	return s.writeFrame(nil)
+}
+
+func (s *Writer) writeFrame(additionalData []byte) error {
+	binary.BigEndian.PutUint64(s.nonce[noncePrefixSize:], s.seq)
+	s.seq++
+	frame := make([]byte, 4, 4+len(s.buf)+s.aead.Overhead())
+	frame = s.aead.Seal(frame, s.nonce, s.buf, additionalData)
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(frame)-4))
+	if s.header != nil {
+		frame = append(s.header, frame...)
+		s.header = nil
+	}
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(frame)
+	return err
+}
+
+// Close 将剩余的数据写入结束帧, 没有写入过数据的流不写入任何内容
+func (s *Writer) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.header != nil && len(s.buf) == 0 {
+		return nil
+	}
+	return s.writeFrame(finalFrameAD)
+}
+
+type Reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	seq   uint64
+	plain []byte
+	final bool
+	// 允许流在帧边界或不完整的最后一帧处结束
+	allowTorn bool
+}
+
+// NewReader 读取并校验流头部, 返回解密后的数据流, 流没有结束帧时返回 ErrTruncatedStream
+func NewReader(r io.Reader, dataKey []byte) (*Reader, error) {
+	return newReader(r, dataKey, false)
+}
+
+// NewRecoveryReader 用于读取异常中断的本地文件, 不要求结束帧, 不完整的最后一帧被忽略
+func NewRecoveryReader(r io.Reader, dataKey []byte) (*Reader, error) {
+	return newReader(r, dataKey, true)
+}
+
+func newReader(r io.Reader, dataKey []byte, allowTorn bool) (*Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReaderSize(r, maxFrameSize)
+	header := make([]byte, len(streamMagic)+noncePrefixSize)
+	if _, err = io.ReadFull(reader, header); err != nil || string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrInvalidStream
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(streamMagic):])
+	return &Reader{r: reader, aead: aead, nonce: nonce, allowTorn: allowTorn}, nil
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if err := s.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *Reader) readFrame() error {
+	var sizeBuf [4]byte
+	n, err := io.ReadFull(s.r, sizeBuf[:])
+	if s.final {
+		// 结束帧之后不能有数据
+		if n > 0 {
+			return ErrInvalidStream
+		}
+		return io.EOF
+	}
+	if err != nil {
+		return s.truncated()
+	}
+	size := binary.BigEndian.Uint32(sizeBuf[:])
+	if size > maxFrameSize+uint32(s.aead.Overhead()) {
+		return ErrInvalidStream
+	}
+	frame := make([]byte, size)
+	if _, err = io.ReadFull(s.r, frame); err != nil {
+		return s.truncated()
+	}
+	binary.BigEndian.PutUint64(s.nonce[noncePrefixSize:], s.seq)
+	s.seq++
+	plain, err := s.aead.Open(nil, s.nonce, frame, nil)
+	if err != nil {
+		if plain, err = s.aead.Open(nil, s.nonce, frame, finalFrameAD); err != nil {
+			return ErrInvalidStream
+		}
+		s.final = true
+	}
+	s.plain = plain
+	return nil
+}
+
+// truncated 没有读到结束帧时流已经结束
+func (s *Reader) truncated() error {
+	if s.allowTorn {
+		return io.EOF
+	}
+	return ErrTruncatedStream
+}
+
+// IsEncryptedFile 判断文件是否是加密流
+func IsEncryptedFile(path string) bool {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	magic := make([]byte, len(streamMagic))
+	if _, err = io.ReadFull(fd, magic); err != nil {
+		return false
+	}
+	return string(magic) == streamMagic
+}
@@ -0,0 +1,212 @@
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+/*
+	会话共享的键盘控制:
+	同一时间只有一个参与者持有键盘, 其他参与者的输入被丢弃。
+	参与者通过 ControlRequestEvent 申请控制, 会话所有者授予、撤销或收回控制;
+	所有者输入时自动收回控制。
+	控制状态只保存在创建会话的 koko 上的 Room 中, 其他 koko 的参与者通过 Receive 经 redis 发送申请,
+	状态变化以 ControlStateEvent 广播给所有参与者
+*/
+
+var (
+	ErrControlDisabled  = errors.New("room control is disabled")
+	ErrControlNoRequest = errors.New("participant has no control request")
+	ErrControlNotHolder = errors.New("participant does not hold the control")
+)
+
+// ControlParticipant 是控制状态中的参与者, Key 用于授予和撤销控制
+type ControlParticipant struct {
+	Key string `json:"key"`
+	MetaMessage
+}
+
+type ControlState struct {
+	Owner    ControlParticipant   `json:"owner"`
+	Holder   ControlParticipant   `json:"holder"`
+	Requests []ControlParticipant `json:"requests"`
+}
+
+func (m MetaMessage) participantKey() string {
+	return m.User + m.Created
+}
+
+func newParticipant(meta MetaMessage) ControlParticipant {
+	return ControlParticipant{Key: meta.participantKey(), MetaMessage: meta}
+}
+
+type roomControl struct {
+	lock     sync.Mutex
+	owner    ControlParticipant
+	holder   ControlParticipant
+	requests []ControlParticipant
+}
+
+func (c *roomControl) state() ControlState {
+	requests := make([]ControlParticipant, len(c.requests))
+	copy(requests, c.requests)
+	return ControlState{Owner: c.owner, Holder: c.holder, Requests: requests}
+}
+
+func (c *roomControl) indexRequest(key string) int {
+	for i := range c.requests {
+		if c.requests[i].Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *roomControl) removeRequest(key string) bool {
+	if i := c.indexRequest(key); i >= 0 {
+		c.requests = append(c.requests[:i], c.requests[i+1:]...)
+		return true
+	}
+	return false
+}
+
+/*
+	EnableControl 启用键盘控制, owner 是会话所有者的输入信息。
+	只在创建会话的 Room 上调用, 代理其他 koko 会话的 Room 不保存控制状态
+*/
+
+func (r *Room) EnableControl(owner MetaMessage) {
+	participant := newParticipant(owner)
+	r.controlLock.Lock()
+	r.control = &roomControl{owner: participant, holder: participant}
+	r.controlLock.Unlock()
+	r.broadcastControlState()
+}
+
+func (r *Room) getControl() *roomControl {
+	r.controlLock.Lock()
+	defer r.controlLock.Unlock()
+	return r.control
+}
+
+// ControlState 返回当前的控制状态, 未启用时返回 false
+func (r *Room) ControlState() (ControlState, bool) {
+	control := r.getControl()
+	if control == nil {
+		return ControlState{}, false
+	}
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	return control.state(), true
+}
+
+// GrantControl 所有者把键盘交给申请控制的参与者
+func (r *Room) GrantControl(key string) error {
+	return r.updateControl(func(c *roomControl) error {
+		i := c.indexRequest(key)
+		if i < 0 {
+			return ErrControlNoRequest
+		}
+		c.holder = c.requests[i]
+		c.removeRequest(key)
+		return nil
+	})
+}
+
+// RevokeControl 所有者撤销参与者的控制或拒绝其申请, 键盘回到所有者
+func (r *Room) RevokeControl(key string) error {
+	return r.updateControl(func(c *roomControl) error {
+		removed := c.removeRequest(key)
+		if c.holder.Key == key && key != c.owner.Key {
+			c.holder = c.owner
+			return nil
+		}
+		if !removed {
+			return ErrControlNotHolder
+		}
+		return nil
+	})
+}
+
+// ReclaimControl 所有者收回键盘并清空所有申请
+func (r *Room) ReclaimControl() error {
+	return r.updateControl(func(c *roomControl) error {
+		c.holder = c.owner
+		c.requests = nil
+		return nil
+	})
+}
+
+func (r *Room) updateControl(fn func(c *roomControl) error) error {
+	control := r.getControl()
+	if control == nil {
+		return ErrControlDisabled
+	}
+	control.lock.Lock()
+	err := fn(control)
+	control.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	r.broadcastControlState()
+	return nil
+}
+
+/*
+	filterControl 在创建会话的 Room 上处理输入:
+	处理控制申请和释放, 丢弃没有持有键盘的参与者的输入。返回 false 表示消息不再发给会话
+*/
+
+func (r *Room) filterControl(msg *RoomMessage) bool {
+	control := r.getControl()
+	if control == nil {
+		return true
+	}
+	key := msg.Meta.participantKey()
+	changed := false
+	pass := true
+	control.lock.Lock()
+	switch msg.Event {
+	case ControlRequestEvent:
+		pass = false
+		if key != control.owner.Key && key != control.holder.Key && control.indexRequest(key) < 0 {
+			control.requests = append(control.requests, newParticipant(msg.Meta))
+			changed = true
+		}
+	case ControlReleaseEvent:
+		pass = false
+		changed = control.removeRequest(key)
+		if key == control.holder.Key && key != control.owner.Key {
+			control.holder = control.owner
+			changed = true
+		}
+	case DataEvent:
+		switch key {
+		case control.holder.Key:
+		case control.owner.Key:
+			// 所有者输入时收回键盘
+			control.holder = control.owner
+			changed = true
+		default:
+			pass = false
+		}
+	}
+	control.lock.Unlock()
+	if changed {
+		r.broadcastControlState()
+	}
+	return pass
+}
+
+// broadcastControlState 广播当前状态, 加锁保证并发修改时广播的顺序与状态一致
+func (r *Room) broadcastControlState() {
+	r.controlBroadcastLock.Lock()
+	defer r.controlBroadcastLock.Unlock()
+	state, ok := r.ControlState()
+	if !ok {
+		return
+	}
+	body, _ := json.Marshal(state)
+	r.Broadcast(&RoomMessage{Event: ControlStateEvent, Body: body})
+}
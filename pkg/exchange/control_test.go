@@ -0,0 +1,58 @@
+package exchange
+
+import (
+	"testing"
+)
+
+func TestRoomControl(t *testing.T) {
+	inChan := make(chan *RoomMessage, 10)
+	room := CreateRoom("test", inChan)
+	go room.run()
+	defer room.stop()
+
+	owner := MetaMessage{UserId: "1", User: "owner", Created: "t1"}
+	guest := MetaMessage{UserId: "2", User: "guest", Created: "t2"}
+	room.EnableControl(owner)
+
+	received := func() int {
+		n := len(inChan)
+		for i := 0; i < n; i++ {
+			<-inChan
+		}
+		return n
+	}
+
+	room.Receive(&RoomMessage{Event: DataEvent, Body: []byte("ls"), Meta: guest})
+	if n := received(); n != 0 {
+		t.Fatalf("guest without control should not type, got %d", n)
+	}
+	if err := room.GrantControl(newParticipant(guest).Key); err != ErrControlNoRequest {
+		t.Fatalf("grant without request got %v", err)
+	}
+
+	room.Receive(&RoomMessage{Event: ControlRequestEvent, Meta: guest})
+	state, _ := room.ControlState()
+	if len(state.Requests) != 1 || state.Requests[0].UserId != "2" {
+		t.Fatalf("expect guest request, got %+v", state.Requests)
+	}
+	if err := room.GrantControl(state.Requests[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	room.Receive(&RoomMessage{Event: DataEvent, Body: []byte("ls"), Meta: guest})
+	room.Receive(&RoomMessage{Event: DataEvent, Body: []byte("pwd"), Meta: owner})
+	if n := received(); n != 2 {
+		t.Fatalf("expect holder and owner input, got %d", n)
+	}
+	// 所有者输入后收回了键盘
+	room.Receive(&RoomMessage{Event: DataEvent, Body: []byte("ls"), Meta: guest})
+	if n := received(); n != 0 {
+		t.Fatalf("guest input after owner reclaim should be dropped, got %d", n)
+	}
+	state, _ = room.ControlState()
+	if state.Holder.UserId != "1" || len(state.Requests) != 0 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if err := room.RevokeControl(newParticipant(guest).Key); err != ErrControlNotHolder {
+		t.Fatalf("revoke guest without control got %v", err)
+	}
+}
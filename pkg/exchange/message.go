@@ -38,6 +38,17 @@ const (
 	ShareUsers = "Share_USERS"
 
 	ActionEvent = "Action"
+
+	// 管理员冻结、解冻用户输入, 冻结期间仍然输出服务器数据
+	FreezeEvent   = "Freeze"
+	UnFreezeEvent = "UnFreeze"
+	// 管理员向用户终端插入一行提示, 不发送给服务器
+	NoticeEvent = "Notice"
+
+	// 共享会话的参与者申请、释放键盘控制, 控制状态变化时广播 ControlStateEvent
+	ControlRequestEvent = "Control_REQUEST"
+	ControlReleaseEvent = "Control_RELEASE"
+	ControlStateEvent   = "Control_STATE"
 )
 
 const (
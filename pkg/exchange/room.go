@@ -10,6 +10,7 @@ import (
 
 	"github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/metrics"
 )
 
 type RoomManager interface {
@@ -55,6 +56,30 @@ type Room struct {
 	once sync.Once
 
 	recentMessages *ring.Ring
+
+	controlLock          sync.Mutex
+	controlBroadcastLock sync.Mutex
+	control              *roomControl // 键盘控制状态, 只在创建会话的 Room 上启用
+
+	sharedLock     sync.Mutex
+	sharedCallback func()
+}
+
+// OnShared 设置会话第一次被分享或监控 (出现第二个连接) 时的回调, 只调用一次
+func (r *Room) OnShared(fn func()) {
+	r.sharedLock.Lock()
+	r.sharedCallback = fn
+	r.sharedLock.Unlock()
+}
+
+func (r *Room) notifyShared() {
+	r.sharedLock.Lock()
+	fn := r.sharedCallback
+	r.sharedCallback = nil
+	r.sharedLock.Unlock()
+	if fn != nil {
+		fn()
+	}
 }
 
 func (r *Room) run() {
@@ -62,8 +87,17 @@ func (r *Room) run() {
 	defer ticker.Stop()
 	defer r.closeOnce()
 	connMaps := make(map[string]*Conn)
+	metrics.RoomsActive.Inc()
+	defer func() {
+		metrics.RoomsActive.Dec()
+		metrics.RoomSubscribers.Add(-float64(len(connMaps)))
+	}()
 	currentOnlineUsers := make(map[string]MetaMessage)
-	var ZMODEMStatus bool
+	var (
+		ZMODEMStatus bool
+		frozen       bool
+		controlState *RoomMessage
+	)
 	for {
 		select {
 		case <-ticker.C:
@@ -79,13 +113,25 @@ func (r *Room) run() {
 			default:
 			}
 		case con := <-r.subscriber:
+			if _, ok := connMaps[con.Id]; !ok {
+				metrics.RoomSubscribers.Inc()
+			}
 			connMaps[con.Id] = con
+			if len(connMaps) > 1 {
+				r.notifyShared()
+			}
 			if ZMODEMStatus {
 				con.handlerMessage(&RoomMessage{
 					Event: ActionEvent,
 					Body:  []byte(ZmodemStartEvent),
 				})
 			}
+			if frozen {
+				con.handlerMessage(&RoomMessage{Event: FreezeEvent})
+			}
+			if controlState != nil {
+				con.handlerMessage(controlState)
+			}
 			r.recentMessages.Do(func(value interface{}) {
 				if msg, ok := value.(*RoomMessage); ok {
 					switch msg.Event {
@@ -101,6 +147,9 @@ func (r *Room) run() {
 			})
 			logger.Debugf("Room %s current connections count: %d", r.Id, len(connMaps))
 		case con := <-r.unSubscriber:
+			if _, ok := connMaps[con.Id]; ok {
+				metrics.RoomSubscribers.Dec()
+			}
 			delete(connMaps, con.Id)
 			logger.Debugf("Room %s current connections count: %d", r.Id, len(connMaps))
 		case msg := <-r.broadcastChan:
@@ -127,6 +176,12 @@ func (r *Room) run() {
 				default:
 					ZMODEMStatus = false
 				}
+			case FreezeEvent:
+				frozen = true
+			case UnFreezeEvent:
+				frozen = false
+			case ControlStateEvent:
+				controlState = msg
 			}
 			r.broadcastMessage(userConns, msg)
 
@@ -155,6 +210,9 @@ func (r *Room) Broadcast(msg *RoomMessage) {
 }
 
 func (r *Room) Receive(msg *RoomMessage) {
+	if !r.filterControl(msg) {
+		return
+	}
 	select {
 	case <-r.done:
 	case r.userInputChan <- msg:
@@ -0,0 +1,419 @@
+package filerecord
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/envelope"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	文件传输内容录制:
+	启用后 SFTP、Web 文件管理和 ZMODEM 传输的文件内容先写入本地 {dir}/{date}/{id}.bin,
+	超过 maxSize 的部分只计算 sha256 不保存。传输结束后压缩为 {id}.bin.gz, 启用录像加密时同时加密,
+	再生成元数据 {id}.json, 依次上传到录像存储的 file_records/{date}/ 下。
+	FTP 日志的 content_record 字段是元数据文件在录像存储中的路径。
+	server 存储只能保存会话录像, null 存储不保存任何内容, 使用这两种存储时不录制文件内容。
+*/
+
+const (
+	storagePrefix = "file_records"
+	dateFormat    = "2006-01-02"
+
+	rawSuffix     = ".bin"
+	contentSuffix = ".bin.gz"
+	metaSuffix    = ".json"
+
+	// 乱序写入时等待计算哈希的数据上限, 超过后放弃计算 sha256
+	maxPendingSize = 8 * 1024 * 1024
+	uploadMaxRetry = 3
+)
+
+type Storage interface {
+	Upload(gZipFile, target string) error
+	TypeName() string
+}
+
+var ErrStorageNotSupported = errors.New("replay storage can not store file records")
+
+// supported server 和 null 存储不能保存文件内容
+func supported(storage Storage) bool {
+	switch storage.TypeName() {
+	case "server", "null":
+		return false
+	}
+	return true
+}
+
+type manager struct {
+	dir     string
+	maxSize int64
+	storage func() Storage
+
+	mu sync.Mutex
+	// 已经告警过的不支持的存储类型
+	unsupported string
+}
+
+var defaultManager *manager
+
+/*
+	Setup 启用文件内容录制, maxSize 为每个文件保存的最大字节数, 小于等于 0 时保存全部内容。
+	当前的录像存储不能保存文件内容时返回 ErrStorageNotSupported, 录像存储切换为支持的存储后开始录制
+*/
+
+func Setup(dir string, maxSize int64, storage func() Storage) error {
+	m := &manager{dir: dir, maxSize: maxSize, storage: storage}
+	defaultManager = m
+	if s := storage(); !supported(s) {
+		m.unsupported = s.TypeName()
+		return fmt.Errorf("%w: %s", ErrStorageNotSupported, s.TypeName())
+	}
+	return nil
+}
+
+// checkStorage 录像存储切换为不支持的存储时告警一次
+func (m *manager) checkStorage(storage Storage) bool {
+	ok := supported(storage)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ok {
+		m.unsupported = ""
+		return true
+	}
+	if m.unsupported != storage.TypeName() {
+		m.unsupported = storage.TypeName()
+		logger.Warnf("Replay storage %s can not store file records, file contents are not recorded", storage.TypeName())
+	}
+	return false
+}
+
+func Enabled() bool {
+	return defaultManager != nil
+}
+
+// Info 是记录到元数据中的传输信息, 与 FTP 日志对应
+type Info struct {
+	SessionID  string `json:"session,omitempty"`
+	User       string `json:"user"`
+	Asset      string `json:"asset"`
+	OrgID      string `json:"org_id"`
+	SystemUser string `json:"system_user"`
+	RemoteAddr string `json:"remote_addr"`
+	Operate    string `json:"operate"`
+	Filename   string `json:"filename"`
+}
+
+type Metadata struct {
+	ID string `json:"id"`
+	Info
+	DateStart    time.Time `json:"date_start"`
+	DateEnd      time.Time `json:"date_end"`
+	Size         int64     `json:"size"`
+	RecordedSize int64     `json:"recorded_size"`
+	Truncated    bool      `json:"truncated"`
+	// 传输的完整内容的 sha256, 内容不连续无法计算时为空
+	SHA256  string            `json:"sha256,omitempty"`
+	Content string            `json:"content"`
+	Key     *envelope.KeyInfo `json:"key,omitempty"`
+}
+
+type Recorder struct {
+	meta    Metadata
+	dateDir string
+	maxSize int64
+	storage Storage
+
+	mu          sync.Mutex
+	file        *os.File
+	hash        hash.Hash
+	next        int64
+	pending     map[int64][]byte
+	pendingSize int
+	hashBroken  bool
+	closed      bool
+}
+
+// New 创建文件内容录制, 未启用或录像存储不支持时返回 nil, nil 的 Recorder 可以直接使用
+func New(info Info) *Recorder {
+	m := defaultManager
+	if m == nil {
+		return nil
+	}
+	storage := m.storage()
+	if !m.checkStorage(storage) {
+		return nil
+	}
+	now := time.Now().UTC()
+	date := now.Format(dateFormat)
+	dateDir := filepath.Join(m.dir, date)
+	if err := os.MkdirAll(dateDir, 0700); err != nil {
+		logger.Errorf("Create file record dir %s err: %s", dateDir, err)
+		return nil
+	}
+	id := common.UUID()
+	fd, err := os.OpenFile(filepath.Join(dateDir, id+rawSuffix), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		logger.Errorf("Create file record %s err: %s", id, err)
+		return nil
+	}
+	return &Recorder{
+		meta: Metadata{
+			ID:        id,
+			Info:      info,
+			DateStart: now,
+			Content:   storageTarget(date, id+contentSuffix),
+		},
+		dateDir: dateDir,
+		maxSize: m.maxSize,
+		storage: storage,
+		file:    fd,
+		hash:    sha256.New(),
+		pending: make(map[int64][]byte),
+	}
+}
+
+func storageTarget(date, filename string) string {
+	return strings.Join([]string{storagePrefix, date, filename}, "/")
+}
+
+// Target 返回元数据文件在录像存储中的路径, 用于关联 FTP 日志
+func (r *Recorder) Target() string {
+	if r == nil {
+		return ""
+	}
+	return storageTarget(r.meta.DateStart.Format(dateFormat), r.meta.ID+metaSuffix)
+}
+
+// WriteAt 记录从 off 开始传输的数据, 可以乱序或重复写入
+func (r *Recorder) WriteAt(p []byte, off int64) {
+	if r == nil || len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	end := off + int64(len(p))
+	if end > r.meta.Size {
+		r.meta.Size = end
+	}
+	r.save(p, off)
+	r.updateHash(p, off)
+}
+
+func (r *Recorder) save(p []byte, off int64) {
+	data := p
+	if r.maxSize > 0 {
+		if off >= r.maxSize {
+			r.meta.Truncated = true
+			return
+		}
+		if off+int64(len(p)) > r.maxSize {
+			data = p[:r.maxSize-off]
+			r.meta.Truncated = true
+		}
+	}
+	if _, err := r.file.WriteAt(data, off); err != nil {
+		logger.Errorf("File record %s write err: %s", r.meta.ID, err)
+		return
+	}
+	if end := off + int64(len(data)); end > r.meta.RecordedSize {
+		r.meta.RecordedSize = end
+	}
+}
+
+/*
+	updateHash 按偏移顺序计算 sha256, 先到的后续数据暂存等待前面的数据。
+	重传已计算过的数据时认为内容相同, 只计算新的部分
+*/
+
+func (r *Recorder) updateHash(p []byte, off int64) {
+	if r.hashBroken {
+		return
+	}
+	switch {
+	case off > r.next:
+		if r.pendingSize+len(p) > maxPendingSize {
+			r.hashBroken = true
+			r.pending = nil
+			return
+		}
+		r.pending[off] = append([]byte(nil), p...)
+		r.pendingSize += len(p)
+		return
+	case off < r.next:
+		if off+int64(len(p)) <= r.next {
+			return
+		}
+		p = p[r.next-off:]
+	}
+	r.hash.Write(p)
+	r.next += int64(len(p))
+	for {
+		data, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+		delete(r.pending, r.next)
+		r.pendingSize -= len(data)
+		r.hash.Write(data)
+		r.next += int64(len(data))
+	}
+}
+
+// Close 结束录制, 在后台压缩并上传
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if err := r.file.Close(); err != nil {
+		logger.Errorf("File record %s close err: %s", r.meta.ID, err)
+	}
+	r.meta.DateEnd = time.Now().UTC()
+	if !r.hashBroken && len(r.pending) == 0 && r.next == r.meta.Size {
+		r.meta.SHA256 = hex.EncodeToString(r.hash.Sum(nil))
+	}
+	r.pending = nil
+	meta := r.meta
+	go r.finish(meta)
+}
+
+func (r *Recorder) finish(meta Metadata) {
+	rawPath := filepath.Join(r.dateDir, meta.ID+rawSuffix)
+	contentPath := filepath.Join(r.dateDir, meta.ID+contentSuffix)
+	var dataKey []byte
+	if wrapper := envelope.Default(); wrapper != nil {
+		key, info, err := envelope.GenerateDataKey(wrapper)
+		if err != nil {
+			// 无法加密时不上传明文内容, 保留本地文件
+			logger.Errorf("File record %s generate data key err: %s", meta.ID, err)
+			return
+		}
+		dataKey = key
+		meta.Key = &info
+	}
+	if err := compressFile(rawPath, contentPath, dataKey); err != nil {
+		logger.Errorf("File record %s compress err: %s", meta.ID, err)
+		return
+	}
+	_ = os.Remove(rawPath)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		logger.Errorf("File record %s marshal metadata err: %s", meta.ID, err)
+		return
+	}
+	metaPath := filepath.Join(r.dateDir, meta.ID+metaSuffix)
+	if err = ioutil.WriteFile(metaPath, data, 0600); err != nil {
+		logger.Errorf("File record %s write metadata err: %s", meta.ID, err)
+		return
+	}
+	if err = upload(r.storage, r.dateDir, meta.ID); err != nil {
+		logger.Errorf("File record %s upload to %s err: %s", meta.ID, r.storage.TypeName(), err)
+		return
+	}
+	logger.Infof("File record %s of %s uploaded to %s", meta.ID, meta.Filename, r.storage.TypeName())
+}
+
+func compressFile(srcPath, dstPath string, dataKey []byte) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	df, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	var sealer *envelope.Writer
+	var w io.Writer = df
+	if dataKey != nil {
+		if sealer, err = envelope.NewWriter(df, dataKey); err != nil {
+			_ = df.Close()
+			return err
+		}
+		w = sealer
+	}
+	gzWriter := gzip.NewWriter(w)
+	_, err = io.Copy(gzWriter, src)
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	if err == nil && sealer != nil {
+		err = sealer.Close()
+	}
+	if closeErr := df.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// upload 先上传内容再上传元数据, 都成功后删除本地文件
+func upload(storage Storage, dateDir, id string) error {
+	date := filepath.Base(dateDir)
+	for _, filename := range []string{id + contentSuffix, id + metaSuffix} {
+		var err error
+		for i := 0; i < uploadMaxRetry; i++ {
+			if err = storage.Upload(filepath.Join(dateDir, filename), storageTarget(date, filename)); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_ = os.Remove(filepath.Join(dateDir, id+contentSuffix))
+	_ = os.Remove(filepath.Join(dateDir, id+metaSuffix))
+	return nil
+}
+
+// UploadRemain 上传之前上传失败的文件内容录制, 只处理已经生成元数据的录制
+func UploadRemain() {
+	m := defaultManager
+	if m == nil {
+		return
+	}
+	metaFiles, err := filepath.Glob(filepath.Join(m.dir, "*", "*"+metaSuffix))
+	if err != nil || len(metaFiles) == 0 {
+		return
+	}
+	storage := m.storage()
+	if !supported(storage) {
+		return
+	}
+	var count int
+	for _, metaPath := range metaFiles {
+		dateDir := filepath.Dir(metaPath)
+		id := strings.TrimSuffix(filepath.Base(metaPath), metaSuffix)
+		if _, err = os.Stat(filepath.Join(dateDir, id+contentSuffix)); err != nil {
+			continue
+		}
+		if err = upload(storage, dateDir, id); err != nil {
+			logger.Errorf("Upload remain file record %s err: %s", id, err)
+			continue
+		}
+		count++
+	}
+	logger.Infof("Upload %d remain file records to %s", count, storage.TypeName())
+}
@@ -0,0 +1,137 @@
+package filerecord
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testStorage struct {
+	dir string
+}
+
+func (s testStorage) Upload(src, target string) error {
+	dst := filepath.Join(s.dir, filepath.FromSlash(target))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(dst+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+func (s testStorage) TypeName() string {
+	return "local"
+}
+
+func waitMetadata(t *testing.T, path string) Metadata {
+	for i := 0; i < 100; i++ {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			var meta Metadata
+			if err = json.Unmarshal(data, &meta); err != nil {
+				t.Fatal(err)
+			}
+			return meta
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("metadata %s not uploaded", path)
+	return Metadata{}
+}
+
+func TestRecorder(t *testing.T) {
+	storageDir := t.TempDir()
+	if err := Setup(t.TempDir(), 10, func() Storage { return testStorage{dir: storageDir} }); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { defaultManager = nil }()
+
+	content := []byte("0123456789abcdefghij")
+	sum := sha256.Sum256(content)
+	recorder := New(Info{Operate: "Upload", Filename: "/tmp/a.txt"})
+	// 乱序和重复写入
+	recorder.WriteAt(content[5:12], 5)
+	recorder.WriteAt(content[:5], 0)
+	recorder.WriteAt(content[:8], 0)
+	recorder.WriteAt(content[12:], 12)
+	recorder.Close()
+
+	meta := waitMetadata(t, filepath.Join(storageDir, filepath.FromSlash(recorder.Target())))
+	if meta.Size != 20 || meta.RecordedSize != 10 || !meta.Truncated || meta.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	fd, err := os.Open(filepath.Join(storageDir, filepath.FromSlash(meta.Content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	reader, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(data, content[:10]) {
+		t.Fatalf("recorded content %q: %v", data, err)
+	}
+
+	// 中间缺少数据时不能计算 sha256
+	recorder = New(Info{Operate: "Download", Filename: "/tmp/b.txt"})
+	recorder.WriteAt(content[:5], 0)
+	recorder.WriteAt(content[10:], 10)
+	recorder.Close()
+	meta = waitMetadata(t, filepath.Join(storageDir, filepath.FromSlash(recorder.Target())))
+	if meta.SHA256 != "" || meta.Size != 20 {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+}
+
+func TestDisabledRecorder(t *testing.T) {
+	recorder := New(Info{Filename: "/tmp/a.txt"})
+	if recorder != nil {
+		t.Fatal("recorder should be nil when disabled")
+	}
+	recorder.WriteAt([]byte("data"), 0)
+	recorder.Close()
+	if recorder.Target() != "" {
+		t.Fatal("nil recorder should have no target")
+	}
+}
+
+type serverStorage struct {
+	testStorage
+}
+
+func (s serverStorage) TypeName() string {
+	return "server"
+}
+
+func TestUnsupportedStorage(t *testing.T) {
+	var storage Storage = serverStorage{}
+	err := Setup(t.TempDir(), 0, func() Storage { return storage })
+	defer func() { defaultManager = nil }()
+	if !errors.Is(err, ErrStorageNotSupported) {
+		t.Fatalf("setup got err %v, want %v", err, ErrStorageNotSupported)
+	}
+	if recorder := New(Info{Filename: "/tmp/a.txt"}); recorder != nil {
+		t.Fatal("recorder should be nil when storage not support file record")
+	}
+	// 切换为支持的存储后开始录制
+	storage = testStorage{dir: t.TempDir()}
+	recorder := New(Info{Filename: "/tmp/a.txt"})
+	if recorder == nil {
+		t.Fatal("recorder should be created after storage changed")
+	}
+	recorder.Close()
+}
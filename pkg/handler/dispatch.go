@@ -1,14 +1,18 @@
 package handler
 
 import (
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/jumpserver/koko/pkg/exchange"
 	"github.com/jumpserver/koko/pkg/i18n"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/common"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/utils"
 )
 
 func (h *InteractiveHandler) Dispatch() {
@@ -153,12 +157,19 @@ func JoinRoom(h *InteractiveHandler, roomId string) {
 		conn := exchange.WrapperUserCon(h.sess)
 		room.Subscribe(conn)
 		defer room.UnSubscribe(conn)
+		control := joinRoomControl{h: h, room: room, roomId: roomId}
 		for {
 			buf := make([]byte, 1024)
 			nr, err := h.sess.Read(buf)
-			if nr > 0 && h.CheckShareRoomWritePerm(roomId) {
-				room.Receive(&exchange.RoomMessage{
-					Event: exchange.DataEvent, Body: buf[:nr]})
+			if nr > 0 {
+				data, quit := control.feed(buf[:nr])
+				if len(data) > 0 && h.CheckShareRoomWritePerm(roomId) {
+					room.Receive(&exchange.RoomMessage{
+						Event: exchange.DataEvent, Body: data})
+				}
+				if quit {
+					break
+				}
 			}
 			if err != nil {
 				break
@@ -167,3 +178,117 @@ func JoinRoom(h *InteractiveHandler, roomId string) {
 		logger.Infof("Conn[%s] user read end", h.sess.Uuid)
 	}
 }
+
+// 加入会话后按 Ctrl-] 进入控制命令行
+const joinControlKey = 0x1d
+
+/*
+	joinRoomControl 处理加入会话后的控制命令:
+	freeze、unfreeze 冻结和解冻用户输入, notice <message> 向用户终端发送提示, quit 退出会话。
+	需要有监控该会话的权限
+*/
+
+type joinRoomControl struct {
+	h      *InteractiveHandler
+	room   *exchange.Room
+	roomId string
+
+	editing bool
+	line    []byte
+	allowed *bool
+}
+
+// feed 处理用户输入, 返回需要发送到会话的数据和是否退出
+func (c *joinRoomControl) feed(p []byte) (data []byte, quit bool) {
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if !c.editing {
+			if b == joinControlKey {
+				c.startEdit()
+				continue
+			}
+			data = append(data, b)
+			continue
+		}
+		switch b {
+		case '\r', '\n':
+			c.editing = false
+			c.write("\r\n")
+			if c.execute(strings.TrimSpace(string(c.line))) {
+				return data, true
+			}
+		case 0x7f, 0x08:
+			if len(c.line) > 0 {
+				_, size := utf8.DecodeLastRune(c.line)
+				c.line = c.line[:len(c.line)-size]
+				c.write("\b \b")
+			}
+		case 0x03, joinControlKey:
+			c.editing = false
+			c.write("\r\n")
+		default:
+			c.line = append(c.line, b)
+			_, _ = c.h.sess.Write([]byte{b})
+		}
+	}
+	return data, false
+}
+
+func (c *joinRoomControl) startEdit() {
+	lang := i18n.NewLang(c.h.i18nLang)
+	if c.allowed == nil {
+		allowed := c.h.CheckShareRoomReadPerm(c.roomId)
+		c.allowed = &allowed
+	}
+	if !*c.allowed {
+		c.write("\r\n" + utils.WrapperWarn(lang.T("No permission to control the session")) + "\r\n")
+		return
+	}
+	c.editing = true
+	c.line = c.line[:0]
+	c.write("\r\n" + lang.T("Session control: freeze | unfreeze | notice <message> | quit") + "\r\n> ")
+}
+
+func (c *joinRoomControl) execute(line string) (quit bool) {
+	lang := i18n.NewLang(c.h.i18nLang)
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	var event string
+	switch strings.ToLower(cmd) {
+	case "":
+		return false
+	case "quit", "exit", "q":
+		return true
+	case "freeze":
+		event = exchange.FreezeEvent
+	case "unfreeze":
+		event = exchange.UnFreezeEvent
+	case "notice":
+		if arg == "" {
+			c.write(lang.T("Notice message is empty") + "\r\n")
+			return false
+		}
+		event = exchange.NoticeEvent
+	default:
+		c.write(fmt.Sprintf(lang.T("Unknown command %s"), cmd) + "\r\n")
+		return false
+	}
+	c.room.Receive(&exchange.RoomMessage{
+		Event: event,
+		Body:  []byte(arg),
+		Meta: exchange.MetaMessage{
+			UserId:     c.h.user.ID,
+			User:       c.h.user.String(),
+			Created:    common.NewNowUTCTime().String(),
+			RemoteAddr: c.h.sess.RemoteAddr(),
+		},
+	})
+	logger.Infof("Conn[%s] user %s send %s to room %s", c.h.sess.Uuid, c.h.user.String(), event, c.roomId)
+	return false
+}
+
+func (c *joinRoomControl) write(s string) {
+	_, _ = io.WriteString(c.h.sess, s)
+}
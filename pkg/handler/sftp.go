@@ -19,6 +19,11 @@ func NewSFTPHandler(jmsService *service.JMService, user *model.User, addr string
 	return &sftpHandler{UserSftpConn: srvconn.NewUserSftpConn(jmsService, user, addr)}
 }
 
+// NewSFTPHandlerWithConn 使用指定的 sftp 目录, 如直连格式只包含一个资产
+func NewSFTPHandlerWithConn(conn *srvconn.UserSftpConn) *sftpHandler {
+	return &sftpHandler{UserSftpConn: conn}
+}
+
 type sftpHandler struct {
 	*srvconn.UserSftpConn
 }
@@ -121,12 +126,12 @@ func (f listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
 	return n, nil
 }
 
-func NewWriterAt(f *sftp.File) io.WriterAt {
+func NewWriterAt(f *srvconn.SftpFile) io.WriterAt {
 	return &clientReadWritAt{f: f, mu: new(sync.RWMutex)}
 }
 
 type clientReadWritAt struct {
-	f  *sftp.File
+	f  *srvconn.SftpFile
 	mu *sync.RWMutex
 }
 
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+const scpRelayEnv = "KOKO_TEST_SCP_RELAY"
+
+// TestSCPRelayHelper 作为 scp -S 指定的程序, 把 scp 的 stdin/stdout 转发到测试中的 sftp 服务
+func TestSCPRelayHelper(t *testing.T) {
+	addr := os.Getenv(scpRelayEnv)
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(2)
+	}
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(os.Stdout, conn)
+	// 直接退出, 避免测试框架的输出写入 scp 的数据流
+	os.Exit(0)
+}
+
+// startFakeAsset 启动只支持 sftp 子系统的 ssh 服务, 文件保存在内存中
+func startFakeAsset(t *testing.T, password string) (string, int) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &gossh.ServerConfig{
+		PasswordCallback: func(conn gossh.ConnMetadata, pass []byte) (*gossh.Permissions, error) {
+			if string(pass) != password {
+				return nil, fmt.Errorf("password rejected for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	conf.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	handlers := sftp.InMemHandler()
+	go func() {
+		for {
+			nConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeAsset(nConn, conf, handlers)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func serveFakeAsset(nConn net.Conn, conf *gossh.ServerConfig, handlers sftp.Handlers) {
+	_, chans, reqs, err := gossh.NewServerConn(nConn, conf)
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(gossh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					server := sftp.NewRequestServer(channel, handlers)
+					go func() {
+						_ = server.Serve()
+						_ = channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+type fakeCore struct {
+	mu      sync.Mutex
+	ftpLogs []model.FTPLog
+}
+
+func (c *fakeCore) logs() []model.FTPLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]model.FTPLog(nil), c.ftpLogs...)
+}
+
+// startFakeCore 返回资产授权的系统用户和认证信息, 并记录文件操作日志
+func startFakeCore(t *testing.T, assetID, password string, systemUsers []model.SystemUser) (*fakeCore, string) {
+	core := &fakeCore{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/assets/"+assetID+"/system-users/"):
+			_ = json.NewEncoder(w).Encode(systemUsers)
+		case strings.HasSuffix(r.URL.Path, "/assets/"+assetID+"/auth-info/"):
+			_ = json.NewEncoder(w).Encode(model.SystemUserAuthInfo{Username: "root", Password: password})
+		case r.URL.Path == service.FTPLogListURL:
+			var data model.FTPLog
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			core.mu.Lock()
+			core.ftpLogs = append(core.ftpLogs, data)
+			core.mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("{}"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return core, server.URL
+}
+
+// serveDirectSFTP 以直连格式的 sftp 处理一次 scp 请求
+func serveDirectSFTP(t *testing.T, jmsService *service.JMService, user *model.User,
+	asset model.Asset, systemUser model.SystemUser) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			userSftp := NewSFTPHandlerWithConn(srvconn.NewUserSftpConnWithDirectAsset(jmsService,
+				user, "127.0.0.1", asset, systemUser))
+			handlers := sftp.Handlers{
+				FileGet:  userSftp,
+				FilePut:  userSftp,
+				FileCmd:  userSftp,
+				FileList: userSftp,
+			}
+			req := sftp.NewRequestServer(conn, handlers)
+			_ = req.Serve()
+			_ = req.Close()
+			userSftp.Close()
+			_ = conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func runSCP(t *testing.T, relayAddr string, args ...string) error {
+	script := filepath.Join(t.TempDir(), "relay.sh")
+	content := fmt.Sprintf("#!/bin/sh\nexec %s -test.run='^TestSCPRelayHelper$'\n", strconv.Quote(os.Args[0]))
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 不指定 -O, 使用 OpenSSH 9 之后默认的 sftp 协议
+	cmd := exec.Command("scp", append([]string{"-q", "-S", script}, args...)...)
+	cmd.Env = append(os.Environ(), scpRelayEnv+"="+relayAddr)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func TestDirectSFTPDefaultSCP(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not found")
+	}
+	conf := config.GetConf()
+	config.GlobalConfig = &conf
+	defer func() { config.GlobalConfig = nil }()
+	const password = "asset-password"
+	host, port := startFakeAsset(t, password)
+	asset := model.Asset{ID: "asset-1", Hostname: "web/01", IP: host,
+		Protocols: []string{"ssh/" + strconv.Itoa(port)}, OrgID: "org-1"}
+	uploadUser := model.SystemUser{ID: "su-upload", Name: "root", Username: "root",
+		Protocol: "ssh", Actions: []string{model.AllAction}}
+	downloadUser := model.SystemUser{ID: "su-download", Name: "readonly", Username: "root",
+		Protocol: "ssh", Actions: []string{model.ConnectAction, model.DownloadAction}}
+	core, coreURL := startFakeCore(t, asset.ID, password, []model.SystemUser{uploadUser, downloadUser})
+	jmsService, err := service.NewAuthJMService(service.JMSCoreHost(coreURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{ID: "user-1", Username: "alice", Name: "alice"}
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "upload.txt")
+	content := []byte("scp over sftp\n")
+	if err = os.WriteFile(localFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 有上传权限的系统用户: 上传后可以下载, 并记录文件操作日志
+	uploadAddr := serveDirectSFTP(t, jmsService, user, asset, uploadUser)
+	if err = runSCP(t, uploadAddr, localFile, "koko:upload.txt"); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	downloaded := filepath.Join(dir, "download.txt")
+	if err = runSCP(t, uploadAddr, "koko:upload.txt", downloaded); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	if data, _ := os.ReadFile(downloaded); !bytes.Equal(data, content) {
+		t.Fatalf("downloaded %q, want %q", data, content)
+	}
+
+	// 只有下载权限的系统用户不能上传
+	downloadAddr := serveDirectSFTP(t, jmsService, user, asset, downloadUser)
+	if err = runSCP(t, downloadAddr, localFile, "koko:denied.txt"); err == nil ||
+		!strings.Contains(err.Error(), "Permission denied") {
+		t.Fatalf("upload without upload permission should be denied, got %v", err)
+	}
+	if err = runSCP(t, downloadAddr, "koko:upload.txt", filepath.Join(dir, "readonly.txt")); err != nil {
+		t.Fatalf("download with download permission: %s", err)
+	}
+
+	want := map[string]bool{
+		"root(root)/" + model.OperateUpload + "/upload.txt":       true,
+		"root(root)/" + model.OperateDownload + "/upload.txt":     true,
+		"readonly(root)/" + model.OperateDownload + "/upload.txt": true,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := make(map[string]bool)
+		for _, item := range core.logs() {
+			if item.Hostname != asset.String() || item.User != user.String() || !item.IsSuccess {
+				t.Fatalf("unexpected ftp log: %+v", item)
+			}
+			got[item.SystemUser+"/"+item.Operate+item.Path] = true
+		}
+		if len(got) == len(want) {
+			for key := range want {
+				if !got[key] {
+					t.Fatalf("got ftp logs %v, want %v", got, want)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got ftp logs %v, want %v", got, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
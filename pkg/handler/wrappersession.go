@@ -2,11 +2,13 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
 
 	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/exchange"
@@ -125,10 +127,33 @@ func (w *WrapperSession) Pty() ssh.Pty {
 	}
 }
 
+// AgentRequested 用户是否请求了 agent 转发 (ssh -A)
+func (w *WrapperSession) AgentRequested() bool {
+	return ssh.AgentRequested(w.Sess)
+}
+
+// OpenAgentChannel 打开到用户 agent 的通道
+func (w *WrapperSession) OpenAgentChannel() (io.ReadWriteCloser, error) {
+	sshConn, ok := w.Sess.Context().Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return nil, errNoSSHConn
+	}
+	channel, reqs, err := sshConn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(reqs)
+	return channel, nil
+}
+
 func (w *WrapperSession) ID() string {
 	return w.Uuid
 }
 
+const agentChannelType = "auth-agent@openssh.com"
+
+var errNoSSHConn = errors.New("no ssh connection in session context")
+
 func NewWrapperSession(sess ssh.Session) *WrapperSession {
 	w := &WrapperSession{
 		Sess:  sess,
@@ -0,0 +1,348 @@
+package hostkey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	资产和网关的 SSH host key 校验:
+	已知的 host key 按 host:port 保存在本地 JSON 文件中, 每个地址可以有多个不同类型的 key。
+	tofu 模式首次连接时记录 host key, strict 模式只接受已记录的 key (来自之前的连接或 core 同步)。
+	任何模式下 host key 与记录不一致都拒绝连接, 资产合法重建后由管理员重置记录。
+*/
+
+const (
+	ModeOff    = "off"
+	ModeTOFU   = "tofu"
+	ModeStrict = "strict"
+)
+
+const (
+	SourceTOFU = "tofu"
+	SourceCore = "core"
+)
+
+var (
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	ErrHostKeyUnknown  = errors.New("host key unknown")
+)
+
+// KeyError 是 host key 校验失败的详细信息
+type KeyError struct {
+	Err      error
+	Addr     string
+	AssetID  string
+	Got      string
+	Expected []string
+}
+
+func (e *KeyError) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("%s for %s: got %s", e.Err, e.Addr, e.Got)
+	}
+	return fmt.Sprintf("%s for %s: expected %s, got %s", e.Err, e.Addr,
+		strings.Join(e.Expected, ","), e.Got)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+type Key struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"public_key"` // authorized_keys 格式
+}
+
+func NewKey(key gossh.PublicKey) Key {
+	return Key{
+		Type:        key.Type(),
+		Fingerprint: gossh.FingerprintSHA256(key),
+		PublicKey:   strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))),
+	}
+}
+
+type Entry struct {
+	Addr        string    `json:"addr"`
+	AssetID     string    `json:"asset_id,omitempty"`
+	Keys        []Key     `json:"keys"`
+	Source      string    `json:"source"`
+	DateCreated time.Time `json:"date_created"`
+	DateUpdated time.Time `json:"date_updated"`
+}
+
+func (e *Entry) fingerprints() []string {
+	res := make([]string, 0, len(e.Keys))
+	for i := range e.Keys {
+		res = append(res, e.Keys[i].Fingerprint)
+	}
+	return res
+}
+
+func (e *Entry) match(fingerprint string) bool {
+	for i := range e.Keys {
+		if e.Keys[i].Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+type Store struct {
+	sync.Mutex
+	path string
+	mode string
+
+	// 这些资产在 tofu 模式下也使用 strict 校验
+	strictAssets map[string]bool
+
+	entries map[string]*Entry
+}
+
+var defaultStore *Store
+
+// Setup 启用 host key 校验, mode 为 tofu 或 strict
+func Setup(path, mode string, strictAssets []string) (*Store, error) {
+	store, err := Open(path, mode, strictAssets)
+	if err != nil {
+		return nil, err
+	}
+	defaultStore = store
+	return store, nil
+}
+
+// Default 返回全局的 host key 存储, 未启用时为 nil
+func Default() *Store {
+	return defaultStore
+}
+
+// HostKeyCallback 返回全局存储对资产的校验函数, 网关的 assetID 为空, 未启用时不校验
+func HostKeyCallback(assetID string) gossh.HostKeyCallback {
+	if defaultStore == nil {
+		return gossh.InsecureIgnoreHostKey()
+	}
+	return defaultStore.HostKeyCallback(assetID)
+}
+
+func Open(path, mode string, strictAssets []string) (*Store, error) {
+	switch mode {
+	case ModeTOFU, ModeStrict:
+	default:
+		return nil, fmt.Errorf("invalid host key verify mode %q", mode)
+	}
+	s := &Store{
+		path:         path,
+		mode:         mode,
+		strictAssets: make(map[string]bool, len(strictAssets)),
+		entries:      make(map[string]*Entry),
+	}
+	for _, assetID := range strictAssets {
+		s.strictAssets[assetID] = true
+	}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	var entries []*Entry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse known hosts %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		s.entries[entry.Addr] = entry
+	}
+	return s, nil
+}
+
+func (s *Store) Mode(assetID string) string {
+	if s.strictAssets[assetID] {
+		return ModeStrict
+	}
+	return s.mode
+}
+
+func (s *Store) HostKeyCallback(assetID string) gossh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		return s.Check(assetID, hostname, key)
+	}
+}
+
+// Check 校验 addr 的 host key, tofu 模式下记录首次连接的 key
+func (s *Store) Check(assetID, addr string, key gossh.PublicKey) error {
+	addr = normalize(addr)
+	got := NewKey(key)
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.entries[addr]
+	if ok {
+		if entry.match(got.Fingerprint) {
+			return nil
+		}
+		logger.Errorf("Host key of %s(asset %s) changed: expected %s, got %s", addr, assetID,
+			strings.Join(entry.fingerprints(), ","), got.Fingerprint)
+		return &KeyError{Err: ErrHostKeyMismatch, Addr: addr, AssetID: assetID,
+			Got: got.Fingerprint, Expected: entry.fingerprints()}
+	}
+	if s.Mode(assetID) == ModeStrict {
+		logger.Errorf("Host key of %s(asset %s) is not pinned: %s", addr, assetID, got.Fingerprint)
+		return &KeyError{Err: ErrHostKeyUnknown, Addr: addr, AssetID: assetID, Got: got.Fingerprint}
+	}
+	now := time.Now()
+	s.entries[addr] = &Entry{Addr: addr, AssetID: assetID, Keys: []Key{got},
+		Source: SourceTOFU, DateCreated: now, DateUpdated: now}
+	logger.Infof("Pin host key of %s(asset %s): %s", addr, assetID, got.Fingerprint)
+	if err := s.save(); err != nil {
+		logger.Errorf("Save known hosts err: %s", err)
+	}
+	return nil
+}
+
+/*
+	Sync 使用 core 下发的 host key 替换对应地址的记录, 同一地址的多个 key 合并为一条记录。
+	返回更新的地址数量, 解析失败的 key 跳过
+*/
+
+func (s *Store) Sync(keys []SyncKey) (int, error) {
+	synced := make(map[string]*Entry)
+	now := time.Now()
+	for i := range keys {
+		item := keys[i]
+		pubKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(item.PublicKey))
+		if err != nil {
+			logger.Errorf("Parse host key of %s err: %s", item.Addr, err)
+			continue
+		}
+		addr := normalize(item.Addr)
+		entry, ok := synced[addr]
+		if !ok {
+			entry = &Entry{Addr: addr, AssetID: item.AssetID, Source: SourceCore,
+				DateCreated: now, DateUpdated: now}
+			synced[addr] = entry
+		}
+		key := NewKey(pubKey)
+		if !entry.match(key.Fingerprint) {
+			entry.Keys = append(entry.Keys, key)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	var changed int
+	for addr, entry := range synced {
+		if old, ok := s.entries[addr]; ok {
+			entry.DateCreated = old.DateCreated
+			if old.Source == SourceCore && sameKeys(old, entry) {
+				continue
+			}
+		}
+		s.entries[addr] = entry
+		changed++
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, s.save()
+}
+
+// Reset 删除资产或地址的记录, 下次连接时重新记录, 返回删除的数量
+func (s *Store) Reset(assetID, addr string) (int, error) {
+	if assetID == "" && addr == "" {
+		return 0, nil
+	}
+	if addr != "" {
+		addr = normalize(addr)
+	}
+	s.Lock()
+	defer s.Unlock()
+	var removed int
+	for key, entry := range s.entries {
+		if (assetID != "" && entry.AssetID == assetID) || (addr != "" && entry.Addr == addr) {
+			delete(s.entries, key)
+			logger.Infof("Reset pinned host key of %s(asset %s)", entry.Addr, entry.AssetID)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.save()
+}
+
+func (s *Store) List() []Entry {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		res = append(res, *entry)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Addr < res[j].Addr
+	})
+	return res
+}
+
+func (s *Store) save() error {
+	entries := make([]*Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Addr < entries[j].Addr
+	})
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// SyncKey 是 core 下发的资产 host key
+type SyncKey struct {
+	AssetID   string
+	Addr      string
+	PublicKey string
+}
+
+func sameKeys(a, b *Entry) bool {
+	if len(a.Keys) != len(b.Keys) {
+		return false
+	}
+	for i := range b.Keys {
+		if !a.match(b.Keys[i].Fingerprint) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize 统一地址格式, 缺少端口时使用 22
+func normalize(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+		port = "22"
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
@@ -0,0 +1,87 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newPublicKey(t *testing.T) gossh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestStoreTOFU(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts.json")
+	store, err := Open(path, ModeTOFU, []string{"strict-asset"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1, key2 := newPublicKey(t), newPublicKey(t)
+	if err = store.Check("asset-1", "10.0.0.1:22", key1); err != nil {
+		t.Fatalf("first connect should pin key: %s", err)
+	}
+	if err = store.Check("asset-1", "10.0.0.1:22", key1); err != nil {
+		t.Fatalf("pinned key should pass: %s", err)
+	}
+	err = store.Check("asset-1", "10.0.0.1:22", key2)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("changed key should be refused, got %v", err)
+	}
+	if err = store.Check("strict-asset", "10.0.0.2:22", key1); !errors.Is(err, ErrHostKeyUnknown) {
+		t.Fatalf("strict asset should refuse unknown key, got %v", err)
+	}
+
+	// 重新打开后记录仍然有效
+	store, err = Open(path, ModeTOFU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Check("asset-1", "10.0.0.1:22", key2); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("reopened store should keep pinned key, got %v", err)
+	}
+	if n, err := store.Reset("asset-1", ""); err != nil || n != 1 {
+		t.Fatalf("reset asset got %d, %v", n, err)
+	}
+	if err = store.Check("asset-1", "10.0.0.1:22", key2); err != nil {
+		t.Fatalf("reset should allow pinning new key: %s", err)
+	}
+}
+
+func TestStoreSync(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "known_hosts.json"), ModeStrict, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1, key2 := newPublicKey(t), newPublicKey(t)
+	authorizedKey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key1)))
+	n, err := store.Sync([]SyncKey{
+		{AssetID: "asset-1", Addr: "Host.Example:2222", PublicKey: authorizedKey},
+		{AssetID: "asset-2", Addr: "10.0.0.3", PublicKey: "invalid"},
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("sync got %d, %v", n, err)
+	}
+	if err = store.Check("asset-1", "host.example:2222", key1); err != nil {
+		t.Fatalf("synced key should pass: %s", err)
+	}
+	if err = store.Check("asset-1", "host.example:2222", key2); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("unsynced key should be refused, got %v", err)
+	}
+	if n, _ = store.Sync([]SyncKey{{AssetID: "asset-1", Addr: "host.example:2222",
+		PublicKey: authorizedKey}}); n != 0 {
+		t.Fatalf("unchanged sync should not update, got %d", n)
+	}
+}
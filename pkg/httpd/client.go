@@ -110,6 +110,13 @@ func (c *Client) HandleRoomEvent(event string, roomMsg *exchange.RoomMessage) {
 	case exchange.ActionEvent:
 		msgType = TERMINALACTION
 		msgData = string(roomMsg.Body)
+	case exchange.FreezeEvent:
+		msgType = TERMINALFREEZE
+	case exchange.UnFreezeEvent:
+		msgType = TERMINALUNFREEZE
+	case exchange.ControlStateEvent:
+		msgType = TERMINALCONTROLSTATE
+		msgData = string(roomMsg.Body)
 	default:
 		logger.Infof("unsupported room msg %+v", roomMsg)
 		return
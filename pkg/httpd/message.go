@@ -33,6 +33,20 @@ const (
 	TERMINALSHAREUSERS = "TERMINAL_SHARE_USERS"
 
 	TERMINALERROR = "TERMINAL_ERROR"
+
+	// 监控会话的管理员冻结、解冻用户输入和发送提示, 冻结状态变化也以同样的类型通知前端
+	TERMINALFREEZE   = "TERMINAL_FREEZE"
+	TERMINALUNFREEZE = "TERMINAL_UNFREEZE"
+	TERMINALNOTICE   = "TERMINAL_NOTICE"
+
+	// 共享会话的键盘控制: 参与者申请、释放控制, 所有者授予、撤销、收回控制, data 为参与者的 key;
+	// 控制状态变化时以 TERMINAL_CONTROL_STATE 通知所有参与者
+	TERMINALCONTROLREQUEST = "TERMINAL_CONTROL_REQUEST"
+	TERMINALCONTROLRELEASE = "TERMINAL_CONTROL_RELEASE"
+	TERMINALCONTROLGRANT   = "TERMINAL_CONTROL_GRANT"
+	TERMINALCONTROLREVOKE  = "TERMINAL_CONTROL_REVOKE"
+	TERMINALCONTROLRECLAIM = "TERMINAL_CONTROL_RECLAIM"
+	TERMINALCONTROLSTATE   = "TERMINAL_CONTROL_STATE"
 )
 
 type WindowSize struct {
@@ -0,0 +1,412 @@
+package httpd
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/auth"
+	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/envelope"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+const (
+	replayFormatCast = "cast"
+	replayFormatText = "txt"
+	replayFormatSVG  = "svg"
+
+	replayDateFormat = "2006-01-02"
+)
+
+var (
+	errReplayNotFound = errors.New("replay not found")
+
+	// server 存储的录像保存在 core 中, 只能通过 core 的录像接口查看
+	errReplayDownloadNotSupported = errors.New("replay storage does not support download, " +
+		"replays saved to core are available from core's session replay API /api/v1/terminal/sessions/{id}/replay/")
+)
+
+/*
+	replayFile 是找到的录像, 分段录像有多个文件按顺序拼接,
+	加密录像使用 dataKey 解密, 解密后的内容不写入临时文件
+*/
+
+type replayFile struct {
+	paths   []string
+	isGzip  bool
+	dataKey []byte
+	// 从存储中下载的临时文件需要删除
+	tmpFiles []string
+}
+
+// gzipPath 返回可以直接下载的明文 .cast.gz 文件
+func (r *replayFile) gzipPath() (string, bool) {
+	if len(r.paths) != 1 || !r.isGzip || r.dataKey != nil {
+		return "", false
+	}
+	return r.paths[0], true
+}
+
+func (r *replayFile) Open() (io.ReadCloser, error) {
+	if len(r.paths) == 1 {
+		return proxy.OpenReplayFile(r.paths[0], r.dataKey)
+	}
+	readers := make([]io.Reader, 0, len(r.paths))
+	closers := make([]io.Closer, 0, len(r.paths))
+	closeAll := func() {
+		for i := range closers {
+			_ = closers[i].Close()
+		}
+	}
+	for i := range r.paths {
+		reader, err := proxy.OpenReplayFile(r.paths[i], r.dataKey)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		readers = append(readers, reader)
+		closers = append(closers, reader)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := proxy.StitchReplaySegments(pw, readers...)
+		closeAll()
+		_ = pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (r *replayFile) Close() {
+	for i := range r.tmpFiles {
+		_ = os.Remove(r.tmpFiles[i])
+	}
+}
+
+// download 从录像存储下载文件到临时文件, 临时文件在 Close 时删除
+func (r *replayFile) download(replayStorage proxy.ReplayStorage, target string) (string, error) {
+	tmpFile, err := os.CreateTemp("", "koko-replay-*-"+path.Base(target))
+	if err != nil {
+		return "", err
+	}
+	_ = tmpFile.Close()
+	r.tmpFiles = append(r.tmpFiles, tmpFile.Name())
+	if err = replayStorage.Download(target, tmpFile.Name()); err != nil {
+		if errors.Is(err, storage.ErrNotSupported) {
+			return "", fmt.Errorf("%w: %s storage", errReplayDownloadNotSupported, replayStorage.TypeName())
+		}
+		return "", fmt.Errorf("%w: download %s from %s storage: %s",
+			errReplayNotFound, target, replayStorage.TypeName(), err)
+	}
+	return tmpFile.Name(), nil
+}
+
+// downloadKey 下载并解密加密录像的数据密钥, 存储中没有密钥文件时录像没有加密
+func (r *replayFile) downloadKey(replayStorage proxy.ReplayStorage, target string) error {
+	keyPath, err := r.download(replayStorage, target)
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	r.dataKey, err = proxy.UnwrapReplayKey(data)
+	return err
+}
+
+/*
+	ReplayHandler 查看或导出会话录像, 支持的 format:
+	cast 原始的 .cast.gz 录像(默认), txt 纯文本记录, svg SVG 动画。
+	优先使用本地未上传或正在录制的录像, 其次从录像存储中下载,
+	存储中的录像按日期保存, 可以通过 date 参数指定, 否则从 core 获取会话的开始日期。
+	server 存储不支持下载, 已上传到 core 的录像返回 501, 需要使用 core 的录像接口查看。
+*/
+
+func (s *Server) ReplayHandler(ctx *gin.Context) {
+	sid := ctx.Param("id")
+	if !common.ValidUUIDString(sid) {
+		ctx.String(http.StatusBadRequest, "invalid session id")
+		return
+	}
+	format := ctx.DefaultQuery("format", replayFormatCast)
+	switch format {
+	case replayFormatCast, replayFormatText, replayFormatSVG:
+	default:
+		ctx.String(http.StatusBadRequest, "unsupported format %s", format)
+		return
+	}
+	viewer := "token"
+	if userValue, ok := ctx.Get(auth.ContextKeyUser); ok {
+		viewer = userValue.(*model.User).String()
+	}
+	replay, err := s.findReplay(sid, ctx.Query("date"))
+	if err != nil {
+		logger.Errorf("Find session %s replay failed: %s", sid, err)
+		switch {
+		case errors.Is(err, errReplayDownloadNotSupported):
+			ctx.String(http.StatusNotImplemented, err.Error())
+			return
+		case errors.Is(err, errReplayNotFound):
+			ctx.String(http.StatusNotFound, err.Error())
+			return
+		}
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer replay.Close()
+	logger.Infof("%s view session %s replay as %s from ip %s", viewer, sid, format, ctx.ClientIP())
+
+	if gzPath, ok := replay.gzipPath(); ok && format == replayFormatCast {
+		ctx.FileAttachment(gzPath, sid+".cast.gz")
+		return
+	}
+	reader, err := replay.Open()
+	if err != nil {
+		logger.Errorf("Open session %s replay failed: %s", sid, err)
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer reader.Close()
+	switch format {
+	case replayFormatCast:
+		// 正在录制、分段和加密的录像需要重新压缩
+		ctx.Header("Content-Type", "application/gzip")
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.cast.gz"`, sid))
+		gzWriter := gzip.NewWriter(ctx.Writer)
+		if _, err = io.Copy(gzWriter, reader); err == nil {
+			err = gzWriter.Close()
+		}
+	default:
+		var castReader *asciinema.Reader
+		if castReader, err = asciinema.NewReader(reader); err != nil {
+			ctx.String(http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if format == replayFormatText {
+			ctx.Header("Content-Type", "text/plain; charset=utf-8")
+			err = asciinema.WriteTranscript(castReader, ctx.Writer)
+		} else {
+			ctx.Header("Content-Type", "image/svg+xml")
+			err = asciinema.WriteSVG(castReader, ctx.Writer, asciinema.SVGOptions{
+				IdleTimeLimit: queryFloat(ctx, "idle"),
+				FrameInterval: queryFloat(ctx, "interval"),
+			})
+		}
+	}
+	if err != nil {
+		logger.Errorf("Write session %s replay as %s failed: %s", sid, format, err)
+	}
+}
+
+func (s *Server) findReplay(sid, date string) (*replayFile, error) {
+	replayDir := config.GetConf().ReplayFolderPath
+	for _, suffix := range []string{".cast.gz", ".cast"} {
+		matches, _ := filepath.Glob(filepath.Join(replayDir, "*", sid+suffix))
+		if len(matches) > 0 {
+			dataKey, err := proxy.LoadReplayKey(filepath.Dir(matches[0]), sid)
+			if err != nil {
+				return nil, err
+			}
+			return &replayFile{paths: matches[:1], isGzip: suffix == ".cast.gz", dataKey: dataKey}, nil
+		}
+	}
+	// 分段录制的会话在本地只保留清单、正在录制和上传失败的分段
+	localDir := ""
+	matches, _ := filepath.Glob(filepath.Join(replayDir, "*", sid+".*"))
+	for _, match := range matches {
+		if _, _, ok := proxy.ParseReplaySegmentFilename(filepath.Base(match)); ok {
+			localDir = filepath.Dir(match)
+			break
+		}
+		if _, ok := proxy.ParseReplayManifestFilename(filepath.Base(match)); ok {
+			localDir = filepath.Dir(match)
+			break
+		}
+	}
+	if localDir != "" {
+		date = filepath.Base(localDir)
+	}
+	if date == "" {
+		sess, err := s.JmsService.GetSessionById(sid)
+		if err != nil || sess.DateStart.IsZero() {
+			return nil, fmt.Errorf("%w: unknown session date, please set date param", errReplayNotFound)
+		}
+		date = sess.DateStart.UTC().Format(replayDateFormat)
+	} else if _, err := time.Parse(replayDateFormat, date); err != nil {
+		return nil, fmt.Errorf("%w: invalid date %s", errReplayNotFound, date)
+	}
+	termConf := s.getTerminalConfig()
+	replayStorage := proxy.NewReplayStorage(s.JmsService, &termConf)
+	if localDir != "" {
+		return stitchReplaySegments(replayStorage, sid, date, localDir)
+	}
+	replay := &replayFile{isGzip: true}
+	target := date + "/" + sid + ".cast.gz"
+	replayPath, err := replay.download(replayStorage, target)
+	if err != nil {
+		replay.Close()
+		if segments, err2 := stitchReplaySegments(replayStorage, sid, date, ""); err2 == nil {
+			return segments, nil
+		}
+		return nil, err
+	}
+	replay.paths = []string{replayPath}
+	if err = replay.downloadKey(replayStorage, date+"/"+proxy.ReplayKeyFilename(sid)); err != nil {
+		replay.Close()
+		return nil, err
+	}
+	if replay.dataKey == nil && envelope.IsEncryptedFile(replayPath) {
+		replay.Close()
+		return nil, fmt.Errorf("%w: replay key of session %s", errReplayNotFound, sid)
+	}
+	return replay, nil
+}
+
+/*
+	stitchReplaySegments 按清单拼接分段录像, 清单、密钥和分段优先使用 localDir 中的本地文件,
+	否则从录像存储中下载, 清单中没有的本地分段(正在录制或上传失败)按序号拼接在后面
+*/
+
+func stitchReplaySegments(replayStorage proxy.ReplayStorage, sid, date, localDir string) (replay *replayFile, err error) {
+	replay = &replayFile{}
+	defer func() {
+		if err != nil {
+			replay.Close()
+		}
+	}()
+	localSegments := make(map[int]string)
+	if localDir != "" {
+		matches, _ := filepath.Glob(filepath.Join(localDir, sid+".*"))
+		for _, match := range matches {
+			if _, index, ok := proxy.ParseReplaySegmentFilename(filepath.Base(match)); ok {
+				localSegments[index] = match
+			}
+		}
+		if replay.dataKey, err = proxy.LoadReplayKey(localDir, sid); err != nil {
+			return nil, err
+		}
+	}
+	manifestPath := filepath.Join(localDir, proxy.ReplayManifestFilename(sid))
+	if localDir == "" || !common.FileExists(manifestPath) {
+		manifestPath, err = replay.download(replayStorage, date+"/"+proxy.ReplayManifestFilename(sid))
+		if err != nil && len(localSegments) == 0 {
+			return nil, err
+		}
+	}
+	manifest := &proxy.ReplayManifest{}
+	if loaded, err2 := proxy.LoadReplayManifest(manifestPath); err2 == nil {
+		manifest = loaded
+	}
+	if replay.dataKey == nil && manifest.Key != "" {
+		if err = replay.downloadKey(replayStorage, manifest.Key); err != nil {
+			return nil, err
+		}
+		if replay.dataKey == nil {
+			return nil, fmt.Errorf("%w: replay key of session %s", errReplayNotFound, sid)
+		}
+	}
+
+	indexes := make(map[int]bool)
+	for _, segment := range manifest.Segments {
+		indexes[segment.Index] = true
+		if localPath, ok := localSegments[segment.Index]; ok {
+			replay.paths = append(replay.paths, localPath)
+			continue
+		}
+		segmentPath, err := replay.download(replayStorage, segment.Target)
+		if err != nil {
+			return nil, err
+		}
+		replay.paths = append(replay.paths, segmentPath)
+	}
+	remainIndexes := make([]int, 0, len(localSegments))
+	for index := range localSegments {
+		if !indexes[index] {
+			remainIndexes = append(remainIndexes, index)
+		}
+	}
+	sort.Ints(remainIndexes)
+	for _, index := range remainIndexes {
+		replay.paths = append(replay.paths, localSegments[index])
+	}
+	if len(replay.paths) == 0 {
+		return nil, fmt.Errorf("%w: session %s has no replay segments", errReplayNotFound, sid)
+	}
+	return replay, nil
+}
+
+// getTerminalConfig 优先使用 koko 缓存的终端配置, core 不可用时也能访问录像存储
+func (s *Server) getTerminalConfig() model.TerminalConfig {
+	if s.terminalConfFunc != nil {
+		return s.terminalConfFunc()
+	}
+	termConf, err := s.JmsService.GetTerminalConfig()
+	if err != nil {
+		logger.Errorf("Get terminal config failed: %s", err)
+	}
+	return termConf
+}
+
+func (s *Server) SetTerminalConfigFunc(fn func() model.TerminalConfig) {
+	s.terminalConfFunc = fn
+}
+
+func queryFloat(ctx *gin.Context, key string) float64 {
+	value, _ := strconv.ParseFloat(ctx.Query(key), 64)
+	return value
+}
+
+/*
+	ReplaySearchHandler 搜索录像输出, 参数:
+	q 关键字, regex=1 时 q 为正则表达式, sid 会话 ID,
+	date_from、date_to 日期范围(2006-01-02), limit 最多返回的匹配条数
+*/
+
+func (s *Server) ReplaySearchHandler(ctx *gin.Context) {
+	opt := proxy.OutputSearchOption{
+		Keyword:   ctx.Query("q"),
+		Regexp:    ctx.Query("regex") == "1" || ctx.Query("regex") == "true",
+		SessionID: ctx.Query("sid"),
+	}
+	if opt.SessionID != "" && !common.ValidUUIDString(opt.SessionID) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	var err error
+	for key, value := range map[string]*time.Time{"date_from": &opt.DateFrom, "date_to": &opt.DateTo} {
+		if date := ctx.Query(key); date != "" {
+			if *value, err = time.Parse(replayDateFormat, date); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + key})
+				return
+			}
+		}
+	}
+	if limit := ctx.Query("limit"); limit != "" {
+		opt.Limit, _ = strconv.Atoi(limit)
+	}
+	results, err := proxy.SearchReplayOutput(opt)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Infof("Search replay output %q from ip %s, %d sessions matched",
+		opt.Keyword, ctx.ClientIP(), len(results))
+	ctx.JSON(http.StatusOK, results)
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/LeeEirc/elfinder"
-	"github.com/pkg/sftp"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/common"
@@ -88,7 +87,7 @@ func NewUserVolume(jmsService *service.JMService, user *model.User, addr, hostId
 		UserSftp:      userSftp,
 		Homename:      homename,
 		basePath:      basePath,
-		chunkFilesMap: make(map[int]*sftp.File),
+		chunkFilesMap: make(map[int]*srvconn.SftpFile),
 		lock:          new(sync.Mutex),
 		IsPod:         isPod,
 		PodConn:       containerOptions,
@@ -102,7 +101,7 @@ type UserVolume struct {
 	Homename string
 	basePath string
 
-	chunkFilesMap map[int]*sftp.File
+	chunkFilesMap map[int]*srvconn.SftpFile
 	lock          *sync.Mutex
 	IsPod         bool
 	PodConn       *srvconn.ContainerOptions
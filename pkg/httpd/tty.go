@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gliderlabs/ssh"
 
@@ -39,6 +40,9 @@ type tty struct {
 	jmsService *service.JMService
 
 	shareInfo *ShareInfo
+	shareMeta exchange.MetaMessage // 共享会话参与者的信息, 用于申请键盘控制
+
+	sessionId atomic.Value // 连接资产时创建的会话, 所有者通过它授予键盘控制
 
 	extraParams url.Values
 }
@@ -133,6 +137,12 @@ func (h *tty) HandleMessage(msg *Message) {
 			UserRead: userR, UserWrite: userW,
 			pty: ssh.Pty{Term: "xterm", Window: win},
 		}
+		h.shareMeta = exchange.MetaMessage{
+			UserId:     h.ws.user.ID,
+			User:       h.ws.user.String(),
+			Created:    common.NewNowUTCTime().String(),
+			RemoteAddr: h.backendClient.RemoteAddr(),
+		}
 		h.wg.Add(1)
 		go h.proxy(&h.wg)
 		return
@@ -189,6 +199,12 @@ func (h *tty) handleTerminalMessage(msg *Message) {
 		logger.Debugf("Ws[%s] receive share request %s", h.ws.Uuid, msg.Data)
 		go h.createShareSession(shareData)
 		return
+	case TERMINALFREEZE, TERMINALUNFREEZE, TERMINALNOTICE:
+		h.sendControlEvent(msg)
+	case TERMINALCONTROLREQUEST, TERMINALCONTROLRELEASE:
+		h.sendShareControlEvent(msg)
+	case TERMINALCONTROLGRANT, TERMINALCONTROLREVOKE, TERMINALCONTROLRECLAIM:
+		h.handleOwnerControl(msg)
 
 	case CLOSE:
 		_ = h.backendClient.Close()
@@ -198,6 +214,75 @@ func (h *tty) handleTerminalMessage(msg *Message) {
 	}
 }
 
+var controlEvents = map[string]string{
+	TERMINALFREEZE:   exchange.FreezeEvent,
+	TERMINALUNFREEZE: exchange.UnFreezeEvent,
+	TERMINALNOTICE:   exchange.NoticeEvent,
+}
+
+// sendControlEvent 只有监控会话的管理员可以冻结、解冻会话和发送提示
+func (h *tty) sendControlEvent(msg *Message) {
+	if h.targetType != TargetTypeMonitor {
+		logger.Errorf("Ws[%s] %s not allowed for target type %s", h.ws.Uuid, msg.Type, h.targetType)
+		return
+	}
+	room := exchange.GetRoom(h.targetId)
+	if room == nil {
+		logger.Errorf("Ws[%s] room %s not found", h.ws.Uuid, h.targetId)
+		return
+	}
+	user := h.ws.user
+	room.Receive(&exchange.RoomMessage{
+		Event: controlEvents[msg.Type],
+		Body:  []byte(msg.Data),
+		Meta: exchange.MetaMessage{
+			UserId:     user.ID,
+			User:       user.String(),
+			Created:    common.NewNowUTCTime().String(),
+			RemoteAddr: h.ws.ClientIP(),
+		},
+	})
+	logger.Infof("Ws[%s] user %s send %s to room %s", h.ws.Uuid, user.String(), msg.Type, h.targetId)
+}
+
+// sendShareControlEvent 共享会话的参与者申请或释放键盘控制
+func (h *tty) sendShareControlEvent(msg *Message) {
+	if h.targetType != TargetTypeShare || h.shareInfo == nil {
+		logger.Errorf("Ws[%s] %s not allowed for target type %s", h.ws.Uuid, msg.Type, h.targetType)
+		return
+	}
+	event := exchange.ControlRequestEvent
+	if msg.Type == TERMINALCONTROLRELEASE {
+		event = exchange.ControlReleaseEvent
+	}
+	if room := exchange.GetRoom(h.shareInfo.Record.SessionId); room != nil {
+		room.Receive(&exchange.RoomMessage{Event: event, Meta: h.shareMeta})
+	}
+}
+
+// handleOwnerControl 会话所有者授予、撤销或收回键盘控制
+func (h *tty) handleOwnerControl(msg *Message) {
+	sid, _ := h.sessionId.Load().(string)
+	sw, ok := proxy.GetSessionById(sid)
+	if !ok {
+		logger.Errorf("Ws[%s] %s session %s not found", h.ws.Uuid, msg.Type, sid)
+		return
+	}
+	var err error
+	switch msg.Type {
+	case TERMINALCONTROLGRANT:
+		err = sw.GrantControl(msg.Data)
+	case TERMINALCONTROLREVOKE:
+		err = sw.RevokeControl(msg.Data)
+	case TERMINALCONTROLRECLAIM:
+		err = sw.ReclaimControl()
+	}
+	if err != nil {
+		logger.Errorf("Ws[%s] %s session %s err: %s", h.ws.Uuid, msg.Type, sid, err)
+		h.ws.SendMessage(&Message{Id: h.ws.Uuid, Type: TERMINALERROR, Err: err.Error()})
+	}
+}
+
 func (h *tty) createShareSession(shareData ShareRequestParams) {
 	// 创建 共享连接
 	res, err := h.handleShareRequest(shareData)
@@ -256,7 +341,7 @@ func (h *tty) getTargetApp(protocol string) bool {
 	switch strings.ToLower(protocol) {
 	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb,
 		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer,
-		srvconn.ProtocolRedis:
+		srvconn.ProtocolRedis, srvconn.ProtocolPostgreSQL:
 		appAsset, err := h.jmsService.GetApplicationById(h.targetId)
 		if err != nil {
 			logger.Errorf("Get %s application failed; %s", protocol, err)
@@ -313,7 +398,8 @@ func (h *tty) proxy(wg *sync.WaitGroup) {
 		}
 		switch h.systemUser.Protocol {
 		case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb,
-			srvconn.ProtocolSQLServer, srvconn.ProtocolRedis:
+			srvconn.ProtocolSQLServer, srvconn.ProtocolRedis,
+			srvconn.ProtocolPostgreSQL:
 			proxyOpts = append(proxyOpts, proxy.ConnectApp(h.app))
 		case srvconn.ProtocolK8s:
 			proxyOpts = append(proxyOpts, proxy.ConnectApp(h.app))
@@ -330,6 +416,7 @@ func (h *tty) proxy(wg *sync.WaitGroup) {
 			return
 		}
 		srv.OnSessionInfo = func(info *model.Session) {
+			h.sessionId.Store(info.ID)
 			data, _ := json.Marshal(info)
 			h.sendSessionMessage(string(data))
 		}
@@ -366,14 +453,7 @@ func (h *tty) CheckEnableShare() bool {
 */
 
 func (h *tty) JoinRoom(c *Client, roomID string) {
-
-	user := h.ws.user
-	meta := exchange.MetaMessage{
-		UserId:     user.ID,
-		User:       user.String(),
-		Created:    common.NewNowUTCTime().String(),
-		RemoteAddr: c.RemoteAddr(),
-	}
+	meta := h.shareMeta
 	if room := exchange.GetRoom(roomID); room != nil {
 		conn := exchange.WrapperUserCon(c)
 		room.Subscribe(conn)
@@ -396,6 +476,8 @@ func (h *tty) JoinRoom(c *Client, roomID string) {
 				break
 			}
 		}
+		// 离开时释放持有的键盘控制和未处理的申请
+		room.Receive(&exchange.RoomMessage{Event: exchange.ControlReleaseEvent, Meta: meta})
 		room.Broadcast(&exchange.RoomMessage{
 			Event: exchange.ShareLeave,
 			Body:  nil,
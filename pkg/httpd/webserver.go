@@ -19,6 +19,7 @@ import (
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/tracing"
 )
 
 const (
@@ -45,6 +46,8 @@ type Server struct {
 	broadCaster *broadcaster
 	Srv         *http.Server
 	JmsService  *service.JMService
+
+	terminalConfFunc func() model.TerminalConfig
 }
 
 func (s *Server) Start() {
@@ -223,6 +226,14 @@ func (s *Server) runTTY(ctx *gin.Context, currentUser *model.User,
 		return
 	}
 	defer wsSocket.Close()
+	traceCtx, span := tracing.Start(ctx.Request.Context(), "web.connection",
+		tracing.String("net.peer.addr", ctx.ClientIP()),
+		tracing.String("enduser.id", currentUser.Username),
+		tracing.String("koko.target_type", targetType),
+		tracing.String("koko.target_id", targetId))
+	span.SetKind(tracing.SpanKindServer)
+	defer span.End()
+	ctx.Request = ctx.Request.WithContext(traceCtx)
 	setting := s.getPublicSetting()
 	userConn := UserWebsocket{
 		Uuid:           common.UUID(),
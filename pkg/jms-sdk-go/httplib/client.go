@@ -3,6 +3,7 @@ package httplib
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,6 +21,52 @@ type AuthSign interface {
 	Sign(req *http.Request) error
 }
 
+// RequestObserver 每次请求结束后回调, statusCode 为 0 表示请求没有得到响应
+type RequestObserver func(method, reqUrl string, statusCode int, duration time.Duration)
+
+/*
+	ResponseCache 保存 GET 请求成功的响应体, 当 core 不可达时 Load 返回缓存的响应,
+	由实现决定哪些请求可以缓存以及缓存的有效期
+*/
+type ResponseCache interface {
+	Store(reqUrl string, body []byte)
+	Load(ctx context.Context, reqUrl string) ([]byte, bool)
+}
+
+// StatusError 是 core 返回 4xx、5xx 状态码时的错误
+type StatusError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *StatusError) Error() string {
+	return e.msg
+}
+
+// IsUnreachable 判断请求失败是否因为 core 不可达: 网络错误或网关返回 502、503、504
+func IsUnreachable(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return isUnavailableCode(statusErr.StatusCode)
+	}
+	return false
+}
+
+func isUnavailableCode(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RequestTracer 在请求发出前回调, 可以修改请求头, 返回的函数在请求结束后调用
+type RequestTracer func(ctx context.Context, req *http.Request) func(statusCode int, err error)
+
 const miniTimeout = time.Second * 30
 
 func NewClient(baseUrl string, timeout time.Duration) (*Client, error) {
@@ -54,6 +101,10 @@ type Client struct {
 	headers  map[string]string
 	http     *http.Client
 	authSign AuthSign
+	observer RequestObserver
+	tracer   RequestTracer
+	cache    ResponseCache
+	ctx      context.Context
 }
 
 func (c *Client) Clone() Client {
@@ -65,11 +116,13 @@ func (c *Client) Clone() Client {
 		Jar:     jar,
 	}
 	return Client{
-		Timeout: c.Timeout,
-		baseUrl: c.baseUrl,
-		cookies: make(map[string]string),
-		headers: make(map[string]string),
-		http:    &con,
+		Timeout:  c.Timeout,
+		baseUrl:  c.baseUrl,
+		cookies:  make(map[string]string),
+		headers:  make(map[string]string),
+		http:     &con,
+		observer: c.observer,
+		tracer:   c.tracer,
 	}
 
 }
@@ -86,6 +139,31 @@ func (c *Client) SetAuthSign(auth AuthSign) {
 	c.authSign = auth
 }
 
+func (c *Client) SetObserver(observer RequestObserver) {
+	c.observer = observer
+}
+
+func (c *Client) SetTracer(tracer RequestTracer) {
+	c.tracer = tracer
+}
+
+// SetResponseCache 设置响应缓存, Clone 不会复制, 避免以其他身份请求时读到缓存
+func (c *Client) SetResponseCache(cache ResponseCache) {
+	c.cache = cache
+}
+
+// SetContext 设置发起请求使用的 context, 用于取消请求和传递链路追踪信息
+func (c *Client) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
 func (c *Client) setReqAuthHeader(r *http.Request) error {
 	if len(c.cookies) != 0 {
 		for k, v := range c.cookies {
@@ -144,7 +222,7 @@ func (c *Client) newRequest(method, reqUrl string, data interface{}, params []ma
 		return nil, err
 	}
 	reader := bytes.NewReader(dataRaw)
-	req, err := http.NewRequest(method, reqUrl, reader)
+	req, err := http.NewRequestWithContext(c.context(), method, reqUrl, reader)
 	if err != nil {
 		return req, err
 	}
@@ -157,8 +235,32 @@ func (c *Client) Do(method, reqUrl string, data, res interface{}, params ...map[
 	if err != nil {
 		return
 	}
+	if c.observer != nil {
+		start := time.Now()
+		defer func() {
+			statusCode := 0
+			if resp != nil {
+				statusCode = resp.StatusCode
+			}
+			c.observer(method, reqUrl, statusCode, time.Since(start))
+		}()
+	}
+	if c.tracer != nil {
+		if finish := c.tracer(c.context(), req); finish != nil {
+			defer func() {
+				statusCode := 0
+				if resp != nil {
+					statusCode = resp.StatusCode
+				}
+				finish(statusCode, err)
+			}()
+		}
+	}
 	resp, err = c.http.Do(req)
 	if err != nil {
+		if c.loadCachedResponse(req, res) {
+			return nil, nil
+		}
 		return
 	}
 	defer resp.Body.Close()
@@ -166,6 +268,9 @@ func (c *Client) Do(method, reqUrl string, data, res interface{}, params ...map[
 	if err != nil {
 		return resp, err
 	}
+	if isUnavailableCode(resp.StatusCode) && c.loadCachedResponse(req, res) {
+		return nil, nil
+	}
 
 	// If is buffer return the raw response body
 	if buf, ok := res.(*bytes.Buffer); ok {
@@ -186,12 +291,34 @@ func (c *Client) Do(method, reqUrl string, data, res interface{}, params ...map[
 	}
 	if resp.StatusCode >= 400 {
 		msg := fmt.Sprintf("%s %s failed, get code: %d, %s", req.Method, req.URL, resp.StatusCode, body)
-		err = errors.New(msg)
+		err = &StatusError{StatusCode: resp.StatusCode, msg: msg}
 		return
 	}
+	if c.cache != nil && req.Method == http.MethodGet {
+		c.cache.Store(req.URL.String(), body)
+	}
 	return
 }
 
+// loadCachedResponse core 不可达时使用缓存的响应填充 res
+func (c *Client) loadCachedResponse(req *http.Request, res interface{}) bool {
+	if c.cache == nil || req.Method != http.MethodGet {
+		return false
+	}
+	body, ok := c.cache.Load(c.context(), req.URL.String())
+	if !ok {
+		return false
+	}
+	if buf, ok := res.(*bytes.Buffer); ok {
+		buf.Write(body)
+		return true
+	}
+	if res != nil {
+		return json.Unmarshal(body, res) == nil
+	}
+	return true
+}
+
 func (c *Client) Get(reqUrl string, res interface{}, params ...map[string]string) (resp *http.Response, err error) {
 	return c.Do("GET", reqUrl, nil, res, params...)
 }
@@ -241,7 +368,7 @@ func (c *Client) PostFileWithFields(reqUrl string, gFile string, fields map[stri
 	bodyReader := io.MultiReader(startPartBuf, bufferFd, endPartBuf)
 	contentLen := int64(startPartBuf.Len()) + size + int64(endPartBuf.Len())
 	reqUrl = c.parseUrl(reqUrl, nil)
-	req, err := http.NewRequest(http.MethodPost, reqUrl, bodyReader)
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, reqUrl, bodyReader)
 	if err != nil {
 		return err
 	}
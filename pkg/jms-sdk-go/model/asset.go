@@ -70,3 +70,11 @@ const (
 	ProtocolK8S    = "k8s"
 	ProtocolMysql  = "mysql"
 )
+
+// AssetHostKey 是 core 中记录的资产 SSH host key, PublicKey 为 authorized_keys 格式
+type AssetHostKey struct {
+	Asset     string `json:"asset"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	PublicKey string `json:"public_key"`
+}
@@ -14,6 +14,9 @@ type FTPLog struct {
 	Path       string         `json:"filename"`
 	DateStart  common.UTCTime `json:"date_start"`
 	IsSuccess  bool           `json:"is_success"`
+
+	// 启用文件内容录制时, 录制元数据在录像存储中的路径
+	ContentRecord string `json:"content_record,omitempty"`
 }
 
 const (
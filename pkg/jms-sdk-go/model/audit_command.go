@@ -13,6 +13,11 @@ type Command struct {
 	Timestamp  int64  `json:"timestamp"`
 	RiskLevel  int64  `json:"risk_level"`
 
+	// 审计日志中会话链的序号和哈希, 未启用审计日志时为空
+	AuditSeq      uint64 `json:"audit_seq,omitempty"`
+	AuditPrevHash string `json:"audit_prev_hash,omitempty"`
+	AuditHash     string `json:"audit_hash,omitempty"`
+
 	DateCreated time.Time `json:"@timestamp"`
 }
 
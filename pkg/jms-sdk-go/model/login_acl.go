@@ -0,0 +1,16 @@
+package model
+
+// LoginACL 是用户登录 core 和 koko 时的访问控制规则, IP 匹配和复核在 core 中处理
+type LoginACL struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Action   string `json:"action"`
+	IsActive bool   `json:"is_active"`
+}
+
+const (
+	LoginACLActionReject  = "reject"
+	LoginACLActionAllow   = "allow"
+	LoginACLActionConfirm = "confirm"
+)
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+const DefaultMaskReplacement = "******"
+
+/*
+	OutputMaskRule 终端输出脱敏规则, 匹配的内容在发送给用户、录像和会话共享前被替换。
+	只设置 Name 时使用内置的同名规则, 如 credit_card、aws_access_key。
+	Replacement 支持正则分组引用, 如 ${1}******
+*/
+
+type OutputMaskRule struct {
+	Name        string `json:"name" mapstructure:"name"`
+	RePattern   string `json:"pattern" mapstructure:"pattern"`
+	IgnoreCase  bool   `json:"ignore_case" mapstructure:"ignore_case"`
+	Replacement string `json:"replacement" mapstructure:"replacement"`
+
+	pattern  *regexp.Regexp
+	compiled bool
+}
+
+var builtinOutputMaskRules = map[string]OutputMaskRule{
+	// Visa、MasterCard、American Express、Discover 等卡号, 允许空格或 - 分隔
+	"credit_card": {
+		RePattern: `\b(?:4\d{3}|5[1-5]\d{2}|2[2-7]\d{2}|6011|3[47]\d{2})[ -]?\d{4}[ -]?\d{4}[ -]?\d{1,4}\b`,
+	},
+	"aws_access_key": {
+		RePattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	},
+	"aws_secret_key": {
+		RePattern:   `(aws_secret_access_key\s*[=:]\s*["']?)[A-Za-z0-9/+]{40}`,
+		IgnoreCase:  true,
+		Replacement: "${1}" + DefaultMaskReplacement,
+	},
+}
+
+func (r *OutputMaskRule) Pattern() *regexp.Regexp {
+	if r.compiled {
+		return r.pattern
+	}
+	rePattern, ignoreCase := r.RePattern, r.IgnoreCase
+	if builtin, ok := builtinOutputMaskRules[r.Name]; ok && rePattern == "" {
+		rePattern, ignoreCase = builtin.RePattern, builtin.IgnoreCase
+		if r.Replacement == "" {
+			r.Replacement = builtin.Replacement
+		}
+	}
+	if rePattern == "" {
+		return nil
+	}
+	syntaxFlag := syntax.Perl
+	if ignoreCase {
+		syntaxFlag = syntax.Perl | syntax.FoldCase
+	}
+	syntaxReg, err := syntax.Parse(rePattern, syntaxFlag)
+	if err != nil {
+		return nil
+	}
+	pattern, err := regexp.Compile(syntaxReg.String())
+	if err == nil {
+		r.pattern = pattern
+		r.compiled = true
+	}
+	return pattern
+}
+
+// Mask 替换所有匹配的内容, 返回替换后的数据和替换的次数
+func (r *OutputMaskRule) Mask(p []byte) ([]byte, int) {
+	pattern := r.Pattern()
+	if pattern == nil {
+		return p, 0
+	}
+	matches := pattern.FindAllSubmatchIndex(p, -1)
+	if len(matches) == 0 {
+		return p, 0
+	}
+	replacement := r.Replacement
+	if replacement == "" {
+		replacement = DefaultMaskReplacement
+	}
+	result := make([]byte, 0, len(p))
+	last := 0
+	for _, match := range matches {
+		result = append(result, p[last:match[0]]...)
+		result = pattern.Expand(result, []byte(replacement), p, match)
+		last = match[1]
+	}
+	result = append(result, p[last:]...)
+	return result, len(matches)
+}
@@ -28,6 +28,14 @@ func (p *Permission) EnablePaste() bool {
 	return p.haveAction(ActionPaste)
 }
 
+func (p *Permission) EnableAgentForwarding() bool {
+	return p.haveAction(ActionAgentForwarding)
+}
+
+func (p *Permission) EnablePortForward() bool {
+	return p.haveAction(ActionPortForward)
+}
+
 func (p *Permission) haveAction(action string) bool {
 	for _, value := range p.Actions {
 		if action == ActionALL || action == value {
@@ -46,6 +54,9 @@ const (
 	ActionCopy           = "clipboard_copy"
 	ActionPaste          = "clipboard_paste"
 	ActionCopyPaste      = "clipboard_copy_paste"
+
+	ActionAgentForwarding = "agent_forwarding"
+	ActionPortForward     = "port_forward"
 )
 
 type ValidateResult struct {
@@ -20,6 +20,9 @@ type Session struct {
 	UserID       string         `json:"user_id"`
 	AssetID      string         `json:"asset_id"`
 	SystemUserID string         `json:"system_user_id"`
+
+	// core 不可达时使用离线缓存建立的会话
+	IsDegraded bool `json:"is_degraded,omitempty"`
 }
 
 type ReplayVersion string
@@ -34,6 +34,7 @@ type SystemUser struct {
 	Token                string   `json:"-"`
 	SuEnabled            bool     `json:"su_enabled"`
 	SuFrom               string   `json:"su_from"`
+	AgentForwarding      bool     `json:"agent_forwarding"`
 }
 
 func (s *SystemUser) String() string {
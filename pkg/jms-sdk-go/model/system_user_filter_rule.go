@@ -1,9 +1,11 @@
 package model
 
 import (
+	"path"
 	"regexp"
 	"regexp/syntax"
 	"sort"
+	"strings"
 )
 
 type RuleAction int
@@ -28,6 +30,11 @@ type SystemUserFilterRule struct {
 	RePattern  string     `json:"pattern"` // 已经处理过的正则字符
 	IgnoreCase bool       `json:"ignore_case"`
 
+	// 数据库会话按语句过滤, 语句类型如 DROP、TRUNCATE、DELETE_WITHOUT_WHERE,
+	// 表名支持通配符, 如 users、db.*、*.users
+	StatementTypes []string `json:"statement_types"`
+	Tables         []string `json:"tables"`
+
 	pattern  *regexp.Regexp
 	compiled bool
 }
@@ -64,6 +71,194 @@ func (sf *SystemUserFilterRule) Match(cmd string) (RuleAction, string) {
 	return sf.Action, found
 }
 
+// IsStatementRule 是否是按 SQL 语句类型或表名过滤的规则
+func (sf *SystemUserFilterRule) IsStatementRule() bool {
+	return len(sf.StatementTypes) > 0 || len(sf.Tables) > 0
+}
+
+/*
+	MatchStatement 匹配一条 SQL 语句
+	stmtTypes 为语句的分类, tables 为语句操作的表, text 为去除注释后的语句
+	语句类型、表名和正则(如果有)需要同时满足
+*/
+
+func (sf *SystemUserFilterRule) MatchStatement(stmtTypes, tables []string, text string) (RuleAction, string) {
+	if len(sf.StatementTypes) > 0 && !matchAnyStatementType(sf.StatementTypes, stmtTypes) {
+		return ActionUnknown, ""
+	}
+	if len(sf.Tables) > 0 && !matchAnyTable(sf.Tables, tables) {
+		return ActionUnknown, ""
+	}
+	if sf.RePattern != "" {
+		return sf.Match(text)
+	}
+	return sf.Action, text
+}
+
+/*
+	MatchRedisCommand 匹配一条 Redis 命令
+	names 为命令名(如 FLUSHALL、CONFIG|SET), keys 为命令操作的 key,
+	规则中的 Tables 作为 key 的 glob 模式, 与 Redis KEYS 命令的规则一致
+*/
+
+func (sf *SystemUserFilterRule) MatchRedisCommand(names, keys []string, text string) (RuleAction, string) {
+	if len(sf.StatementTypes) > 0 && !matchAnyStatementType(sf.StatementTypes, names) {
+		return ActionUnknown, ""
+	}
+	if len(sf.Tables) > 0 && !matchAnyRedisKey(sf.Tables, keys) {
+		return ActionUnknown, ""
+	}
+	if sf.RePattern != "" {
+		return sf.Match(text)
+	}
+	return sf.Action, text
+}
+
+func matchAnyRedisKey(patterns, keys []string) bool {
+	for i := range patterns {
+		for j := range keys {
+			if MatchRedisGlob(patterns[i], keys[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchRedisGlob 与 Redis 的 stringmatchlen 一致, 支持 * ? [a-z] [^a] 和 \ 转义
+func MatchRedisGlob(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if MatchRedisGlob(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			var (
+				not   bool
+				match bool
+			)
+			pattern = pattern[1:]
+			if len(pattern) > 0 && pattern[0] == '^' {
+				not = true
+				pattern = pattern[1:]
+			}
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if pattern[0] == str[0] {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
+
+func matchAnyStatementType(ruleTypes, stmtTypes []string) bool {
+	for i := range ruleTypes {
+		for j := range stmtTypes {
+			if strings.EqualFold(ruleTypes[i], stmtTypes[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchAnyTable(patterns, tables []string) bool {
+	for i := range patterns {
+		for j := range tables {
+			if matchTable(patterns[i], tables[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+	matchTable 从右往左逐段比较表名, 如 users 能匹配 db.users, dbo.users 能匹配 db.dbo.users。
+	语句中未指定库名时无法确定当前所在的库, 只比较表名, 按更严格的方式匹配。
+	语句操作的是整个库时, 表名为 db.*, 规则中任意一段库名或 schema 匹配即可。
+*/
+
+func matchTable(pattern, table string) bool {
+	patterns := strings.Split(strings.ToLower(pattern), ".")
+	names := strings.Split(strings.ToLower(table), ".")
+	if len(names) == 2 && names[1] == "*" {
+		for i := 0; i < len(patterns)-1; i++ {
+			if ok, err := path.Match(patterns[i], names[0]); err == nil && ok {
+				return true
+			}
+		}
+		return false
+	}
+	count := len(patterns)
+	if len(names) < count {
+		count = len(names)
+	}
+	for i := 1; i <= count; i++ {
+		ok, err := path.Match(patterns[len(patterns)-i], names[len(names)-i])
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
 var _ sort.Interface = FilterRules{}
 
 type FilterRules []SystemUserFilterRule
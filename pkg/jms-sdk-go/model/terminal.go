@@ -35,9 +35,24 @@ type TerminalTask struct {
 }
 
 const (
-	TaskKillSession = "kill_session"
+	TaskKillSession      = "kill_session"
+	TaskLockSession      = "lock_session"   // 暂停会话输入
+	TaskUnlockSession    = "unlock_session" // 恢复会话输入
+	TaskReadonlySession  = "readonly_session"
+	TaskBroadcastMessage = "broadcast_message"
+	TaskUploadReplay     = "upload_replay"
+	TaskReloadConfig     = "reload_terminal_config"
+	TaskSyncHostKeys     = "sync_host_keys"
 )
 
 type TaskKwargs struct {
 	TerminatedBy string `json:"terminated_by"`
+	CreatedBy    string `json:"created_by"`
+	Message      string `json:"message"`
+}
+
+// TaskResult 是终端执行任务的结果, 随任务完成状态一起提交
+type TaskResult struct {
+	IsSuccess bool   `json:"is_success"`
+	Message   string `json:"message,omitempty"`
 }
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+/*
+	core 不可达时允许使用本地缓存的 GET 接口: 连接资产需要的授权、认证信息、
+	命令过滤规则、网关和终端配置等, 不包括会话、工单等需要实时结果的接口
+*/
+
+var offlineCacheableURLs = []string{
+	TerminalConfigURL,
+	PublicSettingURL,
+	UserDetailURL,
+
+	UserPermsAssetsURL,
+	UserPermsNodesListURL,
+	UserPermsNodeAssetsListURL,
+	UserPermsApplicationsURL,
+	UserPermsAssetSystemUsersURL,
+	UserPermsApplicationSystemUsersURL,
+	ValidateUserAssetPermissionURL,
+	ValidateApplicationPermissionURL,
+	PermissionURL,
+
+	SystemUserAuthURL,
+	SystemUserAppAuthURL,
+	SystemUserAssetAuthURL,
+
+	AssetDetailURL,
+	AssetPlatFormURL,
+	SystemUserDetailURL,
+	ApplicationDetailURL,
+	SystemUserCmdFilterRulesListURL,
+	CommandFilterRulesListURL,
+	DomainDetailWithGateways,
+}
+
+var offlineCacheablePatterns = compileURLPatterns(offlineCacheableURLs)
+
+func compileURLPatterns(urls []string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(urls))
+	for _, item := range urls {
+		path := strings.SplitN(item, "?", 2)[0]
+		expr := strings.ReplaceAll(regexp.QuoteMeta(path), "%s", "[^/]+")
+		patterns = append(patterns, regexp.MustCompile("^"+expr+"$"))
+	}
+	return patterns
+}
+
+// IsOfflineCacheable 判断请求的响应是否可以缓存用于 core 不可达时的降级连接
+func IsOfflineCacheable(reqUrl string) bool {
+	u, err := url.Parse(reqUrl)
+	if err != nil {
+		return false
+	}
+	for i := range offlineCacheablePatterns {
+		if offlineCacheablePatterns[i].MatchString(u.Path) {
+			return true
+		}
+	}
+	return false
+}
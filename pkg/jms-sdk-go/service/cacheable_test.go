@@ -0,0 +1,21 @@
+package service
+
+import "testing"
+
+func TestIsOfflineCacheable(t *testing.T) {
+	tests := []struct {
+		reqUrl string
+		want   bool
+	}{
+		{"http://core/api/v1/terminal/terminals/config/", true},
+		{"http://core/api/v1/assets/system-users/1/auth-info/?user_id=2", true},
+		{"http://core/api/v1/assets/domains/3/?gateway=1", true},
+		{"http://core/api/v1/terminal/sessions/", false},
+		{"http://core/api/v1/assets/system-users/1/auth-info/extra/", false},
+	}
+	for _, tt := range tests {
+		if got := IsOfflineCacheable(tt.reqUrl); got != tt.want {
+			t.Errorf("IsOfflineCacheable(%s) = %v, want %v", tt.reqUrl, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -40,6 +41,15 @@ func NewAuthJMService(opts ...Option) (*JMService, error) {
 	if opt.sign != nil {
 		httpClient.SetAuthSign(opt.sign)
 	}
+	if opt.observer != nil {
+		httpClient.SetObserver(opt.observer)
+	}
+	if opt.tracer != nil {
+		httpClient.SetTracer(opt.tracer)
+	}
+	if opt.cache != nil {
+		httpClient.SetResponseCache(opt.cache)
+	}
 	httpClient.SetHeader(orgHeaderKey, orgHeaderValue)
 	return &JMService{authClient: httpClient, opt: &opt}, nil
 }
@@ -51,6 +61,17 @@ type JMService struct {
 	sync.Mutex
 }
 
+/*
+	WithContext 返回使用 ctx 发起请求的 JMService, 与原 JMService 共享认证和连接,
+	用于把一次连接中的 API 请求关联到同一条链路
+*/
+
+func (s *JMService) WithContext(ctx context.Context) *JMService {
+	client := *s.authClient
+	client.SetContext(ctx)
+	return &JMService{authClient: &client, opt: s.opt}
+}
+
 func (s *JMService) GetUserById(userID string) (user *model.User, err error) {
 	url := fmt.Sprintf(UserDetailURL, userID)
 	_, err = s.authClient.Get(url, &user)
@@ -18,6 +18,11 @@ func (s *JMService) GetAssetPlatform(assetId string) (platform model.Platform, e
 	return
 }
 
+func (s *JMService) GetAssetHostKeys() (keys []model.AssetHostKey, err error) {
+	_, err = s.authClient.Get(AssetHostKeysURL, &keys)
+	return
+}
+
 func (s *JMService) GetDomainGateways(domainId string) (domain model.Domain, err error) {
 	Url := fmt.Sprintf(DomainDetailWithGateways, domainId)
 	_, err = s.authClient.Get(Url, &domain)
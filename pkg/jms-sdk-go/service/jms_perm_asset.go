@@ -51,6 +51,15 @@ func (s *JMService) GetUserAssetByID(userId, assetId string) (assets []model.Ass
 	return
 }
 
+func (s *JMService) GetUserPermAssetsByHostname(userId, hostname string) (assets []model.Asset, err error) {
+	params := map[string]string{
+		"hostname": hostname,
+	}
+	reqUrl := fmt.Sprintf(UserPermsAssetsURL, userId)
+	_, err = s.authClient.Get(reqUrl, &assets, params)
+	return
+}
+
 func (s *JMService) GetUserPermAssetsByIP(userId, assetIP string) (assets []model.Asset, err error) {
 	params := map[string]string{
 		"ip": assetIP,
@@ -2,10 +2,16 @@ package service
 
 import (
 	"fmt"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 )
 
-func (s *JMService) FinishTask(tid string) error {
-	data := map[string]bool{"is_finished": true}
+func (s *JMService) FinishTask(tid string, result model.TaskResult) error {
+	data := map[string]interface{}{
+		"is_finished": true,
+		"is_success":  result.IsSuccess,
+		"message":     result.Message,
+	}
 	Url := fmt.Sprintf(FinishTaskURL, tid)
 	_, err := s.authClient.Patch(Url, data, nil)
 	return err
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"fmt"
+
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 )
 
@@ -12,3 +14,25 @@ func (s *JMService) CheckUserCookie(cookies map[string]string) (user *model.User
 	_, err = client.Get(UserProfileURL, &user)
 	return
 }
+
+// GetUserByUsername 按用户名精确查找用户, 用于证书登录时映射 principal
+func (s *JMService) GetUserByUsername(username string) (user model.User, err error) {
+	var users []model.User
+	params := map[string]string{"username": username}
+	if _, err = s.authClient.Get(UserListURL, &users, params); err != nil {
+		return
+	}
+	for i := range users {
+		if users[i].Username == username {
+			return users[i], nil
+		}
+	}
+	return user, fmt.Errorf("user %s not found", username)
+}
+
+// GetUserLoginACLs 获取用户的登录 ACL, 证书登录不经过 core 认证时据此拒绝受限的用户
+func (s *JMService) GetUserLoginACLs(userID string) (acls []model.LoginACL, err error) {
+	params := map[string]string{"user": userID}
+	_, err = s.authClient.Get(UserLoginACLListURL, &acls, params)
+	return
+}
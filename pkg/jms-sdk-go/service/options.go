@@ -11,6 +11,9 @@ type option struct {
 	CoreHost string
 	TimeOut  time.Duration
 	sign     httplib.AuthSign
+	observer httplib.RequestObserver
+	tracer   httplib.RequestTracer
+	cache    httplib.ResponseCache
 }
 
 type Option func(*option)
@@ -35,3 +38,21 @@ func JMSAccessKey(keyID, secretID string) Option {
 		}
 	}
 }
+
+func JMSRequestObserver(observer httplib.RequestObserver) Option {
+	return func(o *option) {
+		o.observer = observer
+	}
+}
+
+func JMSRequestTracer(tracer httplib.RequestTracer) Option {
+	return func(o *option) {
+		o.tracer = tracer
+	}
+}
+
+func JMSResponseCache(cache httplib.ResponseCache) Option {
+	return func(o *option) {
+		o.cache = cache
+	}
+}
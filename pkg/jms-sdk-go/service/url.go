@@ -38,7 +38,7 @@ const (
 	ValidateUserAssetPermissionURL     = "/api/v1/perms/asset-permissions/user/validate/"
 	ValidateApplicationPermissionURL   = "/api/v1/perms/application-permissions/user/validate/"
 
-	UserPermsDatabaseURL = "/api/v1/perms/users/%s/applications/?type__in=mysql,mariadb,sqlserver,redis"
+	UserPermsDatabaseURL = "/api/v1/perms/users/%s/applications/?type__in=mysql,mariadb,sqlserver,redis,postgresql"
 )
 
 // 系统用户密码相关API
@@ -50,9 +50,11 @@ const (
 
 // 各资源详情相关API
 const (
+	UserListURL          = "/api/v1/users/users/"
 	UserDetailURL        = "/api/v1/users/users/%s/"
 	AssetDetailURL       = "/api/v1/assets/assets/%s/"
 	AssetPlatFormURL     = "/api/v1/assets/assets/%s/platform/"
+	AssetHostKeysURL     = "/api/v1/assets/host-keys/" // 资产的 SSH host key
 	SystemUserDetailURL  = "/api/v1/assets/system-users/%s/"
 	ApplicationDetailURL = "/api/v1/applications/applications/%s/"
 
@@ -75,6 +77,7 @@ const (
 
 const (
 	AssetLoginConfirmURL = "/api/v1/acls/login-asset/check/"
+	UserLoginACLListURL  = "/api/v1/acls/login-acls/" // 用户登录 ACL
 )
 
 // 命令复核
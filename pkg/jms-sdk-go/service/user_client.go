@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/httplib"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 )
@@ -33,6 +35,10 @@ func (u *UserClient) SetOption(setters ...UserClientOption) {
 	}
 }
 
+func (u *UserClient) SetContext(ctx context.Context) {
+	u.client.SetContext(ctx)
+}
+
 func (u *UserClient) GetAPIToken() (resp AuthResponse, err error) {
 	data := map[string]string{
 		"username":    u.Opts.Username,
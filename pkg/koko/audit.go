@@ -0,0 +1,131 @@
+package koko
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+const auditFolderName = "audit"
+
+// setupAudit 启用审计日志, 启用后无法打开日志时退出, 避免在管理员不知情时丢失审计链
+func setupAudit() {
+	conf := config.GetConf()
+	if !conf.AuditChainEnabled {
+		return
+	}
+	dir := filepath.Join(conf.DataFolderPath, auditFolderName)
+	if _, err := audit.Setup(dir); err != nil {
+		logger.Fatal("Open audit log failed: " + err.Error())
+	}
+	logger.Infof("Audit chain enabled, log dir %s", dir)
+}
+
+func keepSignAuditHead(srv *server) {
+	interval := config.GetConf().AuditHeadInterval
+	if interval <= 0 {
+		interval = 5
+	}
+	tick := time.NewTicker(time.Duration(interval) * time.Minute)
+	defer tick.Stop()
+	for range tick.C {
+		signAuditHead(srv)
+	}
+}
+
+func signAuditHead(srv *server) {
+	auditLog := audit.Default()
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.SignHead(srv.GetSSHSigner()); err != nil {
+		logger.Errorf("Sign audit log head err: %s", err)
+	}
+}
+
+/*
+	RunVerify 执行 koko verify 子命令, 校验审计日志和 ES 中的命令, 返回进程退出码:
+	0 校验通过, 1 发现缺失或修改, 2 参数或读取错误
+*/
+
+func RunVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	logDir := fs.String("log", "", "audit log file or directory")
+	pubKeyPath := fs.String("pubkey", "", "terminal ssh host public key (authorized_keys format)")
+	esHosts := fs.String("es", "", "elasticsearch hosts, separated by comma")
+	esIndex := fs.String("index", "jumpserver", "elasticsearch command index")
+	sid := fs.String("session", "", "only verify commands of the session")
+	insecure := fs.Bool("insecure", false, "skip elasticsearch tls verification")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *logDir == "" && *esHosts == "" {
+		fmt.Fprintln(os.Stderr, "koko verify: -log or -es is required")
+		fs.Usage()
+		return 2
+	}
+	var pubKey gossh.PublicKey
+	if *pubKeyPath != "" {
+		data, err := ioutil.ReadFile(*pubKeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "koko verify: read public key: %s\n", err)
+			return 2
+		}
+		if pubKey, _, _, _, err = gossh.ParseAuthorizedKey(data); err != nil {
+			fmt.Fprintf(os.Stderr, "koko verify: parse public key: %s\n", err)
+			return 2
+		}
+	}
+	verifier := audit.NewVerifier(pubKey)
+	if *logDir != "" {
+		files := []string{*logDir}
+		if info, err := os.Stat(*logDir); err == nil && info.IsDir() {
+			files, err = audit.LogFiles(*logDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "koko verify: %s\n", err)
+				return 2
+			}
+		}
+		if err := verifier.VerifyLogFiles(files...); err != nil {
+			fmt.Fprintf(os.Stderr, "koko verify: %s\n", err)
+			return 2
+		}
+	}
+	if *esHosts != "" {
+		source := audit.ESSource{
+			Hosts:              strings.Split(*esHosts, ","),
+			Index:              *esIndex,
+			SessionID:          *sid,
+			InsecureSkipVerify: *insecure,
+		}
+		commands, err := source.FetchCommands()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "koko verify: %s\n", err)
+			return 2
+		}
+		verifier.VerifyCommands(commands)
+	}
+	report := verifier.Report()
+	for _, msg := range report.Warnings {
+		fmt.Printf("WARN  %s\n", msg)
+	}
+	for _, msg := range report.Problems {
+		fmt.Printf("FAIL  %s\n", msg)
+	}
+	fmt.Printf("records: %d, signed heads: %d, commands: %d, problems: %d, warnings: %d\n",
+		report.Records, report.Heads, report.Commands, len(report.Problems), len(report.Warnings))
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
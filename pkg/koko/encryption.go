@@ -0,0 +1,39 @@
+package koko
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/envelope"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+const replayMasterKeyFilename = "replay_master.key"
+
+// setupReplayEncryption 设置录像加密的主密钥, 配置错误时退出, 避免在管理员不知情时录制明文录像
+func setupReplayEncryption() {
+	conf := config.GetConf()
+	switch strings.ToLower(conf.ReplayEncryption) {
+	case "":
+		return
+	case envelope.ProviderLocal:
+		path := conf.ReplayEncryptionKeyFile
+		if path == "" {
+			path = filepath.Join(conf.KeyFolderPath, replayMasterKeyFilename)
+		}
+		wrapper, err := envelope.NewLocalKeyWrapper(path)
+		if err != nil {
+			logger.Fatal("Load replay master key failed: " + err.Error())
+		}
+		envelope.Setup(wrapper)
+	case envelope.ProviderKMS:
+		if conf.ReplayKMSEndpoint == "" || conf.ReplayKMSKeyID == "" {
+			logger.Fatal("Replay encryption by kms requires REPLAY_KMS_ENDPOINT and REPLAY_KMS_KEY_ID")
+		}
+		envelope.Setup(envelope.NewKMSKeyWrapper(conf.ReplayKMSEndpoint, conf.ReplayKMSKeyID, conf.ReplayKMSToken))
+	default:
+		logger.Fatal("Unsupported REPLAY_ENCRYPTION " + conf.ReplayEncryption)
+	}
+	logger.Infof("Replay encryption enabled, master key provider %s", envelope.Default().Provider())
+}
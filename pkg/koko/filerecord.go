@@ -0,0 +1,33 @@
+package koko
+
+import (
+	"path/filepath"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/filerecord"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+)
+
+const fileRecordFolderName = "file_records"
+
+// setupFileRecord 启用文件内容录制, 录制内容上传到当前终端配置的录像存储
+func setupFileRecord(jmsService *service.JMService, srv *server) {
+	conf := config.GetConf()
+	if !conf.FileRecordEnabled {
+		return
+	}
+	dir := filepath.Join(conf.DataFolderPath, fileRecordFolderName)
+	maxSize := int64(conf.FileRecordMaxSize) * 1024 * 1024
+	err := filerecord.Setup(dir, maxSize, func() filerecord.Storage {
+		terminalConf := srv.GetTerminalConfig()
+		return proxy.NewReplayStorage(jmsService, &terminalConf)
+	})
+	if err != nil {
+		logger.Errorf("FILE_RECORD_ENABLED is set but %s, file contents will not be recorded "+
+			"until the replay storage is changed to local, s3, oss, obs or azure", err)
+		return
+	}
+	logger.Infof("File record enabled, max size %d MB", conf.FileRecordMaxSize)
+}
@@ -0,0 +1,96 @@
+package koko
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/hostkey"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+const knownHostsFileName = "known_hosts.json"
+
+// setupHostKey 启用 host key 校验, 记录无法读取时退出, 避免在管理员不知情时退回到不校验
+func setupHostKey() {
+	conf := config.GetConf()
+	switch conf.HostKeyVerify {
+	case "", hostkey.ModeOff:
+		return
+	}
+	path := filepath.Join(conf.DataFolderPath, knownHostsFileName)
+	if _, err := hostkey.Setup(path, conf.HostKeyVerify, conf.HostKeyStrictAssets); err != nil {
+		logger.Fatal("Open known hosts failed: " + err.Error())
+	}
+	logger.Infof("Host key verify mode %s, known hosts %s", conf.HostKeyVerify, path)
+}
+
+// syncHostKeys 同步 core 中记录的资产 host key
+func syncHostKeys(jmsService *service.JMService) error {
+	store := hostkey.Default()
+	if store == nil {
+		return nil
+	}
+	assetKeys, err := jmsService.GetAssetHostKeys()
+	if err != nil {
+		return err
+	}
+	keys := make([]hostkey.SyncKey, 0, len(assetKeys))
+	for i := range assetKeys {
+		item := assetKeys[i]
+		keys = append(keys, hostkey.SyncKey{
+			AssetID:   item.Asset,
+			Addr:      net.JoinHostPort(item.IP, strconv.Itoa(item.Port)),
+			PublicKey: item.PublicKey,
+		})
+	}
+	changed, err := store.Sync(keys)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Sync %d host keys from core, %d hosts updated", len(keys), changed)
+	return nil
+}
+
+func (e *taskExecutor) syncHostKeys(task model.TerminalTask) error {
+	return syncHostKeys(e.jmsService)
+}
+
+func listHostKeysHandler(ctx *gin.Context) {
+	store := hostkey.Default()
+	if store == nil {
+		ctx.JSON(http.StatusOK, []hostkey.Entry{})
+		return
+	}
+	ctx.JSON(http.StatusOK, store.List())
+}
+
+// resetHostKeyHandler 资产合法重建后删除记录的 host key, 下次连接时按校验模式重新记录
+func resetHostKeyHandler(ctx *gin.Context) {
+	store := hostkey.Default()
+	if store == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "host key verify disabled"})
+		return
+	}
+	assetID := ctx.Query("asset")
+	addr := ctx.Query("addr")
+	if assetID == "" && addr == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "asset or addr required"})
+		return
+	}
+	removed, err := store.Reset(assetID, addr)
+	if err != nil {
+		logger.Errorf("Reset host key asset %s addr %s err: %s", assetID, addr, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Infof("Reset host key asset %s addr %s by %s, removed %d", assetID, addr,
+		ctx.ClientIP(), removed)
+	ctx.JSON(http.StatusOK, gin.H{"removed": removed})
+}
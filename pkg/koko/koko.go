@@ -1,6 +1,7 @@
 package koko
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -8,12 +9,17 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/exchange"
+	"github.com/jumpserver/koko/pkg/filerecord"
+	"github.com/jumpserver/koko/pkg/hostkey"
 	"github.com/jumpserver/koko/pkg/httpd"
 	"github.com/jumpserver/koko/pkg/i18n"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/offline"
 	"github.com/jumpserver/koko/pkg/sshd"
+	"github.com/jumpserver/koko/pkg/tracing"
 
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
@@ -41,6 +47,9 @@ func (k *Koko) Start() {
 }
 
 func (k *Koko) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	tracing.Shutdown(ctx)
+	cancel()
 	k.sshSrv.Stop()
 	k.webSrv.Stop()
 	logger.Info("Quit The KoKo")
@@ -53,7 +62,9 @@ func RunForever(confPath string) {
 	signal.Notify(gracefulStop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	jmsService := MustJMService()
 	srv := NewServer(jmsService)
+	setupFileRecord(jmsService, srv)
 	webSrv := httpd.NewServer(jmsService)
+	webSrv.SetTerminalConfigFunc(srv.GetTerminalConfig)
 	registerWebHandlers(jmsService, webSrv)
 	sshSrv := sshd.NewSSHServer(srv)
 	app := &Koko{
@@ -61,22 +72,47 @@ func RunForever(confPath string) {
 		sshSrv: sshSrv,
 	}
 	app.Start()
-	runTasks(jmsService)
+	runTasks(jmsService, srv)
 	<-gracefulStop
 	app.Stop()
+	signAuditHead(srv)
 }
 
 func bootstrap() {
 	i18n.Initial()
 	logger.Initial()
 	exchange.Initial()
+	registerMetrics()
+	setupTracing()
+	setupReplayEncryption()
+	setupAudit()
+	setupHostKey()
+	setupTargetCertAuthority()
 }
 
-func runTasks(jmsService *service.JMService) {
+func runTasks(jmsService *service.JMService, srv *server) {
 	if config.GetConf().UploadFailedReplay {
 		go uploadRemainReplay(jmsService)
 	}
-	go keepHeartbeat(jmsService)
+	go keepHeartbeat(jmsService, newTaskExecutor(jmsService, srv))
+	go keepUploadRemainCommand(jmsService)
+	go keepReplayRetention(jmsService)
+	if offline.Default() != nil {
+		go keepReconcileDegraded(jmsService)
+	}
+	if audit.Default() != nil {
+		go keepSignAuditHead(srv)
+	}
+	if filerecord.Enabled() {
+		go filerecord.UploadRemain()
+	}
+	if hostkey.Default() != nil {
+		go func() {
+			if err := syncHostKeys(jmsService); err != nil {
+				logger.Errorf("Sync host keys from core err: %s", err)
+			}
+		}()
+	}
 }
 
 func NewServer(jmsService *service.JMService) *server {
@@ -85,8 +121,10 @@ func NewServer(jmsService *service.JMService) *server {
 		logger.Fatal(err)
 	}
 	app := server{
-		jmsService:    jmsService,
-		vscodeClients: make(map[string]*vscodeReq),
+		jmsService:      jmsService,
+		vscodeClients:   make(map[string]*vscodeReq),
+		portForwarders:  make(map[string]*portForwarder),
+		userCertChecker: loadUserCertChecker(),
 	}
 	app.UpdateTerminalConfig(terminalConf)
 	go app.run()
@@ -95,10 +133,17 @@ func NewServer(jmsService *service.JMService) *server {
 
 func MustJMService() *service.JMService {
 	key := MustLoadValidAccessKey()
-	jmsService, err := service.NewAuthJMService(service.JMSCoreHost(
-		config.GlobalConfig.CoreHost), service.JMSTimeOut(30*time.Second),
+	opts := []service.Option{
+		service.JMSCoreHost(config.GlobalConfig.CoreHost),
+		service.JMSTimeOut(30 * time.Second),
 		service.JMSAccessKey(key.ID, key.Secret),
-	)
+		service.JMSRequestObserver(observeCoreRequest),
+		service.JMSRequestTracer(traceCoreRequest),
+	}
+	if cache := setupOfflineCache(key); cache != nil {
+		opts = append(opts, service.JMSResponseCache(cache.ResponseStore()))
+	}
+	jmsService, err := service.NewAuthJMService(opts...)
 	if err != nil {
 		logger.Fatal("创建JMS Service 失败 " + err.Error())
 		os.Exit(1)
@@ -0,0 +1,67 @@
+package koko
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/metrics"
+	"github.com/jumpserver/koko/pkg/proxy"
+)
+
+// 统计录像积压需要遍历录像目录, 定时刷新, 采集指标时使用缓存的值
+const replayBacklogRefreshInterval = time.Minute
+
+var replayBacklog int64
+
+func registerMetrics() {
+	go refreshReplayBacklog()
+	metrics.NewGaugeFunc("koko_replay_upload_backlog",
+		"Replay files of finished sessions waiting to be uploaded.", func() float64 {
+			return float64(atomic.LoadInt64(&replayBacklog))
+		})
+	metrics.NewGaugeFunc("koko_command_spool_backlog",
+		"Command spools of finished sessions waiting to be uploaded.", func() float64 {
+			return float64(proxy.CommandSpoolBacklog())
+		})
+	metrics.NewGaugeFunc("koko_degraded_session_backlog",
+		"Degraded sessions waiting to be reported to core.", func() float64 {
+			return float64(proxy.DegradedSessionBacklog())
+		})
+}
+
+func refreshReplayBacklog() {
+	ticker := time.NewTicker(replayBacklogRefreshInterval)
+	defer ticker.Stop()
+	for {
+		atomic.StoreInt64(&replayBacklog, int64(countReplayBacklog()))
+		<-ticker.C
+	}
+}
+
+// countReplayBacklog 统计本地未上传的录像, 不包括正在录制的会话
+func countReplayBacklog() int {
+	alive := make(map[string]bool)
+	for _, sid := range proxy.GetAliveSessions() {
+		alive[sid] = true
+	}
+	count := 0
+	_ = filepath.Walk(config.GetConf().ReplayFolderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if replayInfo, ok := parseReplayFilename(info.Name()); ok && !alive[replayInfo.Id] {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func observeCoreRequest(method, reqUrl string, statusCode int, duration time.Duration) {
+	metrics.CoreAPIRequestDuration.Observe(duration.Seconds(), method,
+		metrics.NormalizeEndpoint(reqUrl), strconv.Itoa(statusCode))
+}
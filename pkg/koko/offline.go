@@ -0,0 +1,66 @@
+package koko
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/offline"
+	"github.com/jumpserver/koko/pkg/proxy"
+)
+
+const offlineCacheDirName = "offline_cache"
+
+// setupOfflineCache 启用降级模式时创建加密的离线缓存, 未配置密钥时使用 access key 的 secret
+func setupOfflineCache(key model.AccessKey) *offline.Cache {
+	conf := config.GetConf()
+	if !conf.DegradedModeEnabled {
+		return nil
+	}
+	secret := conf.DegradedCacheKey
+	if secret == "" {
+		secret = key.Secret
+	}
+	ttl := time.Duration(conf.DegradedCacheTTL) * time.Minute
+	cacheDir := filepath.Join(conf.DataFolderPath, offlineCacheDirName)
+	cache, err := offline.Setup(cacheDir, secret, ttl, service.IsOfflineCacheable)
+	if err != nil {
+		logger.Errorf("Degraded mode disabled: setup offline cache err: %s", err)
+		return nil
+	}
+	logger.Infof("Degraded mode enabled, offline cache ttl %s", ttl)
+	return cache
+}
+
+const (
+	reconcileDegradedInterval = time.Minute
+	purgeOfflineCacheInterval = time.Hour
+)
+
+// keepReconcileDegraded 定期补报降级会话, 补报后上传这些会话遗留的录像, 并清理过期的离线缓存
+func keepReconcileDegraded(jmsService *service.JMService) {
+	lastPurge := time.Now()
+	for {
+		time.Sleep(reconcileDegradedInterval)
+		if time.Since(lastPurge) > purgeOfflineCacheInterval {
+			if count := offline.Default().Purge(); count > 0 {
+				logger.Infof("Purge %d expired offline cache entries", count)
+			}
+			lastPurge = time.Now()
+		}
+		if proxy.DegradedSessionBacklog() == 0 {
+			continue
+		}
+		sids, err := proxy.ReconcileDegradedSessions(jmsService)
+		if err != nil {
+			logger.Errorf("Reconcile degraded sessions err: %s", err)
+		}
+		if len(sids) > 0 {
+			logger.Infof("Reconcile %d degraded sessions", len(sids))
+			uploadRemainReplayOf(jmsService, sids)
+		}
+	}
+}
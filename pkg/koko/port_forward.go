@@ -0,0 +1,786 @@
+package koko
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/auth"
+	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/config"
+	modelCommon "github.com/jumpserver/koko/pkg/jms-sdk-go/common"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+/*
+	端口转发:
+	-L 和 -D 由客户端打开 direct-tcpip 通道, 目标主机需要解析为用户已授权的资产 (IP 或主机名),
+	端口需要是资产协议的端口或 PORT_FORWARD_ALLOWED_PORTS 中的端口, 资产配置了网域时通过网关连接。
+	-R 使用用户在资产上授权的 ssh 系统用户登录资产, 在资产的 127.0.0.1 上监听,
+	连接通过 forwarded-tcpip 通道转发回用户。
+	转发前按连接资产的流程校验授权: 授权未过期、包含 port_forward 动作、不需要登录复核,
+	授权过期时关闭转发。
+	连接第一次转发到一个资产时在 core 中创建会话, 每个通道结束时作为会话的一条命令保存到命令存储,
+	同时在日志和审计链中记录来源、目标、流量和时长。
+	连接关闭时不再接受新的通道, 关闭进行中的通道的目标连接, 等通道都结束后再结束 core 会话。
+*/
+
+const (
+	forwardedTCPChannelType = "forwarded-tcpip"
+
+	forwardTypeLocal  = "local"
+	forwardTypeRemote = "remote"
+
+	remoteForwardBindHost = "127.0.0.1"
+)
+
+var (
+	errPortForwardDisabled   = errors.New("port forwarding is disabled")
+	errForwardAssetNotFound  = errors.New("forward destination is not a permitted asset")
+	errForwardAssetNotUnique = errors.New("forward destination matches more than one asset, use the hostname")
+	errForwardPortNotAllowed = errors.New("forward port is not allowed")
+	errForwardNoSystemUser   = errors.New("no permitted system user for port forward")
+	errForwardNoPermission   = errors.New("no port forward permission on the asset")
+	errForwardNeedConfirm    = errors.New("asset login needs confirm, port forward is not supported")
+	errRemoteForwardExist    = errors.New("remote forward already exists")
+)
+
+// getPortForwarder 返回 SSH 连接的端口转发, 连接关闭时释放网关和远程转发
+func (s *server) getPortForwarder(ctx ssh.Context) *portForwarder {
+	reqId, ok := ctx.Value(ctxID).(string)
+	if !ok {
+		return nil
+	}
+	user, ok := ctx.Value(auth.ContextKeyUser).(*model.User)
+	if !ok || user.ID == "" {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if forwarder, ok := s.portForwarders[reqId]; ok {
+		return forwarder
+	}
+	forwarder := &portForwarder{
+		srv:            s,
+		ctx:            ctx,
+		user:           user,
+		assets:         make(map[string]model.Asset),
+		permissions:    make(map[string]*forwardPermission),
+		sessions:       make(map[string]*forwardSession),
+		gateways:       make(map[string]*srvconn.SSHClient),
+		remoteForwards: make(map[string]*remoteForward),
+	}
+	if directReq, ok := ctx.Value(auth.ContextKeyDirectLoginFormat).(*auth.DirectLoginAssetReq); ok {
+		forwarder.directReq = directReq
+	}
+	s.portForwarders[reqId] = forwarder
+	go func() {
+		<-ctx.Done()
+		s.Lock()
+		delete(s.portForwarders, reqId)
+		s.Unlock()
+		forwarder.Close()
+	}()
+	return forwarder
+}
+
+type portForwarder struct {
+	srv       *server
+	ctx       ssh.Context
+	user      *model.User
+	directReq *auth.DirectLoginAssetReq
+
+	assetLock sync.Mutex
+	assets    map[string]model.Asset // 目标主机解析到的资产
+
+	permLock    sync.Mutex
+	permissions map[string]*forwardPermission // 资产 ID 和协议对应的授权
+
+	sessionLock sync.Mutex
+	sessions    map[string]*forwardSession // 资产 ID 对应的 core 会话
+
+	gatewayLock sync.Mutex
+	gateways    map[string]*srvconn.SSHClient // 网域 ID 对应的网关连接
+
+	remoteLock     sync.Mutex
+	remoteForwards map[string]*remoteForward
+
+	channelLock sync.Mutex
+	closed      bool
+	channels    sync.WaitGroup
+	dstConns    map[io.Closer]struct{} // 进行中的通道的目标连接
+}
+
+// forwardPermission 是转发到资产时使用的系统用户和授权, 在授权过期前复用
+type forwardPermission struct {
+	systemUser model.SystemUser
+	authInfo   model.SystemUserAuthInfo
+	expireInfo model.ExpireInfo
+}
+
+func (perm *forwardPermission) expireAt() time.Time {
+	return time.Unix(perm.expireInfo.ExpireAt, 0)
+}
+
+// forwardSession 是连接转发到一个资产时在 core 中的会话, 转发通道记录为会话的命令
+type forwardSession struct {
+	session model.Session
+	storage proxy.CommandStorage
+}
+
+type remoteForward struct {
+	asset  model.Asset
+	perm   *forwardPermission
+	client *srvconn.SSHClient
+	ln     net.Listener
+}
+
+/*
+	resolveAsset 把转发的目标主机解析为用户授权的资产。
+	同一 IP 可能存在于多个网域的资产中, 此时要求用户使用主机名
+*/
+
+func (p *portForwarder) resolveAsset(host string) (model.Asset, error) {
+	p.assetLock.Lock()
+	asset, ok := p.assets[host]
+	p.assetLock.Unlock()
+	if ok {
+		return asset, nil
+	}
+	jmsService := p.srv.jmsService
+	var (
+		assets []model.Asset
+		err    error
+	)
+	if net.ParseIP(host) != nil {
+		assets, err = jmsService.GetUserPermAssetsByIP(p.user.ID, host)
+	} else {
+		assets, err = jmsService.GetUserPermAssetsByHostname(p.user.ID, host)
+	}
+	if err != nil {
+		logger.Errorf("User %s get perm assets by %s err: %s", p.user, host, err)
+		return model.Asset{}, err
+	}
+	asset, err = matchForwardAsset(assets, host)
+	if err != nil {
+		return asset, err
+	}
+	p.assetLock.Lock()
+	p.assets[host] = asset
+	p.assetLock.Unlock()
+	return asset, nil
+}
+
+// matchForwardAsset 从授权资产中找出 IP 或主机名匹配的唯一激活资产
+func matchForwardAsset(assets []model.Asset, host string) (model.Asset, error) {
+	matched := make([]model.Asset, 0, 1)
+	for i := range assets {
+		if !assets[i].IsActive {
+			continue
+		}
+		if assets[i].IP == host || strings.EqualFold(assets[i].Hostname, host) {
+			matched = append(matched, assets[i])
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return model.Asset{}, fmt.Errorf("%w: %s", errForwardAssetNotFound, host)
+	case 1:
+		return matched[0], nil
+	default:
+		return model.Asset{}, fmt.Errorf("%w: %s", errForwardAssetNotUnique, host)
+	}
+}
+
+// allowedForwardPort 端口是资产协议的端口或配置允许的端口
+func allowedForwardPort(asset *model.Asset, port int) bool {
+	for _, item := range asset.Protocols {
+		proAndPort := strings.Split(item, "/")
+		if len(proAndPort) == 2 && proAndPort[1] == strconv.Itoa(port) {
+			return true
+		}
+	}
+	for _, allowedPort := range config.GetConf().PortForwardAllowedPorts {
+		if allowedPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *portForwarder) resolveDestination(host string, port int) (model.Asset, error) {
+	asset, err := p.resolveAsset(host)
+	if err != nil {
+		return asset, err
+	}
+	if !allowedForwardPort(&asset, port) {
+		return asset, fmt.Errorf("%w: %s %d", errForwardPortNotAllowed, asset.Hostname, port)
+	}
+	return asset, nil
+}
+
+/*
+	checkPermission 返回用户在资产上可以转发的系统用户和授权, protocol 为空时不限制系统用户协议。
+	直连格式登录时只使用指定的系统用户, 否则按优先级选择第一个校验通过的系统用户
+*/
+
+func (p *portForwarder) checkPermission(asset *model.Asset, protocol string) (*forwardPermission, error) {
+	key := asset.ID + "/" + protocol
+	p.permLock.Lock()
+	perm, ok := p.permissions[key]
+	p.permLock.Unlock()
+	if ok && !perm.expireInfo.IsExpired(time.Now()) {
+		return perm, nil
+	}
+	var (
+		systemUsers []model.SystemUser
+		err         error
+	)
+	if p.directReq != nil {
+		systemUsers, err = p.srv.getMatchedSystemUsers(p.user, p.directReq, *asset)
+	} else {
+		systemUsers, err = p.srv.jmsService.GetSystemUsersByUserIdAndAssetId(p.user.ID, asset.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]model.SystemUser, 0, len(systemUsers))
+	for i := range systemUsers {
+		if protocol == "" || systemUsers[i].IsProtocol(protocol) {
+			matched = append(matched, systemUsers[i])
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("%w: %s", errForwardNoSystemUser, asset.Hostname)
+	}
+	model.SortSystemUserByPriority(matched)
+	for i := range matched {
+		if perm, err = p.validatePermission(asset, &matched[i]); err == nil {
+			break
+		}
+		logger.Debugf("User %s port forward on %s with system user %s refused: %s", p.user,
+			asset.Hostname, matched[i].Username, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.permLock.Lock()
+	p.permissions[key] = perm
+	p.permLock.Unlock()
+	return perm, nil
+}
+
+func (p *portForwarder) validatePermission(asset *model.Asset, systemUser *model.SystemUser) (*forwardPermission, error) {
+	jmsService := p.srv.jmsService
+	expireInfo, err := jmsService.ValidateAssetConnectPermission(p.user.ID, asset.ID, systemUser.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !expireInfo.HasPermission || expireInfo.IsExpired(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", errForwardNoPermission, asset.Hostname)
+	}
+	permission, err := jmsService.GetPermission(p.user.ID, asset.ID, systemUser.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !permission.EnablePortForward() {
+		return nil, fmt.Errorf("%w: %s", errForwardNoPermission, asset.Hostname)
+	}
+	authInfo, err := jmsService.GetSystemUserAuthById(systemUser.ID, asset.ID,
+		p.user.ID, p.user.Username)
+	if err != nil {
+		return nil, err
+	}
+	confirmSrv := auth.NewLoginConfirm(jmsService,
+		auth.ConfirmWithUser(p.user),
+		auth.ConfirmWithSystemUser(&authInfo),
+		auth.ConfirmWithTargetID(asset.ID))
+	needConfirm, err := confirmSrv.CheckIsNeedLoginConfirm()
+	if err != nil {
+		return nil, err
+	}
+	if needConfirm {
+		return nil, fmt.Errorf("%w: %s", errForwardNeedConfirm, asset.Hostname)
+	}
+	return &forwardPermission{systemUser: *systemUser, authInfo: authInfo, expireInfo: expireInfo}, nil
+}
+
+/*
+	getSession 返回连接转发到资产的 core 会话, 第一次转发时创建, 连接关闭时结束。
+	创建失败时只在日志和审计链中记录转发
+*/
+
+func (p *portForwarder) getSession(asset *model.Asset, perm *forwardPermission) *forwardSession {
+	p.sessionLock.Lock()
+	defer p.sessionLock.Unlock()
+	if fs, ok := p.sessions[asset.ID]; ok {
+		return fs
+	}
+	// 会话已经全部结束, 不再创建
+	if p.sessions == nil {
+		return nil
+	}
+	remoteAddr, _, _ := net.SplitHostPort(p.ctx.RemoteAddr().String())
+	session := model.Session{
+		ID:           common.UUID(),
+		User:         p.user.String(),
+		Asset:        asset.String(),
+		SystemUser:   perm.authInfo.String(),
+		LoginFrom:    "ST",
+		RemoteAddr:   remoteAddr,
+		Protocol:     perm.systemUser.Protocol,
+		DateStart:    modelCommon.NewNowUTCTime(),
+		OrgID:        asset.OrgID,
+		UserID:       p.user.ID,
+		AssetID:      asset.ID,
+		SystemUserID: perm.systemUser.ID,
+	}
+	jmsService := p.srv.jmsService
+	if err := jmsService.CreateSession(session); err != nil {
+		logger.Errorf("User %s create port forward session on %s err: %s", p.user, asset.Hostname, err)
+		return nil
+	}
+	if err := jmsService.SessionSuccess(session.ID); err != nil {
+		logger.Errorf("Update port forward session %s err: %s", session.ID, err)
+	}
+	termConf := p.srv.GetTerminalConfig()
+	fs := &forwardSession{session: session, storage: proxy.NewCommandStorage(jmsService, &termConf)}
+	p.sessions[asset.ID] = fs
+	audit.RecordSessionEvent(session.ID, audit.EventSessionStart, map[string]string{
+		"user":        session.User,
+		"asset":       session.Asset,
+		"system_user": session.SystemUser,
+		"protocol":    session.Protocol,
+		"remote_addr": session.RemoteAddr,
+		"type":        "port_forward",
+	})
+	logger.Infof("User %s create port forward session %s on %s", p.user, session.ID, asset.Hostname)
+	return fs
+}
+
+// dial 连接资产的端口, 资产配置了网域时通过网关连接
+func (p *portForwarder) dial(asset *model.Asset, port int) (net.Conn, error) {
+	addr := net.JoinHostPort(asset.IP, strconv.Itoa(port))
+	if asset.Domain == "" {
+		timeout := time.Duration(config.GetConf().SSHTimeout) * time.Second
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	gateway, err := p.getGateway(asset.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return dialTimeout(gateway.Client.Dial, addr, time.Duration(config.GetConf().SSHTimeout)*time.Second)
+}
+
+// dialTimeout 网关的 ssh 客户端 Dial 没有超时, 超时后返回错误, 之后建立的连接直接关闭
+func dialTimeout(dial func(network, addr string) (net.Conn, error), addr string,
+	timeout time.Duration) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial("tcp", addr)
+		done <- dialResult{conn: conn, err: err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ret := <-done:
+		return ret.conn, ret.err
+	case <-timer.C:
+		go func() {
+			if ret := <-done; ret.conn != nil {
+				_ = ret.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %s timeout after %s", addr, timeout)
+	}
+}
+
+// startChannel 连接关闭后不再接受新的转发通道, 接受时需要在通道结束后调用 doneChannel
+func (p *portForwarder) startChannel() bool {
+	p.channelLock.Lock()
+	defer p.channelLock.Unlock()
+	if p.closed {
+		return false
+	}
+	p.channels.Add(1)
+	return true
+}
+
+func (p *portForwarder) doneChannel() {
+	p.channels.Done()
+}
+
+// trackConn 记录通道的目标连接, 连接关闭时关闭, 返回取消记录的函数
+func (p *portForwarder) trackConn(conn io.Closer) func() {
+	p.channelLock.Lock()
+	defer p.channelLock.Unlock()
+	if p.closed {
+		_ = conn.Close()
+		return func() {}
+	}
+	if p.dstConns == nil {
+		p.dstConns = make(map[io.Closer]struct{})
+	}
+	p.dstConns[conn] = struct{}{}
+	return func() {
+		p.channelLock.Lock()
+		delete(p.dstConns, conn)
+		p.channelLock.Unlock()
+	}
+}
+
+// getGateway 同一连接的转发复用网关连接, 网关连接断开后下次重新选择
+func (p *portForwarder) getGateway(domainID string) (*srvconn.SSHClient, error) {
+	p.gatewayLock.Lock()
+	defer p.gatewayLock.Unlock()
+	if client, ok := p.gateways[domainID]; ok {
+		return client, nil
+	}
+	domain, err := p.srv.jmsService.GetDomainGateways(domainID)
+	if err != nil {
+		logger.Errorf("Get domain %s gateways err: %s", domainID, err)
+		return nil, err
+	}
+	client, err := srvconn.GetAvailableGatewayClient(p.ctx, gatewayProxyOptions(&domain)...)
+	if err != nil {
+		logger.Errorf("Domain %s has no available gateway: %s", domain.Name, err)
+		return nil, err
+	}
+	p.gateways[domainID] = client
+	go func() {
+		_ = client.Client.Wait()
+		p.gatewayLock.Lock()
+		if p.gateways[domainID] == client {
+			delete(p.gateways, domainID)
+		}
+		p.gatewayLock.Unlock()
+	}()
+	logger.Infof("User %s port forward use gateway %s of domain %s", p.user, client, domain.Name)
+	return client, nil
+}
+
+// HandleDirectTCPIP 处理 -L 和 -D 的转发通道
+func (p *portForwarder) HandleDirectTCPIP(newChan gossh.NewChannel, destAddr string) {
+	if !p.startChannel() {
+		_ = newChan.Reject(gossh.ConnectionFailed, "connection is closing")
+		return
+	}
+	defer p.doneChannel()
+	host, portStr, _ := net.SplitHostPort(destAddr)
+	port, _ := strconv.Atoi(portStr)
+	asset, err := p.resolveDestination(host, port)
+	if err != nil {
+		logger.Errorf("User %s port forward to %s refused: %s", p.user, destAddr, err)
+		_ = newChan.Reject(gossh.Prohibited, err.Error())
+		return
+	}
+	perm, err := p.checkPermission(&asset, "")
+	if err != nil {
+		logger.Errorf("User %s port forward to %s refused: %s", p.user, destAddr, err)
+		_ = newChan.Reject(gossh.Prohibited, err.Error())
+		return
+	}
+	dstConn, err := p.dial(&asset, port)
+	if err != nil {
+		logger.Errorf("User %s port forward connect %s(%s) err: %s", p.user, asset.Hostname, destAddr, err)
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	defer p.trackConn(dstConn)()
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		_ = dstConn.Close()
+		logger.Errorf("User %s port forward accept channel err: %s", p.user, err)
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	record := p.newRecord(forwardTypeLocal, &asset, perm, p.ctx.RemoteAddr().String(), destAddr)
+	logger.Infof("User %s start port forward from %s to %s(%s)", p.user, record.Source,
+		asset.Hostname, destAddr)
+	fs := p.getSession(&asset, perm)
+	expireTimer := time.AfterFunc(time.Until(perm.expireAt()), func() {
+		logger.Infof("User %s port forward to %s stop as permission has expired", p.user, destAddr)
+		_ = dstConn.Close()
+	})
+	record.BytesSent, record.BytesReceived = pipeForward(ch, dstConn)
+	expireTimer.Stop()
+	p.finishRecord(record, fs)
+}
+
+/*
+	StartRemoteForward 处理 -R 的 tcpip-forward 请求, bindHost 是资产,
+	不支持由服务端分配端口 (bindPort 为 0)
+*/
+
+func (p *portForwarder) StartRemoteForward(bindHost string, bindPort uint32) error {
+	if bindPort == 0 {
+		return fmt.Errorf("%w: %d", errForwardPortNotAllowed, bindPort)
+	}
+	asset, err := p.resolveDestination(bindHost, int(bindPort))
+	if err != nil {
+		logger.Errorf("User %s remote forward on %s:%d refused: %s", p.user, bindHost, bindPort, err)
+		return err
+	}
+	key := net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+	p.remoteLock.Lock()
+	_, exist := p.remoteForwards[key]
+	p.remoteLock.Unlock()
+	if exist {
+		return fmt.Errorf("%w: %s", errRemoteForwardExist, key)
+	}
+	perm, err := p.checkPermission(&asset, srvconn.ProtocolSSH)
+	if err != nil {
+		logger.Errorf("User %s remote forward on %s:%d refused: %s", p.user, bindHost, bindPort, err)
+		return err
+	}
+	client, err := p.srv.newAssetSSHClient(p.ctx, asset, perm.authInfo,
+		fmt.Sprintf("koko:%s:forward", p.user.Username))
+	if err != nil {
+		logger.Errorf("User %s remote forward connect asset %s err: %s", p.user, asset.Hostname, err)
+		return err
+	}
+	listenAddr := net.JoinHostPort(remoteForwardBindHost, strconv.Itoa(int(bindPort)))
+	ln, err := client.Client.Listen("tcp", listenAddr)
+	if err != nil {
+		_ = client.Close()
+		logger.Errorf("User %s remote forward listen %s on asset %s err: %s", p.user, listenAddr,
+			asset.Hostname, err)
+		return err
+	}
+	forward := &remoteForward{asset: asset, perm: perm, client: client, ln: ln}
+	p.remoteLock.Lock()
+	if _, exist = p.remoteForwards[key]; exist {
+		p.remoteLock.Unlock()
+		_ = ln.Close()
+		_ = client.Close()
+		return fmt.Errorf("%w: %s", errRemoteForwardExist, key)
+	}
+	p.remoteForwards[key] = forward
+	p.remoteLock.Unlock()
+	logger.Infof("User %s start remote forward on asset %s %s", p.user, asset.Hostname, listenAddr)
+	go p.serveRemoteForward(key, bindHost, bindPort, forward)
+	return nil
+}
+
+func (p *portForwarder) serveRemoteForward(key, bindHost string, bindPort uint32, forward *remoteForward) {
+	defer func() {
+		p.remoteLock.Lock()
+		if p.remoteForwards[key] == forward {
+			delete(p.remoteForwards, key)
+		}
+		p.remoteLock.Unlock()
+		_ = forward.ln.Close()
+		_ = forward.client.Close()
+		logger.Infof("User %s stop remote forward on asset %s %s", p.user, forward.asset.Hostname,
+			forward.ln.Addr())
+	}()
+	expireTimer := time.AfterFunc(time.Until(forward.perm.expireAt()), func() {
+		logger.Infof("User %s remote forward %s stop as permission has expired", p.user, key)
+		_ = forward.client.Close()
+	})
+	defer expireTimer.Stop()
+	for {
+		conn, err := forward.ln.Accept()
+		if err != nil {
+			logger.Debugf("User %s remote forward %s accept end: %s", p.user, key, err)
+			return
+		}
+		go p.handleRemoteConn(conn, bindHost, bindPort, forward)
+	}
+}
+
+func (p *portForwarder) handleRemoteConn(conn net.Conn, bindHost string, bindPort uint32, forward *remoteForward) {
+	defer conn.Close()
+	if !p.startChannel() {
+		return
+	}
+	defer p.doneChannel()
+	defer p.trackConn(conn)()
+	sshConn, ok := p.ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return
+	}
+	originAddr, originPortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	originPort, _ := strconv.Atoi(originPortStr)
+	payload := gossh.Marshal(&remoteForwardChannelData{
+		DestAddr:   bindHost,
+		DestPort:   bindPort,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	})
+	ch, reqs, err := sshConn.OpenChannel(forwardedTCPChannelType, payload)
+	if err != nil {
+		logger.Errorf("User %s remote forward open channel err: %s", p.user, err)
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	source := fmt.Sprintf("%s(%s)", forward.asset.Hostname, conn.RemoteAddr())
+	record := p.newRecord(forwardTypeRemote, &forward.asset, forward.perm, source, p.ctx.RemoteAddr().String())
+	fs := p.getSession(&forward.asset, forward.perm)
+	record.BytesSent, record.BytesReceived = pipeForward(ch, conn)
+	p.finishRecord(record, fs)
+}
+
+// CancelRemoteForward 处理 cancel-tcpip-forward, 关闭资产上的监听
+func (p *portForwarder) CancelRemoteForward(bindHost string, bindPort uint32) {
+	key := net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+	p.remoteLock.Lock()
+	forward, ok := p.remoteForwards[key]
+	p.remoteLock.Unlock()
+	if ok {
+		_ = forward.ln.Close()
+	}
+}
+
+func (p *portForwarder) Close() {
+	p.channelLock.Lock()
+	p.closed = true
+	for conn := range p.dstConns {
+		_ = conn.Close()
+	}
+	p.channelLock.Unlock()
+	p.remoteLock.Lock()
+	for key := range p.remoteForwards {
+		_ = p.remoteForwards[key].ln.Close()
+	}
+	p.remoteLock.Unlock()
+	p.gatewayLock.Lock()
+	for domainID := range p.gateways {
+		_ = p.gateways[domainID].Close()
+	}
+	p.gatewayLock.Unlock()
+	// 等待进行中的通道保存记录后再结束会话
+	p.channels.Wait()
+	p.sessionLock.Lock()
+	defer p.sessionLock.Unlock()
+	for assetID := range p.sessions {
+		sid := p.sessions[assetID].session.ID
+		audit.RecordSessionEvent(sid, audit.EventSessionEnd, map[string]string{})
+		if err := p.srv.jmsService.SessionDisconnect(sid); err != nil {
+			logger.Errorf("Finish port forward session %s err: %s", sid, err)
+		}
+	}
+	p.sessions = nil
+}
+
+// forwardRecord 是一个转发通道的连接记录, BytesSent 为用户发往资产的字节数
+type forwardRecord struct {
+	Type          string  `json:"type"`
+	SessionID     string  `json:"session_id"`
+	User          string  `json:"user"`
+	Asset         string  `json:"asset"`
+	SystemUser    string  `json:"system_user"`
+	Source        string  `json:"source"`
+	Destination   string  `json:"destination"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	DateStart     string  `json:"date_start"`
+	Duration      float64 `json:"duration"` // 秒
+
+	start time.Time
+	orgID string
+}
+
+func (p *portForwarder) newRecord(forwardType string, asset *model.Asset, perm *forwardPermission,
+	source, destination string) *forwardRecord {
+	now := time.Now()
+	return &forwardRecord{
+		Type:        forwardType,
+		User:        p.user.String(),
+		Asset:       asset.String(),
+		SystemUser:  perm.authInfo.String(),
+		Source:      source,
+		Destination: destination,
+		DateStart:   now.UTC().Format(time.RFC3339),
+		start:       now,
+		orgID:       asset.OrgID,
+	}
+}
+
+// command 转换为会话命令, 命令存储中可以按会话查询每个转发通道
+func (record *forwardRecord) command() *model.Command {
+	input := fmt.Sprintf("%s port forward %s -> %s", record.Type, record.Source, record.Destination)
+	output := fmt.Sprintf("sent %d bytes, received %d bytes in %.1fs", record.BytesSent,
+		record.BytesReceived, record.Duration)
+	return &model.Command{
+		SessionID:   record.SessionID,
+		OrgID:       record.orgID,
+		Server:      record.Asset,
+		User:        record.User,
+		SystemUser:  record.SystemUser,
+		Input:       input,
+		Output:      output,
+		Timestamp:   record.start.Unix(),
+		RiskLevel:   model.NormalLevel,
+		DateCreated: record.start.UTC(),
+	}
+}
+
+func (p *portForwarder) finishRecord(record *forwardRecord, fs *forwardSession) {
+	record.Duration = time.Since(record.start).Seconds()
+	logger.Infof("User %s end %s port forward from %s to %s, sent %d bytes, received %d bytes in %.1fs",
+		p.user, record.Type, record.Source, record.Destination, record.BytesSent, record.BytesReceived,
+		record.Duration)
+	if fs != nil {
+		record.SessionID = fs.session.ID
+		if err := fs.storage.BulkSave([]*model.Command{record.command()}); err != nil {
+			logger.Errorf("Port forward session %s save record err: %s", fs.session.ID, err)
+		}
+	}
+	audit.RecordSessionEvent(record.SessionID, audit.EventPortForward, record)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+/*
+	pipeForward 双向复制数据, 一端读完后半关闭另一端的写,
+	两个方向都结束后关闭连接, 返回 userConn 发出和收到的字节数
+*/
+
+func pipeForward(userConn, dstConn io.ReadWriteCloser) (sent, received int64) {
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(userConn, dstConn)
+		closeWrite(userConn)
+		done <- n
+	}()
+	sent, _ = io.Copy(dstConn, userConn)
+	closeWrite(dstConn)
+	received = <-done
+	_ = userConn.Close()
+	_ = dstConn.Close()
+	return sent, received
+}
+
+func closeWrite(conn io.ReadWriteCloser) {
+	if cw, ok := conn.(closeWriter); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
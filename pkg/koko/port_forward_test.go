@@ -0,0 +1,202 @@
+package koko
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+func TestAllowedForwardPort(t *testing.T) {
+	conf := config.GetConf()
+	conf.PortForwardAllowedPorts = []int{3306}
+	config.GlobalConfig = &conf
+	defer func() { config.GlobalConfig = nil }()
+
+	asset := model.Asset{Protocols: []string{"ssh/22", "rdp/3389"}}
+	tests := []struct {
+		port    int
+		allowed bool
+	}{
+		{22, true},
+		{3389, true},
+		{3306, true},
+		{8080, false},
+		{0, false},
+	}
+	for i := range tests {
+		if got := allowedForwardPort(&asset, tests[i].port); got != tests[i].allowed {
+			t.Fatalf("port %d got allowed %v, want %v", tests[i].port, got, tests[i].allowed)
+		}
+	}
+}
+
+func TestMatchForwardAsset(t *testing.T) {
+	assets := []model.Asset{
+		{ID: "1", Hostname: "web", IP: "10.0.0.1", IsActive: true},
+		{ID: "2", Hostname: "web-dmz", IP: "10.0.0.1", IsActive: true},
+		{ID: "3", Hostname: "db", IP: "10.0.0.2", IsActive: true},
+		{ID: "4", Hostname: "db-old", IP: "10.0.0.2", IsActive: false},
+		{ID: "5", Hostname: "cache", IP: "10.0.0.3", IsActive: false},
+	}
+	tests := []struct {
+		host string
+		id   string
+		err  error
+	}{
+		{"WEB", "1", nil},
+		{"10.0.0.1", "", errForwardAssetNotUnique},
+		{"10.0.0.2", "3", nil},
+		{"db-old", "", errForwardAssetNotFound},
+		{"10.0.0.3", "", errForwardAssetNotFound},
+		{"10.0.0.9", "", errForwardAssetNotFound},
+	}
+	for i := range tests {
+		asset, err := matchForwardAsset(assets, tests[i].host)
+		if !errors.Is(err, tests[i].err) {
+			t.Fatalf("match %s got err %v, want %v", tests[i].host, err, tests[i].err)
+		}
+		if asset.ID != tests[i].id {
+			t.Fatalf("match %s got asset %q, want %q", tests[i].host, asset.ID, tests[i].id)
+		}
+	}
+}
+
+// tcpPair 返回一对本地 TCP 连接, 用于验证半关闭
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	return client, server
+}
+
+func TestPipeForward(t *testing.T) {
+	user, userPeer := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+	request := bytes.Repeat([]byte("q"), 4096)
+	response := bytes.Repeat([]byte("r"), 10000)
+
+	type result struct {
+		sent, received int64
+	}
+	done := make(chan result, 1)
+	go func() {
+		sent, received := pipeForward(userPeer, dst)
+		done <- result{sent, received}
+	}()
+	// 资产读完请求后回复并关闭, 用户读到全部回复
+	go func() {
+		got, _ := ioutil.ReadAll(dstPeer)
+		if !bytes.Equal(got, request) {
+			t.Errorf("destination got %d bytes, want %d", len(got), len(request))
+		}
+		_, _ = dstPeer.Write(response)
+		_ = dstPeer.Close()
+	}()
+	if _, err := user.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	_ = user.(*net.TCPConn).CloseWrite()
+	got, err := ioutil.ReadAll(user)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Fatalf("user got %d bytes, want %d", len(got), len(response))
+	}
+	res := <-done
+	if res.sent != int64(len(request)) || res.received != int64(len(response)) {
+		t.Fatalf("pipe got sent %d received %d, want %d %d", res.sent, res.received,
+			len(request), len(response))
+	}
+	_ = user.Close()
+}
+
+func TestPortForwarderCloseWaitsChannels(t *testing.T) {
+	p := &portForwarder{
+		sessions:       make(map[string]*forwardSession),
+		gateways:       make(map[string]*srvconn.SSHClient),
+		remoteForwards: make(map[string]*remoteForward),
+	}
+	user, userPeer := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+	if !p.startChannel() {
+		t.Fatal("channel should start before close")
+	}
+	channelDone := make(chan struct{})
+	go func() {
+		defer close(channelDone)
+		defer p.doneChannel()
+		defer p.trackConn(dst)()
+		pipeForward(userPeer, dst)
+	}()
+	closeDone := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closeDone)
+	}()
+	// Close 关闭进行中的通道的目标连接
+	_ = dstPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := dstPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("destination should be closed, got %v", err)
+	}
+	select {
+	case <-closeDone:
+		t.Fatal("close should wait for the channel to finish")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = user.Close()
+	for _, done := range []chan struct{}{channelDone, closeDone} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("channel and close should finish after the user connection closed")
+		}
+	}
+	if p.startChannel() {
+		t.Fatal("channel should be refused after close")
+	}
+	if fs := p.getSession(&model.Asset{ID: "asset"}, &forwardPermission{}); fs != nil {
+		t.Fatal("session should not be created after close")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	release := make(chan struct{})
+	client, server := net.Pipe()
+	dial := func(network, addr string) (net.Conn, error) {
+		<-release
+		return client, nil
+	}
+	if _, err := dialTimeout(dial, "10.0.0.1:22", 50*time.Millisecond); err == nil {
+		t.Fatal("expected dial timeout")
+	}
+	// 超时后建立的连接被关闭
+	close(release)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("late connection should be closed, got %v", err)
+	}
+}
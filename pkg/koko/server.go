@@ -7,6 +7,7 @@ import (
 
 	"github.com/jumpserver/koko/pkg/logger"
 	"github.com/jumpserver/koko/pkg/srvconn"
+	"github.com/jumpserver/koko/pkg/sshca"
 
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
@@ -18,20 +19,32 @@ type server struct {
 	sync.Mutex
 
 	vscodeClients map[string]*vscodeReq
+
+	// 每个 SSH 连接的端口转发
+	portForwarders map[string]*portForwarder
+
+	// 配置了用户 CA 时校验用户登录使用的 OpenSSH 证书
+	userCertChecker *sshca.UserChecker
 }
 
 func (s *server) run() {
 	for {
 		time.Sleep(time.Minute)
-		conf, err := s.jmsService.GetTerminalConfig()
-		if err != nil {
+		if err := s.reloadTerminalConfig(); err != nil {
 			logger.Errorf("Update terminal config failed: %s", err)
-			continue
 		}
-		s.UpdateTerminalConfig(conf)
 	}
 }
 
+func (s *server) reloadTerminalConfig() error {
+	conf, err := s.jmsService.GetTerminalConfig()
+	if err != nil {
+		return err
+	}
+	s.UpdateTerminalConfig(conf)
+	return nil
+}
+
 func (s *server) UpdateTerminalConfig(conf model.TerminalConfig) {
 	s.terminalConf.Store(conf)
 }
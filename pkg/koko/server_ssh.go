@@ -1,6 +1,8 @@
 package koko
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,10 +17,13 @@ import (
 	"github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/handler"
+	"github.com/jumpserver/koko/pkg/hostkey"
 	"github.com/jumpserver/koko/pkg/i18n"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
 	"github.com/jumpserver/koko/pkg/srvconn"
+	"github.com/jumpserver/koko/pkg/sshca"
 	"github.com/jumpserver/koko/pkg/sshd"
 	"github.com/jumpserver/koko/pkg/utils"
 )
@@ -65,6 +70,10 @@ func (s *server) PublicKeyAuth(ctx ssh.Context, key ssh.PublicKey) sshd.AuthStat
 		logger.Info("Core API disable publickey auth")
 		return sshd.AuthFailed
 	}
+	if cert, ok := key.(*gossh.Certificate); ok && s.userCertChecker != nil {
+		certAuthHandler := auth.SSHCertificateAuth(s.jmsService, s.userCertChecker)
+		return certAuthHandler(ctx, cert)
+	}
 	publicKey := common.Base64Encode(string(key.Marshal()))
 	sshAuthHandler := auth.SSHPasswordAndPublicKeyAuth(s.jmsService)
 	return sshAuthHandler(ctx, "", publicKey)
@@ -81,7 +90,22 @@ func (s *server) SFTPHandler(sess ssh.Session) {
 		return
 	}
 	host, _, _ := net.SplitHostPort(sess.RemoteAddr().String())
-	userSftp := handler.NewSFTPHandler(s.jmsService, currentUser, host)
+	var sftpConn *srvconn.UserSftpConn
+	// 直连格式只操作指定的资产, OpenSSH 9 之后的 scp 默认使用 sftp 协议
+	if directRequest, ok := sess.Context().Value(auth.ContextKeyDirectLoginFormat).(*auth.DirectLoginAssetReq); ok {
+		asset, systemUser, err := s.matchDirectTarget(currentUser, directRequest)
+		if err != nil {
+			logger.Errorf("User %s sftp request err: %s", currentUser, err)
+			utils.IgnoreErrWriteString(sess.Stderr(), err.Error()+"\r\n")
+			_ = sess.Exit(1)
+			return
+		}
+		logger.Infof("User %s sftp request to %s@%s", currentUser, systemUser.Username, asset.Hostname)
+		sftpConn = srvconn.NewUserSftpConnWithDirectAsset(s.jmsService, currentUser, host, asset, systemUser)
+	} else {
+		sftpConn = srvconn.NewUserSftpConn(s.jmsService, currentUser, host)
+	}
+	userSftp := handler.NewSFTPHandlerWithConn(sftpConn)
 	handlers := sftp.Handlers{
 		FileGet:  userSftp,
 		FilePut:  userSftp,
@@ -102,23 +126,58 @@ func (s *server) SFTPHandler(sess ssh.Session) {
 }
 
 func (s *server) LocalPortForwardingPermission(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
-	return config.GlobalConfig.EnableLocalPortForward
+	conf := config.GetConf()
+	return conf.EnableLocalPortForward || conf.EnablePortForward
 }
+
+/*
+	DirectTCPIPChannelHandler vscode 请求的转发在其目标资产上连接, 需要开启 ENABLE_LOCAL_PORT_FORWARD 和 ENABLE_VSCODE_SUPPORT;
+	其他转发 (-L/-D) 连接用户授权的资产, 需要开启 ENABLE_PORT_FORWARD
+*/
+
 func (s *server) DirectTCPIPChannelHandler(ctx ssh.Context, newChan gossh.NewChannel, destAddr string) {
-	if !config.GetConf().EnableVscodeSupport {
+	reqId, ok := ctx.Value(ctxID).(string)
+	if !ok {
 		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
 		return
 	}
-	reqId, ok := ctx.Value(ctxID).(string)
-	if !ok {
+	conf := config.GetConf()
+	if vsReq := s.getVSCodeReq(reqId); vsReq != nil && conf.EnableLocalPortForward && conf.EnableVscodeSupport {
+		s.vscodePortForward(vsReq, newChan, destAddr)
+		return
+	}
+	if !conf.EnablePortForward {
 		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
 		return
 	}
-	vsReq := s.getVSCodeReq(reqId)
-	if vsReq == nil {
+	forwarder := s.getPortForwarder(ctx)
+	if forwarder == nil {
 		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
 		return
 	}
+	forwarder.HandleDirectTCPIP(newChan, destAddr)
+}
+
+func (s *server) ReversePortForwardingPermission(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	conf := config.GetConf()
+	return conf.EnablePortForward && conf.EnableRemotePortForward
+}
+
+func (s *server) RemotePortForwardHandler(ctx ssh.Context, bindHost string, bindPort uint32) error {
+	forwarder := s.getPortForwarder(ctx)
+	if forwarder == nil {
+		return errPortForwardDisabled
+	}
+	return forwarder.StartRemoteForward(bindHost, bindPort)
+}
+
+func (s *server) CancelRemotePortForwardHandler(ctx ssh.Context, bindHost string, bindPort uint32) {
+	if forwarder := s.getPortForwarder(ctx); forwarder != nil {
+		forwarder.CancelRemoteForward(bindHost, bindPort)
+	}
+}
+
+func (s *server) vscodePortForward(vsReq *vscodeReq, newChan gossh.NewChannel, destAddr string) {
 	dConn, err := vsReq.client.Dial("tcp", destAddr)
 	if err != nil {
 		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
@@ -180,40 +239,78 @@ func (s *server) SessionHandler(sess ssh.Session) {
 		utils.IgnoreErrWriteWindowTitle(sess, termConf.HeaderTitle)
 		return
 	}
+	if directRequest, ok3 := directReq.(*auth.DirectLoginAssetReq); ok3 && sess.RawCommand() != "" {
+		s.proxyExec(sess, user, directRequest)
+		return
+	}
 	if !config.GetConf().EnableVscodeSupport {
 		utils.IgnoreErrWriteString(sess, "No PTY requested.\n")
 		return
 	}
 	if directRequest, ok3 := directReq.(*auth.DirectLoginAssetReq); ok3 {
-		selectedAssets, err := s.getMatchedAssetsByDirectReq(user, directRequest)
+		asset, systemUser, err := s.matchDirectTarget(user, directRequest)
 		if err != nil {
 			logger.Error(err)
 			utils.IgnoreErrWriteString(sess, err.Error())
 			return
 		}
-		if len(selectedAssets) != 1 {
-			msg := fmt.Sprintf(i18n.T("Must be unique asset for %s"), directRequest.AssetInfo)
-			utils.IgnoreErrWriteString(sess, msg)
-			logger.Error(msg)
-			return
-		}
-		selectSysUsers, err := s.getMatchedSystemUsers(user, directRequest, selectedAssets[0])
-		if err != nil {
-			logger.Error(err)
-			utils.IgnoreErrWriteString(sess, err.Error())
-			return
-		}
-		if len(selectSysUsers) != 1 {
-			msg := fmt.Sprintf(i18n.T("Must be unique system user for %s"), directRequest.SysUserInfo)
-			utils.IgnoreErrWriteString(sess, msg)
-			logger.Error(msg)
-			return
-		}
-		s.proxyVscode(sess, user, selectedAssets[0], selectSysUsers[0])
+		s.proxyVscode(sess, user, asset, systemUser)
 	}
 
 }
 
+// matchDirectTarget 返回直连格式唯一匹配的资产和系统用户
+func (s *server) matchDirectTarget(user *model.User,
+	directRequest *auth.DirectLoginAssetReq) (model.Asset, model.SystemUser, error) {
+	selectedAssets, err := s.getMatchedAssetsByDirectReq(user, directRequest)
+	if err != nil {
+		return model.Asset{}, model.SystemUser{}, err
+	}
+	if len(selectedAssets) != 1 {
+		msg := fmt.Sprintf(i18n.T("Must be unique asset for %s"), directRequest.AssetInfo)
+		return model.Asset{}, model.SystemUser{}, errors.New(msg)
+	}
+	selectSysUsers, err := s.getMatchedSystemUsers(user, directRequest, selectedAssets[0])
+	if err != nil {
+		return model.Asset{}, model.SystemUser{}, err
+	}
+	if len(selectSysUsers) != 1 {
+		msg := fmt.Sprintf(i18n.T("Must be unique system user for %s"), directRequest.SysUserInfo)
+		return model.Asset{}, model.SystemUser{}, errors.New(msg)
+	}
+	return selectedAssets[0], selectSysUsers[0], nil
+}
+
+/*
+	proxyExec 处理直连格式的非交互请求 (ssh user@systemuser@asset@koko cmd), 包括 scp -O 和 rsync,
+	命令的输出和退出码原样返回给用户。sftp 子系统 (OpenSSH 9 之后的 scp) 见 SFTPHandler
+*/
+
+func (s *server) proxyExec(sess ssh.Session, user *model.User, directRequest *auth.DirectLoginAssetReq) {
+	asset, systemUser, err := s.matchDirectTarget(user, directRequest)
+	if err != nil {
+		logger.Errorf("User %s exec request err: %s", user, err)
+		utils.IgnoreErrWriteString(sess.Stderr(), err.Error()+"\r\n")
+		_ = sess.Exit(255)
+		return
+	}
+	srv, err := proxy.NewServer(handler.NewWrapperSession(sess),
+		s.jmsService,
+		proxy.ConnectProtocolType(systemUser.Protocol),
+		proxy.ConnectUser(user),
+		proxy.ConnectAsset(&asset),
+		proxy.ConnectSystemUser(&systemUser),
+	)
+	if err != nil {
+		logger.Errorf("User %s exec request err: %s", user, err)
+		utils.IgnoreErrWriteString(sess.Stderr(), err.Error()+"\r\n")
+		_ = sess.Exit(255)
+		return
+	}
+	logger.Infof("User %s exec request to %s@%s", user, systemUser.Username, asset.Hostname)
+	_ = sess.Exit(srv.ProxyExec(sess.RawCommand(), sess.Stderr()))
+}
+
 func (s *server) proxyVscode(sess ssh.Session, user *model.User, asset model.Asset,
 	systemUser model.SystemUser) {
 	ctxId, ok := sess.Context().Value(ctxID).(string)
@@ -233,53 +330,8 @@ func (s *server) proxyVscode(sess ssh.Session, user *model.User, asset model.Ass
 		logger.Errorf("Get asset Permission info err: %s", err)
 		return
 	}
-	var domainGateways *model.Domain
-	if asset.Domain != "" {
-		domainInfo, err := s.jmsService.GetDomainGateways(asset.Domain)
-		if err != nil {
-			logger.Errorf("Get system user auth failed: %s", err)
-			return
-		}
-		domainGateways = &domainInfo
-	}
-	timeout := config.GlobalConfig.SSHTimeout
-	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 7)
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientUsername(systemUserAuthInfo.Username))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHost(asset.IP))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPort(asset.ProtocolPort(systemUserAuthInfo.Protocol)))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPassword(systemUserAuthInfo.Password))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientTimeout(timeout))
-	if systemUserAuthInfo.PrivateKey != "" {
-		// 先使用 password 解析 PrivateKey
-		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(systemUserAuthInfo.PrivateKey),
-			[]byte(systemUserAuthInfo.Password)); err1 == nil {
-			sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
-		} else {
-			// 如果之前使用password解析失败，则去掉 password, 尝试直接解析 PrivateKey 防止错误的passphrase
-			if signer, err1 = gossh.ParsePrivateKey([]byte(systemUserAuthInfo.PrivateKey)); err1 == nil {
-				sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
-			}
-		}
-	}
-
-	if domainGateways != nil && len(domainGateways.Gateways) > 0 {
-		proxyArgs := make([]srvconn.SSHClientOptions, 0, len(domainGateways.Gateways))
-		for i := range domainGateways.Gateways {
-			gateway := domainGateways.Gateways[i]
-			proxyArg := srvconn.SSHClientOptions{
-				Host:       gateway.IP,
-				Port:       strconv.Itoa(gateway.Port),
-				Username:   gateway.Username,
-				Password:   gateway.Password,
-				Passphrase: gateway.Password, // 兼容 带密码的private_key,
-				PrivateKey: gateway.PrivateKey,
-				Timeout:    timeout,
-			}
-			proxyArgs = append(proxyArgs, proxyArg)
-		}
-		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
-	}
-	sshClient, err := srvconn.NewSSHClient(sshAuthOpts...)
+	sshClient, err := s.newAssetSSHClient(sess.Context(), asset, systemUserAuthInfo,
+		fmt.Sprintf("koko:%s:vscode", user.Username))
 	if err != nil {
 		logger.Errorf("Get SSH Client failed: %s", err)
 		return
@@ -341,6 +393,69 @@ func (s *server) proxyVscode(sess ssh.Session, user *model.User, asset model.Ass
 	}
 }
 
+// newAssetSSHClient 使用系统用户的认证信息连接资产, 资产配置了网域时通过网关连接
+func (s *server) newAssetSSHClient(ctx context.Context, asset model.Asset,
+	systemUserAuthInfo model.SystemUserAuthInfo, keyID string) (*srvconn.SSHClient, error) {
+	var domainGateways *model.Domain
+	if asset.Domain != "" {
+		domainInfo, err := s.jmsService.GetDomainGateways(asset.Domain)
+		if err != nil {
+			logger.Errorf("Get domain %s gateways failed: %s", asset.Domain, err)
+			return nil, err
+		}
+		domainGateways = &domainInfo
+	}
+	timeout := config.GlobalConfig.SSHTimeout
+	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 10)
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientUsername(systemUserAuthInfo.Username))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHost(asset.IP))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPort(asset.ProtocolPort(systemUserAuthInfo.Protocol)))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPassword(systemUserAuthInfo.Password))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientTimeout(timeout))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHostKeyCallback(hostkey.HostKeyCallback(asset.ID)))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientCertAuthority(sshca.Default(), keyID))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientContext(ctx))
+	if systemUserAuthInfo.PrivateKey != "" {
+		// 先使用 password 解析 PrivateKey
+		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(systemUserAuthInfo.PrivateKey),
+			[]byte(systemUserAuthInfo.Password)); err1 == nil {
+			sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
+		} else {
+			// 如果之前使用password解析失败，则去掉 password, 尝试直接解析 PrivateKey 防止错误的passphrase
+			if signer, err1 = gossh.ParsePrivateKey([]byte(systemUserAuthInfo.PrivateKey)); err1 == nil {
+				sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
+			}
+		}
+	}
+	if proxyArgs := gatewayProxyOptions(domainGateways); len(proxyArgs) > 0 {
+		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
+	}
+	return srvconn.NewSSHClient(sshAuthOpts...)
+}
+
+// gatewayProxyOptions 网域中网关的连接配置
+func gatewayProxyOptions(domainGateways *model.Domain) []srvconn.SSHClientOptions {
+	if domainGateways == nil || len(domainGateways.Gateways) == 0 {
+		return nil
+	}
+	timeout := config.GlobalConfig.SSHTimeout
+	proxyArgs := make([]srvconn.SSHClientOptions, 0, len(domainGateways.Gateways))
+	for i := range domainGateways.Gateways {
+		gateway := domainGateways.Gateways[i]
+		proxyArg := srvconn.SSHClientOptions{
+			Host:       gateway.IP,
+			Port:       strconv.Itoa(gateway.Port),
+			Username:   gateway.Username,
+			Password:   gateway.Password,
+			Passphrase: gateway.Password, // 兼容 带密码的private_key,
+			PrivateKey: gateway.PrivateKey,
+			Timeout:    timeout,
+		}
+		proxyArgs = append(proxyArgs, proxyArg)
+	}
+	return proxyArgs
+}
+
 func (s *server) getMatchedAssetsByDirectReq(user *model.User, req *auth.DirectLoginAssetReq) ([]model.Asset, error) {
 	if req.IsUUIDString() {
 		asset, err := s.jmsService.GetAssetById(req.AssetInfo)
@@ -0,0 +1,41 @@
+package koko
+
+import (
+	"time"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/sshca"
+)
+
+// loadUserCertChecker 读取用户证书的 CA 公钥, 未配置时不支持证书登录
+func loadUserCertChecker() *sshca.UserChecker {
+	path := config.GetConf().UserCAKeysFile
+	if path == "" {
+		return nil
+	}
+	caKeys, err := sshca.LoadPublicKeys(path)
+	if err != nil {
+		logger.Fatal("Load user ca keys failed: " + err.Error())
+	}
+	logger.Infof("SSH certificate auth enabled, %d user ca keys", len(caKeys))
+	return sshca.NewUserChecker(caKeys)
+}
+
+// setupTargetCertAuthority 启用连接资产时签发短期证书
+func setupTargetCertAuthority() {
+	conf := config.GetConf()
+	if conf.TargetCAKeyFile == "" {
+		return
+	}
+	signer, err := sshca.LoadSigner(conf.TargetCAKeyFile, conf.TargetCAKeyPassphrase)
+	if err != nil {
+		logger.Fatal("Load target ca key failed: " + err.Error())
+	}
+	ttl := conf.TargetCertTTL
+	if ttl <= 0 {
+		ttl = 5
+	}
+	sshca.Setup(signer, time.Duration(ttl)*time.Minute)
+	logger.Infof("Target certificate enabled, ttl %d minutes", ttl)
+}
@@ -1,7 +1,9 @@
 package koko
 
 import (
+	"errors"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -11,11 +13,31 @@ import (
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/metrics"
 	"github.com/jumpserver/koko/pkg/proxy"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
 )
 
 // uploadRemainReplay 上传遗留的录像
 func uploadRemainReplay(jmsService *service.JMService) {
+	uploadRemainReplayIn(jmsService, nil)
+}
+
+// uploadRemainReplayOf 只上传指定会话遗留的录像, 用于运行中补报降级会话之后
+func uploadRemainReplayOf(jmsService *service.JMService, sids []string) {
+	sessions := make(map[string]bool, len(sids))
+	for _, sid := range sids {
+		sessions[sid] = true
+	}
+	uploadRemainReplayIn(jmsService, sessions)
+}
+
+/*
+	uploadRemainReplayIn 上传遗留的录像, sessions 为 nil 时上传所有会话的录像。
+	运行中也会补传录像, 录像还在录制或者由录像自己压缩上传的会话通过 proxy.LockReplay 跳过
+*/
+
+func uploadRemainReplayIn(jmsService *service.JMService, sessions map[string]bool) {
 	replayDir := config.GetConf().ReplayFolderPath
 	conf, err := jmsService.GetTerminalConfig()
 	if err != nil {
@@ -24,11 +46,43 @@ func uploadRemainReplay(jmsService *service.JMService) {
 	}
 	replayStorage := proxy.NewReplayStorage(jmsService, &conf)
 	allRemainFiles := make(map[string]RemainReplay)
+	remainSegments := make(map[remainSegmentSet]time.Time)
+	locked := make(map[string]bool)
+	defer func() {
+		for sid, ok := range locked {
+			if ok {
+				proxy.UnlockReplay(sid)
+			}
+		}
+	}()
+	owned := func(sid string) bool {
+		if sessions != nil && !sessions[sid] {
+			return false
+		}
+		if ok, exist := locked[sid]; exist {
+			return ok
+		}
+		locked[sid] = proxy.LockReplay(sid)
+		return locked[sid]
+	}
 	_ = filepath.Walk(replayDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
 			return nil
 		}
+		if sid, ok := parseReplaySegmentSession(info.Name()); ok {
+			if !owned(sid) {
+				return nil
+			}
+			set := remainSegmentSet{dateDir: filepath.Dir(path), sid: sid}
+			if info.ModTime().After(remainSegments[set]) {
+				remainSegments[set] = info.ModTime()
+			}
+			return nil
+		}
 		if replayInfo, ok := parseReplayFilename(info.Name()); ok {
+			if !owned(replayInfo.Id) {
+				return nil
+			}
 			finishedTime := common.NewUTCTime(info.ModTime())
 			if err2 := jmsService.SessionFinished(replayInfo.Id, finishedTime); err2 != nil {
 				logger.Error(err2)
@@ -40,44 +94,205 @@ func uploadRemainReplay(jmsService *service.JMService) {
 	})
 
 	for absPath, remainReplay := range allRemainFiles {
-		absGzPath := absPath
-		if !remainReplay.IsGzip {
-			switch remainReplay.Version {
-			case model.Version2:
-				if err := ValidateRemainReplayFile(absPath); err != nil {
-					continue
-				}
-				absGzPath = absPath + model.SuffixReplayGz
-			case model.Version3:
-				absGzPath = absPath + model.SuffixGz
-			default:
-				absGzPath = absPath + model.SuffixGz
+		if err = uploadReplayFile(jmsService, replayStorage, absPath, remainReplay); err != nil {
+			logger.Errorf("Upload remain replay file %s failed: %s", absPath, err)
+		}
+	}
+	for set, modTime := range remainSegments {
+		if err = jmsService.SessionFinished(set.sid, common.NewUTCTime(modTime)); err != nil {
+			logger.Error(err)
+			continue
+		}
+		if err = proxy.UploadRemainReplaySegments(jmsService, replayStorage, set.dateDir, set.sid); err != nil {
+			logger.Errorf("Upload remain replay segments of session %s failed: %s", set.sid, err)
+		}
+	}
+	logger.Info("Upload remain replay done")
+}
+
+/*
+	uploadReplayFile 压缩并上传本地的录像文件, 成功后通知 core 并删除本地文件。
+	加密录像解密后压缩再加密, 密钥文件先于录像上传
+*/
+
+func uploadReplayFile(jmsService *service.JMService, replayStorage proxy.ReplayStorage,
+	absPath string, remainReplay RemainReplay) error {
+	replayDir := config.GetConf().ReplayFolderPath
+	dateDir := filepath.Dir(absPath)
+	dataKey, err := proxy.LoadReplayKey(dateDir, remainReplay.Id)
+	if err != nil {
+		return err
+	}
+	absGzPath := absPath
+	if !remainReplay.IsGzip {
+		switch remainReplay.Version {
+		case model.Version2:
+			if err = ValidateRemainReplayFile(absPath); err != nil {
+				return err
 			}
+			absGzPath = absPath + model.SuffixReplayGz
+			err = common.CompressToGzipFile(absPath, absGzPath)
+		case model.Version3:
+			absGzPath = absPath + model.SuffixGz
+			err = proxy.CompressReplayFile(absPath, absGzPath, dataKey, false)
+		default:
+			absGzPath = absPath + model.SuffixGz
+			err = proxy.CompressReplayFile(absPath, absGzPath, dataKey, false)
+		}
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(absPath)
+	}
+	if err = proxy.UploadReplayKey(replayStorage, dateDir, remainReplay.Id); err != nil {
+		return err
+	}
+	Target, _ := filepath.Rel(replayDir, absGzPath)
+	logger.Infof("Upload replay file: %s, type: %s", absGzPath, replayStorage.TypeName())
+	if err := replayStorage.Upload(absGzPath, Target); err != nil {
+		metrics.ReplayUploads.Inc(replayStorage.TypeName(), metrics.ResultFailure)
+		return err
+	}
+	metrics.ReplayUploads.Inc(replayStorage.TypeName(), metrics.ResultSuccess)
+	if err := jmsService.FinishReply(remainReplay.Id); err != nil {
+		logger.Errorf("Notify session %s upload failed: %s", remainReplay.Id, err)
+		return err
+	}
+	_ = os.Remove(absGzPath)
+	proxy.RemoveReplayKey(dateDir, remainReplay.Id)
+	logger.Infof("Upload remain replay file %s success", absGzPath)
+	return nil
+}
 
-			if err = common.CompressToGzipFile(absPath, absGzPath); err != nil {
-				logger.Error(err)
-				continue
+const (
+	uploadCommandInterval = 5 * time.Minute
+	uploadCommandMinDelay = 30 * time.Second
+)
+
+// keepUploadRemainCommand 定期上传 spool 中遗留的命令, 失败后按指数退避重试
+func keepUploadRemainCommand(jmsService *service.JMService) {
+	retryDelay := uploadCommandMinDelay
+	for {
+		if err := uploadRemainCommand(jmsService); err != nil {
+			logger.Errorf("Upload remain commands failed: %s, retry after %s", err, retryDelay)
+			time.Sleep(retryDelay)
+			if retryDelay *= 2; retryDelay > uploadCommandInterval {
+				retryDelay = uploadCommandInterval
 			}
-			_ = os.Remove(absPath)
+			continue
+		}
+		retryDelay = uploadCommandMinDelay
+		time.Sleep(uploadCommandInterval)
+	}
+}
+
+func uploadRemainCommand(jmsService *service.JMService) error {
+	conf, err := jmsService.GetTerminalConfig()
+	if err != nil {
+		return err
+	}
+	cmdStorage := proxy.NewCommandStorage(jmsService, &conf)
+	return proxy.UploadRemainCommands(cmdStorage)
+}
+
+// keepReplayRetention 定期清理录像存储中超过保存时间的录像
+func keepReplayRetention(jmsService *service.JMService) {
+	for {
+		cleanExpiredReplay(jmsService)
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+/*
+	cleanExpiredReplay 按照 SessionKeepDuration(天) 清理录像,
+	本地的录像输出索引在每个节点上清理, 共用的录像存储只在开启 ENABLE_REPLAY_RETENTION 的节点上清理
+*/
+
+func cleanExpiredReplay(jmsService *service.JMService) {
+	conf, err := jmsService.GetTerminalConfig()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if conf.SessionKeepDuration <= 0 {
+		return
+	}
+	expiredTime := time.Now().AddDate(0, 0, -conf.SessionKeepDuration)
+	cleanExpiredReplayIndex(expiredTime)
+	if !config.GetConf().EnableReplayRetention {
+		return
+	}
+	replayStorage := proxy.NewReplayStorage(jmsService, &conf)
+	count, err := cleanExpiredReplayIn(replayStorage, expiredTime)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotSupported) {
+			logger.Debugf("Replay storage %s not support clean expired replay", replayStorage.TypeName())
+			return
 		}
-		Target, _ := filepath.Rel(replayDir, absGzPath)
-		logger.Infof("Upload replay file: %s, type: %s", absGzPath, replayStorage.TypeName())
-		if err2 := replayStorage.Upload(absGzPath, Target); err2 != nil {
-			logger.Errorf("Upload remain replay file %s failed: %s", absGzPath, err2)
+		logger.Errorf("Clean expired replay from storage %s failed: %s", replayStorage.TypeName(), err)
+	}
+	logger.Infof("Clean %d expired replay files from storage %s", count, replayStorage.TypeName())
+}
+
+/*
+	cleanExpiredReplayIn 清理存储中过期的录像, 返回删除的文件数。
+	录像的 key 是 {date}/{sid}.cast.gz, 分段录像还有 {date}/{sid}.{index}.cast.gz 和 {date}/{sid}.manifest.json,
+	加密录像还有 {date}/{sid}.key.json; 先列出日期目录, 只列出过期日期下的文件, 不遍历整个存储
+*/
+
+func cleanExpiredReplayIn(replayStorage proxy.ReplayStorage, expiredTime time.Time) (int, error) {
+	dirs, err := replayStorage.ListDirs()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, dir := range dirs {
+		date, err := time.Parse(replayDateFormat, dir)
+		if err != nil || date.After(expiredTime) {
 			continue
 		}
-		if err := jmsService.FinishReply(remainReplay.Id); err != nil {
-			logger.Errorf("Notify session %s upload failed: %s", remainReplay.Id, err)
+		objects, err := replayStorage.List(dir + "/")
+		if err != nil {
+			return count, err
+		}
+		for _, item := range objects {
+			// 只清理录像文件, 避免误删 bucket 中的其他文件
+			name := path.Base(item.Key)
+			if _, _, ok := isReplayFile(name); !ok && !isReplayMetaFile(name) {
+				continue
+			}
+			if err = replayStorage.Delete(item.Key); err != nil {
+				logger.Errorf("Delete expired replay %s failed: %s", item.Key, err)
+				continue
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+const replayDateFormat = "2006-01-02"
+
+// cleanExpiredReplayIndex 清理本地过期的录像输出索引
+func cleanExpiredReplayIndex(expiredTime time.Time) {
+	indexDir := proxy.ReplayIndexDir()
+	dateDirs, err := os.ReadDir(indexDir)
+	if err != nil {
+		return
+	}
+	for _, dateDir := range dateDirs {
+		date, err := time.Parse(replayDateFormat, dateDir.Name())
+		if err != nil || !dateDir.IsDir() || date.After(expiredTime) {
 			continue
 		}
-		_ = os.Remove(absGzPath)
-		logger.Infof("Upload remain replay file %s success", absGzPath)
+		if err = os.RemoveAll(filepath.Join(indexDir, dateDir.Name())); err != nil {
+			logger.Errorf("Remove expired replay index %s failed: %s", dateDir.Name(), err)
+		}
 	}
-	logger.Info("Upload remain replay done")
 }
 
-// keepHeartbeat 保持心跳
-func keepHeartbeat(jmsService *service.JMService) {
+// keepHeartbeat 保持心跳, 并执行 core 下发的任务
+func keepHeartbeat(jmsService *service.JMService, executor *taskExecutor) {
 	for {
 		time.Sleep(30 * time.Second)
 		data := proxy.GetAliveSessions()
@@ -86,28 +301,12 @@ func keepHeartbeat(jmsService *service.JMService) {
 			logger.Error(err)
 			continue
 		}
-		if len(tasks) != 0 {
-			for _, task := range tasks {
-				switch task.Name {
-				case TaskKillSession:
-					if sw, ok := proxy.GetSessionById(task.Args); ok {
-						sw.Terminate(task.Kwargs.TerminatedBy)
-						if err = jmsService.FinishTask(task.ID); err != nil {
-							logger.Error(err)
-						}
-					}
-				default:
-
-				}
-			}
+		for i := range tasks {
+			executor.Execute(tasks[i])
 		}
 	}
 }
 
-const (
-	TaskKillSession = "kill_session"
-)
-
 func ValidateRemainReplayFile(path string) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, os.ModePerm)
 	if err != nil {
@@ -134,6 +333,29 @@ func ValidateRemainReplayFile(path string) error {
 	return err
 }
 
+// remainSegmentSet 是一个会话在某个日期目录中遗留的分段录像和清单
+type remainSegmentSet struct {
+	dateDir string
+	sid     string
+}
+
+// parseReplaySegmentSession 返回分段录像或清单文件所属的会话
+func parseReplaySegmentSession(filename string) (string, bool) {
+	if sid, _, ok := proxy.ParseReplaySegmentFilename(filename); ok {
+		return sid, true
+	}
+	return proxy.ParseReplayManifestFilename(filename)
+}
+
+// isReplayMetaFile 判断是否是分段录像的清单或加密录像的密钥文件
+func isReplayMetaFile(filename string) bool {
+	if _, ok := proxy.ParseReplayManifestFilename(filename); ok {
+		return true
+	}
+	_, ok := proxy.ParseReplayKeyFilename(filename)
+	return ok
+}
+
 type RemainReplay struct {
 	Id      string // session id
 	IsGzip  bool
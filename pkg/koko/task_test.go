@@ -0,0 +1,50 @@
+package koko
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+func TestCleanExpiredReplayIn(t *testing.T) {
+	dir := t.TempDir()
+	const sid = "0b7a5f2e-3c1d-4e8a-9f6b-2d4c8e1a7b3f"
+	now := time.Now()
+	expiredDate := now.AddDate(0, 0, -10).Format(replayDateFormat)
+	keepDate := now.Format(replayDateFormat)
+	files := []string{
+		expiredDate + "/" + sid + ".cast.gz",
+		expiredDate + "/" + sid + ".key.json",
+		expiredDate + "/readme.txt",
+		keepDate + "/" + sid + ".cast.gz",
+		"other/" + sid + ".cast.gz",
+	}
+	for _, name := range files {
+		absPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(absPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(absPath, []byte("replay"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayStorage := storage.LocalReplayStorage{Directory: dir}
+	count, err := cleanExpiredReplayIn(replayStorage, now.AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("cleaned %d files, want 2", count)
+	}
+	for i, name := range files {
+		_, err = os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		// 只删除过期日期目录下的录像文件
+		if removed := os.IsNotExist(err); removed != (i < 2) {
+			t.Fatalf("%s removed %v", name, removed)
+		}
+	}
+}
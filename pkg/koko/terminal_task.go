@@ -0,0 +1,194 @@
+package koko
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/proxy"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionActive   = errors.New("session is still active")
+	ErrReplayNotFound  = errors.New("local replay not found")
+)
+
+// taskHandler 执行 core 下发的任务, 返回的错误作为任务结果提交
+type taskHandler func(task model.TerminalTask) error
+
+/*
+	taskExecutor 按任务名称分发心跳返回的任务, 执行后通过 FinishTask 提交结果。
+	未注册的任务保持未完成, 留给支持该任务的 koko 版本处理
+*/
+
+type taskExecutor struct {
+	jmsService *service.JMService
+	srv        *server
+
+	handlers map[string]taskHandler
+
+	// 正在执行的任务, 避免心跳重复下发时并发执行
+	running sync.Map
+}
+
+func newTaskExecutor(jmsService *service.JMService, srv *server) *taskExecutor {
+	e := &taskExecutor{
+		jmsService: jmsService,
+		srv:        srv,
+		handlers:   make(map[string]taskHandler),
+	}
+	e.Register(model.TaskKillSession, e.killSession)
+	e.Register(model.TaskLockSession, e.pauseSession)
+	e.Register(model.TaskUnlockSession, e.resumeSession)
+	e.Register(model.TaskReadonlySession, e.readonlySession)
+	e.Register(model.TaskBroadcastMessage, e.broadcastMessage)
+	e.Register(model.TaskUploadReplay, e.uploadReplay)
+	e.Register(model.TaskReloadConfig, e.reloadConfig)
+	e.Register(model.TaskSyncHostKeys, e.syncHostKeys)
+	return e
+}
+
+func (e *taskExecutor) Register(name string, handler taskHandler) {
+	e.handlers[name] = handler
+}
+
+func (e *taskExecutor) Execute(task model.TerminalTask) {
+	handler, ok := e.handlers[task.Name]
+	if !ok {
+		logger.Debugf("Ignore unsupported terminal task %s(%s)", task.Name, task.ID)
+		return
+	}
+	if _, loaded := e.running.LoadOrStore(task.ID, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		defer e.running.Delete(task.ID)
+		result := model.TaskResult{IsSuccess: true}
+		if err := handler(task); err != nil {
+			logger.Errorf("Execute terminal task %s(%s) failed: %s", task.Name, task.ID, err)
+			result = model.TaskResult{IsSuccess: false, Message: err.Error()}
+		}
+		if err := e.jmsService.FinishTask(task.ID, result); err != nil {
+			logger.Errorf("Finish terminal task %s(%s) err: %s", task.Name, task.ID, err)
+		}
+	}()
+}
+
+func (e *taskExecutor) getSession(sid string) (*proxy.SwitchSession, error) {
+	if sw, ok := proxy.GetSessionById(sid); ok {
+		return sw, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sid)
+}
+
+func (e *taskExecutor) killSession(task model.TerminalTask) error {
+	sw, err := e.getSession(task.Args)
+	if err != nil {
+		return err
+	}
+	sw.Terminate(task.Kwargs.TerminatedBy)
+	return nil
+}
+
+func (e *taskExecutor) pauseSession(task model.TerminalTask) error {
+	sw, err := e.getSession(task.Args)
+	if err != nil {
+		return err
+	}
+	sw.Pause(task.Kwargs.CreatedBy)
+	return nil
+}
+
+func (e *taskExecutor) resumeSession(task model.TerminalTask) error {
+	sw, err := e.getSession(task.Args)
+	if err != nil {
+		return err
+	}
+	sw.Resume(task.Kwargs.CreatedBy)
+	return nil
+}
+
+func (e *taskExecutor) readonlySession(task model.TerminalTask) error {
+	sw, err := e.getSession(task.Args)
+	if err != nil {
+		return err
+	}
+	sw.LockReadOnly(task.Kwargs.CreatedBy)
+	return nil
+}
+
+func (e *taskExecutor) broadcastMessage(task model.TerminalTask) error {
+	if task.Kwargs.Message == "" {
+		return errors.New("empty message")
+	}
+	sw, err := e.getSession(task.Args)
+	if err != nil {
+		return err
+	}
+	sw.SendMessage(task.Kwargs.CreatedBy, task.Kwargs.Message)
+	return nil
+}
+
+/*
+	uploadReplay 上传已结束会话遗留在本地的录像。
+	会话结束后录像在后台压缩上传, 录像自己上传完成之前同样返回 ErrSessionActive
+*/
+
+func (e *taskExecutor) uploadReplay(task model.TerminalTask) error {
+	sid := task.Args
+	if _, ok := proxy.GetSessionById(sid); ok {
+		return ErrSessionActive
+	}
+	if !proxy.LockReplay(sid) {
+		return ErrSessionActive
+	}
+	defer proxy.UnlockReplay(sid)
+	replayDir := config.GetConf().ReplayFolderPath
+	replayFiles := make(map[string]RemainReplay)
+	segmentDirs := make(map[string]bool)
+	_ = filepath.Walk(replayDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if segmentSid, ok := parseReplaySegmentSession(info.Name()); ok {
+			if segmentSid == sid {
+				segmentDirs[filepath.Dir(path)] = true
+			}
+			return nil
+		}
+		if replayInfo, ok := parseReplayFilename(info.Name()); ok && replayInfo.Id == sid {
+			replayFiles[path] = replayInfo
+		}
+		return nil
+	})
+	if len(replayFiles) == 0 && len(segmentDirs) == 0 {
+		return fmt.Errorf("%w: %s", ErrReplayNotFound, sid)
+	}
+	conf, err := e.jmsService.GetTerminalConfig()
+	if err != nil {
+		return err
+	}
+	replayStorage := proxy.NewReplayStorage(e.jmsService, &conf)
+	for absPath, replayInfo := range replayFiles {
+		if err = uploadReplayFile(e.jmsService, replayStorage, absPath, replayInfo); err != nil {
+			return err
+		}
+	}
+	for dateDir := range segmentDirs {
+		if err = proxy.UploadRemainReplaySegments(e.jmsService, replayStorage, dateDir, sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *taskExecutor) reloadConfig(task model.TerminalTask) error {
+	return e.srv.reloadTerminalConfig()
+}
@@ -0,0 +1,26 @@
+package koko
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/proxy"
+)
+
+func TestTaskExecutorUploadReplayOwned(t *testing.T) {
+	const sid = "5d3c1a2b-7e4f-4a6b-8c9d-0e1f2a3b4c5d"
+	if !proxy.LockReplay(sid) {
+		t.Fatal("replay already locked")
+	}
+	defer proxy.UnlockReplay(sid)
+	// 录像还在后台上传时不能重复上传
+	e := &taskExecutor{}
+	err := e.uploadReplay(model.TerminalTask{Name: model.TaskUploadReplay, Args: sid})
+	if !errors.Is(err, ErrSessionActive) {
+		t.Fatalf("got %v, want %v", err, ErrSessionActive)
+	}
+	if proxy.LockReplay(sid) {
+		t.Fatal("upload task released the recorder's replay lock")
+	}
+}
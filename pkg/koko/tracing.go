@@ -0,0 +1,76 @@
+package koko
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/metrics"
+	"github.com/jumpserver/koko/pkg/tracing"
+)
+
+const (
+	traceExporterOTLP = "otlp"
+	traceExporterFile = "file"
+)
+
+func setupTracing() {
+	conf := config.GetConf()
+	var exporter tracing.Exporter
+	switch strings.ToLower(conf.TraceExporter) {
+	case "":
+		return
+	case traceExporterOTLP:
+		if conf.TraceOTLPEndpoint == "" {
+			logger.Error("Tracing disabled: TRACE_OTLP_ENDPOINT is empty")
+			return
+		}
+		exporter = tracing.NewOTLPExporter(conf.TraceOTLPEndpoint, conf.TraceOTLPHeaders)
+	case traceExporterFile:
+		path := conf.TraceFilePath
+		if path == "" {
+			path = filepath.Join(conf.LogDirPath, "traces.jsonl")
+		}
+		fileExporter, err := tracing.NewFileExporter(path)
+		if err != nil {
+			logger.Errorf("Tracing disabled: open trace file %s err: %s", path, err)
+			return
+		}
+		exporter = fileExporter
+	default:
+		logger.Errorf("Tracing disabled: unsupported TRACE_EXPORTER %s", conf.TraceExporter)
+		return
+	}
+	tracing.Setup(exporter, func(err error) {
+		logger.Errorf("Export trace spans err: %s", err)
+	})
+	logger.Infof("Tracing enabled, export spans by %s", conf.TraceExporter)
+}
+
+// traceCoreRequest 只记录属于用户连接链路的 core API 请求, 后台任务的请求不单独产生链路
+func traceCoreRequest(ctx context.Context, req *http.Request) func(statusCode int, err error) {
+	if tracing.SpanFromContext(ctx) == nil {
+		return nil
+	}
+	endpoint := metrics.NormalizeEndpoint(req.URL.Path)
+	_, span := tracing.Start(ctx, req.Method+" "+endpoint,
+		tracing.String("http.method", req.Method),
+		tracing.String("http.url", req.URL.Path),
+		tracing.String("http.route", endpoint))
+	span.SetKind(tracing.SpanKindClient)
+	if traceParent := span.TraceParent(); traceParent != "" {
+		req.Header.Set("traceparent", traceParent)
+	}
+	return func(statusCode int, err error) {
+		if statusCode != 0 {
+			span.SetAttributes(tracing.Int("http.status_code", statusCode))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
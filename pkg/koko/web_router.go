@@ -12,6 +12,7 @@ import (
 	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/httpd"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/metrics"
 )
 
 func registerWebHandlers(jmsService *service.JMService, webSrv *httpd.Server) {
@@ -31,6 +32,7 @@ func registerWebHandlers(jmsService *service.JMService, webSrv *httpd.Server) {
 	kokoGroup.Static("/assets", "./ui/dist/assets")
 	kokoGroup.StaticFile("/favicon.ico", "./ui/dist/favicon.ico")
 	kokoGroup.GET("/health/", webSrv.HealthStatusHandler)
+	kokoGroup.GET("/metrics", auth.HTTPMiddleMetricsAuth(), gin.WrapH(metrics.Handler()))
 	eng.LoadHTMLFiles("./templates/elfinder/file_manager.html", "./templates/elfinder/pod_file_manager.html")
 	wsGroup := kokoGroup.Group("/ws/")
 	{
@@ -99,6 +101,20 @@ func registerWebHandlers(jmsService *service.JMService, webSrv *httpd.Server) {
 		elfindlerGroup.Any("/connector/:host/", webSrv.SftpHostConnectorView)
 	}
 
+	replayGroup := kokoGroup.Group("/replay")
+	replayGroup.Use(auth.HTTPMiddleReplayAuth(jmsService))
+	{
+		replayGroup.GET("/search/", webSrv.ReplaySearchHandler)
+		replayGroup.GET("/:id/", webSrv.ReplayHandler)
+	}
+
+	apiGroup := kokoGroup.Group("/api/v1")
+	apiGroup.Use(auth.HTTPMiddleAdminAuth())
+	{
+		apiGroup.GET("/host-keys/", listHostKeysHandler)
+		apiGroup.DELETE("/host-keys/", resetHostKeyHandler)
+	}
+
 	debugGroup := rootGroup.Group("/debug/pprof")
 	debugGroup.Use(auth.HTTPMiddleDebugAuth())
 	{
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	SessionsActive = NewGaugeVec("koko_sessions_active",
+		"Number of active terminal sessions.", "protocol")
+
+	ConnectDuration = NewHistogramVec("koko_connect_duration_seconds",
+		"Time spent connecting to the target asset.", DefBuckets, "protocol", "result")
+
+	ConnectFailures = NewCounterVec("koko_connect_failures_total",
+		"Failed connections to the target asset by reason.", "protocol", "reason")
+
+	SSHClientCacheRequests = NewCounterVec("koko_ssh_client_cache_requests_total",
+		"Lookups of reusable SSH clients by result (hit or miss).", "result")
+
+	RoomsActive = NewGaugeVec("koko_exchange_rooms_active",
+		"Number of session rooms running on this koko.")
+
+	RoomSubscribers = NewGaugeVec("koko_exchange_room_subscribers",
+		"Number of connections subscribed to session rooms.")
+
+	ReplayUploads = NewCounterVec("koko_replay_uploads_total",
+		"Replay upload attempts by storage type and result.", "storage", "result")
+
+	CommandRecords = NewCounterVec("koko_command_records_total",
+		"Commands saved to command storage by storage type and result.", "storage", "result")
+
+	CoreAPIRequestDuration = NewHistogramVec("koko_core_api_request_duration_seconds",
+		"Latency of requests to the JumpServer core API.", DefBuckets, "method", "endpoint", "code")
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	ResultHit  = "hit"
+	ResultMiss = "miss"
+)
+
+var idSegmentPattern = regexp.MustCompile(`^(?:[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?` +
+	`[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}|\d+)$`)
+
+// NormalizeEndpoint 去掉 URL 的查询参数并将 ID 替换为 :id, 避免 endpoint 标签过多
+func NormalizeEndpoint(reqURL string) string {
+	path := reqURL
+	if u, err := url.Parse(reqURL); err == nil {
+		path = u.Path
+	}
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		if idSegmentPattern.MatchString(segments[i]) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Test requests.", "code")
+	counter.Inc("200")
+	counter.Add(2, `5"0\0`)
+	gauge := NewGaugeVec("test_active", "Test gauge.")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	hist := NewHistogramVec("test_duration_seconds", "Test histogram.", []float64{1, 0.1}, "op")
+	hist.Observe(0.05, "get")
+	hist.Observe(0.5, "get")
+	NewGaugeFunc("test_backlog", "Test gauge func.", func() float64 { return 3 })
+
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{code="200"} 1` + "\n",
+		`test_requests_total{code="5\"0\\0"} 2` + "\n",
+		"# TYPE test_active gauge\ntest_active 1\n",
+		`test_duration_seconds_bucket{op="get",le="0.1"} 1` + "\n",
+		`test_duration_seconds_bucket{op="get",le="1"} 2` + "\n",
+		`test_duration_seconds_bucket{op="get",le="+Inf"} 2` + "\n",
+		`test_duration_seconds_sum{op="get"} 0.55` + "\n",
+		"test_backlog 3\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output missing %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"/api/v1/users/33511e29-3058-49c5-85da-56a296494714/?a=1": "/api/v1/users/:id/",
+		"/api/v1/terminal/sessions/123/replay/":                   "/api/v1/terminal/sessions/:id/replay/",
+		"http://core:8080/api/v1/terminal/terminals/config/?x=1":  "/api/v1/terminal/terminals/config/",
+	}
+	for input, want := range tests {
+		if got := NormalizeEndpoint(input); got != want {
+			t.Errorf("NormalizeEndpoint(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
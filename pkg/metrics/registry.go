@@ -0,0 +1,302 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Prometheus 文本格式(0.0.4)的指标, 只实现 koko 用到的 counter、gauge 和 histogram,
+	指标在包初始化时注册到 defaultRegistry, 通过 Handler 输出
+*/
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type registry struct {
+	lock       sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+var defaultRegistry = &registry{names: make(map[string]bool)}
+
+func (r *registry) register(name string, c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *registry) writeTo(w io.Writer) error {
+	r.lock.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.lock.Unlock()
+	bw := bufio.NewWriter(w)
+	for i := range collectors {
+		collectors[i].write(bw)
+	}
+	return bw.Flush()
+}
+
+// WriteTo 以 Prometheus 文本格式输出所有指标
+func WriteTo(w io.Writer) error {
+	return defaultRegistry.writeTo(w)
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_ = WriteTo(w)
+	})
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *metricDesc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+}
+
+func (d *metricDesc) labelKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *metricDesc) formatLabels(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		values := strings.Split(key, "\xff")
+		for i := range d.labels {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, d.labels[i], escapeLabel(values[i])))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// valueVec 是 counter 和 gauge 共用的实现
+type valueVec struct {
+	metricDesc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newValueVec(typ, name, help string, labels []string) *valueVec {
+	v := &valueVec{
+		metricDesc: metricDesc{name: name, help: help, typ: typ, labels: labels},
+		values:     make(map[string]float64),
+	}
+	defaultRegistry.register(name, v)
+	return v
+}
+
+func (v *valueVec) add(delta float64, labelValues []string) {
+	key := v.labelKey(labelValues)
+	v.lock.Lock()
+	v.values[key] += delta
+	v.lock.Unlock()
+}
+
+func (v *valueVec) set(value float64, labelValues []string) {
+	key := v.labelKey(labelValues)
+	v.lock.Lock()
+	v.values[key] = value
+	v.lock.Unlock()
+}
+
+func (v *valueVec) write(w *bufio.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.formatLabels(key), formatValue(v.values[key]))
+	}
+}
+
+type CounterVec struct {
+	vec *valueVec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newValueVec("counter", name, help, labels)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.vec.add(1, labelValues)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.vec.add(delta, labelValues)
+}
+
+type GaugeVec struct {
+	vec *valueVec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newValueVec("gauge", name, help, labels)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.set(value, labelValues)
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.vec.add(1, labelValues)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.vec.add(-1, labelValues)
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.vec.add(delta, labelValues)
+}
+
+// GaugeFunc 在输出时调用 fn 获取当前值
+type GaugeFunc struct {
+	metricDesc
+	fn func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricDesc: metricDesc{name: name, help: help, typ: "gauge"}, fn: fn}
+	defaultRegistry.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	metricDesc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		metricDesc: metricDesc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets:    buckets,
+		values:     make(map[string]*histogram),
+	}
+	defaultRegistry.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.labelKey(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	item, ok := h.values[key]
+	if !ok {
+		item = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = item
+	}
+	for i := range h.buckets {
+		if value <= h.buckets[i] {
+			item.counts[i]++
+		}
+	}
+	item.count++
+	item.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		item := h.values[key]
+		for i := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				h.formatLabels(key, "le", formatValue(h.buckets[i])), item.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", "+Inf"), item.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatValue(item.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(key), item.count)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(value string) string {
+	return labelReplacer.Replace(value)
+}
+
+func escapeHelp(value string) string {
+	return helpReplacer.Replace(value)
+}
@@ -0,0 +1,240 @@
+package offline
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	core 不可达时的降级缓存:
+	最近一次成功请求的授权、过滤规则、认证信息等响应使用 AES-GCM 加密后保存在本地,
+	每个 key 一个文件, 超过 TTL 的缓存不再使用。
+	只有在 core 不可达时才会读取缓存, 读取过缓存的连接通过 Marker 标记为降级会话。
+*/
+
+var ErrInvalidEntry = errors.New("invalid offline cache entry")
+
+type Cache struct {
+	dir       string
+	ttl       time.Duration
+	aead      cipher.AEAD
+	cacheable func(reqUrl string) bool
+}
+
+var defaultCache *Cache
+
+// Setup 启用降级缓存, secret 用于派生加密密钥, cacheable 决定哪些请求的响应可以缓存
+func Setup(dir, secret string, ttl time.Duration, cacheable func(reqUrl string) bool) (*Cache, error) {
+	cache, err := NewCache(dir, secret, ttl, cacheable)
+	if err != nil {
+		return nil, err
+	}
+	defaultCache = cache
+	return cache, nil
+}
+
+// Default 返回全局的降级缓存, 未启用时为 nil
+func Default() *Cache {
+	return defaultCache
+}
+
+func NewCache(dir, secret string, ttl time.Duration, cacheable func(reqUrl string) bool) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, ttl: ttl, aead: aead, cacheable: cacheable}, nil
+}
+
+type entry struct {
+	Key     string          `json:"key"`
+	SavedAt time.Time       `json:"saved_at"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func (c *Cache) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Save 加密保存 value, 写入临时文件后 rename, 避免读到写了一半的缓存
+func (c *Cache) Save(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.saveRaw(key, data)
+}
+
+func (c *Cache) saveRaw(key string, data []byte) error {
+	plaintext, err := json.Marshal(entry{Key: key, SavedAt: time.Now(), Data: data})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, []byte(key))
+	path := c.entryPath(key)
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Load 读取未过期的缓存到 value
+func (c *Cache) Load(key string, value interface{}) bool {
+	data, ok := c.loadRaw(key)
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(data, value) == nil
+}
+
+func (c *Cache) loadRaw(key string) (json.RawMessage, bool) {
+	item, err := c.read(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("Read offline cache %s err: %s", key, err)
+		}
+		return nil, false
+	}
+	if time.Since(item.SavedAt) > c.ttl {
+		return nil, false
+	}
+	return item.Data, true
+}
+
+func (c *Cache) read(key string) (item entry, err error) {
+	sealed, err := ioutil.ReadFile(c.entryPath(key))
+	if err != nil {
+		return item, err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return item, ErrInvalidEntry
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(key))
+	if err != nil {
+		return item, err
+	}
+	if err = json.Unmarshal(plaintext, &item); err != nil {
+		return item, err
+	}
+	if item.Key != key {
+		return item, ErrInvalidEntry
+	}
+	return item, nil
+}
+
+func (c *Cache) Delete(key string) {
+	_ = os.Remove(c.entryPath(key))
+}
+
+/*
+	Purge 删除过期的缓存, 返回删除的数量。
+	key 作为加密的附加数据, 清理时无法预先知道 key, 所以只按文件修改时间判断
+*/
+
+func (c *Cache) Purge() int {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, info := range files {
+		if info.IsDir() || time.Since(info.ModTime()) <= c.ttl {
+			continue
+		}
+		if err = os.Remove(filepath.Join(c.dir, info.Name())); err == nil {
+			count++
+		}
+	}
+	return count
+}
+
+const responseKeyPrefix = "response:"
+
+// ResponseStore 实现 httplib.ResponseCache, 按请求 URL 缓存 core 的响应
+type ResponseStore struct {
+	cache *Cache
+}
+
+func (c *Cache) ResponseStore() *ResponseStore {
+	return &ResponseStore{cache: c}
+}
+
+func (r *ResponseStore) Store(reqUrl string, body []byte) {
+	if r.cache.cacheable != nil && !r.cache.cacheable(reqUrl) {
+		return
+	}
+	if !json.Valid(body) {
+		return
+	}
+	if err := r.cache.saveRaw(responseKeyPrefix+reqUrl, body); err != nil {
+		logger.Errorf("Save offline cache %s err: %s", reqUrl, err)
+	}
+}
+
+// Load 读取缓存的响应, 并标记 ctx 中的 Marker
+func (r *ResponseStore) Load(ctx context.Context, reqUrl string) ([]byte, bool) {
+	if r.cache.cacheable != nil && !r.cache.cacheable(reqUrl) {
+		return nil, false
+	}
+	data, ok := r.cache.loadRaw(responseKeyPrefix + reqUrl)
+	if !ok {
+		return nil, false
+	}
+	logger.Infof("Core unreachable, use offline cache for %s", reqUrl)
+	if marker := markerFromContext(ctx); marker != nil {
+		atomic.StoreInt32(&marker.degraded, 1)
+	}
+	return data, true
+}
+
+type markerKey struct{}
+
+// Marker 记录一次连接的请求是否使用了降级缓存
+type Marker struct {
+	degraded int32
+}
+
+func (m *Marker) Degraded() bool {
+	return atomic.LoadInt32(&m.degraded) == 1
+}
+
+func WithMarker(ctx context.Context) (context.Context, *Marker) {
+	marker := &Marker{}
+	return context.WithValue(ctx, markerKey{}, marker), marker
+}
+
+func markerFromContext(ctx context.Context) *Marker {
+	if ctx == nil {
+		return nil
+	}
+	marker, _ := ctx.Value(markerKey{}).(*Marker)
+	return marker
+}
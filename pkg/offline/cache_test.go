@@ -0,0 +1,132 @@
+package offline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, "secret", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Save("perm:1", map[string]string{"name": "web"}); err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]string
+	if !cache.Load("perm:1", &value) || value["name"] != "web" {
+		t.Fatalf("load cached value failed: %v", value)
+	}
+	if cache.Load("perm:2", &value) {
+		t.Fatal("load missing key should fail")
+	}
+
+	other, err := NewCache(dir, "other", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Load("perm:1", &value) {
+		t.Fatal("load with wrong secret should fail")
+	}
+
+	expired, err := NewCache(dir, "secret", -time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Load("perm:1", &value) {
+		t.Fatal("load expired value should fail")
+	}
+	if count := expired.Purge(); count != 1 {
+		t.Fatalf("purge expired entries got %d", count)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Fatalf("cache dir not empty after purge: %v", files)
+	}
+}
+
+func TestCacheEntryTampered(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, "secret", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Save("a", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// 把 a 的缓存文件换成 b 的位置, key 作为附加数据校验失败
+	if err = os.Rename(cache.entryPath("a"), cache.entryPath("b")); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if cache.Load("b", &value) {
+		t.Fatal("load moved entry should fail")
+	}
+}
+
+func TestResponseStore(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), "secret", time.Hour, func(reqUrl string) bool {
+		return reqUrl == "/api/perms"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := cache.ResponseStore()
+	store.Store("/api/perms", []byte(`{"ok":true}`))
+	store.Store("/api/sessions", []byte(`{"ok":true}`))
+	store.Store("/api/perms?invalid", []byte(`not json`))
+
+	ctx, marker := WithMarker(context.Background())
+	if _, ok := store.Load(ctx, "/api/sessions"); ok {
+		t.Fatal("load not cacheable url should fail")
+	}
+	if marker.Degraded() {
+		t.Fatal("marker should not be degraded")
+	}
+	body, ok := store.Load(ctx, "/api/perms")
+	if !ok || string(body) != `{"ok":true}` {
+		t.Fatalf("load cached response failed: %s", body)
+	}
+	if !marker.Degraded() {
+		t.Fatal("marker should be degraded after load cached response")
+	}
+}
+
+func TestVerifyUser(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), "secret", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := model.User{ID: "1", Username: "admin"}
+	if err = cache.SaveUser(user, "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.SaveUser(user, "", "ssh-ed25519 AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := cache.VerifyUser("admin", "password", ""); !ok || u.ID != "1" {
+		t.Fatal("verify password failed")
+	}
+	if _, ok := cache.VerifyUser("admin", "wrong", ""); ok {
+		t.Fatal("verify wrong password should fail")
+	}
+	if _, ok := cache.VerifyUser("admin", "", "ssh-ed25519 AAAA"); !ok {
+		t.Fatal("verify public key failed")
+	}
+	if _, ok := cache.VerifyUser("admin", "", "ssh-ed25519 BBBB"); ok {
+		t.Fatal("verify unknown public key should fail")
+	}
+
+	user.OTPLevel = 2
+	if err = cache.SaveUser(user, "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.VerifyUser("admin", "password", ""); ok {
+		t.Fatal("user with MFA should not be cached")
+	}
+}
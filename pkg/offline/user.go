@@ -0,0 +1,105 @@
+package offline
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+/*
+	用户认证缓存: 只保存密码的 PBKDF2 摘要和公钥指纹,
+	需要 MFA 或登录复核的用户不缓存, 保证降级时不会绕过二次认证
+*/
+
+const (
+	userKeyPrefix     = "user:"
+	passwordIteration = 100000
+	passwordKeyLen    = 32
+)
+
+type userCredential struct {
+	User         model.User `json:"user"`
+	Salt         []byte     `json:"salt,omitempty"`
+	PasswordHash []byte     `json:"password_hash,omitempty"`
+	PublicKeys   []string   `json:"public_keys,omitempty"`
+}
+
+func hashPassword(password string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(password), salt, passwordIteration, passwordKeyLen, sha256.New)
+}
+
+func publicKeyFingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(publicKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveUser 在用户通过 core 认证后保存凭据, 供 core 不可达时离线认证
+func (c *Cache) SaveUser(user model.User, password, publicKey string) error {
+	if user.OTPLevel > 0 {
+		c.DeleteUser(user.Username)
+		return nil
+	}
+	key := userKeyPrefix + user.Username
+	var cred userCredential
+	if !c.Load(key, &cred) || cred.User.ID != user.ID {
+		cred = userCredential{}
+	}
+	cred.User = user
+	if password != "" {
+		cred.Salt = make([]byte, 16)
+		if _, err := rand.Read(cred.Salt); err != nil {
+			return err
+		}
+		cred.PasswordHash = hashPassword(password, cred.Salt)
+	}
+	if publicKey != "" {
+		fingerprint := publicKeyFingerprint(publicKey)
+		found := false
+		for i := range cred.PublicKeys {
+			if cred.PublicKeys[i] == fingerprint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			cred.PublicKeys = append(cred.PublicKeys, fingerprint)
+		}
+	}
+	return c.Save(key, &cred)
+}
+
+// VerifyUser 使用缓存的凭据认证用户
+func (c *Cache) VerifyUser(username, password, publicKey string) (user model.User, ok bool) {
+	var cred userCredential
+	if !c.Load(userKeyPrefix+username, &cred) {
+		return user, false
+	}
+	switch {
+	case password != "":
+		if len(cred.PasswordHash) == 0 {
+			return user, false
+		}
+		ok = subtle.ConstantTimeCompare(hashPassword(password, cred.Salt), cred.PasswordHash) == 1
+	case publicKey != "":
+		fingerprint := publicKeyFingerprint(publicKey)
+		for i := range cred.PublicKeys {
+			if subtle.ConstantTimeCompare([]byte(cred.PublicKeys[i]), []byte(fingerprint)) == 1 {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return user, false
+	}
+	return cred.User, true
+}
+
+func (c *Cache) DeleteUser(username string) {
+	c.Delete(userKeyPrefix + username)
+}
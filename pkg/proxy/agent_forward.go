@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+// agentForwardingConn 是支持 agent 转发的用户连接, 目前只有 ssh 登录的用户连接
+type agentForwardingConn interface {
+	AgentRequested() bool
+	OpenAgentChannel() (io.ReadWriteCloser, error)
+}
+
+/*
+	agentForwardingEnabled agent 转发需要同时满足:
+	用户登录时请求了转发 (ssh -A), 系统用户开启了 agent 转发, 授权包含 agent_forwarding 动作
+*/
+
+func (s *Server) agentForwardingEnabled() bool {
+	if s.connOpts.ProtocolType != srvconn.ProtocolSSH {
+		return false
+	}
+	userConn, ok := s.UserConn.(agentForwardingConn)
+	if !ok || !userConn.AgentRequested() {
+		return false
+	}
+	return s.connOpts.systemUser.AgentForwarding && s.permActions.EnableAgentForwarding()
+}
+
+// newAgentForwarder 创建会话的 agent 转发, 每次签名都记录到会话的审计链
+func (s *Server) newAgentForwarder() *srvconn.AgentForwarder {
+	userConn := s.UserConn.(agentForwardingConn)
+	return srvconn.NewAgentForwarder(userConn.OpenAgentChannel, func(event srvconn.AgentSignEvent) {
+		fingerprint := gossh.FingerprintSHA256(event.Key)
+		content := map[string]string{
+			"user":        s.connOpts.user.String(),
+			"key":         fingerprint,
+			"key_type":    event.Key.Type(),
+			"flags":       fmt.Sprintf("%d", event.Flags),
+			"data_length": fmt.Sprintf("%d", event.DataLen),
+		}
+		if event.Err != nil {
+			content["error"] = event.Err.Error()
+			logger.Errorf("Session[%s] agent sign with key %s err: %s", s.ID, fingerprint, event.Err)
+		} else {
+			logger.Infof("Session[%s] agent sign with key %s", s.ID, fingerprint)
+		}
+		audit.RecordSessionEvent(s.ID, audit.EventAgentSign, content)
+	})
+}
+
+// disableAgentForwarding 会话被分享或监控时关闭 agent 转发, 避免其他人借用用户的密钥
+func (s *SwitchSession) disableAgentForwarding() {
+	forwarder := s.p.agentForwarder
+	if forwarder == nil || forwarder.Disabled() {
+		return
+	}
+	forwarder.Disable()
+	audit.RecordSessionEvent(s.ID, audit.EventAgentDisabled, map[string]string{"reason": "shared"})
+	lang := s.p.connOpts.getLang()
+	s.notify(lang.T("Session is shared or monitored, agent forwarding disabled"), "")
+	logger.Infof("Session[%s] is shared or monitored, agent forwarding disabled", s.ID)
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	命令的 write-ahead spool:
+	{DataFolderPath}/command_spool/{sid}.jsonl 按顺序保存会话的每条命令,
+	{sid}.offset 记录已经保存到命令存储的条数。
+	命令写入后不立即 fsync, 命令记录协程每次保存一批命令前 Sync 一次。
+	保存失败时命令记录协程不在内存中保留这些命令, 重试时从 offset 开始读取 spool。
+	会话的命令全部保存成功后删除这两个文件, 否则由 UploadRemainCommands 继续上传。
+*/
+
+const (
+	commandSpoolDirName   = "command_spool"
+	commandSpoolSuffix    = ".jsonl"
+	commandOffsetSuffix   = ".offset"
+	commandSpoolBatchSize = 100
+	commandSpoolMaxLine   = 16 * 1024 * 1024
+)
+
+// 正在记录命令的会话, 上传遗留命令时需要跳过
+var activeCommandSpools sync.Map
+
+func commandSpoolDir() string {
+	return filepath.Join(config.GetConf().DataFolderPath, commandSpoolDirName)
+}
+
+// CommandSpoolBacklog 返回已结束的会话遗留的 spool 数量, 即等待 UploadRemainCommands 上传的会话数
+func CommandSpoolBacklog() int {
+	files, _ := filepath.Glob(filepath.Join(commandSpoolDir(), "*"+commandSpoolSuffix))
+	count := 0
+	for i := range files {
+		sid := strings.TrimSuffix(filepath.Base(files[i]), commandSpoolSuffix)
+		if _, ok := activeCommandSpools.Load(sid); !ok {
+			count++
+		}
+	}
+	return count
+}
+
+type commandSpool struct {
+	sessionID  string
+	walPath    string
+	offsetPath string
+
+	// Append 在会话协程中调用, Sync、Ack 和 Close 在命令记录协程中调用
+	sync.Mutex
+	fd     *os.File
+	base   int // 打开时已有的行数, 之后追加的第 n 条命令在第 base+n 行
+	total  int
+	acked  int
+	broken bool
+	dirty  bool
+}
+
+func openCommandSpool(dir, sessionID string) (*commandSpool, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	s := commandSpool{
+		sessionID:  sessionID,
+		walPath:    filepath.Join(dir, sessionID+commandSpoolSuffix),
+		offsetPath: filepath.Join(dir, sessionID+commandOffsetSuffix),
+	}
+	activeCommandSpools.Store(sessionID, struct{}{})
+	// 文件已存在时(例如之前保存失败遗留的), 继续在后面追加
+	total, err := countSpoolLines(s.walPath)
+	if err != nil {
+		activeCommandSpools.Delete(sessionID)
+		return nil, err
+	}
+	fd, err := os.OpenFile(s.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		activeCommandSpools.Delete(sessionID)
+		return nil, err
+	}
+	s.fd = fd
+	s.base = total
+	s.total = total
+	s.acked = readSpoolOffset(s.offsetPath)
+	return &s, nil
+}
+
+// Append 命令写入 spool 之后才进入发送队列
+func (s *commandSpool) Append(cmd *model.Command) error {
+	data, err := json.Marshal(cmd)
+	s.Lock()
+	defer s.Unlock()
+	if s.broken || s.fd == nil {
+		return nil
+	}
+	if err != nil {
+		s.broken = true
+		return err
+	}
+	data = append(data, '\n')
+	if _, err = s.fd.Write(data); err != nil {
+		s.broken = true
+		return err
+	}
+	s.total++
+	s.dirty = true
+	return nil
+}
+
+// Sync 将上次 Sync 之后写入的命令刷到磁盘
+func (s *commandSpool) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.sync()
+}
+
+func (s *commandSpool) sync() error {
+	if s.broken || s.fd == nil || !s.dirty {
+		return nil
+	}
+	if err := s.fd.Sync(); err != nil {
+		s.broken = true
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Ack 记录已经保存成功的命令条数
+func (s *commandSpool) Ack(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.ackTo(s.acked + n)
+}
+
+func (s *commandSpool) ackTo(line int) {
+	// 写入失败后 spool 与发送队列不再对应, 不更新 offset, 剩余的命令由 UploadRemainCommands 重新上传
+	if s.broken {
+		return
+	}
+	s.acked = line
+	if err := writeSpoolOffset(s.offsetPath, s.acked); err != nil {
+		logger.Errorf("Session %s: write command spool offset err: %s", s.sessionID, err)
+	}
+}
+
+// status 返回已写入和已保存的行数, 以及 spool 是否与发送队列一致
+func (s *commandSpool) status() (total, acked int, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.total, s.acked, !s.broken && s.fd != nil
+}
+
+// save 从 offset 开始读取 spool 中未保存的命令并分批保存, 返回保存到的行数
+func (s *commandSpool) save(bulkSave func([]*model.Command) error) (int, error) {
+	if err := s.Sync(); err != nil {
+		return 0, err
+	}
+	total, acked, _ := s.status()
+	if acked >= total {
+		return acked, nil
+	}
+	err := saveSpoolLines(s.sessionID, s.walPath, acked, total, bulkSave, func(line int) error {
+		s.Lock()
+		defer s.Unlock()
+		s.ackTo(line)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (s *commandSpool) Close() {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.sync(); err != nil {
+		logger.Errorf("Session %s: sync command spool err: %s", s.sessionID, err)
+	}
+	_ = s.fd.Close()
+	s.fd = nil
+	if !s.broken && s.acked >= s.total {
+		_ = os.Remove(s.walPath)
+		_ = os.Remove(s.offsetPath)
+	} else {
+		logger.Infof("Session %s: %d commands remain in spool %s",
+			s.sessionID, s.total-s.acked, s.walPath)
+	}
+	activeCommandSpools.Delete(s.sessionID)
+}
+
+// UploadRemainCommands 上传 spool 中遗留的命令
+func UploadRemainCommands(cmdStorage CommandStorage) error {
+	return uploadRemainCommandsIn(cmdStorage, commandSpoolDir())
+}
+
+func uploadRemainCommandsIn(cmdStorage CommandStorage, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), commandSpoolSuffix) {
+			continue
+		}
+		sid := strings.TrimSuffix(entry.Name(), commandSpoolSuffix)
+		if _, ok := activeCommandSpools.Load(sid); ok {
+			continue
+		}
+		if err = uploadCommandSpool(cmdStorage, dir, sid); err != nil {
+			return err
+		}
+		logger.Infof("Upload remain commands of session %s success", sid)
+	}
+	return nil
+}
+
+func uploadCommandSpool(cmdStorage CommandStorage, dir, sid string) error {
+	walPath := filepath.Join(dir, sid+commandSpoolSuffix)
+	offsetPath := filepath.Join(dir, sid+commandOffsetSuffix)
+	err := saveSpoolLines(sid, walPath, readSpoolOffset(offsetPath), -1, cmdStorage.BulkSave, func(line int) error {
+		return writeSpoolOffset(offsetPath, line)
+	})
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(walPath)
+	_ = os.Remove(offsetPath)
+	return nil
+}
+
+/*
+	saveSpoolLines 分批保存 spool 中 (from, to] 行的命令, to 小于 0 时读到文件结尾,
+	每批保存成功后调用 ack 记录保存到的行数
+*/
+
+func saveSpoolLines(sid, walPath string, from, to int, bulkSave func([]*model.Command) error,
+	ack func(line int) error) error {
+	fd, err := os.Open(walPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	cmdList := make([]*model.Command, 0, commandSpoolBatchSize)
+	lineNo := from
+	save := func() error {
+		if len(cmdList) > 0 {
+			if err := bulkSave(cmdList); err != nil {
+				return err
+			}
+			cmdList = cmdList[:0]
+		}
+		return ack(lineNo)
+	}
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), commandSpoolMaxLine)
+	for line := 1; scanner.Scan(); line++ {
+		if line <= from {
+			continue
+		}
+		lineNo = line
+		var cmd model.Command
+		if err = json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			// 异常退出时最后一行可能不完整
+			logger.Errorf("Session %s: skip invalid spool line %d: %s", sid, line, err)
+		} else {
+			cmdList = append(cmdList, &cmd)
+		}
+		if len(cmdList) >= commandSpoolBatchSize {
+			if err = save(); err != nil {
+				return err
+			}
+		}
+		// 会话仍在追加命令, 只读取到 to 行
+		if to >= 0 && line >= to {
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return save()
+}
+
+func countSpoolLines(path string) (int, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer fd.Close()
+	var count int
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := fd.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				count++
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return count, nil
+}
+
+func readSpoolOffset(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	offset, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return offset
+}
+
+func writeSpoolOffset(path string, offset int) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strconv.Itoa(offset)), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+type fakeCommandStorage struct {
+	saved []*model.Command
+	err   error
+}
+
+func (f *fakeCommandStorage) BulkSave(commands []*model.Command) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.saved = append(f.saved, commands...)
+	return nil
+}
+
+func (f *fakeCommandStorage) TypeName() string {
+	return "fake"
+}
+
+func TestCommandSpool(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openCommandSpool(dir, "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{"ls", "pwd", "whoami"} {
+		if err = spool.Append(&model.Command{SessionID: "sid", Input: input}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spool.Ack(1)
+	fake := &fakeCommandStorage{}
+	// 会话还在记录时不上传
+	if err = uploadRemainCommandsIn(fake, dir); err != nil || len(fake.saved) != 0 {
+		t.Fatalf("active spool should be skipped: %v %v", err, fake.saved)
+	}
+	spool.Close()
+	if _, err = os.Stat(spool.walPath); err != nil {
+		t.Fatalf("unacked spool should be kept: %s", err)
+	}
+
+	fake.err = errors.New("storage down")
+	if err = uploadRemainCommandsIn(fake, dir); err == nil {
+		t.Fatal("expected upload error")
+	}
+	fake.err = nil
+	if err = uploadRemainCommandsIn(fake, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.saved) != 2 || fake.saved[0].Input != "pwd" || fake.saved[1].Input != "whoami" {
+		t.Fatalf("unexpected saved commands: %+v", fake.saved)
+	}
+	if _, err = os.Stat(spool.walPath); !os.IsNotExist(err) {
+		t.Fatalf("spool should be removed after upload: %v", err)
+	}
+}
+
+func TestCommandSpoolConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openCommandSpool(dir, "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 200
+	done := make(chan struct{})
+	// 会话协程追加命令, 命令记录协程同时 Sync 和 Ack
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			if err := spool.Append(&model.Command{SessionID: "sid", Input: "ls"}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	acked := 0
+	for acked < count {
+		if err = spool.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		spool.Lock()
+		n := spool.total - spool.acked
+		spool.Unlock()
+		spool.Ack(n)
+		acked += n
+	}
+	<-done
+	spool.Close()
+	if _, err = os.Stat(spool.walPath); !os.IsNotExist(err) {
+		t.Fatalf("acked spool should be removed: %v", err)
+	}
+	if err = spool.Append(&model.Command{SessionID: "sid", Input: "ls"}); err != nil {
+		t.Fatalf("append after close should be ignored: %s", err)
+	}
+}
+
+func TestCommandRecorderFlushFromSpool(t *testing.T) {
+	spool, err := openCommandSpool(t.TempDir(), "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	fake := &fakeCommandStorage{err: errors.New("storage down")}
+	c := CommandRecorder{sessionID: "sid", storage: fake, spool: spool}
+	var cmdList []*model.Command
+	for i, input := range []string{"ls", "pwd", "whoami"} {
+		cmd := &model.Command{SessionID: "sid", Input: input}
+		if err = spool.Append(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if c.spooled(i+1, false) {
+			t.Fatalf("command %d should be kept in memory", i+1)
+		}
+		cmdList = append(cmdList, cmd)
+	}
+	// 保存失败后命令只保留在 spool 中
+	cmdList, _, backlog, err := c.flush(cmdList, nil, false)
+	if err == nil || !backlog || len(cmdList) != 0 {
+		t.Fatalf("flush got err %v backlog %v memory %d", err, backlog, len(cmdList))
+	}
+	for i, input := range []string{"id", "date"} {
+		if err = spool.Append(&model.Command{SessionID: "sid", Input: input}); err != nil {
+			t.Fatal(err)
+		}
+		if !c.spooled(4+i, backlog) {
+			t.Fatalf("command %d should only be in spool during backlog", 4+i)
+		}
+	}
+	fake.err = nil
+	if _, _, backlog, err = c.flush(nil, nil, backlog); err != nil || backlog {
+		t.Fatalf("retry got err %v backlog %v", err, backlog)
+	}
+	var inputs []string
+	for _, cmd := range fake.saved {
+		inputs = append(inputs, cmd.Input)
+	}
+	if strings.Join(inputs, ",") != "ls,pwd,whoami,id,date" {
+		t.Fatalf("unexpected saved commands: %v", inputs)
+	}
+	// 已经从 spool 保存的命令不再重复保存
+	if !c.spooled(5, false) || c.spooled(6, false) {
+		t.Fatal("unexpected spooled state after retry")
+	}
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jumpserver/koko/pkg/config"
+	modelCommon "github.com/jumpserver/koko/pkg/jms-sdk-go/common"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/httplib"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/offline"
+)
+
+/*
+	降级会话的补报:
+	启用离线缓存后, 向 core 报告会话状态时如果 core 不可达, 会话的创建、连接结果和结束时间
+	保存到 {DataFolderPath}/degraded_sessions/{sid}.json, 之后该会话的状态都只写入这个文件,
+	core 恢复后由 ReconcileDegradedSessions 按顺序补报。
+*/
+
+const (
+	degradedSessionDirName = "degraded_sessions"
+	degradedSessionSuffix  = ".json"
+)
+
+// 还在写入记录的会话, 补报时需要跳过
+var activeDegradedSessions sync.Map
+
+func degradedSessionDir() string {
+	return filepath.Join(config.GetConf().DataFolderPath, degradedSessionDirName)
+}
+
+type degradedSessionRecord struct {
+	Session   model.Session        `json:"session"`
+	Created   bool                 `json:"created"`
+	IsSuccess *bool                `json:"is_success,omitempty"`
+	DateEnd   *modelCommon.UTCTime `json:"date_end,omitempty"`
+}
+
+func (r *degradedSessionRecord) path() string {
+	return filepath.Join(degradedSessionDir(), r.Session.ID+degradedSessionSuffix)
+}
+
+func (r *degradedSessionRecord) save() error {
+	if err := os.MkdirAll(degradedSessionDir(), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmpPath := r.path() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, r.path())
+}
+
+// sessionReporter 向 core 报告会话状态, core 不可达时改为写入本地记录
+type sessionReporter struct {
+	jmsService *service.JMService
+	session    *model.Session
+
+	lock    sync.Mutex
+	created bool
+	record  *degradedSessionRecord
+}
+
+func (r *sessionReporter) report(call func() error, update func(record *degradedSessionRecord)) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.record == nil {
+		err := call()
+		if err == nil || offline.Default() == nil || !httplib.IsUnreachable(err) {
+			return err
+		}
+		logger.Warnf("Core unreachable, record session %s state locally: %s", r.session.ID, err)
+		r.session.IsDegraded = true
+		r.record = &degradedSessionRecord{Session: *r.session, Created: r.created}
+		activeDegradedSessions.Store(r.session.ID, struct{}{})
+	}
+	update(r.record)
+	return r.record.save()
+}
+
+func (r *sessionReporter) Create() error {
+	r.session.DateStart = modelCommon.NewNowUTCTime()
+	return r.report(func() error {
+		if err := r.jmsService.CreateSession(*r.session); err != nil {
+			return err
+		}
+		r.created = true
+		return nil
+	}, func(record *degradedSessionRecord) {})
+}
+
+func (r *sessionReporter) Success() error {
+	return r.report(func() error {
+		return r.jmsService.SessionSuccess(r.session.ID)
+	}, func(record *degradedSessionRecord) {
+		success := true
+		record.IsSuccess = &success
+	})
+}
+
+func (r *sessionReporter) Failed(err error) error {
+	return r.report(func() error {
+		return r.jmsService.SessionFailed(r.session.ID, err)
+	}, func(record *degradedSessionRecord) {
+		success := false
+		record.IsSuccess = &success
+	})
+}
+
+func (r *sessionReporter) Disconnect() error {
+	defer activeDegradedSessions.Delete(r.session.ID)
+	return r.report(func() error {
+		return r.jmsService.SessionDisconnect(r.session.ID)
+	}, func(record *degradedSessionRecord) {
+		dateEnd := modelCommon.NewNowUTCTime()
+		record.DateEnd = &dateEnd
+	})
+}
+
+// DegradedSessionBacklog 返回等待补报的降级会话数量
+func DegradedSessionBacklog() int {
+	files, _ := filepath.Glob(filepath.Join(degradedSessionDir(), "*"+degradedSessionSuffix))
+	return len(files)
+}
+
+/*
+	ReconcileDegradedSessions 补报已结束的降级会话, 返回补报成功的会话 ID。
+	core 仍不可达时返回错误, 已经补报的步骤会写回记录, 避免重复创建会话
+*/
+
+func ReconcileDegradedSessions(jmsService *service.JMService) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(degradedSessionDir(), "*"+degradedSessionSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var sids []string
+	for _, path := range files {
+		sid := strings.TrimSuffix(filepath.Base(path), degradedSessionSuffix)
+		if _, ok := activeDegradedSessions.Load(sid); ok {
+			continue
+		}
+		if err = reconcileDegradedSession(jmsService, path); err != nil {
+			return sids, err
+		}
+		sids = append(sids, sid)
+	}
+	return sids, nil
+}
+
+func reconcileDegradedSession(jmsService *service.JMService, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var record degradedSessionRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		logger.Errorf("Invalid degraded session record %s: %s", path, err)
+		return os.Remove(path)
+	}
+	sid := record.Session.ID
+	if !record.Created {
+		if err = jmsService.CreateSession(record.Session); err != nil {
+			return err
+		}
+		record.Created = true
+		if err = record.save(); err != nil {
+			return err
+		}
+	}
+	if record.IsSuccess != nil {
+		if *record.IsSuccess {
+			err = jmsService.SessionSuccess(sid)
+		} else {
+			err = jmsService.SessionFailed(sid, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// koko 异常退出时没有结束时间, 使用记录最后的修改时间
+	dateEnd := modelCommon.NewUTCTime(info.ModTime())
+	if record.DateEnd != nil {
+		dateEnd = *record.DateEnd
+	}
+	if err = jmsService.SessionFinished(sid, dateEnd); err != nil {
+		return err
+	}
+	logger.Infof("Reconcile degraded session %s success", sid)
+	return os.Remove(path)
+}
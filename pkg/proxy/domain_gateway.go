@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -11,8 +12,10 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/hostkey"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/tracing"
 )
 
 type domainGateway struct {
@@ -24,6 +27,9 @@ type domainGateway struct {
 	selectedGateway *model.Gateway
 	ln              net.Listener
 
+	// 链路追踪的上下文, 网关探测记录为其中 span 的子 span
+	ctx context.Context
+
 	once sync.Once
 }
 
@@ -70,8 +76,8 @@ func (d *domainGateway) handlerConn(srcCon net.Conn) {
 var ErrNoAvailable = errors.New("no available domain")
 
 func (d *domainGateway) Start() (err error) {
-	if !d.getAvailableGateway() {
-		return ErrNoAvailable
+	if err = d.getAvailableGateway(); err != nil {
+		return err
 	}
 	d.ln, err = net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -87,8 +93,13 @@ func (d *domainGateway) GetListenAddr() *net.TCPAddr {
 	return d.ln.Addr().(*net.TCPAddr)
 }
 
-func (d *domainGateway) getAvailableGateway() bool {
+// getAvailableGateway 选择可用的网关, 网关的 host key 校验失败时返回具体原因
+func (d *domainGateway) getAvailableGateway() error {
+	traceCtx, span := tracing.Start(d.ctx, "gateway.select",
+		tracing.String("koko.domain", d.domain.Name))
+	defer span.End()
 	configTimeout := time.Duration(config.GetConf().SSHTimeout)
+	var hostKeyErr error
 	for i := range d.domain.Gateways {
 		gateway := d.domain.Gateways[i]
 		if gateway.Protocol == "ssh" {
@@ -107,27 +118,46 @@ func (d *domainGateway) getAvailableGateway() bool {
 					auths = append(auths, gossh.PublicKeys(signer))
 				}
 			}
+			var gatewayKeyErr error
+			hostKeyCallback := hostkey.HostKeyCallback("")
 			sshConfig := gossh.ClientConfig{
-				User:            gateway.Username,
-				Auth:            auths,
-				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
-				Timeout:         configTimeout * time.Second,
+				User: gateway.Username,
+				Auth: auths,
+				HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+					gatewayKeyErr = hostKeyCallback(hostname, remote, key)
+					return gatewayKeyErr
+				},
+				Timeout: configTimeout * time.Second,
 			}
 			addr := net.JoinHostPort(gateway.IP, strconv.Itoa(gateway.Port))
+			_, probeSpan := tracing.Start(traceCtx, "gateway.probe",
+				tracing.String("koko.gateway", gateway.Name),
+				tracing.String("net.peer.addr", addr))
 			sshClient, err := gossh.Dial("tcp", addr, &sshConfig)
+			probeSpan.RecordError(err)
+			probeSpan.End()
 			logger.Debugf("Domain %s try dial gateway %s", d.domain.Name, gateway.Name)
 			if err != nil {
 				logger.Errorf("Dial gateway %s err: %s ", gateway.Name, err)
+				if gatewayKeyErr != nil {
+					hostKeyErr = gatewayKeyErr
+				}
 				continue
 			}
 			logger.Infof("Domain %s use gateway %s", d.domain.Name, gateway.Name)
+			span.SetAttributes(tracing.String("koko.gateway", gateway.Name))
 			d.sshClient = sshClient
 			d.selectedGateway = &gateway
-			return true
+			return nil
 		}
 	}
 	logger.Errorf("Domain %s has no available gateway", d.domain.Name)
-	return false
+	if hostKeyErr != nil {
+		span.RecordError(hostKeyErr)
+		return hostKeyErr
+	}
+	span.RecordError(ErrNoAvailable)
+	return ErrNoAvailable
 }
 
 func (d *domainGateway) Stop() {
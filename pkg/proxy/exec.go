@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/audit"
+	modelCommon "github.com/jumpserver/koko/pkg/jms-sdk-go/common"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+// execExitCodeError koko 拒绝或无法执行命令时的退出码, 与 ssh 客户端连接失败的退出码一致
+const execExitCodeError = 255
+
+// fileTransfer 是 scp 或 rsync 在资产上执行的服务端命令
+type fileTransfer struct {
+	Operate string
+	Path    string
+}
+
+/*
+	parseFileTransfer 识别 scp 和 rsync 的服务端命令:
+	scp -t 接收文件为上传, scp -f 发送文件为下载;
+	rsync --server --sender 为下载, 没有 --sender 为上传
+*/
+
+func parseFileTransfer(command string) (*fileTransfer, bool) {
+	fields := strings.Fields(command)
+	if len(fields) < 2 {
+		return nil, false
+	}
+	var (
+		operate string
+		args    []string
+	)
+	switch path.Base(fields[0]) {
+	case "scp":
+		i := 1
+		for ; i < len(fields) && strings.HasPrefix(fields[i], "-"); i++ {
+			if fields[i] == "--" {
+				i++
+				break
+			}
+			flags := strings.TrimPrefix(fields[i], "-")
+			switch {
+			case strings.Contains(flags, "t"):
+				operate = model.OperateUpload
+			case strings.Contains(flags, "f"):
+				operate = model.OperateDownload
+			}
+		}
+		args = fields[i:]
+	case "rsync":
+		if fields[1] != "--server" {
+			return nil, false
+		}
+		operate = model.OperateUpload
+		i := 2
+		for ; i < len(fields) && strings.HasPrefix(fields[i], "-"); i++ {
+			if fields[i] == "--sender" {
+				operate = model.OperateDownload
+			}
+		}
+		// rsync 服务端参数之后是占位的 "." 和文件路径
+		if i < len(fields) && fields[i] == "." {
+			i++
+		}
+		args = fields[i:]
+	default:
+		return nil, false
+	}
+	if operate == "" {
+		return nil, false
+	}
+	filename := strings.Trim(strings.Join(args, " "), `'"`)
+	return &fileTransfer{Operate: operate, Path: filename}, true
+}
+
+/*
+	ProxyExec 在资产上执行非交互命令 (ssh user@asset@koko cmd, scp -O, rsync), 返回命令的退出码。
+	整个命令行按命令过滤规则校验, 非交互请求无法等待复核, 需要复核的命令和登录直接拒绝;
+	scp 和 rsync 的文件传输需要上传或下载权限, 并记录为 FTP 日志。
+	标准输出原样转发, koko 的提示写入 stderr, 避免破坏 scp 和 rsync 的协议
+*/
+
+func (s *Server) ProxyExec(command string, stderr io.Writer) int {
+	lang := s.connOpts.getLang()
+	if s.connOpts.ProtocolType != srvconn.ProtocolSSH || s.suFromSystemUserAuthInfo != nil {
+		writeExecError(stderr, lang.T("Exec request only supports ssh system user without su"))
+		return execExitCodeError
+	}
+	if s.systemUserAuthInfo.Username == "" {
+		writeExecError(stderr, lang.T("Get auth username failed"))
+		return execExitCodeError
+	}
+	confirmSrv := s.newLoginConfirmService(s.UserConn.Context())
+	needConfirm, err := confirmSrv.CheckIsNeedLoginConfirm()
+	if err != nil {
+		logger.Errorf("Conn[%s] validate login confirm api err: %s", s.UserConn.ID(), err)
+		writeExecError(stderr, lang.T("validate Login confirm err: Core Api failed"))
+		return execExitCodeError
+	}
+	if needConfirm {
+		writeExecError(stderr, lang.T("Need ticket confirm to login, please use an interactive session"))
+		return execExitCodeError
+	}
+
+	if err = s.CreateSessionCallback(); err != nil {
+		logger.Errorf("Conn[%s] submit session %s to core server err: %s", s.UserConn.ID(), s.ID, err)
+		writeExecError(stderr, lang.T("Connect with api server failed"))
+		return execExitCodeError
+	}
+	defer func() {
+		if err := s.DisConnectedCallback(); err != nil {
+			logger.Errorf("Conn[%s] update session %s err: %+v", s.UserConn.ID(), s.ID, err)
+		}
+	}()
+	asset, _ := s.getAssetInfo()
+	audit.RecordSessionEvent(s.ID, audit.EventSessionStart, map[string]string{
+		"user":        s.connOpts.user.String(),
+		"asset":       asset,
+		"system_user": s.systemUserAuthInfo.String(),
+		"protocol":    s.connOpts.ProtocolType,
+		"remote_addr": s.UserConn.RemoteAddr(),
+		"command":     command,
+	})
+	cmdRecorder := s.GetCommandRecorder()
+	defer func() {
+		audit.RecordSessionEvent(s.ID, audit.EventSessionEnd, map[string]string{})
+		cmdRecorder.End()
+	}()
+	recordCommand := func(riskLevel int64) {
+		input := command
+		if len(input) > 128 {
+			input = input[:128]
+		}
+		cmd := s.GenerateCommandItem(s.connOpts.user.String(), input, "", riskLevel, time.Now())
+		audit.RecordCommand(cmd)
+		cmdRecorder.Record(cmd)
+	}
+
+	if rule, ok := s.matchExecFilterRule(command); ok {
+		recordCommand(model.DangerLevel)
+		msg := fmt.Sprintf(lang.T("Command `%s` is forbidden"), command)
+		if rule.Action == model.ActionConfirm {
+			msg = lang.T("Command review is not currently supported")
+		}
+		writeExecError(stderr, msg)
+		logger.Infof("Conn[%s] exec command `%s` refused by filter rule %s", s.UserConn.ID(), command, rule.ID)
+		return execExitCodeError
+	}
+	transfer, isTransfer := parseFileTransfer(command)
+	if isTransfer && !s.allowFileTransfer(transfer) {
+		recordCommand(model.DangerLevel)
+		msg := lang.T("have no permission to upload file")
+		if transfer.Operate == model.OperateDownload {
+			msg = lang.T("have no permission to download file")
+		}
+		writeExecError(stderr, msg)
+		s.recordFileTransfer(transfer, false)
+		return execExitCodeError
+	}
+
+	sshClient, err := srvconn.NewSSHClient(s.getSSHClientOptions(s.UserConn.Context(), s.systemUserAuthInfo)...)
+	if err != nil {
+		logger.Errorf("Conn[%s] exec get ssh client err: %s", s.UserConn.ID(), err)
+		writeExecError(stderr, fmt.Sprintf("%s error: %s", s.connOpts.ConnectMsg(),
+			s.ConvertErrorToReadableMsg(err)))
+		if err2 := s.ConnectedFailedCallback(err); err2 != nil {
+			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
+		}
+		return execExitCodeError
+	}
+	defer sshClient.Close()
+	sess, err := sshClient.AcquireSession()
+	if err != nil {
+		logger.Errorf("SSH client(%s) start session err %s", sshClient, err)
+		writeExecError(stderr, s.ConvertErrorToReadableMsg(err))
+		if err2 := s.ConnectedFailedCallback(err); err2 != nil {
+			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
+		}
+		return execExitCodeError
+	}
+	defer sshClient.ReleaseSession(sess)
+	defer sess.Close()
+	if err2 := s.ConnectedSuccessCallback(); err2 != nil {
+		logger.Errorf("Conn[%s] update session %s err: %s", s.UserConn.ID(), s.ID, err2)
+	}
+	recordCommand(model.NormalLevel)
+
+	// 命令结束时不等待用户的标准输入结束, 与 sshd 的行为一致
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		writeExecError(stderr, err.Error())
+		return execExitCodeError
+	}
+	go func() {
+		_, _ = io.Copy(stdin, s.UserConn)
+		_ = stdin.Close()
+	}()
+	sess.Stdout = s.UserConn
+	sess.Stderr = stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.watchExec(sess, stderr, done)
+
+	logger.Infof("Conn[%s] session %s exec command `%s` on %s", s.UserConn.ID(), s.ID, command, sshClient)
+	exitCode := execExitCode(sess.Run(command))
+	if isTransfer {
+		s.recordFileTransfer(transfer, exitCode == 0)
+	}
+	logger.Infof("Conn[%s] session %s exec command end with exit code %d", s.UserConn.ID(), s.ID, exitCode)
+	return exitCode
+}
+
+// watchExec 用户断开或授权过期时结束命令
+func (s *Server) watchExec(sess *gossh.Session, stderr io.Writer, done <-chan struct{}) {
+	expireAfter := time.Until(time.Unix(s.expireInfo.ExpireAt, 0))
+	if expireAfter < 0 {
+		expireAfter = 0
+	}
+	timer := time.NewTimer(expireAfter)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-s.UserConn.Context().Done():
+	case <-timer.C:
+		lang := s.connOpts.getLang()
+		writeExecError(stderr, lang.T("Permission has expired, disconnect"))
+		logger.Infof("Conn[%s] session %s exec stop as permission has expired", s.UserConn.ID(), s.ID)
+	}
+	_ = sess.Close()
+}
+
+// matchExecFilterRule 返回拒绝或需要复核整个命令行的过滤规则
+func (s *Server) matchExecFilterRule(command string) (model.SystemUserFilterRule, bool) {
+	for i := range s.filterRules {
+		rule := s.filterRules[i]
+		action, _ := rule.Match(command)
+		switch action {
+		case model.ActionAllow:
+			return rule, false
+		case model.ActionDeny, model.ActionConfirm:
+			return rule, true
+		}
+	}
+	return model.SystemUserFilterRule{}, false
+}
+
+func (s *Server) allowFileTransfer(transfer *fileTransfer) bool {
+	switch transfer.Operate {
+	case model.OperateUpload:
+		return s.permActions.EnableUpload()
+	case model.OperateDownload:
+		return s.permActions.EnableDownload()
+	}
+	return false
+}
+
+func (s *Server) recordFileTransfer(transfer *fileTransfer, isSuccess bool) {
+	data := model.FTPLog{
+		User:       s.connOpts.user.String(),
+		Hostname:   s.connOpts.asset.String(),
+		OrgID:      s.connOpts.asset.OrgID,
+		SystemUser: s.connOpts.systemUser.String(),
+		RemoteAddr: s.UserConn.RemoteAddr(),
+		Operate:    transfer.Operate,
+		Path:       transfer.Path,
+		DateStart:  modelCommon.NewNowUTCTime(),
+		IsSuccess:  isSuccess,
+	}
+	if err := s.jmsService.CreateFileOperationLog(data); err != nil {
+		logger.Errorf("Conn[%s] session %s create ftp log err: %s", s.UserConn.ID(), s.ID, err)
+	}
+}
+
+// execExitCode 返回命令的退出码, 命令被信号结束或连接断开时返回 255
+func execExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *gossh.ExitError
+	if errors.As(err, &exitErr) && exitErr.Signal() == "" {
+		return exitErr.ExitStatus()
+	}
+	logger.Debugf("Exec command end err: %s", err)
+	return execExitCodeError
+}
+
+func writeExecError(stderr io.Writer, msg string) {
+	_, _ = io.WriteString(stderr, msg+"\r\n")
+}
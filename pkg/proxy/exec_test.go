@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+func TestParseFileTransfer(t *testing.T) {
+	tests := []struct {
+		command    string
+		isTransfer bool
+		operate    string
+		path       string
+	}{
+		{"scp -t /tmp/a.txt", true, model.OperateUpload, "/tmp/a.txt"},
+		{"scp -r -d -t -- /tmp/dir", true, model.OperateUpload, "/tmp/dir"},
+		{"/usr/bin/scp -f '/var/log/messages'", true, model.OperateDownload, "/var/log/messages"},
+		{"scp -pf data.tar.gz", true, model.OperateDownload, "data.tar.gz"},
+		{"rsync --server -vlogDtpre.iLsfxC . /tmp/dst/", true, model.OperateUpload, "/tmp/dst/"},
+		{"rsync --server --sender -vlogDtpre.iLsfxC . /etc/hosts", true, model.OperateDownload, "/etc/hosts"},
+		{"rsync -av /tmp/a /tmp/b", false, "", ""},
+		{"scp -v", false, "", ""},
+		{"ls -al /tmp", false, "", ""},
+		{"scp", false, "", ""},
+	}
+	for i := range tests {
+		transfer, ok := parseFileTransfer(tests[i].command)
+		if ok != tests[i].isTransfer {
+			t.Fatalf("parse %q got transfer %v, want %v", tests[i].command, ok, tests[i].isTransfer)
+		}
+		if !ok {
+			continue
+		}
+		if transfer.Operate != tests[i].operate || transfer.Path != tests[i].path {
+			t.Fatalf("parse %q got %+v, want %s %s", tests[i].command,
+				transfer, tests[i].operate, tests[i].path)
+		}
+	}
+}
+
+func TestServer_MatchExecFilterRule(t *testing.T) {
+	// 规则已按优先级排序, 先匹配到的允许规则优先于之后的拒绝规则
+	s := &Server{filterRules: []model.SystemUserFilterRule{
+		{ID: "allow-ls", RePattern: `\bls\b`, Action: model.ActionAllow},
+		{ID: "deny-rm", RePattern: `\brm\b`, Action: model.ActionDeny},
+		{ID: "confirm-reboot", RePattern: `\breboot\b`, Action: model.ActionConfirm},
+		{ID: "deny-all", RePattern: `.*`, Action: model.ActionDeny},
+	}}
+	tests := []struct {
+		command string
+		ruleID  string
+		reject  bool
+	}{
+		{"ls -al /tmp", "allow-ls", false},
+		{"ls /tmp; rm -rf /tmp/a", "allow-ls", false},
+		{"rm -rf /tmp/a", "deny-rm", true},
+		{"reboot", "confirm-reboot", true},
+		{"whoami", "deny-all", true},
+	}
+	for i := range tests {
+		rule, reject := s.matchExecFilterRule(tests[i].command)
+		if rule.ID != tests[i].ruleID || reject != tests[i].reject {
+			t.Fatalf("match %q got rule %q reject %v, want %q %v", tests[i].command,
+				rule.ID, reject, tests[i].ruleID, tests[i].reject)
+		}
+	}
+	if _, reject := (&Server{}).matchExecFilterRule("rm -rf /"); reject {
+		t.Fatal("no filter rules should not reject")
+	}
+}
+
+// runExitCommand 在本地 SSH 服务上执行命令, 服务端以命令指定的退出码结束会话
+func runExitCommand(t *testing.T, command string) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &ssh.Server{Handler: func(sess ssh.Session) {
+		switch sess.RawCommand() {
+		case "close":
+			_ = sess.Close()
+		default:
+			code, _ := strconv.Atoi(sess.RawCommand())
+			_ = sess.Exit(code)
+		}
+	}}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+	client, err := gossh.Dial("tcp", ln.Addr().String(), &gossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	return sess.Run(command)
+}
+
+func TestExecExitCode(t *testing.T) {
+	tests := []struct {
+		command string
+		code    int
+	}{
+		{"0", 0},
+		{"3", 3},
+		{"127", 127},
+		{"close", execExitCodeError},
+	}
+	for i := range tests {
+		err := runExitCommand(t, tests[i].command)
+		if code := execExitCode(err); code != tests[i].code {
+			t.Fatalf("command %q err %v got exit code %d, want %d", tests[i].command,
+				err, code, tests[i].code)
+		}
+	}
+	if code := execExitCode(io.EOF); code != execExitCodeError {
+		t.Fatalf("io.EOF got exit code %d, want %d", code, execExitCodeError)
+	}
+}
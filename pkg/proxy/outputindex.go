@@ -0,0 +1,399 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/envelope"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	录像输出的全文索引:
+	录制时去掉终端控制字符, 按行保存到 {DataFolderPath}/replay_index/{date}/{sid}.txt,
+	每行的格式为 "{offset}\t{text}", offset 是该行输出相对录像开始的秒数,
+	可以直接定位到 asciinema 录像中的时间点。
+	加密录像的索引使用会话的数据密钥加密, 密钥文件 {sid}.key.json 和索引保存在同一目录,
+	搜索时使用主密钥解密; 加密索引在会话结束写入完成后才能搜索到。
+*/
+
+const (
+	replayIndexDirName = "replay_index"
+	replayIndexSuffix  = ".txt"
+
+	maxIndexLineLength = 4096
+)
+
+func ReplayIndexDir() string {
+	return filepath.Join(config.GetConf().DataFolderPath, replayIndexDirName)
+}
+
+const (
+	indexStateGround = iota
+	indexStateEscape
+	indexStateCSI
+	indexStateOSC
+	indexStateCharset
+)
+
+// newOutputIndexer dataKey 不为空时加密索引, keyInfo 为录像的密钥文件内容
+func newOutputIndexer(dir, date, sid string, dataKey, keyInfo []byte) (*outputIndexer, error) {
+	dateDir := filepath.Join(dir, date)
+	if err := common.EnsureDirExist(dateDir); err != nil {
+		return nil, err
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if dataKey != nil {
+		if err := ioutil.WriteFile(filepath.Join(dateDir, ReplayKeyFilename(sid)), keyInfo, 0600); err != nil {
+			return nil, err
+		}
+		// 每次录制都使用新的数据密钥, 不能追加到之前的加密流
+		flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	fd, err := os.OpenFile(filepath.Join(dateDir, sid+replayIndexSuffix), flag, 0640)
+	if err != nil {
+		return nil, err
+	}
+	indexer := outputIndexer{fd: fd}
+	var w io.Writer = fd
+	if dataKey != nil {
+		if indexer.sealer, err = envelope.NewWriter(fd, dataKey); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		w = indexer.sealer
+	}
+	indexer.writer = bufio.NewWriter(w)
+	return &indexer, nil
+}
+
+type outputIndexer struct {
+	fd     *os.File
+	sealer *envelope.Writer
+	writer *bufio.Writer
+
+	line      []rune
+	col       int
+	lineStart float64
+
+	state   int
+	params  []byte
+	escape  bool
+	utf8Buf []byte
+}
+
+// Write 解析一段输出, ts 为输出相对录像开始的秒数
+func (o *outputIndexer) Write(ts float64, p []byte) {
+	data := p
+	if len(o.utf8Buf) > 0 {
+		data = append(o.utf8Buf, p...)
+		o.utf8Buf = nil
+	}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(data) {
+			o.utf8Buf = append(o.utf8Buf[:0], data...)
+			break
+		}
+		data = data[size:]
+		o.handleRune(ts, r)
+	}
+	if err := o.writer.Flush(); err != nil {
+		logger.Errorf("Write replay index err: %s", err)
+	}
+}
+
+func (o *outputIndexer) handleRune(ts float64, r rune) {
+	switch o.state {
+	case indexStateEscape:
+		o.state = indexStateGround
+		switch r {
+		case '[':
+			o.state = indexStateCSI
+			o.params = o.params[:0]
+		case ']', 'P', 'X', '^', '_':
+			o.state = indexStateOSC
+		case '(', ')', '*', '+', '#', '%':
+			o.state = indexStateCharset
+		case 'D', 'E', 'M':
+			o.emit()
+		}
+		return
+	case indexStateCSI:
+		if r >= 0x20 && r <= 0x3f {
+			o.params = append(o.params, byte(r))
+			return
+		}
+		o.state = indexStateGround
+		o.handleCSI(r)
+		return
+	case indexStateOSC:
+		switch {
+		case r == 0x07:
+			o.state = indexStateGround
+		case r == 0x1b:
+			o.escape = true
+		case o.escape:
+			o.escape = false
+			if r == '\\' {
+				o.state = indexStateGround
+			}
+		}
+		return
+	case indexStateCharset:
+		o.state = indexStateGround
+		return
+	}
+	switch r {
+	case 0x1b:
+		o.state = indexStateEscape
+	case '\r':
+		o.col = 0
+	case '\n', '\v', '\f':
+		o.emit()
+	case '\b':
+		if o.col > 0 {
+			o.col--
+		}
+	case '\t':
+		o.put(ts, ' ')
+	default:
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+			return
+		}
+		o.put(ts, r)
+	}
+}
+
+func (o *outputIndexer) handleCSI(r rune) {
+	n, _ := strconv.Atoi(strings.TrimLeft(string(o.params), "?"))
+	switch r {
+	case 'K':
+		switch n {
+		case 0:
+			if o.col < len(o.line) {
+				o.line = o.line[:o.col]
+			}
+		case 2:
+			o.line = o.line[:0]
+		}
+	case 'C':
+		o.col += maxInt(n, 1)
+	case 'D':
+		o.col = maxInt(o.col-maxInt(n, 1), 0)
+	case 'G':
+		o.col = maxInt(n-1, 0)
+	case 'P':
+		if o.col < len(o.line) {
+			end := minInt(o.col+maxInt(n, 1), len(o.line))
+			o.line = append(o.line[:o.col], o.line[end:]...)
+		}
+	case 'H', 'f', 'd', 'A', 'B', 'J':
+		// 光标跳到其他行, 如 vim、top 等全屏程序
+		o.emit()
+	}
+}
+
+func (o *outputIndexer) put(ts float64, r rune) {
+	if len(o.line) == 0 {
+		o.lineStart = ts
+	}
+	for len(o.line) < o.col {
+		o.line = append(o.line, ' ')
+	}
+	if o.col < len(o.line) {
+		o.line[o.col] = r
+	} else {
+		o.line = append(o.line, r)
+	}
+	o.col++
+	if len(o.line) >= maxIndexLineLength {
+		o.emit()
+	}
+}
+
+func (o *outputIndexer) emit() {
+	text := strings.TrimSpace(string(o.line))
+	o.line = o.line[:0]
+	o.col = 0
+	if text == "" {
+		return
+	}
+	_, _ = fmt.Fprintf(o.writer, "%.3f\t%s\n", o.lineStart, text)
+}
+
+func (o *outputIndexer) Close() {
+	o.emit()
+	_ = o.writer.Flush()
+	if o.sealer != nil {
+		_ = o.sealer.Close()
+	}
+	_ = o.fd.Close()
+}
+
+type OutputSearchOption struct {
+	Keyword   string
+	Regexp    bool
+	SessionID string
+	DateFrom  time.Time
+	DateTo    time.Time
+	Limit     int
+}
+
+type OutputMatch struct {
+	Offset float64 `json:"offset"`
+	Text   string  `json:"text"`
+}
+
+type OutputSearchResult struct {
+	SessionID string        `json:"session_id"`
+	Date      string        `json:"date"`
+	Matches   []OutputMatch `json:"matches"`
+}
+
+// SearchReplayOutput 在录像输出索引中搜索, 按日期从新到旧返回最多 Limit 条匹配
+func SearchReplayOutput(opt OutputSearchOption) ([]OutputSearchResult, error) {
+	return searchReplayOutput(ReplayIndexDir(), opt)
+}
+
+func searchReplayOutput(dir string, opt OutputSearchOption) ([]OutputSearchResult, error) {
+	match, err := newOutputMatcher(opt.Keyword, opt.Regexp)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Limit <= 0 {
+		opt.Limit = 200
+	}
+	dateDirs, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Slice(dateDirs, func(i, j int) bool {
+		return dateDirs[i].Name() > dateDirs[j].Name()
+	})
+	results := make([]OutputSearchResult, 0, 10)
+	count := 0
+	for _, dateDir := range dateDirs {
+		date, err := time.Parse(dateTimeFormat, dateDir.Name())
+		if !dateDir.IsDir() || err != nil {
+			continue
+		}
+		if (!opt.DateFrom.IsZero() && date.Before(opt.DateFrom)) ||
+			(!opt.DateTo.IsZero() && date.After(opt.DateTo)) {
+			continue
+		}
+		pattern := "*" + replayIndexSuffix
+		if opt.SessionID != "" {
+			pattern = opt.SessionID + replayIndexSuffix
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, dateDir.Name(), pattern))
+		sort.Strings(files)
+		for _, file := range files {
+			matches, err := searchIndexFile(file, match, opt.Limit-count)
+			if err != nil {
+				logger.Errorf("Search replay index %s err: %s", file, err)
+				continue
+			}
+			if len(matches) == 0 {
+				continue
+			}
+			results = append(results, OutputSearchResult{
+				SessionID: strings.TrimSuffix(filepath.Base(file), replayIndexSuffix),
+				Date:      dateDir.Name(),
+				Matches:   matches,
+			})
+			if count += len(matches); count >= opt.Limit {
+				return results, nil
+			}
+		}
+	}
+	return results, nil
+}
+
+func newOutputMatcher(keyword string, isRegexp bool) (func(string) bool, error) {
+	if keyword == "" {
+		return nil, fmt.Errorf("empty search keyword")
+	}
+	if isRegexp {
+		re, err := regexp.Compile(keyword)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	keyword = strings.ToLower(keyword)
+	return func(text string) bool {
+		return strings.Contains(strings.ToLower(text), keyword)
+	}, nil
+}
+
+func searchIndexFile(path string, match func(string) bool, limit int) ([]OutputMatch, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var r io.Reader = fd
+	sid := strings.TrimSuffix(filepath.Base(path), replayIndexSuffix)
+	dataKey, err := LoadReplayKey(filepath.Dir(path), sid)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey != nil {
+		// 正在录制的会话还没有写入结束帧
+		if _, ok := GetSessionById(sid); ok {
+			r, err = envelope.NewRecoveryReader(fd, dataKey)
+		} else {
+			r, err = envelope.NewReader(fd, dataKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var matches []OutputMatch
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(matches) < limit {
+		line := scanner.Text()
+		index := strings.IndexByte(line, '\t')
+		if index < 0 {
+			continue
+		}
+		text := line[index+1:]
+		if !match(text) {
+			continue
+		}
+		offset, _ := strconv.ParseFloat(line[:index], 64)
+		matches = append(matches, OutputMatch{Offset: offset, Text: text})
+	}
+	return matches, scanner.Err()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/envelope"
+)
+
+func TestOutputIndexer(t *testing.T) {
+	dir := t.TempDir()
+	indexer, err := newOutputIndexer(dir, "2021-01-02", "sid", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer.Write(0.5, []byte("$ cat secret.txt\r\n\x1b[01;31mpass"))
+	indexer.Write(1.25, []byte("word=abc\x1b[0m\r\nxxx\rAPI_KEY=\xe5\xaf"))
+	indexer.Write(2, []byte("\x86\xe9\x92\xa5\x1b[K\r\n"))
+	indexer.Close()
+
+	tests := []struct {
+		opt     OutputSearchOption
+		offsets []float64
+		texts   []string
+	}{
+		{
+			opt:     OutputSearchOption{Keyword: "PASSWORD"},
+			offsets: []float64{0.5},
+			texts:   []string{"password=abc"},
+		},
+		{
+			opt:     OutputSearchOption{Keyword: `^API_KEY=\S+$`, Regexp: true},
+			offsets: []float64{1.25},
+			texts:   []string{"API_KEY=密钥"},
+		},
+		{
+			opt: OutputSearchOption{Keyword: "secret", SessionID: "other"},
+		},
+	}
+	for _, tt := range tests {
+		results, err := searchReplayOutput(dir, tt.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.texts) == 0 {
+			if len(results) != 0 {
+				t.Errorf("%q: expected no result, got %+v", tt.opt.Keyword, results)
+			}
+			continue
+		}
+		if len(results) != 1 || results[0].SessionID != "sid" || results[0].Date != "2021-01-02" {
+			t.Fatalf("%q: unexpected results %+v", tt.opt.Keyword, results)
+		}
+		for i, match := range results[0].Matches {
+			if match.Offset != tt.offsets[i] || match.Text != tt.texts[i] {
+				t.Errorf("%q: expected %v %q, got %+v", tt.opt.Keyword, tt.offsets[i], tt.texts[i], match)
+			}
+		}
+	}
+}
+
+func TestOutputIndexerEncrypted(t *testing.T) {
+	wrapper, err := envelope.NewLocalKeyWrapper(filepath.Join(t.TempDir(), "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Setup(wrapper)
+	defer envelope.Setup(nil)
+
+	dir := t.TempDir()
+	dataKey, keyInfo, err := newReplayKey(t.TempDir(), "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer, err := newOutputIndexer(dir, "2021-01-02", "sid", dataKey, keyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer.Write(0.5, []byte("password=abc\r\n"))
+	indexer.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "2021-01-02", "sid"+replayIndexSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("password")) {
+		t.Fatal("encrypted index contains plain text")
+	}
+	results, err := searchReplayOutput(dir, OutputSearchOption{Keyword: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Matches) != 1 || results[0].Matches[0].Text != "password=abc" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+const (
+	// 大段输出末尾不完整的单词暂存到下一段输出再脱敏, 避免敏感数据被分在两段中
+	maskHoldMinChunk = 128
+	maskHoldMaxBytes = 256
+	maskFlushDelay   = 20 * time.Millisecond
+
+	maskCommandPrefix = "[output masked]"
+)
+
+func newOutputMasker(rules []model.OutputMaskRule) *outputMasker {
+	validRules := make([]model.OutputMaskRule, 0, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		if rule.Pattern() == nil {
+			continue
+		}
+		validRules = append(validRules, rule)
+	}
+	if len(validRules) == 0 {
+		return nil
+	}
+	return &outputMasker{rules: validRules, counts: make(map[string]int)}
+}
+
+type outputMasker struct {
+	rules   []model.OutputMaskRule
+	pending []byte
+	counts  map[string]int
+}
+
+// Mask 脱敏一段输出, 末尾可能不完整的内容暂存, 由 Flush 或下一段输出带出
+func (m *outputMasker) Mask(p []byte) []byte {
+	data := p
+	if len(m.pending) > 0 {
+		data = append(m.pending, p...)
+		m.pending = nil
+	}
+	if cut := holdIndex(data); cut < len(data) {
+		m.pending = append(m.pending, data[cut:]...)
+		data = data[:cut]
+	}
+	return m.mask(data)
+}
+
+// Flush 返回暂存的输出
+func (m *outputMasker) Flush() []byte {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	data := m.pending
+	m.pending = nil
+	return m.mask(data)
+}
+
+func (m *outputMasker) HasPending() bool {
+	return len(m.pending) > 0
+}
+
+func (m *outputMasker) mask(data []byte) []byte {
+	for i := range m.rules {
+		var count int
+		if data, count = m.rules[i].Mask(data); count > 0 {
+			m.counts[m.rules[i].Name] += count
+		}
+	}
+	return data
+}
+
+// PopCounts 返回并清空各规则的脱敏次数
+func (m *outputMasker) PopCounts() map[string]int {
+	if len(m.counts) == 0 {
+		return nil
+	}
+	counts := m.counts
+	m.counts = make(map[string]int)
+	return counts
+}
+
+/*
+	holdIndex 返回需要暂存的起始位置:
+	只暂存大段输出末尾不以空白或控制字符结束的部分, 交互输入的回显不受影响
+*/
+
+func holdIndex(data []byte) int {
+	if len(data) < maskHoldMinChunk {
+		return len(data)
+	}
+	index := bytes.LastIndexFunc(data, func(r rune) bool {
+		return r <= ' ' || r == 0x7f
+	})
+	if len(data)-index-1 > maskHoldMaxBytes {
+		return len(data)
+	}
+	return index + 1
+}
+
+func maskEventCommands(counts map[string]int, user CurrentActiveUser) []*ExecutedCommand {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	cmds := make([]*ExecutedCommand, 0, len(names))
+	for _, name := range names {
+		ruleName := name
+		if ruleName == "" {
+			ruleName = "unnamed"
+		}
+		cmds = append(cmds, &ExecutedCommand{
+			Command:     fmt.Sprintf("%s %s", maskCommandPrefix, ruleName),
+			Output:      fmt.Sprintf("%d matches redacted", counts[name]),
+			CreatedDate: now,
+			RiskLevel:   model.LessRiskFlag,
+			User:        user,
+		})
+	}
+	return cmds
+}
@@ -63,6 +63,7 @@ type Parser struct {
 	command         string
 	output          string
 	cmdCreateDate   time.Time
+	cmdUser         CurrentActiveUser // 输入命令的用户, 共享会话交接键盘后不会记录为下一个输入的用户
 	cmdInputParser  *CmdParser
 	cmdOutputParser *CmdParser
 
@@ -80,6 +81,27 @@ type Parser struct {
 	i18nLang string
 
 	platform *model.Platform
+
+	// 内置客户端直接回调执行的语句, 不再从终端回显中解析命令
+	statementMode bool
+
+	cmdRecordLock   sync.Mutex
+	cmdRecordClosed bool
+
+	// psql 从终端解析的输入需要拼接为完整的语句再匹配过滤规则
+	stmtSplitter *srvconn.SQLSplitter
+
+	// Redis 会话中加载过的脚本, 用于检查 EVALSHA 执行的命令
+	redisScripts redisScriptCache
+
+	// 服务器输出脱敏, 没有配置规则时为 nil
+	outputMasker *outputMasker
+
+	// 会话被管理员暂停或设置只读时返回 true, 此时丢弃用户输入
+	inputLocked func() bool
+
+	// 处理管理员通过会话房间发来的冻结、解冻和提示事件
+	controlHandler func(msg *exchange.RoomMessage)
 }
 
 func (p *Parser) initial() {
@@ -88,6 +110,21 @@ func (p *Parser) initial() {
 	p.cmdOutputParser = NewCmdParser(p.id, CommandOutputParserName)
 	p.closed = make(chan struct{})
 	p.cmdRecordChan = make(chan *ExecutedCommand, 1024)
+	if p.protocolType == srvconn.ProtocolPostgreSQL {
+		p.stmtSplitter = &srvconn.SQLSplitter{PostgreSQLDialect: true}
+	}
+}
+
+func (p *Parser) SetInputLocked(fn func() bool) {
+	p.inputLocked = fn
+}
+
+func (p *Parser) SetControlHandler(fn func(msg *exchange.RoomMessage)) {
+	p.controlHandler = fn
+}
+
+func (p *Parser) isInputLocked() bool {
+	return p.inputLocked != nil && p.inputLocked()
 }
 
 // ParseStream 解析数据流
@@ -95,11 +132,15 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 	p.userOutputChan = make(chan []byte, 1)
 	p.srvOutputChan = make(chan []byte, 1)
 	logger.Infof("Session %s: Parser start", p.id)
+	maskFlushTimer := time.NewTimer(maskFlushDelay)
+	maskFlushTimer.Stop()
 	go func() {
 		defer func() {
+			maskFlushTimer.Stop()
 			// 会话结束，结算命令结果
 			p.sendCommandRecord()
-			close(p.cmdRecordChan)
+			p.sendMaskRecords()
+			p.closeCmdRecordChan()
 			close(p.userOutputChan)
 			close(p.srvOutputChan)
 			p.zmodemParser.Cleanup()
@@ -117,9 +158,14 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 				switch msg.Event {
 				case exchange.DataEvent:
 					b = msg.Body
+				case exchange.FreezeEvent, exchange.UnFreezeEvent, exchange.NoticeEvent:
+					if p.controlHandler != nil {
+						p.controlHandler(msg)
+					}
+					continue
 				}
 				p.UpdateActiveUser(msg)
-				if len(b) == 0 {
+				if len(b) == 0 || p.isInputLocked() {
 					continue
 				}
 				b = p.ParseUserInput(b)
@@ -134,12 +180,29 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 					return
 				}
 				b = p.ParseServerOutput(b)
+				if p.outputMasker != nil {
+					if p.hasPendingOutput() {
+						maskFlushTimer.Reset(maskFlushDelay)
+					}
+					if len(b) == 0 {
+						continue
+					}
+				}
+				select {
+				case <-p.closed:
+					return
+				case p.srvOutputChan <- b:
+				}
+			case <-maskFlushTimer.C:
+				b := p.flushPendingOutput()
+				if len(b) == 0 {
+					continue
+				}
 				select {
 				case <-p.closed:
 					return
 				case p.srvOutputChan <- b:
 				}
-
 			}
 		}
 	}()
@@ -190,9 +253,22 @@ func (p *Parser) parseInputState(b []byte) []byte {
 		}
 		return b
 	}
+	if p.statementMode {
+		// 内置客户端等待复核时丢弃用户输入
+		if p.confirmStatus.InRunning() {
+			if p.confirmStatus.IsNeedCancel(b) {
+				logger.Infof("Session %s: user cancel confirm status", p.id)
+			}
+			return nil
+		}
+		return b
+	}
 	if !p.IsNeedParse() {
 		return b
 	}
+	if p.stmtSplitter != nil && bytes.IndexByte(b, CharCTRLC) >= 0 {
+		p.resetStatementSplitter()
+	}
 
 	if p.confirmStatus.InRunning() {
 		if p.confirmStatus.IsNeedCancel(b) {
@@ -258,7 +334,7 @@ func (p *Parser) parseInputState(b []byte) []byte {
 		p.inputState = false
 		// 用户输入了Enter，开始结算命令
 		p.parseCmdInput()
-		if rule, cmd, ok := p.IsMatchCommandRule(p.command); ok {
+		if rule, cmd, ok := p.matchInputCommand(); ok {
 			switch rule.Action {
 			case model.ActionDeny:
 				p.forbiddenCommand(cmd)
@@ -316,7 +392,7 @@ func (p *Parser) forbiddenCommand(cmd string) {
 		Output:      fbdMsg,
 		CreatedDate: p.cmdCreateDate,
 		RiskLevel:   model.HighRiskFlag,
-		User:        p.currentActiveUser}
+		User:        p.cmdUser}
 	p.command = ""
 	p.output = ""
 	p.userOutputChan <- p.breakInputPacket()
@@ -331,6 +407,7 @@ func (p *Parser) parseCmdInput() {
 		p.command = commands[len(commands)-1]
 	}
 	p.cmdCreateDate = time.Now()
+	p.cmdUser = p.getCurrentActiveUser()
 }
 
 // parseCmdOutput 解析命令输出
@@ -406,12 +483,59 @@ func (p *Parser) splitCmdStream(b []byte) []byte {
 func (p *Parser) ParseServerOutput(b []byte) []byte {
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	b = p.maskServerOutput(b)
+	if p.statementMode || len(b) == 0 {
+		return b
+	}
+	return p.splitCmdStream(b)
+}
+
+// maskServerOutput 脱敏服务器输出, zmodem 传输文件时不处理
+func (p *Parser) maskServerOutput(b []byte) []byte {
+	if p.outputMasker == nil {
+		return b
+	}
+	if p.zmodemParser.IsStartSession() {
+		if pending := p.outputMasker.Flush(); len(pending) > 0 {
+			return append(pending, b...)
+		}
+		return b
+	}
+	return p.outputMasker.Mask(b)
+}
+
+func (p *Parser) hasPendingOutput() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.outputMasker.HasPending()
+}
+
+// flushPendingOutput 输出暂存的服务器输出
+func (p *Parser) flushPendingOutput() []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b := p.outputMasker.Flush()
+	if p.statementMode || len(b) == 0 {
+		return b
+	}
 	return p.splitCmdStream(b)
 }
 
+// matchInputCommand 匹配从终端解析出的命令, psql 需要等语句完整后再按语句匹配
+func (p *Parser) matchInputCommand() (model.SystemUserFilterRule, string, bool) {
+	if stmt, ok := p.feedStatementLine(p.command); ok {
+		return p.IsMatchStatementRule(stmt)
+	}
+	return p.IsMatchCommandRule(p.command)
+}
+
 // IsMatchCommandRule 判断命令是不是在过滤规则中
 func (p *Parser) IsMatchCommandRule(command string) (model.SystemUserFilterRule, string, bool) {
 	for _, rule := range p.cmdFilterRules {
+		if rule.IsStatementRule() {
+			// 按语句类型和表名过滤的规则只用于数据库会话
+			continue
+		}
 		allowed, cmd := rule.Match(command)
 		switch allowed {
 		case model.ActionAllow:
@@ -543,11 +667,26 @@ func (p *Parser) sendCommandRecord() {
 			Output:      p.output,
 			CreatedDate: p.cmdCreateDate,
 			RiskLevel:   model.LessRiskFlag,
-			User:        p.currentActiveUser,
+			User:        p.cmdUser,
 		}
 		p.command = ""
 		p.output = ""
 	}
+	p.sendMaskRecords()
+}
+
+// sendMaskRecords 将输出脱敏的次数记录为命令事件
+func (p *Parser) sendMaskRecords() {
+	if p.outputMasker == nil {
+		return
+	}
+	p.lock.Lock()
+	counts := p.outputMasker.PopCounts()
+	user := p.currentActiveUser
+	p.lock.Unlock()
+	for _, cmd := range maskEventCommands(counts, user) {
+		p.sendStatementRecord(cmd)
+	}
 }
 
 func (p *Parser) NeedRecord() bool {
@@ -558,9 +697,16 @@ func (p *Parser) CommandRecordChan() chan *ExecutedCommand {
 	return p.cmdRecordChan
 }
 
+// UpdateActiveUser 记录最后输入数据的用户, 其他事件不改变当前用户
 func (p *Parser) UpdateActiveUser(msg *exchange.RoomMessage) {
+	if msg.Event != exchange.DataEvent || msg.Meta.UserId == "" {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.currentActiveUser.UserId = msg.Meta.UserId
 	p.currentActiveUser.User = msg.Meta.User
+	p.currentActiveUser.RemoteAddr = msg.Meta.RemoteAddr
 }
 
 type ExecutedCommand struct {
@@ -624,6 +770,10 @@ func isPlatform(p *model.Platform, platform string) bool {
 
 func (p *Parser) breakInputPacket() []byte {
 	switch p.protocolType {
+	case srvconn.ProtocolPostgreSQL:
+		// psql 中 CTRL+C 会清空多行语句的缓冲区
+		p.resetStatementSplitter()
+		return []byte{CharCTRLC}
 	case model.ProtocolTelnet:
 		if isHuaWei(p.platform) {
 			return []byte{CharCTRLE, utils.CharCleanLine, '\r'}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/i18n"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/srvconn"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+var _ srvconn.StatementHook = (*Parser)(nil)
+
+// EnableStatementMode 内置客户端会回调实际执行的语句, 需在 ParseStream 之前调用
+func (p *Parser) EnableStatementMode() {
+	p.statementMode = true
+}
+
+// BeforeExecute 语句执行前匹配命令过滤规则
+func (p *Parser) BeforeExecute(stmt string) error {
+	lang := i18n.NewLang(p.i18nLang)
+	rule, cmd, ok := p.IsMatchStatementRule(stmt)
+	if !ok {
+		return nil
+	}
+	var msg string
+	switch rule.Action {
+	case model.ActionDeny:
+		msg = fmt.Sprintf(lang.T("Command `%s` is forbidden"), cmd)
+	case model.ActionConfirm:
+		action, processor := p.waitStatementConfirm(rule, stmt)
+		switch action {
+		case model.ActionAllow:
+			statusMsg := fmt.Sprintf(lang.T("%s approved"), processor)
+			p.sendStatementOutput(utils.WrapperString(statusMsg, utils.Green) + "\r\n")
+			return nil
+		case model.ActionDeny:
+			msg = fmt.Sprintf(lang.T("%s rejected"), processor)
+		default:
+			// 用户取消复核, 不执行也不记录
+			return errors.New("")
+		}
+	default:
+		return nil
+	}
+	logger.Infof("Session %s: statement `%s` is forbidden by rule %s", p.id, stmt, rule.ID)
+	p.sendStatementRecord(&ExecutedCommand{
+		Command:     stmt,
+		Output:      msg,
+		CreatedDate: time.Now(),
+		RiskLevel:   model.HighRiskFlag,
+		User:        p.getCurrentActiveUser(),
+	})
+	return errors.New(utils.WrapperString(msg, utils.Red))
+}
+
+// AfterExecute 记录执行的语句和结果
+func (p *Parser) AfterExecute(stmt string, output string) {
+	p.sendStatementRecord(&ExecutedCommand{
+		Command:     stmt,
+		Output:      output,
+		CreatedDate: time.Now(),
+		RiskLevel:   model.LessRiskFlag,
+		User:        p.getCurrentActiveUser(),
+	})
+}
+
+/*
+	waitStatementConfirm 内置客户端在执行语句前等待复核,
+	复核期间用户输入会被丢弃, CTRL+C 取消复核
+*/
+
+func (p *Parser) waitStatementConfirm(rule model.SystemUserFilterRule, stmt string) (model.RuleAction, string) {
+	p.confirmStatus.SetRule(rule)
+	p.confirmStatus.SetCmd(stmt)
+	p.confirmStatus.SetAction(model.ActionUnknown)
+	p.confirmStatus.ResetCtx()
+	p.confirmStatus.SetStatus(StatusStart)
+	p.confirmStatus.wg.Add(1)
+	p.waitCommandConfirm()
+	p.confirmStatus.wg.Done()
+	p.sendStatementOutput("\r\n")
+	// 复核结束, 重置状态
+	p.confirmStatus.SetStatus(StatusNone)
+	return p.confirmStatus.GetAction(), p.confirmStatus.GetProcessor()
+}
+
+func (p *Parser) sendStatementOutput(msg string) {
+	select {
+	case <-p.closed:
+	case p.srvOutputChan <- []byte(msg):
+	}
+}
+
+// IsMatchStatementRule 数据库会话中将输入切分为语句逐条匹配, 拒绝优先于复核, 复核优先于允许
+func (p *Parser) IsMatchStatementRule(text string) (model.SystemUserFilterRule, string, bool) {
+	if p.protocolType == srvconn.ProtocolRedis {
+		return p.IsMatchRedisRule(text)
+	}
+	dialect, ok := getSQLDialect(p.protocolType)
+	if !ok {
+		return p.IsMatchCommandRule(text)
+	}
+	var (
+		matchedRule model.SystemUserFilterRule
+		matchedCmd  string
+		matched     bool
+	)
+	for _, stmt := range parseSQLStatements(text, dialect) {
+		rule, cmd, ok := p.matchStatementRule(stmt)
+		if !ok {
+			continue
+		}
+		switch rule.Action {
+		case model.ActionDeny:
+			return rule, cmd, true
+		case model.ActionConfirm:
+			if !matched || matchedRule.Action != model.ActionConfirm {
+				matchedRule, matchedCmd, matched = rule, cmd, true
+			}
+		default:
+			if !matched {
+				matchedRule, matchedCmd, matched = rule, cmd, true
+			}
+		}
+	}
+	return matchedRule, matchedCmd, matched
+}
+
+func (p *Parser) matchStatementRule(stmt sqlStatement) (model.SystemUserFilterRule, string, bool) {
+	for _, rule := range p.cmdFilterRules {
+		var (
+			action model.RuleAction
+			cmd    string
+		)
+		if rule.IsStatementRule() {
+			action, cmd = rule.MatchStatement(stmt.Types, stmt.Tables, stmt.Text)
+		} else {
+			action, cmd = rule.Match(stmt.Text)
+		}
+		switch action {
+		case model.ActionAllow, model.ActionConfirm, model.ActionDeny:
+			return rule, cmd, true
+		default:
+		}
+	}
+	return model.SystemUserFilterRule{}, "", false
+}
+
+/*
+	feedStatementLine 终端中解析出的 psql 输入,
+	语句未结束或者只有元命令时返回 false, 否则返回已经完整的语句
+*/
+
+func (p *Parser) feedStatementLine(line string) (string, bool) {
+	if p.stmtSplitter == nil {
+		return line, false
+	}
+	// 元命令由 SQLSplitter 解析, \g \gx 等只有在引号和注释之外才视为结束符
+	stmts := p.stmtSplitter.Feed(line)
+	if len(stmts) == 0 {
+		return "", false
+	}
+	texts := make([]string, 0, len(stmts))
+	for i := range stmts {
+		texts = append(texts, stmts[i].Text)
+	}
+	return strings.Join(texts, srvconn.SQLDefaultDelimiter+"\n"), true
+}
+
+func (p *Parser) resetStatementSplitter() {
+	if p.stmtSplitter != nil {
+		p.stmtSplitter.Reset()
+	}
+}
+
+func (p *Parser) getCurrentActiveUser() CurrentActiveUser {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.currentActiveUser
+}
+
+// sendStatementRecord 由内置客户端的协程调用, 需要避免向已关闭的 chan 发送
+func (p *Parser) sendStatementRecord(cmd *ExecutedCommand) {
+	p.cmdRecordLock.Lock()
+	defer p.cmdRecordLock.Unlock()
+	if p.cmdRecordClosed {
+		return
+	}
+	p.cmdRecordChan <- cmd
+}
+
+func (p *Parser) closeCmdRecordChan() {
+	p.cmdRecordLock.Lock()
+	defer p.cmdRecordLock.Unlock()
+	p.cmdRecordClosed = true
+	close(p.cmdRecordChan)
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,9 +13,11 @@ import (
 	"github.com/jumpserver/koko/pkg/asciinema"
 	"github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/envelope"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/metrics"
 )
 
 type CommandRecorder struct {
@@ -23,11 +26,17 @@ type CommandRecorder struct {
 
 	queue  chan *model.Command
 	closed chan struct{}
+	spool  *commandSpool
 
 	jmsService *service.JMService
 }
 
 func (c *CommandRecorder) Record(command *model.Command) {
+	if c.spool != nil {
+		if err := c.spool.Append(command); err != nil {
+			logger.Errorf("Session %s: command spool append err: %s", c.sessionID, err)
+		}
+	}
 	c.queue <- command
 }
 
@@ -40,60 +49,180 @@ func (c *CommandRecorder) End() {
 	close(c.closed)
 }
 
+const (
+	commandRetryMinDelay = 10 * time.Second
+	commandRetryMaxDelay = 5 * time.Minute
+
+	// 没有 spool 时内存中最多保留的命令数
+	maxMemoryCommands = 1000
+)
+
+/*
+	record 批量保存命令。有 spool 时保存失败的命令不保留在内存中, 等待重试期间收到的命令也只在 spool 中,
+	重试时从 spool 的 offset 开始读取; 之后队列中已经从 spool 保存过的命令直接丢弃
+*/
+
 func (c *CommandRecorder) record() {
 	cmdList := make([]*model.Command, 0, 10)
 	notificationList := make([]*model.Command, 0, 10)
-	maxRetry := 0
+	retryDelay := commandRetryMinDelay
+	var (
+		retryAt time.Time
+		// spool 中有未保存且不在 cmdList 中的命令
+		backlog  bool
+		received int
+	)
+	receive := func(p *model.Command) {
+		received++
+		if p.RiskLevel == model.DangerLevel {
+			notificationList = append(notificationList, p)
+		}
+		if !c.spooled(received, backlog) {
+			cmdList = append(cmdList, p)
+		}
+	}
 	logger.Infof("Session %s: Command recorder start", c.sessionID)
 	defer logger.Infof("Session %s: Command recorder close", c.sessionID)
+	if c.spool != nil {
+		defer c.spool.Close()
+	}
 	tick := time.NewTicker(time.Second * 10)
 	defer tick.Stop()
 	for {
 		select {
 		case <-c.closed:
-			if len(cmdList) == 0 {
+			// End 之前记录的命令可能还在队列中
+			c.drainQueue(receive)
+			if !backlog && len(cmdList) == 0 {
 				return
 			}
+			if _, _, _, err := c.flush(cmdList, notificationList, backlog); err != nil {
+				logger.Errorf("Session %s: command bulk save err: %s", c.sessionID, err)
+			}
+			return
 		case p, ok := <-c.queue:
 			if !ok {
 				return
 			}
-			if p.RiskLevel == model.DangerLevel {
-				notificationList = append(notificationList, p)
-			}
-			cmdList = append(cmdList, p)
+			receive(p)
 			if len(cmdList) < 5 {
 				continue
 			}
 		case <-tick.C:
-			if len(cmdList) == 0 {
+			if !backlog && len(cmdList) == 0 {
 				continue
 			}
 		}
-		if len(notificationList) > 0 {
-			if err := c.jmsService.NotifyCommand(notificationList); err == nil {
-				notificationList = notificationList[:0]
-			} else {
-				logger.Errorf("Session %s: command notify err: %s", c.sessionID, err)
+		// 每批命令只 fsync 一次, 等待重试时同样需要落盘
+		if c.spool != nil {
+			if err := c.spool.Sync(); err != nil {
+				logger.Errorf("Session %s: command spool sync err: %s", c.sessionID, err)
 			}
 		}
-		err := c.storage.BulkSave(cmdList)
+		if time.Now().Before(retryAt) {
+			if len(cmdList) > maxMemoryCommands {
+				cmdList = cmdList[1:]
+			}
+			if len(notificationList) > maxMemoryCommands {
+				notificationList = notificationList[1:]
+			}
+			continue
+		}
+		var err error
+		cmdList, notificationList, backlog, err = c.flush(cmdList, notificationList, backlog)
 		if err == nil {
-			cmdList = cmdList[:0]
-			maxRetry = 0
+			retryDelay = commandRetryMinDelay
+			retryAt = time.Time{}
 			continue
 		}
-		if err != nil {
-			logger.Errorf("Session %s: command bulk save err: %s", c.sessionID, err)
+		logger.Errorf("Session %s: command bulk save err: %s, retry after %s",
+			c.sessionID, err, retryDelay)
+		retryAt = time.Now().Add(retryDelay)
+		if retryDelay *= 2; retryDelay > commandRetryMaxDelay {
+			retryDelay = commandRetryMaxDelay
 		}
+	}
+}
+
+/*
+	spooled 判断队列中的第 n 条命令是否不需要保留在内存中:
+	已经从 spool 读取并保存过, 或者 spool 中有积压且这条命令已写入 spool
+*/
 
-		if maxRetry > 5 {
-			cmdList = cmdList[1:]
+func (c *CommandRecorder) spooled(n int, backlog bool) bool {
+	if c.spool == nil {
+		return false
+	}
+	total, acked, ok := c.spool.status()
+	line := c.spool.base + n
+	if line <= acked {
+		return true
+	}
+	return backlog && ok && line <= total
+}
+
+func (c *CommandRecorder) drainQueue(receive func(p *model.Command)) {
+	for {
+		select {
+		case p, ok := <-c.queue:
+			if !ok {
+				return
+			}
+			receive(p)
+		default:
+			return
 		}
-		maxRetry++
 	}
 }
 
+/*
+	flush 发送高危命令通知并保存命令, 有积压时先从 spool 读取保存。
+	有 spool 时保存失败的 cmdList 不再保留在内存中, 返回 backlog 为 true;
+	spool 写入失败后积压的命令留给 UploadRemainCommands 上传
+*/
+
+func (c *CommandRecorder) flush(cmdList, notificationList []*model.Command,
+	backlog bool) ([]*model.Command, []*model.Command, bool, error) {
+	if len(notificationList) > 0 {
+		if err := c.jmsService.NotifyCommand(notificationList); err == nil {
+			notificationList = notificationList[:0]
+		} else {
+			logger.Errorf("Session %s: command notify err: %s", c.sessionID, err)
+		}
+	}
+	spoolOK := false
+	if c.spool != nil {
+		_, _, spoolOK = c.spool.status()
+	}
+	if backlog && spoolOK {
+		if _, err := c.spool.save(c.bulkSave); err != nil {
+			return cmdList, notificationList, true, err
+		}
+	}
+	if len(cmdList) == 0 {
+		return cmdList, notificationList, false, nil
+	}
+	if err := c.bulkSave(cmdList); err != nil {
+		if spoolOK {
+			return cmdList[:0], notificationList, true, err
+		}
+		return cmdList, notificationList, false, err
+	}
+	if c.spool != nil {
+		c.spool.Ack(len(cmdList))
+	}
+	return cmdList[:0], notificationList, false, nil
+}
+
+func (c *CommandRecorder) bulkSave(cmdList []*model.Command) error {
+	if err := c.storage.BulkSave(cmdList); err != nil {
+		metrics.CommandRecords.Add(float64(len(cmdList)), c.storage.TypeName(), metrics.ResultFailure)
+		return err
+	}
+	metrics.CommandRecords.Add(float64(len(cmdList)), c.storage.TypeName(), metrics.ResultSuccess)
+	return nil
+}
+
 /*
 old file format: sessionId.replay.gz
 new file format: sessionId.cast.replay.gz "application/x-asciicast"
@@ -106,6 +235,19 @@ const (
 	replayGzFilenameSuffix = ".gz"
 )
 
+// 本地录像正在被录制、压缩或上传的会话, 补传遗留录像时需要跳过, 避免同时操作同一个文件
+var activeReplays sync.Map
+
+// LockReplay 标记会话的本地录像正在处理, 已经被标记时返回 false
+func LockReplay(sid string) bool {
+	_, loaded := activeReplays.LoadOrStore(sid, struct{}{})
+	return !loaded
+}
+
+func UnlockReplay(sid string) {
+	activeReplays.Delete(sid)
+}
+
 func NewReplayRecord(sid string, jmsService *service.JMService,
 	storage ReplayStorage, info *ReplyInfo) (*ReplyRecorder, error) {
 	recorder := &ReplyRecorder{
@@ -118,6 +260,13 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 	if recorder.isNullStorage() {
 		return recorder, nil
 	}
+	// 录像上传完成后才取消标记
+	LockReplay(sid)
+	defer func() {
+		if recorder.err != nil {
+			UnlockReplay(sid)
+		}
+	}()
 	today := info.TimeStamp.UTC().Format(dateTimeFormat)
 	replayRootDir := config.GetConf().ReplayFolderPath
 	sessionReplayDirPath := filepath.Join(replayRootDir, today)
@@ -128,6 +277,13 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 		return recorder, err
 	}
 	filename := sid + replayFilenameSuffix
+	segmentDuration, segmentSize := replaySegmentLimit()
+	// server 存储每个会话只能上传一个录像文件, 不分段
+	segmented := (segmentDuration > 0 || segmentSize > 0) && storage.TypeName() != "server"
+	if segmented {
+		recorder.segmentIndex = 1
+		filename = ReplaySegmentFilename(sid, recorder.segmentIndex)
+	}
 	gzFilename := filename + replayGzFilenameSuffix
 	absFilePath := filepath.Join(sessionReplayDirPath, filename)
 	absGZFilePath := filepath.Join(sessionReplayDirPath, gzFilename)
@@ -135,6 +291,15 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 	recorder.absGzipFilePath = absGZFilePath
 	recorder.absFilePath = absFilePath
 	recorder.Target = storageTargetName
+	var keyInfo []byte
+	if replayEncryptionEnabled(storage) {
+		// 不能加密时不录制, 避免产生明文录像
+		if recorder.dataKey, keyInfo, err = newReplayKey(sessionReplayDirPath, sid); err != nil {
+			logger.Errorf("Session %s create replay data key error: %s", sid, err)
+			recorder.err = err
+			return recorder, err
+		}
+	}
 	fd, err := os.Create(recorder.absFilePath)
 	if err != nil {
 		logger.Errorf("Create replay file %s error: %s\n", recorder.absFilePath, err)
@@ -142,13 +307,28 @@ func NewReplayRecord(sid string, jmsService *service.JMService,
 		return recorder, err
 	}
 	logger.Infof("Create replay file %s", recorder.absFilePath)
-	recorder.file = fd
-
-	options := make([]asciinema.Option, 0, 3)
-	options = append(options, asciinema.WithHeight(info.Height))
-	options = append(options, asciinema.WithWidth(info.Width))
-	options = append(options, asciinema.WithTimestamp(info.TimeStamp))
-	recorder.Writer = asciinema.NewWriter(recorder.file, options...)
+	if err = recorder.setFile(fd); err != nil {
+		logger.Errorf("Session %s encrypt replay file error: %s", sid, err)
+		_ = fd.Close()
+		recorder.err = err
+		return recorder, err
+	}
+	if segmented {
+		recorder.segmentDuration = segmentDuration
+		recorder.segmentSize = segmentSize
+		recorder.segments = newReplaySegmentQueue()
+		uploader := newReplaySegmentUploader(sid, sessionReplayDirPath, storage, recorder.dataKey)
+		uploader.manifest.Width = info.Width
+		uploader.manifest.Height = info.Height
+		uploader.manifest.Timestamp = info.TimeStamp.Unix()
+		go recorder.uploadSegments(uploader)
+	}
+	// 加密录像的输出索引使用同一个数据密钥加密
+	if indexer, err := newOutputIndexer(ReplayIndexDir(), today, sid, recorder.dataKey, keyInfo); err == nil {
+		recorder.indexer = indexer
+	} else {
+		logger.Errorf("Session %s create replay index failed: %s", sid, err)
+	}
 	return recorder, nil
 }
 
@@ -166,6 +346,174 @@ type ReplyRecorder struct {
 
 	file *os.File
 	once sync.Once
+
+	indexer *outputIndexer
+
+	// 分段录制时的分段限制、当前分段和等待上传的分段
+	segmentDuration time.Duration
+	segmentSize     int64
+	segmentIndex    int
+	segmentStart    time.Time
+	written         *countWriter
+	segments        *replaySegmentQueue
+
+	// 加密录像的数据密钥, 每条记录加密为一帧
+	dataKey []byte
+	sealer  *envelope.Writer
+}
+
+type replaySegmentFile struct {
+	path  string
+	index int
+}
+
+/*
+	replaySegmentQueue 等待上传的分段队列, 不限制长度。
+	上传慢或者存储不可用时, 录制协程入队也不会阻塞用户的会话
+*/
+
+type replaySegmentQueue struct {
+	sync.Mutex
+	items  []replaySegmentFile
+	closed bool
+	notify chan struct{}
+}
+
+func newReplaySegmentQueue() *replaySegmentQueue {
+	return &replaySegmentQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *replaySegmentQueue) Push(segment replaySegmentFile) {
+	q.Lock()
+	q.items = append(q.items, segment)
+	q.Unlock()
+	q.wakeup()
+}
+
+func (q *replaySegmentQueue) Close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.wakeup()
+}
+
+// Pop 等待下一个分段, 队列关闭并且没有分段时返回 false
+func (q *replaySegmentQueue) Pop() (replaySegmentFile, bool) {
+	for {
+		q.Lock()
+		if len(q.items) > 0 {
+			segment := q.items[0]
+			q.items = q.items[1:]
+			q.Unlock()
+			return segment, true
+		}
+		closed := q.closed
+		q.Unlock()
+		if closed {
+			return replaySegmentFile{}, false
+		}
+		<-q.notify
+	}
+}
+
+func (q *replaySegmentQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (r *ReplyRecorder) setFile(fd *os.File) error {
+	var w io.Writer = fd
+	if r.dataKey != nil {
+		sealer, err := envelope.NewWriter(fd, r.dataKey)
+		if err != nil {
+			return err
+		}
+		r.sealer = sealer
+		w = sealer
+	}
+	r.file = fd
+	r.written = &countWriter{w: w}
+	r.segmentStart = time.Now()
+	options := make([]asciinema.Option, 0, 3)
+	options = append(options, asciinema.WithHeight(r.info.Height))
+	options = append(options, asciinema.WithWidth(r.info.Width))
+	options = append(options, asciinema.WithTimestamp(r.info.TimeStamp))
+	r.Writer = asciinema.NewWriter(r.written, options...)
+	return nil
+}
+
+func (r *ReplyRecorder) segmentFull() bool {
+	if r.segments == nil || r.written.n == 0 {
+		return false
+	}
+	if r.segmentDuration > 0 && time.Since(r.segmentStart) >= r.segmentDuration {
+		return true
+	}
+	return r.segmentSize > 0 && r.written.n >= r.segmentSize
+}
+
+// closeFile 加密录像写入结束帧后关闭文件
+func (r *ReplyRecorder) closeFile() {
+	if r.sealer != nil {
+		if err := r.sealer.Close(); err != nil {
+			logger.Errorf("Session %s close encrypted replay failed: %s", r.SessionID, err)
+		}
+	}
+	_ = r.file.Close()
+}
+
+// rotateSegment 结束当前分段交给上传协程, 并创建下一个分段
+func (r *ReplyRecorder) rotateSegment() {
+	r.closeFile()
+	r.segments.Push(replaySegmentFile{path: r.absFilePath, index: r.segmentIndex})
+	r.segmentIndex++
+	absFilePath := filepath.Join(filepath.Dir(r.absFilePath), ReplaySegmentFilename(r.SessionID, r.segmentIndex))
+	fd, err := os.Create(absFilePath)
+	if err != nil {
+		logger.Errorf("Session %s create replay segment %s error: %s", r.SessionID, absFilePath, err)
+		r.err = err
+		return
+	}
+	logger.Debugf("Session %s create replay segment %s", r.SessionID, absFilePath)
+	r.absFilePath = absFilePath
+	if err = r.setFile(fd); err != nil {
+		logger.Errorf("Session %s encrypt replay segment %s error: %s", r.SessionID, absFilePath, err)
+		_ = fd.Close()
+		r.err = err
+		return
+	}
+	r.once = sync.Once{}
+}
+
+func (r *ReplyRecorder) uploadSegments(uploader *replaySegmentUploader) {
+	defer UnlockReplay(r.SessionID)
+	for {
+		segment, ok := r.segments.Pop()
+		if !ok {
+			break
+		}
+		if err := uploader.Upload(segment.path, segment.index, 3); err != nil {
+			logger.Errorf("Session %s upload replay segment %d err: %s", r.SessionID, segment.index, err)
+		}
+	}
+	if err := uploader.Finish(r.jmsService); err != nil {
+		logger.Errorf("Session %s finish replay segments err: %s", r.SessionID, err)
+		return
+	}
+	logger.Infof("Session %s: Replay segments upload done", r.SessionID)
 }
 
 func (r *ReplyRecorder) isNullStorage() bool {
@@ -177,26 +525,61 @@ func (r *ReplyRecorder) Record(p []byte) {
 		return
 	}
 	if len(p) > 0 {
+		if r.segmentFull() {
+			r.rotateSegment()
+			if r.err != nil {
+				return
+			}
+		}
 		r.once.Do(func() {
 			if err := r.Writer.WriteHeader(); err != nil {
 				logger.Errorf("Session %s write replay header failed: %s", r.SessionID, err)
 			}
 		})
-		if err := r.Writer.WriteRow(p); err != nil {
+		ts := float64(time.Now().UnixNano()-r.Writer.TimestampNano) / float64(time.Second)
+		if err := r.Writer.WriteStdout(ts, p); err != nil {
 			logger.Errorf("Session %s write replay row failed: %s", r.SessionID, err)
 		}
+		if r.sealer != nil {
+			if err := r.sealer.Flush(); err != nil {
+				logger.Errorf("Session %s encrypt replay row failed: %s", r.SessionID, err)
+			}
+		}
+		if r.indexer != nil {
+			r.indexer.Write(ts, p)
+		}
 	}
 }
 
 func (r *ReplyRecorder) End() {
+	if r.segments != nil {
+		r.endSegments()
+		return
+	}
 	if r.isNullStorage() {
 		return
 	}
-	_ = r.file.Close()
+	r.closeFile()
+	if r.indexer != nil {
+		r.indexer.Close()
+	}
 	go r.uploadReplay()
 }
 
+// endSegments 把最后一个分段交给上传协程, 上传完成后标记清单完成
+func (r *ReplyRecorder) endSegments() {
+	if r.err == nil {
+		r.closeFile()
+		r.segments.Push(replaySegmentFile{path: r.absFilePath, index: r.segmentIndex})
+	}
+	if r.indexer != nil {
+		r.indexer.Close()
+	}
+	r.segments.Close()
+}
+
 func (r *ReplyRecorder) uploadReplay() {
+	defer UnlockReplay(r.SessionID)
 	logger.Infof("Session %s: Replay recorder is uploading", r.SessionID)
 	if !common.FileExists(r.absFilePath) {
 		logger.Info("Replay file not found, passed: ", r.absFilePath)
@@ -205,11 +588,15 @@ func (r *ReplyRecorder) uploadReplay() {
 	if stat, err := os.Stat(r.absFilePath); err == nil && stat.Size() == 0 {
 		logger.Info("Replay file is empty, removed: ", r.absFilePath)
 		_ = os.Remove(r.absFilePath)
+		RemoveReplayKey(filepath.Dir(r.absFilePath), r.SessionID)
 		return
 	}
 	if !common.FileExists(r.absGzipFilePath) {
 		logger.Debug("Compress replay file: ", r.absFilePath)
-		_ = common.GzipCompressFile(r.absFilePath, r.absGzipFilePath)
+		if err := CompressReplayFile(r.absFilePath, r.absGzipFilePath, r.dataKey, false); err != nil {
+			logger.Errorf("Session %s compress replay file err: %s", r.SessionID, err)
+			return
+		}
 		_ = os.Remove(r.absFilePath)
 	}
 	r.UploadGzipFile(3)
@@ -221,11 +608,22 @@ func (r *ReplyRecorder) UploadGzipFile(maxRetry int) {
 		_ = os.Remove(r.absGzipFilePath)
 		return
 	}
+	dateDir := filepath.Dir(r.absGzipFilePath)
 	for i := 0; i <= maxRetry; i++ {
 		logger.Infof("Upload replay file: %s, type: %s", r.absGzipFilePath, r.storage.TypeName())
-		err := r.storage.Upload(r.absGzipFilePath, r.Target)
+		// 密钥文件先于录像上传, 避免存储中出现无法解密的录像
+		err := UploadReplayKey(r.storage, dateDir, r.SessionID)
+		if err == nil {
+			err = r.storage.Upload(r.absGzipFilePath, r.Target)
+		}
+		result := metrics.ResultSuccess
+		if err != nil {
+			result = metrics.ResultFailure
+		}
+		metrics.ReplayUploads.Inc(r.storage.TypeName(), result)
 		if err == nil {
 			_ = os.Remove(r.absGzipFilePath)
+			RemoveReplayKey(dateDir, r.SessionID)
 			if err = r.jmsService.FinishReply(r.SessionID); err != nil {
 				logger.Errorf("Session[%s] finish replay err: %s", r.SessionID, err)
 			}
@@ -237,6 +635,11 @@ func (r *ReplyRecorder) UploadGzipFile(maxRetry int) {
 			if r.storage.TypeName() == "server" {
 				break
 			}
+			if r.dataKey != nil {
+				// server 存储不能保存密钥文件, 保留在本地等待补传
+				logger.Errorf("Session[%s] encrypted replay keep in local for remain upload", r.SessionID)
+				break
+			}
 			logger.Errorf("Session[%s] using server storage retry upload", r.SessionID)
 			r.storage = storage.ServerStorage{StorageType: "server", JmsService: r.jmsService}
 			r.UploadGzipFile(3)
@@ -47,6 +47,41 @@ func (a AzureReplayStorage) Upload(gZipFilePath, target string) (err error) {
 	return
 }
 
+func (a AzureReplayStorage) Delete(target string) error {
+	return ErrNotSupported
+}
+
+func (a AzureReplayStorage) List(prefix string) ([]ObjectInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (a AzureReplayStorage) ListDirs() ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (a AzureReplayStorage) Download(target, localPath string) (err error) {
+	file, err := os.Create(localPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	credential, err := azblob.NewSharedKeyCredential(a.AccountName, a.AccountKey)
+	if err != nil {
+		logger.Error("Invalid credentials with error: " + err.Error())
+		return
+	}
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	endpoint := fmt.Sprintf("https://%s.blob.%s/%s", a.AccountName, a.EndpointSuffix, a.ContainerName)
+	URL, _ := url.Parse(endpoint)
+	blobURL := azblob.NewContainerURL(*URL, p).NewBlobURL(target)
+	err = azblob.DownloadBlobToFile(context.TODO(), blobURL, 0, azblob.CountToEnd, file,
+		azblob.DownloadFromBlobOptions{Parallelism: 4})
+	if err != nil {
+		logger.Errorf("Azure download file %s failed: %s", target, err)
+	}
+	return
+}
+
 func (a AzureReplayStorage) TypeName() string {
 	return "azure"
 }
@@ -0,0 +1,65 @@
+package recorderstorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	FileCommandStorage 以 JSON lines 的格式将命令写入本地文件,
+	文件超过 MaxSize(MB) 后由 lumberjack 切割并保留 MaxBackups 个历史文件
+*/
+
+type FileCommandStorage struct {
+	FilePath   string
+	MaxSize    int
+	MaxBackups int
+}
+
+func (f FileCommandStorage) BulkSave(commands []*model.Command) (err error) {
+	var buf bytes.Buffer
+	for i := range commands {
+		data, err := json.Marshal(commands[i])
+		if err != nil {
+			logger.Errorf("File storage marshal command err: %s", err)
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	// 一次写入全部命令, 避免切割时同一批命令分散在两个文件中
+	_, err = getCommandFileWriter(f).Write(buf.Bytes())
+	return err
+}
+
+func (f FileCommandStorage) TypeName() string {
+	return "file"
+}
+
+var (
+	commandFileWriters     = make(map[string]*lumberjack.Logger)
+	commandFileWritersLock sync.Mutex
+)
+
+// getCommandFileWriter 所有会话共用同一个文件的 writer, 由 lumberjack 保证并发写入和切割
+func getCommandFileWriter(f FileCommandStorage) *lumberjack.Logger {
+	commandFileWritersLock.Lock()
+	defer commandFileWritersLock.Unlock()
+	if w, ok := commandFileWriters[f.FilePath]; ok {
+		return w
+	}
+	w := &lumberjack.Logger{
+		Filename:   f.FilePath,
+		MaxSize:    f.MaxSize,
+		MaxBackups: f.MaxBackups,
+		LocalTime:  true,
+	}
+	commandFileWriters[f.FilePath] = w
+	return w
+}
@@ -0,0 +1,71 @@
+package recorderstorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+func TestFileCommandStorage_BulkSave(t *testing.T) {
+	dir := t.TempDir()
+	storage := FileCommandStorage{FilePath: filepath.Join(dir, "command.log"), MaxSize: 1}
+	// 每批约 300KB, 写入 5 批后超过 1MB 触发切割
+	padding := strings.Repeat("x", 1024)
+	const batches, batchSize = 5, 300
+	for i := 0; i < batches; i++ {
+		commands := make([]*model.Command, 0, batchSize)
+		for j := 0; j < batchSize; j++ {
+			commands = append(commands, &model.Command{SessionID: strconv.Itoa(i),
+				Input: strconv.Itoa(j), Output: padding})
+		}
+		if err := storage.BulkSave(commands); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = getCommandFileWriter(storage).Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "command*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("got %d files, want rotated backups", len(files))
+	}
+	seen := make(map[string]bool)
+	for _, name := range files {
+		counts := make(map[string]int)
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+		for scanner.Scan() {
+			var cmd model.Command
+			if err = json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+				t.Fatalf("%s: invalid line: %s", name, err)
+			}
+			counts[cmd.SessionID]++
+		}
+		_ = f.Close()
+		if err = scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		// 同一批命令不会分散在两个文件中
+		for sid, count := range counts {
+			if count != batchSize || seen[sid] {
+				t.Fatalf("batch %s split across files: %d commands in %s", sid, count, name)
+			}
+			seen[sid] = true
+		}
+	}
+	if len(seen) != batches {
+		t.Fatalf("got %d batches, want %d", len(seen), batches)
+	}
+}
@@ -0,0 +1,544 @@
+package recorderstorage
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	KafkaCommandStorage 将命令以 JSON 格式发送到 Kafka topic,
+	同一个会话的命令使用会话 ID 作为 key 写入同一个 partition, 保证顺序。
+	只实现了发送消息所需的 Metadata、Produce 请求(Kafka 0.11 及以上版本),
+	支持 TLS 和 SASL/PLAIN 认证。连接后先通过 ApiVersions 请求确认 broker 支持使用的请求版本。
+*/
+
+type KafkaCommandStorage struct {
+	Brokers  []string
+	Topic    string
+	Username string
+	Password string
+
+	UseTLS             bool
+	InsecureSkipVerify bool
+}
+
+func (k KafkaCommandStorage) BulkSave(commands []*model.Command) (err error) {
+	if len(commands) == 0 {
+		return nil
+	}
+	client := kafkaClient{storage: k, conns: make(map[int32]*kafkaConn)}
+	defer client.Close()
+	meta, err := client.fetchMetadata()
+	if err != nil {
+		logger.Errorf("Kafka fetch topic %s metadata err: %s", k.Topic, err)
+		return err
+	}
+	batches := make(map[int32][]kafkaRecord)
+	for _, item := range commands {
+		value, err := json.Marshal(item)
+		if err != nil {
+			logger.Errorf("Kafka marshal command err: %s", err)
+			return err
+		}
+		partition := meta.partitionForKey(item.SessionID)
+		batches[partition] = append(batches[partition], kafkaRecord{
+			Key:       []byte(item.SessionID),
+			Value:     value,
+			Timestamp: item.DateCreated,
+		})
+	}
+	for partition, records := range batches {
+		leader := meta.leaders[partition]
+		if err = client.produce(meta, leader, partition, records); err != nil {
+			logger.Errorf("Kafka produce to topic %s partition %d err: %s", k.Topic, partition, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (k KafkaCommandStorage) TypeName() string {
+	return "kafka"
+}
+
+const (
+	kafkaClientID = "koko"
+
+	kafkaApiProduce       int16 = 0
+	kafkaApiMetadata      int16 = 3
+	kafkaApiSaslHandshake int16 = 17
+	kafkaApiApiVersions   int16 = 18
+	kafkaApiSaslAuth      int16 = 36
+
+	kafkaProduceVersion       int16 = 3
+	kafkaMetadataVersion      int16 = 4
+	kafkaSaslHandshakeVersion int16 = 1
+	kafkaSaslAuthVersion      int16 = 0
+
+	kafkaTimeout = 15 * time.Second
+)
+
+var (
+	errKafkaNoBroker           = errors.New("no available kafka broker")
+	errKafkaUnsupportedVersion = errors.New("kafka broker does not support request version")
+)
+
+var kafkaApiNames = map[int16]string{
+	kafkaApiProduce:       "Produce",
+	kafkaApiMetadata:      "Metadata",
+	kafkaApiSaslHandshake: "SaslHandshake",
+	kafkaApiSaslAuth:      "SaslAuthenticate",
+}
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return "kafka server error code " + strconv.Itoa(int(e))
+}
+
+type kafkaRecord struct {
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+type kafkaMetadata struct {
+	brokers    map[int32]string
+	partitions []int32
+	leaders    map[int32]int32
+}
+
+func (m *kafkaMetadata) partitionForKey(key string) int32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.partitions[h.Sum32()%uint32(len(m.partitions))]
+}
+
+type kafkaClient struct {
+	storage KafkaCommandStorage
+	// 按 broker id 缓存的连接, -1 为 bootstrap 连接
+	conns map[int32]*kafkaConn
+}
+
+func (c *kafkaClient) Close() {
+	for _, conn := range c.conns {
+		_ = conn.Close()
+	}
+}
+
+func (c *kafkaClient) fetchMetadata() (*kafkaMetadata, error) {
+	var lastErr = errKafkaNoBroker
+	for _, addr := range c.storage.Brokers {
+		conn, err := c.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		meta, err := conn.metadata(c.storage.Topic)
+		if err != nil {
+			_ = conn.Close()
+			lastErr = err
+			continue
+		}
+		if old, ok := c.conns[-1]; ok {
+			_ = old.Close()
+		}
+		c.conns[-1] = conn
+		return meta, nil
+	}
+	return nil, lastErr
+}
+
+func (c *kafkaClient) produce(meta *kafkaMetadata, leader, partition int32, records []kafkaRecord) error {
+	conn, ok := c.conns[leader]
+	if !ok {
+		addr, ok := meta.brokers[leader]
+		if !ok {
+			return fmt.Errorf("%w: leader %d of partition %d", errKafkaNoBroker, leader, partition)
+		}
+		var err error
+		if conn, err = c.dial(addr); err != nil {
+			return err
+		}
+		c.conns[leader] = conn
+	}
+	return conn.produce(c.storage.Topic, partition, records)
+}
+
+func (c *kafkaClient) dial(addr string) (*kafkaConn, error) {
+	dialer := net.Dialer{Timeout: kafkaTimeout}
+	var (
+		netConn net.Conn
+		err     error
+	)
+	if c.storage.UseTLS {
+		netConn, err = tls.DialWithDialer(&dialer, "tcp", addr,
+			&tls.Config{InsecureSkipVerify: c.storage.InsecureSkipVerify})
+	} else {
+		netConn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &kafkaConn{conn: netConn}
+	if err = conn.checkApiVersions(c.storage.Username != ""); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if c.storage.Username != "" {
+		if err = conn.saslPlain(c.storage.Username, c.storage.Password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+type kafkaConn struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+func (c *kafkaConn) Close() error {
+	return c.conn.Close()
+}
+
+// roundTrip 发送请求并返回去掉响应头的响应内容
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body []byte) (*kafkaDecoder, error) {
+	c.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // 请求长度, 最后填充
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(c.correlationID)
+	req.string(kafkaClientID)
+	req.buf.Write(body)
+	data := req.buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	_ = c.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := c.conn.Write(data); err != nil {
+		return nil, err
+	}
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(c.conn, sizeBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(sizeBuf[:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{data: resp}
+	if correlationID := d.int32(); correlationID != c.correlationID {
+		return nil, fmt.Errorf("kafka correlation id mismatch: %d != %d", correlationID, c.correlationID)
+	}
+	return d, d.err
+}
+
+/*
+	checkApiVersions 使用 ApiVersions v0 请求获取 broker 支持的版本范围,
+	不支持使用的请求版本时返回错误, 避免发送 broker 无法解析的请求
+*/
+
+func (c *kafkaConn) checkApiVersions(sasl bool) error {
+	d, err := c.roundTrip(kafkaApiApiVersions, 0, nil)
+	if err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("kafka api versions: %w", kafkaError(code))
+	}
+	type versionRange struct{ min, max int16 }
+	supported := make(map[int16]versionRange)
+	for i := d.arrayLen(); i > 0; i-- {
+		apiKey := d.int16()
+		supported[apiKey] = versionRange{min: d.int16(), max: d.int16()}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	required := map[int16]int16{
+		kafkaApiProduce:  kafkaProduceVersion,
+		kafkaApiMetadata: kafkaMetadataVersion,
+	}
+	if sasl {
+		required[kafkaApiSaslHandshake] = kafkaSaslHandshakeVersion
+		required[kafkaApiSaslAuth] = kafkaSaslAuthVersion
+	}
+	for apiKey, version := range required {
+		r, ok := supported[apiKey]
+		if !ok || version < r.min || version > r.max {
+			return fmt.Errorf("%w: %s v%d, supported %d-%d", errKafkaUnsupportedVersion,
+				kafkaApiNames[apiKey], version, r.min, r.max)
+		}
+	}
+	return nil
+}
+
+func (c *kafkaConn) saslPlain(username, password string) error {
+	var req kafkaEncoder
+	req.string("PLAIN")
+	d, err := c.roundTrip(kafkaApiSaslHandshake, kafkaSaslHandshakeVersion, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("kafka sasl handshake: %w", kafkaError(code))
+	}
+	req = kafkaEncoder{}
+	req.bytes([]byte("\x00" + username + "\x00" + password))
+	if d, err = c.roundTrip(kafkaApiSaslAuth, kafkaSaslAuthVersion, req.buf.Bytes()); err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("kafka sasl authenticate %s: %w", d.nullableString(), kafkaError(code))
+	}
+	return d.err
+}
+
+// metadata 使用 Metadata v4 请求
+func (c *kafkaConn) metadata(topic string) (*kafkaMetadata, error) {
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(topic)
+	req.int8(1) // allow_auto_topic_creation
+	d, err := c.roundTrip(kafkaApiMetadata, kafkaMetadataVersion, req.buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	meta := kafkaMetadata{
+		brokers: make(map[int32]string),
+		leaders: make(map[int32]int32),
+	}
+	d.int32() // throttle_time_ms
+	for i := d.arrayLen(); i > 0; i-- {
+		nodeID := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		meta.brokers[nodeID] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.nullableString() // cluster_id
+	d.int32()          // controller_id
+	for i := d.arrayLen(); i > 0; i-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // is_internal
+		for j := d.arrayLen(); j > 0; j-- {
+			partitionCode := d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			if name == topic && partitionCode == 0 && leader >= 0 {
+				meta.partitions = append(meta.partitions, partition)
+				meta.leaders[partition] = leader
+			}
+		}
+		if name == topic && code != 0 {
+			return nil, fmt.Errorf("kafka topic %s metadata: %w", topic, kafkaError(code))
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(meta.partitions) == 0 {
+		return nil, fmt.Errorf("kafka topic %s has no available partition", topic)
+	}
+	return &meta, nil
+}
+
+// produce 使用 Produce v3 请求, 消息格式为 RecordBatch v2
+func (c *kafkaConn) produce(topic string, partition int32, records []kafkaRecord) error {
+	var req kafkaEncoder
+	req.int16(-1) // transactional_id null
+	req.int16(1)  // acks: leader
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(encodeKafkaRecordBatch(records))
+	d, err := c.roundTrip(kafkaApiProduce, kafkaProduceVersion, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for i := d.arrayLen(); i > 0; i-- {
+		d.string()
+		for j := d.arrayLen(); j > 0; j-- {
+			d.int32() // partition
+			if code := d.int16(); code != 0 {
+				return kafkaError(code)
+			}
+			d.int64() // base_offset
+			d.int64() // log_append_time
+		}
+	}
+	return d.err
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeKafkaRecordBatch(records []kafkaRecord) []byte {
+	firstTimestamp := records[0].Timestamp
+	maxTimestamp := firstTimestamp
+	var body kafkaEncoder
+	for i := range records {
+		if records[i].Timestamp.After(maxTimestamp) {
+			maxTimestamp = records[i].Timestamp
+		}
+		var record kafkaEncoder
+		record.int8(0) // attributes
+		record.varint(records[i].Timestamp.Sub(firstTimestamp).Milliseconds())
+		record.varint(int64(i)) // offset delta
+		record.varint(int64(len(records[i].Key)))
+		record.buf.Write(records[i].Key)
+		record.varint(int64(len(records[i].Value)))
+		record.buf.Write(records[i].Value)
+		record.varint(0) // headers
+		body.varint(int64(record.buf.Len()))
+		body.buf.Write(record.buf.Bytes())
+	}
+	// crc 从 attributes 开始计算
+	var crcPart kafkaEncoder
+	crcPart.int16(0) // attributes: 不压缩
+	crcPart.int32(int32(len(records) - 1))
+	crcPart.int64(firstTimestamp.UnixNano() / int64(time.Millisecond))
+	crcPart.int64(maxTimestamp.UnixNano() / int64(time.Millisecond))
+	crcPart.int64(-1) // producer_id
+	crcPart.int16(-1) // producer_epoch
+	crcPart.int32(-1) // base_sequence
+	crcPart.int32(int32(len(records)))
+	crcPart.buf.Write(body.buf.Bytes())
+
+	var batch kafkaEncoder
+	batch.int64(0) // base_offset
+	// batch_length 为 partition_leader_epoch 之后的长度
+	batch.int32(int32(4 + 1 + 4 + crcPart.buf.Len()))
+	batch.int32(-1) // partition_leader_epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(crcPart.buf.Bytes(), crc32cTable)))
+	batch.buf.Write(crcPart.buf.Bytes())
+	return batch.buf.Bytes()
+}
+
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.buf.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf.WriteString(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf.Write(v)
+}
+
+// varint 使用 zigzag 编码, 与 Kafka 一致
+func (e *kafkaEncoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	e.buf.Write(tmp[:n])
+}
+
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.read(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.read(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.read(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.read(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.read(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.read(int(n)))
+}
+
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for i := d.arrayLen(); i > 0; i-- {
+		d.int32()
+	}
+}
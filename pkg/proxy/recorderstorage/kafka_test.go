@@ -0,0 +1,344 @@
+package recorderstorage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+/*
+	按 Kafka 协议记录的 broker 响应帧, 不包括长度和 correlation_id,
+	Metadata 响应中的端口由测试 broker 填充
+*/
+
+const (
+	// ApiVersions v0: Produce 0-9, Metadata 0-12, SaslHandshake 0-1, ApiVersions 0-3, SaslAuthenticate 0-2
+	kafkaFrameApiVersions = "0000" + "00000005" +
+		"0000" + "0000" + "0009" +
+		"0003" + "0000" + "000c" +
+		"0011" + "0000" + "0001" +
+		"0012" + "0000" + "0003" +
+		"0024" + "0000" + "0002"
+
+	// ApiVersions v0: Kafka 0.10.0 只支持 Produce 0-2, Metadata 0-1
+	kafkaFrameApiVersionsOld = "0000" + "00000002" +
+		"0000" + "0000" + "0002" +
+		"0003" + "0000" + "0001"
+
+	// Metadata v4: broker 1 为 127.0.0.1, topic command 有两个 partition, leader 都是 broker 1
+	kafkaFrameMetadata = "00000000" +
+		"00000001" + "00000001" + "0009" + "3132372e302e302e31" + "%08x" + "ffff" +
+		"ffff" + "00000001" +
+		"00000001" + "0000" + "0007" + "636f6d6d616e64" + "00" +
+		"00000002" +
+		"0000" + "00000000" + "00000001" + "00000001" + "00000001" + "00000001" + "00000001" +
+		"0000" + "00000001" + "00000001" + "00000001" + "00000001" + "00000001" + "00000001"
+
+	// Metadata v4: 没有 broker, topic command 返回 UNKNOWN_TOPIC_OR_PARTITION
+	kafkaFrameMetadataUnknownTopic = "00000000" +
+		"00000000" + "ffff" + "ffffffff" +
+		"00000001" + "0003" + "0007" + "636f6d6d616e64" + "00" + "00000000"
+
+	// Produce v3: 写入成功
+	kafkaFrameProduce = "00000001" + "0007" + "636f6d6d616e64" +
+		"00000001" + "00000000" + "0000" + "0000000000000000" + "ffffffffffffffff" +
+		"00000000"
+
+	// Produce v3: NOT_LEADER_FOR_PARTITION
+	kafkaFrameProduceNotLeader = "00000001" + "0007" + "636f6d6d616e64" +
+		"00000001" + "00000000" + "0006" + "ffffffffffffffff" + "ffffffffffffffff" +
+		"00000000"
+)
+
+type kafkaTestRequest struct {
+	apiKey     int16
+	apiVersion int16
+	clientID   string
+	body       []byte
+}
+
+// kafkaTestBroker 按 api key 返回记录的响应帧, 并保存收到的请求
+type kafkaTestBroker struct {
+	ln     net.Listener
+	frames map[int16]string
+
+	sync.Mutex
+	requests []kafkaTestRequest
+	closed   int
+}
+
+func newKafkaTestBroker(t *testing.T, frames map[int16]string) *kafkaTestBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &kafkaTestBroker{ln: ln, frames: frames}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *kafkaTestBroker) Addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *kafkaTestBroker) Close() {
+	_ = b.ln.Close()
+}
+
+func (b *kafkaTestBroker) Requests() []kafkaTestRequest {
+	b.Lock()
+	defer b.Unlock()
+	return append([]kafkaTestRequest(nil), b.requests...)
+}
+
+// Closed 返回客户端已经断开的连接数
+func (b *kafkaTestBroker) Closed() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.closed
+}
+
+func (b *kafkaTestBroker) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		b.Lock()
+		b.closed++
+		b.Unlock()
+	}()
+	port := conn.LocalAddr().(*net.TCPAddr).Port
+	for {
+		var sizeBuf [4]byte
+		if _, err := io.ReadFull(conn, sizeBuf[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(sizeBuf[:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		d := kafkaDecoder{data: data}
+		req := kafkaTestRequest{apiKey: d.int16(), apiVersion: d.int16()}
+		correlationID := d.int32()
+		req.clientID = d.string()
+		req.body = d.data
+		b.Lock()
+		b.requests = append(b.requests, req)
+		b.Unlock()
+
+		frame := b.frames[req.apiKey]
+		if strings.Contains(frame, "%08x") {
+			frame = fmt.Sprintf(frame, port)
+		}
+		body, err := hex.DecodeString(frame)
+		if err != nil {
+			return
+		}
+		var resp kafkaEncoder
+		resp.int32(int32(4 + len(body)))
+		resp.int32(correlationID)
+		resp.buf.Write(body)
+		if _, err = conn.Write(resp.buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func TestKafkaCommandStorage_BulkSave(t *testing.T) {
+	broker := newKafkaTestBroker(t, map[int16]string{
+		kafkaApiApiVersions: kafkaFrameApiVersions,
+		kafkaApiMetadata:    kafkaFrameMetadata,
+		kafkaApiProduce:     kafkaFrameProduce,
+	})
+	defer broker.Close()
+
+	now := time.Unix(1700000000, 0)
+	commands := []*model.Command{
+		{SessionID: "s1", Input: "ls", DateCreated: now},
+		{SessionID: "s1", Input: "pwd", DateCreated: now.Add(time.Second)},
+	}
+	storage := KafkaCommandStorage{Brokers: []string{broker.Addr()}, Topic: "command"}
+	if err := storage.BulkSave(commands); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := broker.Requests()
+	expected := []struct{ apiKey, apiVersion int16 }{
+		{kafkaApiApiVersions, 0},
+		{kafkaApiMetadata, kafkaMetadataVersion},
+		// leader 使用新的连接, 同样先确认版本
+		{kafkaApiApiVersions, 0},
+		{kafkaApiProduce, kafkaProduceVersion},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("broker got %d requests, want %d", len(requests), len(expected))
+	}
+	for i := range expected {
+		if requests[i].apiKey != expected[i].apiKey || requests[i].apiVersion != expected[i].apiVersion {
+			t.Fatalf("request %d got api %d v%d, want api %d v%d", i, requests[i].apiKey,
+				requests[i].apiVersion, expected[i].apiKey, expected[i].apiVersion)
+		}
+		if requests[i].clientID != kafkaClientID {
+			t.Fatalf("request %d got client id %q", i, requests[i].clientID)
+		}
+	}
+
+	// Produce v3 请求体
+	d := kafkaDecoder{data: requests[3].body}
+	if transactionalID := d.int16(); transactionalID != -1 {
+		t.Fatalf("transactional id length %d, want null", transactionalID)
+	}
+	d.int16() // acks
+	d.int32() // timeout
+	if n := d.arrayLen(); n != 1 {
+		t.Fatalf("produce got %d topics", n)
+	}
+	if topic := d.string(); topic != "command" {
+		t.Fatalf("produce topic %q", topic)
+	}
+	d.arrayLen()
+	if partition := d.int32(); partition != (&kafkaMetadata{partitions: []int32{0, 1}}).partitionForKey("s1") {
+		t.Fatalf("produce partition %d does not match session key", partition)
+	}
+	batch := d.read(int(d.int32()))
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	records := decodeTestRecordBatch(t, batch)
+	if len(records) != len(commands) {
+		t.Fatalf("batch got %d records, want %d", len(records), len(commands))
+	}
+	for i := range records {
+		var cmd model.Command
+		if err := json.Unmarshal(records[i].Value, &cmd); err != nil {
+			t.Fatal(err)
+		}
+		if string(records[i].Key) != "s1" || cmd.Input != commands[i].Input {
+			t.Fatalf("record %d got key %q input %q", i, records[i].Key, cmd.Input)
+		}
+	}
+}
+
+func TestKafkaCommandStorage_BulkSaveErrors(t *testing.T) {
+	cmd := []*model.Command{{SessionID: "s1", Input: "ls", DateCreated: time.Now()}}
+
+	broker := newKafkaTestBroker(t, map[int16]string{
+		kafkaApiApiVersions: kafkaFrameApiVersionsOld,
+	})
+	err := KafkaCommandStorage{Brokers: []string{broker.Addr()}, Topic: "command"}.BulkSave(cmd)
+	broker.Close()
+	if !errors.Is(err, errKafkaUnsupportedVersion) {
+		t.Fatalf("old broker got err %v, want %v", err, errKafkaUnsupportedVersion)
+	}
+	if requests := broker.Requests(); len(requests) != 1 {
+		t.Fatalf("old broker got %d requests, want only ApiVersions", len(requests))
+	}
+
+	broker = newKafkaTestBroker(t, map[int16]string{
+		kafkaApiApiVersions: kafkaFrameApiVersions,
+		kafkaApiMetadata:    kafkaFrameMetadata,
+		kafkaApiProduce:     kafkaFrameProduceNotLeader,
+	})
+	defer broker.Close()
+	err = KafkaCommandStorage{Brokers: []string{broker.Addr()}, Topic: "command"}.BulkSave(cmd)
+	var kafkaErr kafkaError
+	if !errors.As(err, &kafkaErr) || kafkaErr != 6 {
+		t.Fatalf("produce got err %v, want kafka error code 6", err)
+	}
+}
+
+func TestKafkaCommandStorage_BulkSaveClosesFailedBootstrap(t *testing.T) {
+	bad := newKafkaTestBroker(t, map[int16]string{
+		kafkaApiApiVersions: kafkaFrameApiVersions,
+		kafkaApiMetadata:    kafkaFrameMetadataUnknownTopic,
+	})
+	defer bad.Close()
+	good := newKafkaTestBroker(t, map[int16]string{
+		kafkaApiApiVersions: kafkaFrameApiVersions,
+		kafkaApiMetadata:    kafkaFrameMetadata,
+		kafkaApiProduce:     kafkaFrameProduce,
+	})
+	defer good.Close()
+
+	cmd := []*model.Command{{SessionID: "s1", Input: "ls", DateCreated: time.Now()}}
+	storage := KafkaCommandStorage{Brokers: []string{bad.Addr(), good.Addr()}, Topic: "command"}
+	if err := storage.BulkSave(cmd); err != nil {
+		t.Fatal(err)
+	}
+	// 获取 metadata 失败的 bootstrap 连接需要关闭, 成功的连接在 BulkSave 结束时关闭
+	deadline := time.Now().Add(time.Second)
+	for bad.Closed() != 1 || good.Closed() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("closed connections: bad broker %d, good broker %d", bad.Closed(), good.Closed())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// decodeTestRecordBatch 按 RecordBatch v2 格式解析, 并校验 crc
+func decodeTestRecordBatch(t *testing.T, batch []byte) []kafkaRecord {
+	d := kafkaDecoder{data: batch}
+	d.int64() // base_offset
+	if length := int(d.int32()); length != len(d.data) {
+		t.Fatalf("batch length %d, want %d", length, len(d.data))
+	}
+	d.int32() // partition_leader_epoch
+	if magic := d.int8(); magic != 2 {
+		t.Fatalf("batch magic %d, want 2", magic)
+	}
+	crc := uint32(d.int32())
+	if sum := crc32.Checksum(d.data, crc32.MakeTable(crc32.Castagnoli)); sum != crc {
+		t.Fatalf("batch crc %x, want %x", crc, sum)
+	}
+	d.int16() // attributes
+	d.int32() // last_offset_delta
+	firstTimestamp := d.int64()
+	d.int64() // max_timestamp
+	d.int64() // producer_id
+	d.int16() // producer_epoch
+	d.int32() // base_sequence
+	count := int(d.int32())
+	varint := func() int64 {
+		v, n := binary.Varint(d.data)
+		if n <= 0 {
+			t.Fatal("invalid varint")
+		}
+		d.data = d.data[n:]
+		return v
+	}
+	records := make([]kafkaRecord, 0, count)
+	for i := 0; i < count; i++ {
+		varint() // length
+		d.int8() // attributes
+		delta := varint()
+		if offsetDelta := varint(); offsetDelta != int64(i) {
+			t.Fatalf("record %d offset delta %d", i, offsetDelta)
+		}
+		key := d.read(int(varint()))
+		value := d.read(int(varint()))
+		varint() // headers
+		records = append(records, kafkaRecord{Key: key, Value: value,
+			Timestamp: time.Unix(0, (firstTimestamp+delta)*int64(time.Millisecond))})
+	}
+	if d.err != nil || len(d.data) != 0 {
+		t.Fatalf("batch decode err %v, %d bytes left", d.err, len(d.data))
+	}
+	return records
+}
@@ -0,0 +1,154 @@
+package recorderstorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+/*
+	LocalReplayStorage 将压缩后的录像保存到本地目录,
+	目录结构与对象存储的 key 保持一致, 如 2021-01-01/{sid}.cast.gz
+*/
+
+type LocalReplayStorage struct {
+	Directory string
+}
+
+func (l LocalReplayStorage) Upload(gZipFilePath, target string) (err error) {
+	dstPath, err := l.absPath(target)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		logger.Errorf("Local storage create dir %s failed: %s", filepath.Dir(dstPath), err)
+		return err
+	}
+	src, err := os.Open(gZipFilePath)
+	if err != nil {
+		logger.Errorf("Open %s file failed: %s", gZipFilePath, err)
+		return err
+	}
+	defer src.Close()
+	// 先写入临时文件再重命名, 避免出现不完整的录像
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		logger.Errorf("Local storage create file %s failed: %s", tmpPath, err)
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		logger.Errorf("Local storage save file %s failed: %s", gZipFilePath, err)
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dstPath)
+}
+
+func (l LocalReplayStorage) Delete(target string) error {
+	absPath, err := l.absPath(target)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(absPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 清理空的日期目录
+	if dir := filepath.Dir(absPath); dir != filepath.Clean(l.Directory) {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+func (l LocalReplayStorage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	root := filepath.Clean(l.Directory)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (l LocalReplayStorage) ListDirs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Clean(l.Directory))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs, nil
+}
+
+func (l LocalReplayStorage) Download(target, localPath string) error {
+	srcPath, err := l.absPath(target)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (l LocalReplayStorage) TypeName() string {
+	return "local"
+}
+
+var errInvalidTarget = errors.New("invalid storage target")
+
+// absPath target 不允许跳出存储目录
+func (l LocalReplayStorage) absPath(target string) (string, error) {
+	root := filepath.Clean(l.Directory)
+	absPath := filepath.Join(root, filepath.FromSlash(target))
+	if rel, err := filepath.Rel(root, absPath); err != nil || rel == "." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) || rel == ".." {
+		return "", fmt.Errorf("%w: %s", errInvalidTarget, target)
+	}
+	return absPath, nil
+}
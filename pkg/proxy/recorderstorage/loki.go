@@ -0,0 +1,117 @@
+package recorderstorage
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+/*
+	LokiCommandStorage 通过 Grafana Loki 的 push API 保存命令,
+	label 只使用固定的值, 会话等高基数的字段放在日志内容中
+*/
+
+type LokiCommandStorage struct {
+	URL      string
+	Labels   map[string]string
+	TenantID string
+	Username string
+	Password string
+
+	InsecureSkipVerify bool
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (l LokiCommandStorage) BulkSave(commands []*model.Command) (err error) {
+	// 高危命令单独一个 stream, 方便告警
+	streams := make(map[int64]*lokiStream)
+	for _, item := range commands {
+		stream, ok := streams[item.RiskLevel]
+		if !ok {
+			labels := map[string]string{"job": "koko"}
+			for k, v := range l.Labels {
+				labels[k] = v
+			}
+			labels["risk_level"] = strconv.FormatInt(item.RiskLevel, 10)
+			stream = &lokiStream{Stream: labels}
+			streams[item.RiskLevel] = stream
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			logger.Errorf("Loki marshal command err: %s", err)
+			return err
+		}
+		timestamp := item.DateCreated
+		if timestamp.IsZero() {
+			timestamp = time.Unix(item.Timestamp, 0)
+		}
+		stream.Values = append(stream.Values,
+			[2]string{strconv.FormatInt(timestamp.UnixNano(), 10), string(data)})
+	}
+	var req lokiPushRequest
+	for _, stream := range streams {
+		req.Streams = append(req.Streams, *stream)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return l.push(body)
+}
+
+func (l LokiCommandStorage) push(body []byte) error {
+	pushURL := strings.TrimSuffix(l.URL, "/")
+	if !strings.HasSuffix(pushURL, lokiPushPath) {
+		pushURL += lokiPushPath
+	}
+	req, err := http.NewRequest(http.MethodPost, pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.TenantID)
+	}
+	if l.Username != "" {
+		req.SetBasicAuth(l.Username, l.Password)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: l.InsecureSkipVerify}
+	client := http.Client{Transport: transport, Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Errorf("Loki push commands err: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("loki push status %d: %s", resp.StatusCode, msg)
+		logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (l LokiCommandStorage) TypeName() string {
+	return "loki"
+}
@@ -0,0 +1,91 @@
+package recorderstorage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+func TestLokiCommandStorage_BulkSave(t *testing.T) {
+	var (
+		reqPath  string
+		tenantID string
+		username string
+		password string
+		pushReq  lokiPushRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath = r.URL.Path
+		tenantID = r.Header.Get("X-Scope-OrgID")
+		username, password, _ = r.BasicAuth()
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &pushReq); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	now := time.Unix(1700000000, 0)
+	commands := []*model.Command{
+		{SessionID: "s1", Input: "ls", RiskLevel: 0, DateCreated: now},
+		{SessionID: "s1", Input: "rm -rf /", RiskLevel: 5, DateCreated: now.Add(time.Second)},
+		{SessionID: "s2", Input: "pwd", RiskLevel: 0, Timestamp: now.Unix() + 2},
+	}
+	storage := LokiCommandStorage{URL: server.URL + "/", Labels: map[string]string{"env": "test"},
+		TenantID: "tenant", Username: "user", Password: "pass"}
+	if err := storage.BulkSave(commands); err != nil {
+		t.Fatal(err)
+	}
+	if reqPath != lokiPushPath || tenantID != "tenant" || username != "user" || password != "pass" {
+		t.Fatalf("unexpected request: path %s tenant %s auth %s:%s", reqPath, tenantID, username, password)
+	}
+	// 按风险等级分为两个 stream
+	if len(pushReq.Streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(pushReq.Streams))
+	}
+	inputs := make(map[string][]string)
+	for _, stream := range pushReq.Streams {
+		if stream.Stream["job"] != "koko" || stream.Stream["env"] != "test" {
+			t.Fatalf("unexpected labels: %v", stream.Stream)
+		}
+		for _, value := range stream.Values {
+			var cmd model.Command
+			if err := json.Unmarshal([]byte(value[1]), &cmd); err != nil {
+				t.Fatal(err)
+			}
+			timestamp := cmd.DateCreated
+			if timestamp.IsZero() {
+				timestamp = time.Unix(cmd.Timestamp, 0)
+			}
+			if value[0] != strconv.FormatInt(timestamp.UnixNano(), 10) {
+				t.Fatalf("command %s timestamp %s", cmd.Input, value[0])
+			}
+			riskLevel := stream.Stream["risk_level"]
+			inputs[riskLevel] = append(inputs[riskLevel], cmd.Input)
+		}
+	}
+	if len(inputs["0"]) != 2 || inputs["0"][0] != "ls" || inputs["0"][1] != "pwd" ||
+		len(inputs["5"]) != 1 || inputs["5"][0] != "rm -rf /" {
+		t.Fatalf("unexpected stream values: %v", inputs)
+	}
+}
+
+func TestLokiCommandStorage_BulkSaveError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "entry too far behind", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	storage := LokiCommandStorage{URL: server.URL + lokiPushPath}
+	err := storage.BulkSave([]*model.Command{{SessionID: "s1", Input: "ls", DateCreated: time.Now()}})
+	if err == nil {
+		t.Fatal("expected error for non 2xx status")
+	}
+}
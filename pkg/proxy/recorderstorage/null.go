@@ -23,6 +23,22 @@ func (f NullStorage) Upload(gZipFile, target string) (err error) {
 	return
 }
 
+func (f NullStorage) Delete(target string) (err error) {
+	return
+}
+
+func (f NullStorage) List(prefix string) (objects []ObjectInfo, err error) {
+	return
+}
+
+func (f NullStorage) ListDirs() (dirs []string, err error) {
+	return
+}
+
+func (f NullStorage) Download(target, localPath string) (err error) {
+	return ErrNotSupported
+}
+
 func (f NullStorage) TypeName() string {
 	return "null"
 }
@@ -1,6 +1,9 @@
 package recorderstorage
 
 import (
+	"io"
+	"os"
+
 	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
 
 	"github.com/jumpserver/koko/pkg/logger"
@@ -30,6 +33,41 @@ func (o OBSReplayStorage) Upload(gZipFilePath, target string) (err error) {
 	return
 }
 
+func (o OBSReplayStorage) Delete(target string) error {
+	return ErrNotSupported
+}
+
+func (o OBSReplayStorage) List(prefix string) ([]ObjectInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (o OBSReplayStorage) ListDirs() ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (o OBSReplayStorage) Download(target, localPath string) (err error) {
+	client, err := obs.New(o.AccessKey, o.SecretKey, o.Endpoint)
+	if err != nil {
+		return
+	}
+	input := &obs.GetObjectInput{}
+	input.Bucket = o.Bucket
+	input.Key = target
+	output, err := client.GetObject(input)
+	if err != nil {
+		logger.Errorf("OBS download file %s failed: %s", target, err)
+		return err
+	}
+	defer output.Body.Close()
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, output.Body)
+	return err
+}
+
 func (o OBSReplayStorage) TypeName() string {
 	return "obs"
 }
@@ -26,6 +26,31 @@ func (o OSSReplayStorage) Upload(gZipFilePath, target string) (err error) {
 	return bucket.PutObjectFromFile(target, gZipFilePath)
 }
 
+func (o OSSReplayStorage) Delete(target string) error {
+	return ErrNotSupported
+}
+
+func (o OSSReplayStorage) List(prefix string) ([]ObjectInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (o OSSReplayStorage) ListDirs() ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (o OSSReplayStorage) Download(target, localPath string) (err error) {
+	client, err := oss.New(o.Endpoint, o.AccessKey, o.SecretKey)
+	if err != nil {
+		return
+	}
+	bucket, err := client.Bucket(o.Bucket)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	return bucket.GetObjectToFile(target, localPath)
+}
+
 func (o OSSReplayStorage) TypeName() string {
 	return "oss"
 }
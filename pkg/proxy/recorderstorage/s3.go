@@ -1,11 +1,15 @@
 package recorderstorage
 
 import (
+	"crypto/tls"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/jumpserver/koko/pkg/logger"
@@ -17,6 +21,27 @@ type S3ReplayStorage struct {
 	AccessKey string
 	SecretKey string
 	Endpoint  string
+
+	// MinIO 等自建的对象存储需要使用 path-style 的地址
+	ForcePathStyle     bool
+	InsecureSkipVerify bool
+}
+
+func (s S3ReplayStorage) newSession() (*session.Session, error) {
+	s3Config := &aws.Config{
+		Credentials:      credentials.NewStaticCredentials(s.AccessKey, s.SecretKey, ""),
+		Region:           aws.String(s.Region),
+		S3ForcePathStyle: aws.Bool(s.ForcePathStyle),
+	}
+	if s.Endpoint != "" {
+		s3Config.Endpoint = aws.String(s.Endpoint)
+	}
+	if s.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		s3Config.HTTPClient = &http.Client{Transport: transport}
+	}
+	return session.NewSession(s3Config)
 }
 
 func (s S3ReplayStorage) Upload(gZipFilePath, target string) (err error) {
@@ -27,14 +52,8 @@ func (s S3ReplayStorage) Upload(gZipFilePath, target string) (err error) {
 		return err
 	}
 	defer file.Close()
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(s.AccessKey, s.SecretKey, ""),
-		Endpoint:         aws.String(s.Endpoint),
-		Region:           aws.String(s.Region),
-		S3ForcePathStyle: aws.Bool(true),
-	}
 
-	sess, err := session.NewSession(s3Config)
+	sess, err := s.newSession()
 	if err != nil {
 		logger.Errorf("S3 new session failed: %s", err)
 		return err
@@ -56,6 +75,94 @@ func (s S3ReplayStorage) Upload(gZipFilePath, target string) (err error) {
 	return
 }
 
+func (s S3ReplayStorage) Delete(target string) error {
+	sess, err := s.newSession()
+	if err != nil {
+		logger.Errorf("S3 new session failed: %s", err)
+		return err
+	}
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(target),
+	})
+	if err != nil {
+		logger.Errorf("S3 delete file %s failed: %s", target, err)
+	}
+	return err
+}
+
+func (s S3ReplayStorage) List(prefix string) ([]ObjectInfo, error) {
+	sess, err := s.newSession()
+	if err != nil {
+		logger.Errorf("S3 new session failed: %s", err)
+		return nil, err
+	}
+	var objects []ObjectInfo
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	err = s3.New(sess).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(item.Key),
+				Size:         aws.Int64Value(item.Size),
+				LastModified: aws.TimeValue(item.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		logger.Errorf("S3 list files with prefix %s failed: %s", prefix, err)
+	}
+	return objects, err
+}
+
+// ListDirs 使用 Delimiter 只返回顶层的 CommonPrefixes, 不遍历整个 bucket
+func (s S3ReplayStorage) ListDirs() ([]string, error) {
+	sess, err := s.newSession()
+	if err != nil {
+		logger.Errorf("S3 new session failed: %s", err)
+		return nil, err
+	}
+	var dirs []string
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Delimiter: aws.String("/"),
+	}
+	err = s3.New(sess).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.CommonPrefixes {
+			dirs = append(dirs, strings.TrimSuffix(aws.StringValue(item.Prefix), "/"))
+		}
+		return true
+	})
+	if err != nil {
+		logger.Errorf("S3 list dirs failed: %s", err)
+	}
+	return dirs, err
+}
+
+func (s S3ReplayStorage) Download(target, localPath string) (err error) {
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sess, err := s.newSession()
+	if err != nil {
+		logger.Errorf("S3 new session failed: %s", err)
+		return err
+	}
+	_, err = s3manager.NewDownloader(sess).Download(file, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(target),
+	})
+	if err != nil {
+		logger.Errorf("S3 download file %s failed: %s", target, err)
+	}
+	return err
+}
+
 func (s S3ReplayStorage) TypeName() string {
 	return "s3"
-}
\ No newline at end of file
+}
@@ -22,6 +22,24 @@ func (s ServerStorage) Upload(gZipFilePath, target string) (err error) {
 	return s.JmsService.Upload(sessionID, gZipFilePath)
 }
 
+// Delete 录像保存在 core 中, 由 core 负责清理
+func (s ServerStorage) Delete(target string) error {
+	return ErrNotSupported
+}
+
+func (s ServerStorage) List(prefix string) ([]ObjectInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (s ServerStorage) ListDirs() ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// Download core 没有按 target 下载录像的接口, 录像需要通过 core 的会话录像接口查看
+func (s ServerStorage) Download(target, localPath string) error {
+	return ErrNotSupported
+}
+
 func (s ServerStorage) TypeName() string {
 	return s.StorageType
 }
@@ -0,0 +1,15 @@
+package recorderstorage
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotSupported = errors.New("operation not supported by this storage")
+
+// ObjectInfo 存储中的录像文件
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
@@ -0,0 +1,600 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+/*
+	Redis 会话按命令过滤:
+		按 redis-cli 的规则切分参数(支持引号和转义), 得到规范的命令名和操作的 key,
+		规则的 StatementTypes 匹配命令名(如 FLUSHALL、CONFIG|SET), Tables 匹配 key 的 glob 模式,
+		正则规则匹配规范化后的命令行。
+		EVAL、SCRIPT LOAD、FUNCTION LOAD 会检查脚本中 redis.call/redis.pcall 调用的命令,
+		无法静态确定调用的命令时增加 SCRIPT_DYNAMIC_CALL 类型,
+		EVALSHA 执行的脚本不是本会话加载的时增加 EVALSHA_UNKNOWN_SCRIPT 类型。
+*/
+
+const (
+	redisTypeDynamicCall   = "SCRIPT_DYNAMIC_CALL"
+	redisTypeUnknownScript = "EVALSHA_UNKNOWN_SCRIPT"
+)
+
+type redisCommand struct {
+	// Text 规范化后的命令行, 命令名为大写
+	Text  string
+	Names []string
+	Keys  []string
+}
+
+// redisKeySpec 与 COMMAND INFO 中的 first key、last key、step 含义一致, last 为负数表示从末尾计算
+type redisKeySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+var redisKeySpecs = map[string]redisKeySpec{}
+
+func init() {
+	specs := []struct {
+		spec     redisKeySpec
+		commands string
+	}{
+		{redisKeySpec{1, 1, 1}, "GET SET SETNX SETEX PSETEX APPEND STRLEN INCR DECR INCRBY DECRBY INCRBYFLOAT " +
+			"GETSET GETDEL GETEX GETRANGE SUBSTR SETRANGE GETBIT SETBIT BITCOUNT BITPOS BITFIELD BITFIELD_RO " +
+			"EXPIRE PEXPIRE EXPIREAT PEXPIREAT EXPIRETIME PEXPIRETIME PERSIST TTL PTTL TYPE DUMP RESTORE MOVE " +
+			"HGET HSET HSETNX HMSET HMGET HDEL HLEN HEXISTS HKEYS HVALS HGETALL HINCRBY HINCRBYFLOAT HSCAN " +
+			"HSTRLEN HRANDFIELD LPUSH RPUSH LPUSHX RPUSHX LPOP RPOP LLEN LRANGE LINDEX LSET LINSERT LREM LTRIM " +
+			"LPOS SADD SREM SCARD SMEMBERS SISMEMBER SMISMEMBER SPOP SRANDMEMBER SSCAN ZADD ZREM ZCARD ZSCORE " +
+			"ZMSCORE ZINCRBY ZRANK ZREVRANK ZRANGE ZREVRANGE ZRANGEBYSCORE ZREVRANGEBYSCORE ZRANGEBYLEX " +
+			"ZREVRANGEBYLEX ZCOUNT ZLEXCOUNT ZREMRANGEBYRANK ZREMRANGEBYSCORE ZREMRANGEBYLEX ZSCAN ZPOPMIN " +
+			"ZPOPMAX ZRANDMEMBER PFADD GEOADD GEODIST GEOHASH GEOPOS GEORADIUS GEORADIUS_RO GEORADIUSBYMEMBER " +
+			"GEORADIUSBYMEMBER_RO GEOSEARCH XADD XLEN XRANGE XREVRANGE XDEL XTRIM XACK XPENDING XCLAIM " +
+			"XAUTOCLAIM XSETID SORT SORT_RO PUBLISH"},
+		{redisKeySpec{1, -1, 1}, "DEL UNLINK EXISTS TOUCH MGET WATCH SINTER SUNION SDIFF SINTERSTORE " +
+			"SUNIONSTORE SDIFFSTORE PFCOUNT PFMERGE"},
+		{redisKeySpec{1, -1, 2}, "MSET MSETNX"},
+		{redisKeySpec{1, 2, 1}, "RENAME RENAMENX RPOPLPUSH BRPOPLPUSH SMOVE LMOVE BLMOVE COPY " +
+			"GEOSEARCHSTORE ZRANGESTORE"},
+		{redisKeySpec{1, -2, 1}, "BLPOP BRPOP BZPOPMIN BZPOPMAX"},
+		{redisKeySpec{2, -1, 1}, "BITOP"},
+		{redisKeySpec{2, 2, 1}, "OBJECT|ENCODING OBJECT|FREQ OBJECT|IDLETIME OBJECT|REFCOUNT MEMORY|USAGE " +
+			"XINFO|STREAM XINFO|GROUPS XINFO|CONSUMERS XGROUP|CREATE XGROUP|DESTROY XGROUP|SETID " +
+			"XGROUP|CREATECONSUMER XGROUP|DELCONSUMER"},
+		{redisKeySpec{3, 3, 1}, "MIGRATE"},
+	}
+	for i := range specs {
+		for _, name := range strings.Fields(specs[i].commands) {
+			redisKeySpecs[name] = specs[i].spec
+		}
+	}
+}
+
+// 有子命令的命令, 命令名为 CONFIG|SET 的形式
+var redisContainerCommands = map[string]bool{
+	"ACL": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true,
+	"DEBUG": true, "FUNCTION": true, "LATENCY": true, "MEMORY": true, "MODULE": true,
+	"OBJECT": true, "PUBSUB": true, "SCRIPT": true, "SLOWLOG": true, "XGROUP": true, "XINFO": true,
+}
+
+// 参数中 numkeys 的位置, key 紧跟在 numkeys 之后
+var redisNumKeysIndex = map[string]int{
+	"EVAL": 2, "EVALSHA": 2, "EVAL_RO": 2, "EVALSHA_RO": 2, "FCALL": 2, "FCALL_RO": 2,
+	"ZUNIONSTORE": 2, "ZINTERSTORE": 2, "ZDIFFSTORE": 2, "BLMPOP": 2, "BZMPOP": 2,
+	"ZUNION": 1, "ZINTER": 1, "ZDIFF": 1, "ZINTERCARD": 1, "SINTERCARD": 1, "LMPOP": 1, "ZMPOP": 1,
+}
+
+// parseRedisCommand 按 redis-cli 的规则解析一行命令, scripts 用于查找 EVALSHA 执行的脚本
+func parseRedisCommand(line string, scripts *redisScriptCache) ([]redisCommand, error) {
+	args, err := srvconn.SplitRedisArgs(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	cmd := newRedisCommand(args)
+	cmds := []redisCommand{cmd}
+	name := cmd.Names[len(cmd.Names)-1]
+	var script string
+	switch name {
+	case "EVAL", "EVAL_RO", "SCRIPT|LOAD", "FUNCTION|LOAD":
+		script = lastScriptArg(name, args)
+		scripts.Add(script)
+	case "EVALSHA", "EVALSHA_RO":
+		if len(args) > 1 {
+			var ok bool
+			if script, ok = scripts.Get(args[1]); !ok {
+				cmds[0].Names = append(cmds[0].Names, redisTypeUnknownScript)
+			}
+		}
+	}
+	if script == "" {
+		return cmds, nil
+	}
+	keys, argv := redisScriptArgs(args)
+	calls, dynamic := inspectRedisScript(script, keys, argv)
+	if dynamic {
+		cmds[0].Names = append(cmds[0].Names, redisTypeDynamicCall)
+	}
+	for i := range calls {
+		cmds = append(cmds, newRedisCommand(calls[i]))
+	}
+	return cmds, nil
+}
+
+func newRedisCommand(args []string) redisCommand {
+	name := strings.ToUpper(args[0])
+	cmd := redisCommand{Names: []string{name}}
+	fullName := name
+	if redisContainerCommands[name] && len(args) > 1 {
+		fullName = name + "|" + strings.ToUpper(args[1])
+		cmd.Names = append(cmd.Names, fullName)
+	}
+	cmd.Keys = redisCommandKeys(fullName, args)
+	var text strings.Builder
+	text.WriteString(name)
+	for _, arg := range args[1:] {
+		text.WriteByte(' ')
+		text.WriteString(quoteRedisArg(arg))
+	}
+	cmd.Text = text.String()
+	return cmd
+}
+
+func redisCommandKeys(name string, args []string) []string {
+	if index, ok := redisNumKeysIndex[name]; ok {
+		if index >= len(args) {
+			return nil
+		}
+		numKeys, err := strconv.Atoi(args[index])
+		if err != nil || numKeys <= 0 {
+			return nil
+		}
+		end := minInt(index+1+numKeys, len(args))
+		keys := append([]string(nil), args[index+1:end]...)
+		if strings.HasSuffix(name, "STORE") {
+			// ZUNIONSTORE 等的第一个参数是目标 key
+			keys = append(keys, args[1])
+		}
+		return keys
+	}
+	switch name {
+	case "XREAD", "XREADGROUP":
+		for i := range args {
+			if strings.EqualFold(args[i], "STREAMS") {
+				streams := args[i+1:]
+				return append([]string(nil), streams[:len(streams)/2]...)
+			}
+		}
+		return nil
+	}
+	spec, ok := redisKeySpecs[name]
+	if !ok {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys []string
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+func lastScriptArg(name string, args []string) string {
+	switch name {
+	case "EVAL", "EVAL_RO":
+		if len(args) > 1 {
+			return args[1]
+		}
+	default:
+		// SCRIPT LOAD script, FUNCTION LOAD [REPLACE] code
+		if len(args) > 2 {
+			return args[len(args)-1]
+		}
+	}
+	return ""
+}
+
+// redisScriptArgs 返回 EVAL/EVALSHA 的 KEYS 和 ARGV
+func redisScriptArgs(args []string) (keys, argv []string) {
+	if len(args) < 3 || !strings.HasPrefix(strings.ToUpper(args[0]), "EVAL") {
+		return nil, nil
+	}
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil || numKeys < 0 {
+		return nil, nil
+	}
+	end := minInt(3+numKeys, len(args))
+	return args[3:end], args[end:]
+}
+
+func quoteRedisArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n\"'\\") {
+		return arg
+	}
+	return strconv.Quote(arg)
+}
+
+/*
+	redisScriptCache 记录会话中加载过的脚本,
+	EVAL 和 SCRIPT LOAD 都会在服务端按 SHA1 缓存脚本, 之后可以通过 EVALSHA 执行
+*/
+
+type redisScriptCache struct {
+	lock    sync.Mutex
+	scripts map[string]string
+}
+
+func (c *redisScriptCache) Add(script string) {
+	if c == nil || script == "" {
+		return
+	}
+	sum := sha1.Sum([]byte(script))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.scripts == nil {
+		c.scripts = make(map[string]string)
+	}
+	c.scripts[hex.EncodeToString(sum[:])] = script
+}
+
+func (c *redisScriptCache) Get(sha string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	script, ok := c.scripts[strings.ToLower(sha)]
+	return script, ok
+}
+
+type luaTokenKind int
+
+const (
+	luaTokenName luaTokenKind = iota
+	luaTokenString
+	luaTokenNumber
+	luaTokenSymbol
+)
+
+type luaToken struct {
+	kind  luaTokenKind
+	value string
+}
+
+func (t luaToken) is(kind luaTokenKind, value string) bool {
+	return t.kind == kind && t.value == value
+}
+
+// 可以间接访问 redis 对象或执行动态代码的函数
+var luaDynamicNames = map[string]bool{
+	"_G": true, "getfenv": true, "setfenv": true, "rawget": true,
+	"load": true, "loadstring": true, "dofile": true, "loadfile": true,
+}
+
+/*
+	inspectRedisScript 从 Lua 脚本中找出 redis.call/redis.pcall 调用的命令和参数,
+	参数为 KEYS[n]、ARGV[n] 时替换为实际的值。
+	redis 对象被赋值给其他变量、命令名不是常量等无法确定调用的情况, dynamic 为 true
+*/
+
+func inspectRedisScript(script string, keys, argv []string) (calls [][]string, dynamic bool) {
+	tokens := tokenizeLua(script)
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.kind != luaTokenName {
+			continue
+		}
+		if luaDynamicNames[token.value] {
+			dynamic = true
+			continue
+		}
+		if token.value != "redis" || (i > 0 && tokens[i-1].is(luaTokenSymbol, ".")) {
+			continue
+		}
+		method, next := luaFieldAccess(tokens, i+1)
+		switch method {
+		case "call", "pcall":
+		case "":
+			// redis 被赋值或作为参数传递
+			dynamic = true
+			continue
+		default:
+			continue
+		}
+		args, end, ok := luaCallArgs(tokens, next, keys, argv)
+		if !ok || len(args) == 0 || args[0] == "" {
+			dynamic = true
+			continue
+		}
+		calls = append(calls, args)
+		i = end - 1
+	}
+	return calls, dynamic
+}
+
+// luaFieldAccess 解析 .call、:call、["call"] 形式的字段访问, 返回字段名和之后的位置
+func luaFieldAccess(tokens []luaToken, i int) (string, int) {
+	switch {
+	case i+1 < len(tokens) && (tokens[i].is(luaTokenSymbol, ".") || tokens[i].is(luaTokenSymbol, ":")) &&
+		tokens[i+1].kind == luaTokenName:
+		return tokens[i+1].value, i + 2
+	case i+2 < len(tokens) && tokens[i].is(luaTokenSymbol, "[") && tokens[i+1].kind == luaTokenString &&
+		tokens[i+2].is(luaTokenSymbol, "]"):
+		return tokens[i+1].value, i + 3
+	}
+	return "", i
+}
+
+/*
+	luaCallArgs 解析函数调用的参数, 支持 f(...) 和 f "str" 两种形式,
+	无法确定值的参数为空字符串, 第一个参数无法确定时 ok 为 false
+*/
+
+func luaCallArgs(tokens []luaToken, i int, keys, argv []string) (args []string, end int, ok bool) {
+	if i >= len(tokens) {
+		return nil, i, false
+	}
+	if tokens[i].kind == luaTokenString {
+		return []string{tokens[i].value}, i + 1, true
+	}
+	if !tokens[i].is(luaTokenSymbol, "(") {
+		return nil, i, false
+	}
+	var (
+		depth int
+		arg   []luaToken
+	)
+	flush := func() {
+		args = append(args, luaConstValue(arg, keys, argv))
+		arg = arg[:0]
+	}
+	for j := i + 1; j < len(tokens); j++ {
+		token := tokens[j]
+		if token.kind == luaTokenSymbol {
+			switch token.value {
+			case "(", "{", "[":
+				depth++
+			case ")", "}", "]":
+				if depth == 0 && token.value == ")" {
+					if len(arg) > 0 || len(args) > 0 {
+						flush()
+					}
+					return args, j + 1, len(args) > 0 && args[0] != ""
+				}
+				depth--
+			case ",":
+				if depth == 0 {
+					flush()
+					continue
+				}
+			}
+		}
+		arg = append(arg, token)
+	}
+	return args, len(tokens), false
+}
+
+// luaConstValue 返回常量表达式的值, 支持字符串、数字和 KEYS[n]、ARGV[n]
+func luaConstValue(tokens []luaToken, keys, argv []string) string {
+	switch {
+	case len(tokens) == 1 && (tokens[0].kind == luaTokenString || tokens[0].kind == luaTokenNumber):
+		return tokens[0].value
+	case len(tokens) == 4 && tokens[0].kind == luaTokenName && tokens[1].is(luaTokenSymbol, "[") &&
+		tokens[2].kind == luaTokenNumber && tokens[3].is(luaTokenSymbol, "]"):
+		values := keys
+		switch tokens[0].value {
+		case "KEYS":
+		case "ARGV":
+			values = argv
+		default:
+			return ""
+		}
+		index, err := strconv.Atoi(tokens[2].value)
+		if err != nil || index < 1 || index > len(values) {
+			return ""
+		}
+		return values[index-1]
+	}
+	return ""
+}
+
+// tokenizeLua 去除注释并切分为 token, 字符串 token 的值为转义后的内容
+func tokenizeLua(text string) []luaToken {
+	var tokens []luaToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case isLuaSpace(c):
+			i++
+			continue
+		case strings.HasPrefix(text[i:], "--"):
+			if level, ok := luaLongBracket(text, i+2); ok {
+				_, i = readLuaLongString(text, i+2, level)
+			} else {
+				i = skipLuaLine(text, i)
+			}
+			continue
+		}
+		var token luaToken
+		switch {
+		case c == '\'' || c == '"':
+			token.kind = luaTokenString
+			token.value, i = readLuaQuoted(text, i)
+		case c == '[':
+			if level, ok := luaLongBracket(text, i); ok {
+				token.kind = luaTokenString
+				token.value, i = readLuaLongString(text, i, level)
+				break
+			}
+			token.kind = luaTokenSymbol
+			token.value = "["
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(text) && (isLuaNameByte(text[i]) || text[i] == '.') {
+				i++
+			}
+			token.kind = luaTokenNumber
+			token.value = text[start:i]
+		case isLuaNameByte(c):
+			start := i
+			for i < len(text) && isLuaNameByte(text[i]) {
+				i++
+			}
+			token.kind = luaTokenName
+			token.value = text[start:i]
+		default:
+			token.kind = luaTokenSymbol
+			token.value = text[i : i+1]
+			i++
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func isLuaNameByte(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// luaLongBracket 判断 i 处是否是 [[ 或 [==[ 形式的长字符串开始, 返回等号的个数
+func luaLongBracket(text string, i int) (int, bool) {
+	if i >= len(text) || text[i] != '[' {
+		return 0, false
+	}
+	level := 0
+	for j := i + 1; j < len(text); j++ {
+		switch text[j] {
+		case '=':
+			level++
+		case '[':
+			return level, true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+func readLuaLongString(text string, i, level int) (string, int) {
+	start := i + level + 2
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(text[start:], closing)
+	if end < 0 {
+		return text[start:], len(text)
+	}
+	return text[start : start+end], start + end + len(closing)
+}
+
+func readLuaQuoted(text string, i int) (string, int) {
+	quote := text[i]
+	var value strings.Builder
+	for i++; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			i++
+			switch next := text[i]; {
+			case next == 'n':
+				value.WriteByte('\n')
+			case next == 't':
+				value.WriteByte('\t')
+			case next == 'r':
+				value.WriteByte('\r')
+			case next >= '0' && next <= '9':
+				// \ddd 十进制转义, 如 "\102\108ushall"
+				j := i
+				for j < len(text) && j < i+3 && text[j] >= '0' && text[j] <= '9' {
+					j++
+				}
+				n, _ := strconv.Atoi(text[i:j])
+				value.WriteByte(byte(n))
+				i = j - 1
+			default:
+				value.WriteByte(next)
+			}
+		case c == quote:
+			return value.String(), i + 1
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String(), len(text)
+}
+
+// IsMatchRedisRule Redis 会话按命令匹配过滤规则, 拒绝优先于复核, 复核优先于允许
+func (p *Parser) IsMatchRedisRule(line string) (model.SystemUserFilterRule, string, bool) {
+	cmds, err := parseRedisCommand(line, &p.redisScripts)
+	if err != nil || len(cmds) == 0 {
+		// 无法解析的命令服务端也不会执行, 按原始文本匹配
+		return p.IsMatchCommandRule(line)
+	}
+	var (
+		matchedRule model.SystemUserFilterRule
+		matchedCmd  string
+		matched     bool
+	)
+	for i := range cmds {
+		rule, cmd, ok := p.matchRedisRule(cmds[i])
+		if !ok {
+			continue
+		}
+		switch rule.Action {
+		case model.ActionDeny:
+			return rule, cmd, true
+		case model.ActionConfirm:
+			if !matched || matchedRule.Action != model.ActionConfirm {
+				matchedRule, matchedCmd, matched = rule, cmd, true
+			}
+		default:
+			if !matched {
+				matchedRule, matchedCmd, matched = rule, cmd, true
+			}
+		}
+	}
+	return matchedRule, matchedCmd, matched
+}
+
+func (p *Parser) matchRedisRule(cmd redisCommand) (model.SystemUserFilterRule, string, bool) {
+	// 兼容按小写命令名编写的正则规则
+	lowerText := strings.ToLower(cmd.Names[0]) + strings.TrimPrefix(cmd.Text, cmd.Names[0])
+	for _, rule := range p.cmdFilterRules {
+		action, matchedCmd := rule.MatchRedisCommand(cmd.Names, cmd.Keys, cmd.Text)
+		if action == model.ActionUnknown && rule.RePattern != "" {
+			action, matchedCmd = rule.MatchRedisCommand(cmd.Names, cmd.Keys, lowerText)
+		}
+		switch action {
+		case model.ActionAllow, model.ActionConfirm, model.ActionDeny:
+			return rule, matchedCmd, true
+		default:
+		}
+	}
+	return model.SystemUserFilterRule{}, "", false
+}
+
+func isLuaSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func skipLuaLine(text string, i int) int {
+	if end := strings.IndexByte(text[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(text)
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+func TestParseRedisCommand(t *testing.T) {
+	tests := []struct {
+		line  string
+		names [][]string
+		keys  [][]string
+	}{
+		{
+			line:  `  "flush""all"`,
+			names: nil,
+		},
+		{
+			line:  `"FlushAll"   async`,
+			names: [][]string{{"FLUSHALL"}},
+			keys:  [][]string{nil},
+		},
+		{
+			line:  `config set "save" ""`,
+			names: [][]string{{"CONFIG", "CONFIG|SET"}},
+			keys:  [][]string{nil},
+		},
+		{
+			line:  `mset user:1 a 'user:2' b`,
+			names: [][]string{{"MSET"}},
+			keys:  [][]string{{"user:1", "user:2"}},
+		},
+		{
+			line:  `xread count 2 streams s1 s2 0 0`,
+			names: [][]string{{"XREAD"}},
+			keys:  [][]string{{"s1", "s2"}},
+		},
+		{
+			line:  `eval "redis.call('del', KEYS[1]) return redis [ 'pcall' ] (ARGV[1])" 1 user:1 FLUSHDB`,
+			names: [][]string{{"EVAL"}, {"DEL"}, {"FLUSHDB"}},
+			keys:  [][]string{{"user:1"}, {"user:1"}, nil},
+		},
+		{
+			line:  `eval "local r = redis; return r.call('flushall')" 0`,
+			names: [][]string{{"EVAL", redisTypeDynamicCall}},
+			keys:  [][]string{nil},
+		},
+		{
+			line:  `eval "return redis.call('flu' .. 'shall')" 0`,
+			names: [][]string{{"EVAL", redisTypeDynamicCall}},
+			keys:  [][]string{nil},
+		},
+		{
+			line:  `eval "return redis.call(\"\\102lushall\") -- redis.call('get', 'x')" 0`,
+			names: [][]string{{"EVAL"}, {"FLUSHALL"}},
+			keys:  [][]string{nil, nil},
+		},
+		{
+			line:  `evalsha 0123456789012345678901234567890123456789 0`,
+			names: [][]string{{"EVALSHA", redisTypeUnknownScript}},
+			keys:  [][]string{nil},
+		},
+	}
+	for _, tt := range tests {
+		cmds, err := parseRedisCommand(tt.line, &redisScriptCache{})
+		if tt.names == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.line)
+			}
+			continue
+		}
+		if err != nil || len(cmds) != len(tt.names) {
+			t.Fatalf("%q: expected %d commands, got %+v %v", tt.line, len(tt.names), cmds, err)
+		}
+		for i := range cmds {
+			if !reflect.DeepEqual(cmds[i].Names, tt.names[i]) {
+				t.Errorf("%q: command %d names %v, want %v", tt.line, i, cmds[i].Names, tt.names[i])
+			}
+			if !reflect.DeepEqual(cmds[i].Keys, tt.keys[i]) {
+				t.Errorf("%q: command %d keys %v, want %v", tt.line, i, cmds[i].Keys, tt.keys[i])
+			}
+		}
+	}
+}
+
+func TestParseRedisCommand_EvalSha(t *testing.T) {
+	scripts := &redisScriptCache{}
+	if _, err := parseRedisCommand(`script load "return redis.call('flushall')"`, scripts); err != nil {
+		t.Fatal(err)
+	}
+	// sha1("return redis.call('flushall')")
+	cmds, err := parseRedisCommand(`EVALSHA d530a22111e074618d24a380340dd3d8bc48af4a 0`, scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 2 || cmds[1].Names[0] != "FLUSHALL" {
+		t.Errorf("expected FLUSHALL from loaded script, got %+v", cmds)
+	}
+}
+
+func TestParser_IsMatchRedisRule(t *testing.T) {
+	p := Parser{
+		protocolType: srvconn.ProtocolRedis,
+		cmdFilterRules: []model.SystemUserFilterRule{
+			{ID: "flush", StatementTypes: []string{"FLUSHALL", "FLUSHDB"}, Action: model.ActionDeny},
+			{ID: "config", StatementTypes: []string{"config|set"}, Action: model.ActionConfirm},
+			{ID: "keys", StatementTypes: []string{"DEL", "UNLINK"}, Tables: []string{"order:[0-9]*"}, Action: model.ActionDeny},
+			{ID: "regex", RePattern: `^keys\b`, Action: model.ActionDeny},
+		},
+	}
+	tests := []struct {
+		line string
+		rule string
+	}{
+		{"flushall", "flush"},
+		{"  'FLUSHDB'  ", "flush"},
+		{`eval "return redis.pcall('FlushAll')" 0`, "flush"},
+		{`CONFIG SET dir /tmp`, "config"},
+		{`config get dir`, ""},
+		{`del "order:42" other`, "keys"},
+		{`del order:x`, ""},
+		{`eval "return redis.call('unlink', KEYS[1])" 1 order:1`, "keys"},
+		{`KEYS *`, "regex"},
+		{`get flushall`, ""},
+	}
+	for _, tt := range tests {
+		rule, _, ok := p.IsMatchStatementRule(tt.line)
+		if ok != (tt.rule != "") || rule.ID != tt.rule {
+			t.Errorf("%q: matched rule %q, want %q", tt.line, rule.ID, tt.rule)
+		}
+	}
+}
+
+func TestMatchRedisGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"user:*", "user:1.2/3", true},
+		{"user:?", "user:12", false},
+		{"order:[0-9]*", "order:42", true},
+		{"order:[^0-9]*", "order:42", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"*", "", true},
+	}
+	for _, tt := range tests {
+		if got := model.MatchRedisGlob(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchRedisGlob(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/envelope"
+)
+
+/*
+	录像加密:
+	启用 REPLAY_ENCRYPTION 后, 录制时为会话生成数据密钥, 主密钥加密后的密钥信息保存为 {date}/{sid}.key.json。
+	本地录制的 {sid}.cast 是明文 asciicast 的加密流, 压缩时先解密再压缩, 压缩后的 {sid}.cast.gz 再加密,
+	上传录像前先上传密钥文件, 录像和密钥文件都上传成功后才删除本地的密钥文件。
+	server 存储每个会话只能保存一个录像文件, 不能保存密钥文件, 因此不加密。
+*/
+
+const replayKeySuffix = ".key.json"
+
+var (
+	ErrReplayEncryptionDisabled = errors.New("replay is encrypted but replay encryption is disabled")
+	ErrReplayKeyNotSupported    = errors.New("replay storage can not save replay key")
+)
+
+func ReplayKeyFilename(sid string) string {
+	return sid + replayKeySuffix
+}
+
+// ParseReplayKeyFilename 解析密钥文件名 {sid}.key.json
+func ParseReplayKeyFilename(filename string) (sid string, ok bool) {
+	sid = strings.TrimSuffix(filename, replayKeySuffix)
+	if sid == filename || len(sid) != 36 {
+		return "", false
+	}
+	return sid, true
+}
+
+func replayEncryptionEnabled(storage ReplayStorage) bool {
+	return envelope.Default() != nil && storage.TypeName() != "server"
+}
+
+// newReplayKey 生成会话的数据密钥并保存密钥文件, 返回数据密钥和密钥文件内容
+func newReplayKey(dateDir, sid string) (dataKey, keyInfo []byte, err error) {
+	dataKey, info, err := envelope.GenerateDataKey(envelope.Default())
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyInfo, err = json.Marshal(info); err != nil {
+		return nil, nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dateDir, ReplayKeyFilename(sid)), keyInfo, 0600); err != nil {
+		return nil, nil, err
+	}
+	return dataKey, keyInfo, nil
+}
+
+// LoadReplayKey 读取 dateDir 中会话的数据密钥, 没有密钥文件说明录像没有加密, 返回 nil
+func LoadReplayKey(dateDir, sid string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dateDir, ReplayKeyFilename(sid)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapReplayKey(data)
+}
+
+// UnwrapReplayKey 使用当前的主密钥解密密钥文件中的数据密钥
+func UnwrapReplayKey(data []byte) ([]byte, error) {
+	var info envelope.KeyInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	wrapper := envelope.Default()
+	if wrapper == nil {
+		return nil, ErrReplayEncryptionDisabled
+	}
+	return info.Unwrap(wrapper)
+}
+
+// UploadReplayKey 上传会话的密钥文件, 没有密钥文件时不上传
+func UploadReplayKey(storage ReplayStorage, dateDir, sid string) error {
+	keyPath := filepath.Join(dateDir, ReplayKeyFilename(sid))
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		return nil
+	}
+	if storage.TypeName() == "server" {
+		return ErrReplayKeyNotSupported
+	}
+	target := strings.Join([]string{filepath.Base(dateDir), ReplayKeyFilename(sid)}, "/")
+	return storage.Upload(keyPath, target)
+}
+
+func RemoveReplayKey(dateDir, sid string) {
+	_ = os.Remove(filepath.Join(dateDir, ReplayKeyFilename(sid)))
+}
+
+type replayReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *replayReadCloser) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err2 := r.closers[i].Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+/*
+	OpenReplayFile 打开录像文件, dataKey 不为空时先解密, .gz 文件再解压。
+	未压缩的录像只保存在本地, 可能是正在录制或异常退出时遗留的, 解密时不要求结束帧
+*/
+
+func OpenReplayFile(path string, dataKey []byte) (io.ReadCloser, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	isGzip := strings.HasSuffix(path, replayGzFilenameSuffix)
+	rc := &replayReadCloser{Reader: fd, closers: []io.Closer{fd}}
+	if dataKey != nil {
+		if isGzip {
+			rc.Reader, err = envelope.NewReader(fd, dataKey)
+		} else {
+			rc.Reader, err = envelope.NewRecoveryReader(fd, dataKey)
+		}
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+	}
+	if isGzip {
+		gzReader, err := gzip.NewReader(rc.Reader)
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+		rc.Reader = gzReader
+		rc.closers = append(rc.closers, gzReader)
+	}
+	return rc, nil
+}
+
+/*
+	CompressReplayFile 压缩录像, dataKey 不为空时解密后压缩再加密。
+	dropPartial 时丢弃不完整的最后一行
+*/
+
+func CompressReplayFile(srcPath, dstPath string, dataKey []byte, dropPartial bool) error {
+	src, err := OpenReplayFile(srcPath, dataKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	df, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	var sealer *envelope.Writer
+	var w io.Writer = df
+	if dataKey != nil {
+		if sealer, err = envelope.NewWriter(df, dataKey); err != nil {
+			_ = df.Close()
+			return err
+		}
+		w = sealer
+	}
+	gzWriter := gzip.NewWriter(w)
+	gzWriter.Name = filepath.Base(srcPath)
+	gzWriter.ModTime = time.Now().UTC()
+	if dropPartial {
+		err = copyCompleteLines(gzWriter, src)
+	} else {
+		_, err = io.Copy(gzWriter, src)
+	}
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	if err == nil && sealer != nil {
+		err = sealer.Close()
+	}
+	if closeErr := df.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func copyCompleteLines(dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if _, err = dst.Write(line); err != nil {
+			return err
+		}
+	}
+}
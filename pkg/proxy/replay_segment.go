@@ -0,0 +1,390 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/metrics"
+)
+
+/*
+	录像分段:
+	配置 REPLAY_SEGMENT_DURATION 或 REPLAY_SEGMENT_SIZE 后, 录像按时长或大小切分为 {sid}.{index}.cast,
+	每个分段都写入相同时间戳的 asciicast 头, 事件时间都相对会话开始时间, 播放时去掉后续分段的头拼接即可。
+	分段写完后压缩为 {date}/{sid}.{index}.cast.gz 在会话过程中上传, 每上传一个分段就更新并上传
+	{date}/{sid}.manifest.json, 会话结束后清单标记为 complete 并通知 core 录像上传完成。
+	上传失败的分段和清单保留在本地, 由 UploadRemainReplaySegments 补传。
+*/
+
+const (
+	replayManifestSuffix  = ".manifest.json"
+	replayManifestVersion = 1
+	replaySegmentIndexLen = 4
+)
+
+type ReplayManifest struct {
+	SessionID string `json:"session_id"`
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Complete  bool   `json:"complete"`
+	// 加密录像的密钥文件
+	Key      string          `json:"key,omitempty"`
+	Segments []ReplaySegment `json:"segments"`
+}
+
+// ReplaySegment 是已上传的分段, Start 和 End 是分段第一条和最后一条事件的时间(秒), Size 是压缩后的大小
+type ReplaySegment struct {
+	Index  int     `json:"index"`
+	Target string  `json:"target"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	Size   int64   `json:"size"`
+}
+
+func (m *ReplayManifest) AddSegment(segment ReplaySegment) {
+	for i := range m.Segments {
+		if m.Segments[i].Index == segment.Index {
+			m.Segments[i] = segment
+			return
+		}
+	}
+	m.Segments = append(m.Segments, segment)
+	sort.Slice(m.Segments, func(i, j int) bool {
+		return m.Segments[i].Index < m.Segments[j].Index
+	})
+}
+
+func (m *ReplayManifest) save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func LoadReplayManifest(path string) (*ReplayManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ReplayManifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func ReplaySegmentFilename(sid string, index int) string {
+	return fmt.Sprintf("%s.%0*d%s", sid, replaySegmentIndexLen, index, replayFilenameSuffix)
+}
+
+func ReplayManifestFilename(sid string) string {
+	return sid + replayManifestSuffix
+}
+
+// ParseReplaySegmentFilename 解析分段文件名 {sid}.{index}.cast 或 {sid}.{index}.cast.gz
+func ParseReplaySegmentFilename(filename string) (sid string, index int, ok bool) {
+	name := strings.TrimSuffix(filename, replayGzFilenameSuffix)
+	if !strings.HasSuffix(name, replayFilenameSuffix) {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(name, replayFilenameSuffix), ".")
+	// 序号至少补齐到 replaySegmentIndexLen 位, 超过 9999 的分段序号位数更多
+	if len(parts) != 2 || len(parts[0]) != 36 || len(parts[1]) < replaySegmentIndexLen ||
+		strings.Trim(parts[1], "0123456789") != "" {
+		return
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index <= 0 {
+		return "", 0, false
+	}
+	return parts[0], index, true
+}
+
+// ParseReplayManifestFilename 解析清单文件名 {sid}.manifest.json
+func ParseReplayManifestFilename(filename string) (sid string, ok bool) {
+	sid = strings.TrimSuffix(filename, replayManifestSuffix)
+	if sid == filename || len(sid) != 36 {
+		return "", false
+	}
+	return sid, true
+}
+
+// StitchReplaySegments 按顺序拼接分段, 只保留第一个分段的 asciicast 头
+func StitchReplaySegments(dst io.Writer, segments ...io.Reader) error {
+	for i := range segments {
+		reader := bufio.NewReader(segments[i])
+		if i > 0 {
+			if _, err := reader.ReadBytes('\n'); err != nil {
+				if errors.Is(err, io.EOF) {
+					continue
+				}
+				return err
+			}
+		}
+		if _, err := io.Copy(dst, reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegmentLimit 返回分段的时长和大小限制, 都为 0 时不分段
+func replaySegmentLimit() (time.Duration, int64) {
+	conf := config.GetConf()
+	duration := time.Duration(conf.ReplaySegmentDuration) * time.Minute
+	size := int64(conf.ReplaySegmentSize) * 1024 * 1024
+	if duration < 0 {
+		duration = 0
+	}
+	if size < 0 {
+		size = 0
+	}
+	return duration, size
+}
+
+/*
+	compressReplaySegment 压缩分段并删除原文件, 返回压缩后的路径。
+	koko 异常退出时分段最后一行可能不完整, 压缩时丢弃, 避免拼接后中间出现无法解析的行
+*/
+
+func compressReplaySegment(path string, dataKey []byte) (string, error) {
+	if strings.HasSuffix(path, replayGzFilenameSuffix) {
+		return path, nil
+	}
+	gzPath := path + replayGzFilenameSuffix
+	if err := CompressReplayFile(path, gzPath, dataKey, true); err != nil {
+		_ = os.Remove(gzPath)
+		return "", err
+	}
+	_ = os.Remove(path)
+	return gzPath, nil
+}
+
+// scanReplaySegment 读取压缩分段的头和事件时间范围
+func scanReplaySegment(gzPath string, dataKey []byte) (header asciinema.Header, start, end float64, err error) {
+	src, err := OpenReplayFile(gzPath, dataKey)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	reader, err := asciinema.NewReader(src)
+	if err != nil {
+		return
+	}
+	header = reader.Header()
+	first := true
+	for {
+		event, err2 := reader.ReadEvent()
+		if err2 != nil {
+			if !errors.Is(err2, io.EOF) {
+				err = err2
+			}
+			return
+		}
+		if first {
+			start = event.Time
+			first = false
+		}
+		end = event.Time
+	}
+}
+
+/*
+	replaySegmentUploader 按顺序压缩、上传分段并更新清单。
+	上传失败的分段保留在本地, 清单只记录上传成功的分段
+*/
+
+type replaySegmentUploader struct {
+	sid          string
+	date         string
+	storage      ReplayStorage
+	manifest     *ReplayManifest
+	manifestPath string
+	dateDir      string
+	dataKey      []byte
+	failed       bool
+}
+
+func newReplaySegmentUploader(sid, dateDir string, storage ReplayStorage, dataKey []byte) *replaySegmentUploader {
+	manifestPath := filepath.Join(dateDir, ReplayManifestFilename(sid))
+	manifest, err := LoadReplayManifest(manifestPath)
+	if err != nil {
+		manifest = &ReplayManifest{SessionID: sid}
+	}
+	manifest.Version = replayManifestVersion
+	return &replaySegmentUploader{
+		sid:          sid,
+		date:         filepath.Base(dateDir),
+		storage:      storage,
+		manifest:     manifest,
+		manifestPath: manifestPath,
+		dateDir:      dateDir,
+		dataKey:      dataKey,
+	}
+}
+
+func (u *replaySegmentUploader) target(filename string) string {
+	return strings.Join([]string{u.date, filename}, "/")
+}
+
+// Upload 上传一个分段, 分段为空时直接删除
+func (u *replaySegmentUploader) Upload(path string, index int, maxRetry int) error {
+	if stat, err := os.Stat(path); err == nil && stat.Size() == 0 {
+		_ = os.Remove(path)
+		return nil
+	}
+	if u.dataKey != nil && u.manifest.Key == "" {
+		if err := UploadReplayKey(u.storage, u.dateDir, u.sid); err != nil {
+			u.failed = true
+			return err
+		}
+		u.manifest.Key = u.target(ReplayKeyFilename(u.sid))
+	}
+	gzPath, err := compressReplaySegment(path, u.dataKey)
+	if err != nil {
+		u.failed = true
+		return err
+	}
+	header, start, end, err := scanReplaySegment(gzPath, u.dataKey)
+	if err != nil {
+		logger.Errorf("Session %s scan replay segment %s err: %s", u.sid, gzPath, err)
+	}
+	if u.manifest.Timestamp == 0 && err == nil {
+		u.manifest.Width = header.Width
+		u.manifest.Height = header.Height
+		u.manifest.Timestamp = header.Timestamp
+	}
+	stat, err := os.Stat(gzPath)
+	if err != nil {
+		u.failed = true
+		return err
+	}
+	target := u.target(filepath.Base(gzPath))
+	for i := 0; i <= maxRetry; i++ {
+		logger.Infof("Upload replay segment: %s, type: %s", gzPath, u.storage.TypeName())
+		err = u.storage.Upload(gzPath, target)
+		result := metrics.ResultSuccess
+		if err != nil {
+			result = metrics.ResultFailure
+		}
+		metrics.ReplayUploads.Inc(u.storage.TypeName(), result)
+		if err == nil {
+			break
+		}
+		logger.Errorf("Upload replay segment %s err: %s", gzPath, err)
+	}
+	if err != nil {
+		u.failed = true
+		return err
+	}
+	_ = os.Remove(gzPath)
+	u.manifest.AddSegment(ReplaySegment{
+		Index: index, Target: target,
+		Start: start, End: end, Size: stat.Size(),
+	})
+	return u.uploadManifest()
+}
+
+func (u *replaySegmentUploader) uploadManifest() error {
+	if err := u.manifest.save(u.manifestPath); err != nil {
+		u.failed = true
+		return err
+	}
+	if err := u.storage.Upload(u.manifestPath, u.target(filepath.Base(u.manifestPath))); err != nil {
+		u.failed = true
+		return err
+	}
+	return nil
+}
+
+/*
+	Finish 标记清单完成并上传, 所有分段都上传成功后通知 core 并删除本地清单,
+	否则保留清单等待补传
+*/
+
+func (u *replaySegmentUploader) Finish(jmsService *service.JMService) error {
+	if len(u.manifest.Segments) == 0 && !u.failed {
+		// 没有任何输出, 与不分段时一样不上传录像
+		_ = os.Remove(u.manifestPath)
+		RemoveReplayKey(u.dateDir, u.sid)
+		return nil
+	}
+	u.manifest.Complete = true
+	if err := u.uploadManifest(); err != nil {
+		return err
+	}
+	if u.failed {
+		return fmt.Errorf("session %s has replay segments not uploaded", u.sid)
+	}
+	if err := jmsService.FinishReply(u.sid); err != nil {
+		return err
+	}
+	_ = os.Remove(u.manifestPath)
+	RemoveReplayKey(u.dateDir, u.sid)
+	return nil
+}
+
+/*
+	UploadRemainReplaySegments 补传 dateDir 中会话遗留的分段, 合并到本地清单或新建的清单中,
+	上传完成后标记清单完成并通知 core
+*/
+
+func UploadRemainReplaySegments(jmsService *service.JMService, storage ReplayStorage, dateDir, sid string) error {
+	matches, err := filepath.Glob(filepath.Join(dateDir, sid+".*"))
+	if err != nil {
+		return err
+	}
+	// 压缩时异常退出会同时存在未压缩和不完整的压缩文件, 优先使用未压缩的文件
+	segmentPaths := make(map[int]string)
+	for _, path := range matches {
+		_, index, ok := ParseReplaySegmentFilename(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		if exist, ok := segmentPaths[index]; ok && !strings.HasSuffix(exist, replayGzFilenameSuffix) {
+			continue
+		}
+		segmentPaths[index] = path
+	}
+	indexes := make([]int, 0, len(segmentPaths))
+	for index := range segmentPaths {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	dataKey, err := LoadReplayKey(dateDir, sid)
+	if err != nil {
+		return err
+	}
+	uploader := newReplaySegmentUploader(sid, dateDir, storage, dataKey)
+	for _, index := range indexes {
+		if err = uploader.Upload(segmentPaths[index], index, 0); err != nil {
+			return err
+		}
+	}
+	if err = uploader.Finish(jmsService); err != nil {
+		return err
+	}
+	logger.Infof("Upload remain replay segments of session %s success", sid)
+	return nil
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/asciinema"
+	"github.com/jumpserver/koko/pkg/envelope"
+	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
+)
+
+const testSegmentSid = "0b6f3c2e-6a4b-4c3e-9d2a-1f5e8a7b9c0d"
+
+func TestParseReplaySegmentFilename(t *testing.T) {
+	name := ReplaySegmentFilename(testSegmentSid, 12)
+	if name != testSegmentSid+".0012.cast" {
+		t.Fatalf("unexpected segment filename %s", name)
+	}
+	for _, filename := range []string{name, name + ".gz"} {
+		sid, index, ok := ParseReplaySegmentFilename(filename)
+		if !ok || sid != testSegmentSid || index != 12 {
+			t.Fatalf("parse %s got %s %d %v", filename, sid, index, ok)
+		}
+	}
+	// 长时间会话的分段序号超过 4 位
+	name = ReplaySegmentFilename(testSegmentSid, 10000)
+	if sid, index, ok := ParseReplaySegmentFilename(name + ".gz"); !ok || sid != testSegmentSid || index != 10000 {
+		t.Fatalf("parse %s got %s %d %v", name, sid, index, ok)
+	}
+	for _, filename := range []string{
+		testSegmentSid + ".cast", testSegmentSid + ".cast.gz",
+		testSegmentSid + ".0000.cast", testSegmentSid + ".12.cast",
+		testSegmentSid + ".+0012.cast",
+	} {
+		if _, _, ok := ParseReplaySegmentFilename(filename); ok {
+			t.Fatalf("%s should not be a segment", filename)
+		}
+	}
+	if sid, ok := ParseReplayManifestFilename(ReplayManifestFilename(testSegmentSid)); !ok || sid != testSegmentSid {
+		t.Fatal("parse manifest filename failed")
+	}
+}
+
+func TestReplaySegmentUploadAndStitch(t *testing.T) {
+	testReplaySegmentUploadAndStitch(t, nil)
+	dataKey := make([]byte, envelope.DataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	testReplaySegmentUploadAndStitch(t, dataKey)
+}
+
+func testReplaySegmentUploadAndStitch(t *testing.T, dataKey []byte) {
+	dateDir := filepath.Join(t.TempDir(), "2021-01-01")
+	if err := os.MkdirAll(dateDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	header := `{"version":2,"width":80,"height":24,"timestamp":1609459200,"env":{"SHELL":"/bin/bash","TERM":"xterm"}}` + "\n"
+	segments := []string{
+		header + `[0.5,"o","a"]` + "\n" + `[1.5,"o","b"]` + "\n",
+		// 异常退出时最后一行不完整
+		header + `[61.0,"o","c"]` + "\n" + `[62.0,"o",`,
+	}
+	for i, content := range segments {
+		path := filepath.Join(dateDir, ReplaySegmentFilename(testSegmentSid, i+1))
+		if err := writeReplayFile(path, content, dataKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storageDir := t.TempDir()
+	uploader := newReplaySegmentUploader(testSegmentSid, dateDir, storage.LocalReplayStorage{Directory: storageDir}, dataKey)
+	for i := range segments {
+		path := filepath.Join(dateDir, ReplaySegmentFilename(testSegmentSid, i+1))
+		if err := uploader.Upload(path, i+1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := LoadReplayManifest(filepath.Join(storageDir, "2021-01-01", ReplayManifestFilename(testSegmentSid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Width != 80 || len(manifest.Segments) != 2 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if seg := manifest.Segments[1]; seg.Index != 2 || seg.Start != 61 || seg.End != 61 ||
+		seg.Target != "2021-01-01/"+testSegmentSid+".0002.cast.gz" {
+		t.Fatalf("unexpected segment %+v", seg)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dateDir, testSegmentSid+".*.cast*")); len(files) != 0 {
+		t.Fatalf("local segments not removed: %v", files)
+	}
+
+	readers := make([]io.Reader, 0, len(manifest.Segments))
+	for _, seg := range manifest.Segments {
+		reader, err := OpenReplayFile(filepath.Join(storageDir, seg.Target), dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	var buf bytes.Buffer
+	if err = StitchReplaySegments(&buf, readers...); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := asciinema.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	for {
+		event, err := reader.ReadEvent()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data += event.Data
+	}
+	if data != "abc" {
+		t.Fatalf("stitched replay got %q", data)
+	}
+}
+
+func writeReplayFile(path, content string, dataKey []byte) error {
+	if dataKey == nil {
+		return ioutil.WriteFile(path, []byte(content), 0640)
+	}
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	sealer, err := envelope.NewWriter(fd, dataKey)
+	if err != nil {
+		return err
+	}
+	if _, err = sealer.Write([]byte(content)); err != nil {
+		return err
+	}
+	return sealer.Close()
+}
+
+func TestReplaySegmentQueue(t *testing.T) {
+	q := newReplaySegmentQueue()
+	// 没有消费者时入队也不会阻塞
+	for i := 1; i <= 100; i++ {
+		q.Push(replaySegmentFile{index: i})
+	}
+	done := make(chan []int)
+	go func() {
+		var indexes []int
+		for {
+			segment, ok := q.Pop()
+			if !ok {
+				done <- indexes
+				return
+			}
+			indexes = append(indexes, segment.index)
+		}
+	}()
+	q.Push(replaySegmentFile{index: 101})
+	q.Close()
+	indexes := <-done
+	if len(indexes) != 101 {
+		t.Fatalf("got %d segments, want 101", len(indexes))
+	}
+	for i := range indexes {
+		if indexes[i] != i+1 {
+			t.Fatalf("segment %d got index %d", i, indexes[i])
+		}
+	}
+}
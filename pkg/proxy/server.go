@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,12 +20,17 @@ import (
 
 	"github.com/jumpserver/koko/pkg/common"
 	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/filerecord"
+	"github.com/jumpserver/koko/pkg/hostkey"
 	"github.com/jumpserver/koko/pkg/i18n"
 	modelCommon "github.com/jumpserver/koko/pkg/jms-sdk-go/common"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/offline"
 	"github.com/jumpserver/koko/pkg/srvconn"
+	"github.com/jumpserver/koko/pkg/sshca"
+	"github.com/jumpserver/koko/pkg/tracing"
 	"github.com/jumpserver/koko/pkg/utils"
 )
 
@@ -121,7 +127,7 @@ func (opts *ConnectionOptions) TerminalTitle() string {
 			opts.systemUser.Username,
 			opts.asset.IP)
 	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer,
-		srvconn.ProtocolRedis:
+		srvconn.ProtocolRedis, srvconn.ProtocolPostgreSQL:
 		title = fmt.Sprintf("%s://%s@%s",
 			opts.ProtocolType,
 			opts.systemUser.Username,
@@ -141,7 +147,8 @@ func (opts *ConnectionOptions) ConnectMsg() string {
 	case srvconn.ProtocolTELNET,
 		srvconn.ProtocolSSH:
 		msg = fmt.Sprintf(lang.T("Connecting to %s@%s"), opts.systemUser.Name, opts.asset.IP)
-	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer, srvconn.ProtocolRedis:
+	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer, srvconn.ProtocolRedis,
+		srvconn.ProtocolPostgreSQL:
 		msg = fmt.Sprintf(lang.T("Connecting to Database %s"), opts.app)
 	case srvconn.ProtocolK8s:
 		msg = fmt.Sprintf(lang.T("Connecting to Kubernetes %s"), opts.app.Attrs.Cluster)
@@ -162,6 +169,7 @@ var (
 	ErrUnMatchProtocol = errors.New("the protocols are not matched")
 	ErrAPIFailed       = errors.New("api failed")
 	ErrPermission      = errors.New("no permission")
+	ErrSessionNotReady = errors.New("session is not ready")
 	ErrNoAuthInfo      = errors.New("no auth info")
 )
 
@@ -178,20 +186,28 @@ var (
 		5. 获取当前的终端配置，（录像和命令存储配置)
 */
 
-func NewServer(conn UserConnection, jmsService *service.JMService, opts ...ConnectionOption) (*Server, error) {
+func NewServer(conn UserConnection, jmsService *service.JMService, opts ...ConnectionOption) (srv *Server, err error) {
 	connOpts := &ConnectionOptions{}
 	for _, setter := range opts {
 		setter(connOpts)
 	}
 	lang := connOpts.getLang()
+	traceCtx, span := tracing.Start(conn.Context(), "koko.prepare_session",
+		tracing.String("koko.protocol", connOpts.ProtocolType))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	// core 不可达时使用离线缓存的请求会标记 marker, 这样的会话标记为降级会话
+	apiCtx, marker := offline.WithMarker(tracing.Detach(traceCtx))
+	apiService := jmsService.WithContext(apiCtx)
 
 	if err := srvconn.IsSupportedProtocol(connOpts.ProtocolType); err != nil {
 		logger.Errorf("Conn[%s] checking protocol %s failed: %s", conn.ID(),
 			connOpts.ProtocolType, err)
 		var errMsg string
 		switch {
-		case errors.Is(err, srvconn.ErrMySQLClient), errors.Is(err, srvconn.ErrRedisClient),
-			errors.Is(err, srvconn.ErrKubectlClient), errors.Is(err, srvconn.ErrSQLServerClient):
+		case errors.Is(err, srvconn.ErrKubectlClient), errors.Is(err, srvconn.ErrPostgreSQLClient):
 			errMsg = lang.T("%s protocol client not installed.")
 			errMsg = fmt.Sprintf(errMsg, connOpts.ProtocolType)
 			err = fmt.Errorf("%w: %s", ErrMissClient, err)
@@ -204,7 +220,7 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 		return nil, err
 	}
 
-	terminalConf, err := jmsService.GetTerminalConfig()
+	terminalConf, err := apiService.GetTerminalConfig()
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err)
 	}
@@ -221,7 +237,7 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 		appId = connOpts.app.ID
 	}
 
-	filterRules, err := jmsService.GetCommandFilterRules(userId, sysId, assetId, appId)
+	filterRules, err := apiService.GetCommandFilterRules(userId, sysId, assetId, appId)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err)
 	}
@@ -241,22 +257,22 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 
 	switch connOpts.ProtocolType {
 	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolRedis,
-		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer:
-		authInfo, err := jmsService.GetUserApplicationAuthInfo(connOpts.systemUser.ID, connOpts.app.ID,
+		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer, srvconn.ProtocolPostgreSQL:
+		authInfo, err := apiService.GetUserApplicationAuthInfo(connOpts.systemUser.ID, connOpts.app.ID,
 			connOpts.user.ID, connOpts.user.Username)
 		if err != nil {
 			return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err)
 		}
 		sysUserAuthInfo = &authInfo
 		if connOpts.app.Domain != "" {
-			domain, err := jmsService.GetDomainGateways(connOpts.app.Domain)
+			domain, err := apiService.GetDomainGateways(connOpts.app.Domain)
 			if err != nil {
 				return nil, err
 			}
 			domainGateways = &domain
 		}
 		checkConnectPermFunc = func() (model.ExpireInfo, error) {
-			return jmsService.ValidateApplicationPermission(connOpts.user.ID,
+			return apiService.ValidateApplicationPermission(connOpts.user.ID,
 				connOpts.app.ID, connOpts.systemUser.ID)
 		}
 		assetName := connOpts.app.Name
@@ -284,7 +300,7 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 			return nil, fmt.Errorf("%w: %s", ErrUnMatchProtocol, msg)
 		}
 
-		authInfo, err := jmsService.GetSystemUserAuthById(connOpts.systemUser.ID, connOpts.asset.ID,
+		authInfo, err := apiService.GetSystemUserAuthById(connOpts.systemUser.ID, connOpts.asset.ID,
 			connOpts.user.ID, connOpts.user.Username)
 		if err != nil {
 			return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err)
@@ -293,7 +309,7 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 		if connOpts.systemUser.SuEnabled {
 			suSystemUserId := connOpts.systemUser.SuFrom
 			assetId := connOpts.asset.ID
-			suAuthInfo, err := jmsService.GetSystemUserAuthById(suSystemUserId, assetId,
+			suAuthInfo, err := apiService.GetSystemUserAuthById(suSystemUserId, assetId,
 				connOpts.user.ID, connOpts.user.Username)
 			if err != nil {
 				return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err)
@@ -301,22 +317,22 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 			suSysUserAuthInfo = &suAuthInfo
 		}
 		if connOpts.asset.Domain != "" {
-			domain, err := jmsService.GetDomainGateways(connOpts.asset.Domain)
+			domain, err := apiService.GetDomainGateways(connOpts.asset.Domain)
 			if err != nil {
 				return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err)
 			}
 			domainGateways = &domain
 		}
 		checkConnectPermFunc = func() (model.ExpireInfo, error) {
-			return jmsService.ValidateAssetConnectPermission(connOpts.user.ID,
+			return apiService.ValidateAssetConnectPermission(connOpts.user.ID,
 				connOpts.asset.ID, connOpts.systemUser.ID)
 		}
-		assetPlatform, err2 := jmsService.GetAssetPlatform(connOpts.asset.ID)
+		assetPlatform, err2 := apiService.GetAssetPlatform(connOpts.asset.ID)
 		if err2 != nil {
 			return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err2)
 		}
 		// 获取权限校验
-		permission, err3 := jmsService.GetPermission(connOpts.user.ID, connOpts.asset.ID, connOpts.systemUser.ID)
+		permission, err3 := apiService.GetPermission(connOpts.user.ID, connOpts.asset.ID, connOpts.systemUser.ID)
 		if err3 != nil {
 			return nil, fmt.Errorf("%w: %s", ErrAPIFailed, err3)
 		}
@@ -348,6 +364,14 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 		utils.IgnoreErrWriteString(conn, msg)
 		return nil, ErrPermission
 	}
+	if marker.Degraded() {
+		apiSession.IsDegraded = true
+		logger.Warnf("Conn[%s] core unreachable, session %s use offline cache", conn.ID(), apiSession.ID)
+		msg := lang.T("Core API is unreachable, connecting in degraded mode with cached permissions")
+		utils.IgnoreErrWriteString(conn, utils.WrapperWarn(msg))
+		utils.IgnoreErrWriteString(conn, utils.CharNewLine)
+	}
+	reporter := &sessionReporter{jmsService: jmsService, session: apiSession}
 
 	return &Server{
 		ID:         apiSession.ID,
@@ -366,19 +390,11 @@ func NewServer(conn UserConnection, jmsService *service.JMService, opts ...Conne
 		platform:       platform,
 		permActions:    perms,
 		sessionInfo:    apiSession,
-		CreateSessionCallback: func() error {
-			apiSession.DateStart = modelCommon.NewNowUTCTime()
-			return jmsService.CreateSession(*apiSession)
-		},
-		ConnectedSuccessCallback: func() error {
-			return jmsService.SessionSuccess(apiSession.ID)
-		},
-		ConnectedFailedCallback: func(err error) error {
-			return jmsService.SessionFailed(apiSession.ID, err)
-		},
-		DisConnectedCallback: func() error {
-			return jmsService.SessionDisconnect(apiSession.ID)
-		},
+
+		CreateSessionCallback:    reporter.Create,
+		ConnectedSuccessCallback: reporter.Success,
+		ConnectedFailedCallback:  reporter.Failed,
+		DisConnectedCallback:     reporter.Disconnect,
 	}, nil
 }
 
@@ -404,6 +420,8 @@ type Server struct {
 
 	cacheSSHConnection *srvconn.SSHConnection
 
+	agentForwarder *srvconn.AgentForwarder
+
 	CreateSessionCallback    func() error
 	ConnectedSuccessCallback func() error
 	ConnectedFailedCallback  func(err error) error
@@ -414,6 +432,11 @@ type Server struct {
 	OnSessionInfo func(info *model.Session)
 
 	loginTicketId string
+
+	// 正在录制内容的 ZMODEM 文件
+	zmodemRecordLock sync.Mutex
+	zmodemRecordFile *zmodem.ZFileInfo
+	zmodemRecorder   *filerecord.Recorder
 }
 
 func (s *Server) IsKeyboardMode() bool {
@@ -435,23 +458,20 @@ func (s *Server) CheckPermissionExpired(now time.Time) bool {
 func (s *Server) ZmodemFileTransferEvent(zinfo *zmodem.ZFileInfo, status bool) {
 	switch s.connOpts.ProtocolType {
 	case srvconn.ProtocolTELNET, srvconn.ProtocolSSH:
-		operate := model.OperateDownload
-		switch zinfo.Type() {
-		case zmodem.TypeUpload:
-			operate = model.OperateUpload
-		case zmodem.TypeDownload:
-			operate = model.OperateDownload
-		}
+		recorder := s.takeZmodemRecorder(zinfo)
+		recorder.Close()
 		item := model.FTPLog{
 			OrgID:      s.connOpts.asset.OrgID,
 			User:       s.connOpts.user.String(),
 			Hostname:   s.connOpts.asset.String(),
 			SystemUser: s.systemUserAuthInfo.String(),
 			RemoteAddr: s.UserConn.RemoteAddr(),
-			Operate:    operate,
+			Operate:    zmodemOperate(zinfo),
 			Path:       zinfo.Filename(),
 			DateStart:  modelCommon.NewUTCTime(zinfo.Time()),
 			IsSuccess:  status,
+
+			ContentRecord: recorder.Target(),
 		}
 		if err := s.jmsService.CreateFileOperationLog(item); err != nil {
 			logger.Errorf("Create zmodem ftp log err: %s", err)
@@ -459,6 +479,52 @@ func (s *Server) ZmodemFileTransferEvent(zinfo *zmodem.ZFileInfo, status bool) {
 	}
 }
 
+// ZmodemFileDataEvent 录制 ZMODEM 传输的文件内容, 新文件的数据到达时结束上一个文件的录制
+func (s *Server) ZmodemFileDataEvent(zinfo *zmodem.ZFileInfo, offset int64, p []byte) {
+	switch s.connOpts.ProtocolType {
+	case srvconn.ProtocolTELNET, srvconn.ProtocolSSH:
+	default:
+		return
+	}
+	s.zmodemRecordLock.Lock()
+	defer s.zmodemRecordLock.Unlock()
+	if s.zmodemRecordFile != zinfo {
+		s.zmodemRecorder.Close()
+		s.zmodemRecordFile = zinfo
+		s.zmodemRecorder = filerecord.New(filerecord.Info{
+			SessionID:  s.ID,
+			User:       s.connOpts.user.String(),
+			Asset:      s.connOpts.asset.String(),
+			OrgID:      s.connOpts.asset.OrgID,
+			SystemUser: s.systemUserAuthInfo.String(),
+			RemoteAddr: s.UserConn.RemoteAddr(),
+			Operate:    zmodemOperate(zinfo),
+			Filename:   zinfo.Filename(),
+		})
+	}
+	s.zmodemRecorder.WriteAt(p, offset)
+}
+
+// takeZmodemRecorder 返回 zinfo 的内容录制, 没有录制时返回 nil
+func (s *Server) takeZmodemRecorder(zinfo *zmodem.ZFileInfo) *filerecord.Recorder {
+	s.zmodemRecordLock.Lock()
+	defer s.zmodemRecordLock.Unlock()
+	if s.zmodemRecordFile != zinfo {
+		return nil
+	}
+	recorder := s.zmodemRecorder
+	s.zmodemRecordFile = nil
+	s.zmodemRecorder = nil
+	return recorder
+}
+
+func zmodemOperate(zinfo *zmodem.ZFileInfo) string {
+	if zinfo.Type() == zmodem.TypeUpload {
+		return model.OperateUpload
+	}
+	return model.OperateDownload
+}
+
 func (s *Server) GetFilterParser() *Parser {
 	var (
 		enableUpload   bool
@@ -474,6 +540,9 @@ func (s *Server) GetFilterParser() *Parser {
 	}
 	zParser := zmodem.New()
 	zParser.FileEventCallback = s.ZmodemFileTransferEvent
+	if filerecord.Enabled() {
+		zParser.FileDataCallback = s.ZmodemFileDataEvent
+	}
 	parser := Parser{
 		id:             s.ID,
 		protocolType:   s.connOpts.ProtocolType,
@@ -484,6 +553,7 @@ func (s *Server) GetFilterParser() *Parser {
 		zmodemParser:   zParser,
 		i18nLang:       s.connOpts.i18nLang,
 		platform:       s.platform,
+		outputMasker:   newOutputMasker(config.GetConf().OutputMaskRules),
 	}
 	parser.initial()
 	return &parser
@@ -513,29 +583,18 @@ func (s *Server) GetCommandRecorder() *CommandRecorder {
 		closed:     make(chan struct{}),
 		jmsService: s.jmsService,
 	}
+	if spool, err := openCommandSpool(commandSpoolDir(), s.ID); err == nil {
+		cmdR.spool = spool
+	} else {
+		logger.Errorf("Session %s: open command spool err: %s", s.ID, err)
+	}
 	go cmdR.record()
 	return &cmdR
 }
 
 func (s *Server) GenerateCommandItem(user, input, output string,
 	riskLevel int64, createdDate time.Time) *model.Command {
-	var (
-		server string
-		orgID  string
-	)
-	switch s.connOpts.ProtocolType {
-	case srvconn.ProtocolTELNET, srvconn.ProtocolSSH:
-		server = s.connOpts.asset.String()
-		orgID = s.connOpts.asset.OrgID
-
-	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolRedis,
-		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer:
-		server = s.connOpts.app.Name
-		if s.connOpts.k8sContainer != nil {
-			server = s.connOpts.k8sContainer.K8sName(server)
-		}
-		orgID = s.connOpts.app.OrgID
-	}
+	server, orgID := s.getAssetInfo()
 	return &model.Command{
 		SessionID:   s.ID,
 		OrgID:       orgID,
@@ -550,6 +609,24 @@ func (s *Server) GenerateCommandItem(user, input, output string,
 	}
 }
 
+// getAssetInfo 返回命令和审计日志中记录的资产名称和组织
+func (s *Server) getAssetInfo() (server, orgID string) {
+	switch s.connOpts.ProtocolType {
+	case srvconn.ProtocolTELNET, srvconn.ProtocolSSH:
+		server = s.connOpts.asset.String()
+		orgID = s.connOpts.asset.OrgID
+
+	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolRedis,
+		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer, srvconn.ProtocolPostgreSQL:
+		server = s.connOpts.app.Name
+		if s.connOpts.k8sContainer != nil {
+			server = s.connOpts.k8sContainer.K8sName(server)
+		}
+		orgID = s.connOpts.app.OrgID
+	}
+	return
+}
+
 func (s *Server) getUsernameIfNeed() (err error) {
 	if s.systemUserAuthInfo.Username == "" {
 		logger.Infof("Conn[%s] need manuel input system user username", s.UserConn.ID())
@@ -601,7 +678,7 @@ func (s *Server) checkRequiredAuth() error {
 			return errors.New("no auth token")
 		}
 	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolTELNET,
-		srvconn.ProtocolSQLServer:
+		srvconn.ProtocolSQLServer, srvconn.ProtocolPostgreSQL:
 		if err := s.getUsernameIfNeed(); err != nil {
 			msg := utils.WrapperWarn(lang.T("Get auth username failed"))
 			utils.IgnoreErrWriteString(s.UserConn, msg)
@@ -633,7 +710,8 @@ func (s *Server) checkRequiredAuth() error {
 				s.UserConn.ID(), s.connOpts.systemUser.Name, s.connOpts.asset.Hostname)
 		}
 
-		if s.systemUserAuthInfo.PrivateKey == "" {
+		// 签发证书认证时不预先输入密码, 资产不信任 CA 时通过 keyboard-interactive 输入
+		if s.systemUserAuthInfo.PrivateKey == "" && sshca.Default() == nil {
 			if err := s.getAuthPasswordIfNeed(); err != nil {
 				msg := utils.WrapperWarn(lang.T("Get auth password failed"))
 				utils.IgnoreErrWriteString(s.UserConn, msg)
@@ -655,7 +733,9 @@ func (s *Server) checkReuseSSHClient() bool {
 		platformMatched := s.connOpts.asset.Platform == linuxPlatform
 		protocolMatched := s.connOpts.systemUser.Protocol == model.ProtocolSSH
 		notSuSystemUser := !s.connOpts.systemUser.SuEnabled
-		return platformMatched && protocolMatched && notSuSystemUser
+		// agent 转发的通道注册在 client 上, 不能复用其他会话的连接
+		notAgentForwarding := !s.agentForwardingEnabled()
+		return platformMatched && protocolMatched && notSuSystemUser && notAgentForwarding
 	}
 	return false
 }
@@ -696,7 +776,7 @@ func (s *Server) getCacheSSHConn() (srvConn *srvconn.SSHConnection, ok bool) {
 	return cacheConn, true
 }
 
-func (s *Server) createAvailableGateWay(domain *model.Domain) (*domainGateway, error) {
+func (s *Server) createAvailableGateWay(ctx context.Context, domain *model.Domain) (*domainGateway, error) {
 	var dGateway *domainGateway
 	switch s.connOpts.ProtocolType {
 	case srvconn.ProtocolK8s:
@@ -708,12 +788,15 @@ func (s *Server) createAvailableGateWay(domain *model.Domain) (*domainGateway, e
 			domain:  domain,
 			dstIP:   dstHost,
 			dstPort: dstPort,
+			ctx:     ctx,
 		}
-	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer, srvconn.ProtocolRedis:
+	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer, srvconn.ProtocolRedis,
+		srvconn.ProtocolPostgreSQL:
 		dGateway = &domainGateway{
 			domain:  domain,
 			dstIP:   s.connOpts.app.Attrs.Host,
 			dstPort: s.connOpts.app.Attrs.Port,
+			ctx:     ctx,
 		}
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrUnMatchProtocol,
@@ -831,20 +914,44 @@ func (s *Server) getSQLServerConn(localTunnelAddr *net.TCPAddr) (srvConn *srvcon
 	return
 }
 
-func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
-	loginSystemUser := s.systemUserAuthInfo
-	if s.suFromSystemUserAuthInfo != nil {
-		loginSystemUser = s.suFromSystemUserAuthInfo
+func (s *Server) getPostgreSQLConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.PostgreSQLConn, err error) {
+	host := s.connOpts.app.Attrs.Host
+	port := s.connOpts.app.Attrs.Port
+	if localTunnelAddr != nil {
+		host = "127.0.0.1"
+		port = localTunnelAddr.Port
 	}
-	key := srvconn.MakeReuseSSHClientKey(s.connOpts.user.ID, s.connOpts.asset.ID, loginSystemUser.ID,
-		s.connOpts.asset.IP, loginSystemUser.Username)
+	srvConn, err = srvconn.NewPostgreSQLConnection(
+		srvconn.SqlHost(host),
+		srvconn.SqlPort(port),
+		srvconn.SqlUsername(s.systemUserAuthInfo.Username),
+		srvconn.SqlPassword(s.systemUserAuthInfo.Password),
+		srvconn.SqlDBName(s.connOpts.app.Attrs.Database),
+		srvconn.SqlPtyWin(srvconn.Windows{
+			Width:  s.UserConn.Pty().Window.Width,
+			Height: s.UserConn.Pty().Window.Height,
+		}),
+	)
+	return
+}
+
+/*
+	getSSHClientOptions 连接资产的认证、host key 和网关配置, 不包括需要用户输入的 keyboard-interactive 认证,
+	certOpts 为签发短期证书时按会话开启的权限
+*/
+
+func (s *Server) getSSHClientOptions(ctx context.Context, loginSystemUser *model.SystemUserAuthInfo,
+	certOpts ...sshca.CertOption) []srvconn.SSHClientOption {
 	timeout := config.GlobalConfig.SSHTimeout
-	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 6)
+	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 12)
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientUsername(loginSystemUser.Username))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHost(s.connOpts.asset.IP))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPort(s.connOpts.asset.ProtocolPort(loginSystemUser.Protocol)))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPassword(loginSystemUser.Password))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientTimeout(timeout))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHostKeyCallback(hostkey.HostKeyCallback(s.connOpts.asset.ID)))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientCertAuthority(sshca.Default(),
+		fmt.Sprintf("koko:%s:%s", s.connOpts.user.Username, s.ID), certOpts...))
 	if loginSystemUser.PrivateKey != "" {
 		// 先使用 password 解析 PrivateKey
 		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(loginSystemUser.PrivateKey),
@@ -857,6 +964,28 @@ func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
 			}
 		}
 	}
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientContext(ctx))
+	// 获取网关配置
+	proxyArgs := s.getGatewayProxyOptions()
+	if proxyArgs != nil {
+		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
+	}
+	return sshAuthOpts
+}
+
+func (s *Server) getSSHConn(ctx context.Context) (srvConn *srvconn.SSHConnection, err error) {
+	loginSystemUser := s.systemUserAuthInfo
+	if s.suFromSystemUserAuthInfo != nil {
+		loginSystemUser = s.suFromSystemUserAuthInfo
+	}
+	key := srvconn.MakeReuseSSHClientKey(s.connOpts.user.ID, s.connOpts.asset.ID, loginSystemUser.ID,
+		s.connOpts.asset.IP, loginSystemUser.Username)
+	agentForwarding := s.agentForwardingEnabled()
+	certOpts := make([]sshca.CertOption, 0, 1)
+	if agentForwarding {
+		certOpts = append(certOpts, sshca.CertPermitAgentForwarding())
+	}
+	sshAuthOpts := s.getSSHClientOptions(ctx, loginSystemUser, certOpts...)
 	var passwordTryCount int
 	password := loginSystemUser.Password
 	kb := srvconn.SSHClientKeyboardAuth(func(user, instruction string,
@@ -886,20 +1015,28 @@ func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
 		return ans, nil
 	})
 	sshAuthOpts = append(sshAuthOpts, kb)
-	// 获取网关配置
-	proxyArgs := s.getGatewayProxyOptions()
-	if proxyArgs != nil {
-		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
-	}
 	sshClient, err := srvconn.NewSSHClient(sshAuthOpts...)
 	if err != nil {
 		logger.Errorf("Get new ssh client err: %s", err)
 		return nil, err
 	}
-	srvconn.AddClientCache(key, sshClient)
+	// agent 转发的 client 只属于当前会话, 不加入缓存, 会话结束时关闭
+	var agentForwarder *srvconn.AgentForwarder
+	if agentForwarding {
+		agentForwarder = s.newAgentForwarder()
+		if err = agentForwarder.Forward(sshClient.Client); err != nil {
+			_ = sshClient.Close()
+			return nil, err
+		}
+	} else {
+		srvconn.AddClientCache(key, sshClient)
+	}
 	sess, err := sshClient.AcquireSession()
 	if err != nil {
 		logger.Errorf("SSH client(%s) start session err %s", sshClient, err)
+		if agentForwarder != nil {
+			_ = sshClient.Close()
+		}
 		return nil, err
 	}
 	pty := s.UserConn.Pty()
@@ -924,12 +1061,22 @@ func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
 		sshConnectOpts = append(sshConnectOpts, srvconn.SSHSudoUsername(suUsername))
 		sshConnectOpts = append(sshConnectOpts, srvconn.SSHSudoPassword(suPassword))
 	}
+	if agentForwarder != nil {
+		sshConnectOpts = append(sshConnectOpts, srvconn.SSHAgentForwarding(true))
+	}
 	sshConn, err := srvconn.NewSSHConnection(sess, sshConnectOpts...)
 	if err != nil {
 		_ = sess.Close()
 		sshClient.ReleaseSession(sess)
+		if agentForwarder != nil {
+			_ = sshClient.Close()
+		}
 		return nil, err
 	}
+	if agentForwarder != nil {
+		s.agentForwarder = agentForwarder
+		logger.Infof("Conn[%s] agent forwarding enabled for %s", s.UserConn.ID(), sshClient)
+	}
 	if s.suFromSystemUserAuthInfo != nil {
 		lang := s.connOpts.getLang()
 		msg := fmt.Sprintf(lang.T("Switched to %s"), s.systemUserAuthInfo)
@@ -944,6 +1091,9 @@ func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
 		_ = sess.Wait()
 		sshClient.ReleaseSession(sess)
 		logger.Infof("SSH client(%s) shell connection release", sshClient)
+		if agentForwarder != nil {
+			_ = sshClient.Close()
+		}
 	}()
 	return sshConn, nil
 
@@ -1007,7 +1157,7 @@ func (s *Server) getGatewayProxyOptions() []srvconn.SSHClientOptions {
 	return nil
 }
 
-func (s *Server) getServerConn(proxyAddr *net.TCPAddr) (srvconn.ServerConnection, error) {
+func (s *Server) getServerConn(ctx context.Context, proxyAddr *net.TCPAddr) (srvconn.ServerConnection, error) {
 	if s.cacheSSHConnection != nil {
 		return s.cacheSSHConnection, nil
 	}
@@ -1019,7 +1169,7 @@ func (s *Server) getServerConn(proxyAddr *net.TCPAddr) (srvconn.ServerConnection
 	go s.sendConnectingMsg(done)
 	switch s.connOpts.ProtocolType {
 	case srvconn.ProtocolSSH:
-		return s.getSSHConn()
+		return s.getSSHConn(ctx)
 	case srvconn.ProtocolTELNET:
 		return s.getTelnetConn()
 	case srvconn.ProtocolK8s:
@@ -1030,6 +1180,8 @@ func (s *Server) getServerConn(proxyAddr *net.TCPAddr) (srvconn.ServerConnection
 		return s.getRedisConn(proxyAddr)
 	case srvconn.ProtocolSQLServer:
 		return s.getSQLServerConn(proxyAddr)
+	case srvconn.ProtocolPostgreSQL:
+		return s.getPostgreSQLConn(proxyAddr)
 	default:
 		return nil, ErrUnMatchProtocol
 	}
@@ -1066,6 +1218,17 @@ func (s *Server) sendConnectingMsg(done chan struct{}) {
 }
 
 func (s *Server) checkLoginConfirm() bool {
+	traceCtx, span := tracing.Start(s.UserConn.Context(), "login_confirm.wait")
+	defer span.End()
+	confirmSrv := s.newLoginConfirmService(traceCtx)
+	ok := s.validateLoginConfirm(&confirmSrv, s.UserConn)
+	s.loginTicketId = confirmSrv.GetTicketId()
+	span.SetAttributes(tracing.String("koko.ticket_id", s.loginTicketId),
+		tracing.Bool("koko.confirmed", ok))
+	return ok
+}
+
+func (s *Server) newLoginConfirmService(ctx context.Context) auth.LoginConfirmService {
 	opts := make([]auth.ConfirmOption, 0, 4)
 	opts = append(opts, auth.ConfirmWithUser(s.connOpts.user))
 	opts = append(opts, auth.ConfirmWithSystemUser(s.systemUserAuthInfo))
@@ -1075,7 +1238,7 @@ func (s *Server) checkLoginConfirm() bool {
 	)
 	switch s.connOpts.ProtocolType {
 	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb, srvconn.ProtocolRedis,
-		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer:
+		srvconn.ProtocolK8s, srvconn.ProtocolSQLServer, srvconn.ProtocolPostgreSQL:
 		targetType = model.AppType
 		targetId = s.connOpts.app.ID
 	default:
@@ -1083,10 +1246,8 @@ func (s *Server) checkLoginConfirm() bool {
 	}
 	opts = append(opts, auth.ConfirmWithTargetType(targetType))
 	opts = append(opts, auth.ConfirmWithTargetID(targetId))
-	confirmSrv := auth.NewLoginConfirm(s.jmsService, opts...)
-	ok := s.validateLoginConfirm(&confirmSrv, s.UserConn)
-	s.loginTicketId = confirmSrv.GetTicketId()
-	return ok
+	apiService := s.jmsService.WithContext(tracing.Detach(ctx))
+	return auth.NewLoginConfirm(apiService, opts...)
 }
 
 func (s *Server) Proxy() {
@@ -1112,6 +1273,7 @@ func (s *Server) Proxy() {
 		ctx:           ctx,
 		cancel:        cancel,
 		p:             s,
+		noticeChan:    make(chan sessionNotice, 8),
 	}
 	if err := s.CreateSessionCallback(); err != nil {
 		msg := lang.T("Connect with api server failed")
@@ -1136,12 +1298,16 @@ func (s *Server) Proxy() {
 			logger.Errorf("Conn[%s] update session %s err: %+v", s.UserConn.ID(), s.ID, err)
 		}
 	}()
+	traceCtx, connectSpan := tracing.Start(s.UserConn.Context(), "koko.connect_asset",
+		tracing.String("koko.session_id", s.ID),
+		tracing.String("koko.protocol", s.connOpts.ProtocolType))
+	defer connectSpan.End()
 	var proxyAddr *net.TCPAddr
 	if s.domainGateways != nil && len(s.domainGateways.Gateways) != 0 {
 		switch s.connOpts.ProtocolType {
 		case srvconn.ProtocolMySQL, srvconn.ProtocolK8s, srvconn.ProtocolRedis,
-			srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer:
-			dGateway, err := s.createAvailableGateWay(s.domainGateways)
+			srvconn.ProtocolMariadb, srvconn.ProtocolSQLServer, srvconn.ProtocolPostgreSQL:
+			dGateway, err := s.createAvailableGateWay(traceCtx, s.domainGateways)
 			if err != nil {
 				msg := lang.T("Start domain gateway failed %s")
 				msg = fmt.Sprintf(msg, err)
@@ -1152,9 +1318,10 @@ func (s *Server) Proxy() {
 			err = dGateway.Start()
 			if err != nil {
 				msg := lang.T("Start domain gateway failed %s")
-				msg = fmt.Sprintf(msg, err)
+				msg = fmt.Sprintf(msg, s.ConvertErrorToReadableMsg(err))
 				utils.IgnoreErrWriteString(s.UserConn, utils.WrapperWarn(msg))
 				logger.Error(msg)
+				connectSpan.RecordError(err)
 				return
 			}
 			defer dGateway.Stop()
@@ -1162,7 +1329,11 @@ func (s *Server) Proxy() {
 		default:
 		}
 	}
-	srvCon, err := s.getServerConn(proxyAddr)
+	connectStart := time.Now()
+	srvCon, err := s.getServerConn(traceCtx, proxyAddr)
+	s.observeConnect(time.Since(connectStart), err)
+	connectSpan.RecordError(err)
+	connectSpan.End()
 	if err != nil {
 		logger.Error(err)
 		s.sendConnectErrorMsg(err)
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"sync"
+
+	"github.com/jumpserver/koko/pkg/metrics"
 )
 
 var sessManager = newSessionManager()
@@ -17,10 +19,12 @@ func GetAliveSessions() []string {
 
 func AddCommonSwitch(s *SwitchSession) {
 	sessManager.Add(s.ID, s)
+	metrics.SessionsActive.Inc(s.p.connOpts.ProtocolType)
 }
 
 func RemoveCommonSwitch(s *SwitchSession) {
 	sessManager.Delete(s.ID)
+	metrics.SessionsActive.Dec(s.p.connOpts.ProtocolType)
 }
 
 func newSessionManager() *sessionManager {
@@ -0,0 +1,470 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/jumpserver/koko/pkg/srvconn"
+)
+
+/*
+	数据库会话按语句过滤命令:
+		将输入按结束符切分为完整的语句, 去除注释后按语句类型
+		(DROP、TRUNCATE、ALTER、DELETE_WITHOUT_WHERE 等) 和操作的表进行匹配,
+		避免通过多行语句、注释或 \G 等方式绕过命令过滤。
+*/
+
+const (
+	sqlTypeDeleteWithoutWhere = "DELETE_WITHOUT_WHERE"
+	sqlTypeUpdateWithoutWhere = "UPDATE_WITHOUT_WHERE"
+)
+
+type sqlDialect = srvconn.SQLDialect
+
+const (
+	sqlDialectMySQL      = srvconn.SQLDialectMySQL
+	sqlDialectSQLServer  = srvconn.SQLDialectSQLServer
+	sqlDialectPostgreSQL = srvconn.SQLDialectPostgreSQL
+)
+
+func getSQLDialect(protocol string) (sqlDialect, bool) {
+	switch protocol {
+	case srvconn.ProtocolMySQL, srvconn.ProtocolMariadb:
+		return sqlDialectMySQL, true
+	case srvconn.ProtocolSQLServer:
+		return sqlDialectSQLServer, true
+	case srvconn.ProtocolPostgreSQL:
+		return sqlDialectPostgreSQL, true
+	}
+	return 0, false
+}
+
+type sqlStatement struct {
+	// Text 去除注释后的语句
+	Text   string
+	Types  []string
+	Tables []string
+}
+
+// parseSQLStatements 将一段 SQL 切分为语句并分类
+func parseSQLStatements(text string, dialect sqlDialect) []sqlStatement {
+	tokens := tokenizeSQL(text, dialect)
+	stmts := make([]sqlStatement, 0, 1)
+	for _, stmtTokens := range splitSQLTokens(tokens, dialect) {
+		stmts = append(stmts, classifySQLTokens(stmtTokens))
+	}
+	return stmts
+}
+
+type sqlTokenKind = srvconn.SQLTokenKind
+
+const (
+	sqlTokenWord      = srvconn.SQLTokenWord
+	sqlTokenIdent     = srvconn.SQLTokenIdent
+	sqlTokenString    = srvconn.SQLTokenString
+	sqlTokenSymbol    = srvconn.SQLTokenSymbol
+	sqlTokenDelimiter = srvconn.SQLTokenDelimiter
+)
+
+type sqlToken struct {
+	kind  sqlTokenKind
+	value string
+}
+
+func (t sqlToken) isWord(words ...string) bool {
+	if t.kind != sqlTokenWord {
+		return false
+	}
+	for i := range words {
+		if strings.EqualFold(t.value, words[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t sqlToken) isSymbol(symbol string) bool {
+	return t.kind == sqlTokenSymbol && t.value == symbol
+}
+
+func (t sqlToken) upper() string {
+	return strings.ToUpper(t.value)
+}
+
+// tokenizeSQL 去除注释并切分为 token, 与 srvconn.SQLSplitter 使用同一个词法分析
+func tokenizeSQL(text string, dialect sqlDialect) []sqlToken {
+	lexTokens, _ := srvconn.SQLLexer{Dialect: dialect}.Tokenize(text)
+	tokens := make([]sqlToken, 0, len(lexTokens))
+	for i := range lexTokens {
+		tokens = append(tokens, sqlToken{kind: lexTokens[i].Kind, value: lexTokens[i].Value})
+	}
+	return tokens
+}
+
+/*
+	splitSQLTokens 按结束符切分语句。
+	SQL Server 的批处理中语句之间可以没有分号, 需要根据语句开头的关键字切分
+*/
+
+func splitSQLTokens(tokens []sqlToken, dialect sqlDialect) [][]sqlToken {
+	var (
+		stmts [][]sqlToken
+		start int
+		depth int
+	)
+	appendStmt := func(end int) {
+		if end > start {
+			stmts = append(stmts, tokens[start:end])
+		}
+	}
+	for i := range tokens {
+		switch {
+		case tokens[i].isSymbol("("):
+			depth++
+		case tokens[i].isSymbol(")"):
+			if depth > 0 {
+				depth--
+			}
+		case tokens[i].kind == sqlTokenDelimiter || tokens[i].isSymbol(";"):
+			// MySQL 可执行注释中的分号是符号, 同样切分
+			appendStmt(i)
+			start = i + 1
+			depth = 0
+		case dialect == sqlDialectSQLServer && depth == 0 && i > start &&
+			isTSQLStatementStart(tokens, i):
+			appendStmt(i)
+			start = i
+		}
+	}
+	appendStmt(len(tokens))
+	return stmts
+}
+
+var (
+	// 这些关键字之后的 DELETE、UPDATE 等不是新语句的开始, 如 ON DELETE CASCADE
+	tsqlContinueKeywords = map[string]bool{
+		"ON": true, "FOR": true, "AFTER": true, "BEFORE": true, "OF": true, "OR": true,
+		"THEN": true, "GRANT": true, "REVOKE": true, "DENY": true, "KEY": true, "AS": true,
+		"UNION": true, "ALL": true, "EXCEPT": true, "INTERSECT": true, "INSERT": true,
+		"INTO": true, "EXISTS": true, "IN": true, "DISTINCT": true, "NOT": true,
+	}
+
+	tsqlStatementKeywords = map[string]bool{
+		"DELETE": true, "UPDATE": true, "INSERT": true, "MERGE": true, "SELECT": true,
+		"EXEC": true, "EXECUTE": true, "USE": true,
+	}
+
+	// 需要后跟对象类型的关键字, 如 ALTER TABLE t DROP COLUMN c 中的 DROP 不是新语句
+	tsqlObjectStatementKeywords = map[string]bool{
+		"DROP": true, "ALTER": true, "CREATE": true, "TRUNCATE": true,
+	}
+)
+
+func isTSQLStatementStart(tokens []sqlToken, i int) bool {
+	token := tokens[i]
+	if token.kind != sqlTokenWord {
+		return false
+	}
+	prev := tokens[i-1]
+	if prev.kind == sqlTokenSymbol && prev.value != ")" {
+		return false
+	}
+	if prev.kind == sqlTokenWord && tsqlContinueKeywords[prev.upper()] {
+		return false
+	}
+	keyword := token.upper()
+	switch {
+	case tsqlStatementKeywords[keyword]:
+		return true
+	case tsqlObjectStatementKeywords[keyword]:
+		return i+1 < len(tokens) && sqlObjectKeywords[tokens[i+1].upper()]
+	}
+	return false
+}
+
+var (
+	sqlObjectKeywords = map[string]bool{
+		"TABLE": true, "DATABASE": true, "SCHEMA": true, "VIEW": true, "INDEX": true,
+		"PROCEDURE": true, "PROC": true, "FUNCTION": true, "TRIGGER": true, "USER": true,
+		"ROLE": true, "LOGIN": true, "SEQUENCE": true, "EVENT": true, "TYPE": true,
+		"SYNONYM": true, "EXTENSION": true, "TABLESPACE": true,
+	}
+
+	// 对象类型之前可能出现的修饰词, 如 DROP TEMPORARY TABLE、CREATE OR REPLACE VIEW
+	sqlObjectModifiers = map[string]bool{
+		"TEMPORARY": true, "TEMP": true, "OR": true, "REPLACE": true, "UNIQUE": true,
+		"CLUSTERED": true, "NONCLUSTERED": true, "MATERIALIZED": true, "UNLOGGED": true,
+		"GLOBAL": true, "LOCAL": true, "FOREIGN": true,
+	}
+
+	// 语句关键字之后的修饰词, 如 DELETE LOW_PRIORITY FROM t
+	sqlVerbModifiers = map[string]bool{
+		"LOW_PRIORITY": true, "HIGH_PRIORITY": true, "DELAYED": true, "QUICK": true,
+		"IGNORE": true, "ONLY": true, "FROM": true, "INTO": true, "TABLE": true,
+		"IF": true, "NOT": true, "EXISTS": true,
+	}
+
+	// 之后紧跟表名的关键字
+	sqlTableKeywords = map[string]bool{
+		"FROM": true, "JOIN": true, "USING": true,
+	}
+
+	// CTE 之后真正执行的语句
+	sqlCTEStatementKeywords = map[string]bool{
+		"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+	}
+)
+
+func classifySQLTokens(tokens []sqlToken) sqlStatement {
+	stmt := sqlStatement{Text: formatSQLTokens(tokens)}
+	start := 0
+	for start < len(tokens) && tokens[start].isSymbol("(") {
+		start++
+	}
+	if start >= len(tokens) || tokens[start].kind != sqlTokenWord {
+		return stmt
+	}
+	tables := make(map[string]bool)
+	addTable := func(name string) {
+		if name != "" && !tables[name] {
+			tables[name] = true
+			stmt.Tables = append(stmt.Tables, name)
+		}
+	}
+	verb := tokens[start].upper()
+	if verb == "WITH" {
+		if i := indexTopLevelWord(tokens, start+1, sqlCTEStatementKeywords); i > 0 {
+			start = i
+			verb = tokens[i].upper()
+		}
+	}
+	stmt.Types = append(stmt.Types, verb)
+	next := start + 1
+	// DROP TABLE、ALTER TABLE 等带对象类型的语句
+	for next < len(tokens) && tokens[next].kind == sqlTokenWord &&
+		sqlObjectModifiers[tokens[next].upper()] {
+		next++
+	}
+	var object string
+	if next < len(tokens) && tokens[next].kind == sqlTokenWord && sqlObjectKeywords[tokens[next].upper()] {
+		object = tokens[next].upper()
+		stmt.Types = append(stmt.Types, verb+"_"+object)
+		next++
+	}
+	switch verb {
+	case "DROP", "TRUNCATE", "ALTER", "CREATE", "RENAME":
+		switch object {
+		case "DATABASE", "SCHEMA":
+			if name, _ := readSQLName(tokens, skipSQLModifiers(tokens, next)); name != "" {
+				addTable(name + ".*")
+			}
+		case "TABLE", "VIEW":
+			for _, name := range readSQLNameList(tokens, skipSQLModifiers(tokens, next)) {
+				addTable(name)
+			}
+		case "":
+			// TRUNCATE t 可以省略 TABLE
+			if verb == "TRUNCATE" {
+				for _, name := range readSQLNameList(tokens, skipSQLModifiers(tokens, next)) {
+					addTable(name)
+				}
+			}
+		case "INDEX", "TRIGGER":
+			// DROP INDEX i ON t
+			if i := indexTopLevelWord(tokens, next, map[string]bool{"ON": true}); i > 0 {
+				name, _ := readSQLName(tokens, skipSQLModifiers(tokens, i+1))
+				addTable(name)
+			}
+		}
+	case "DELETE", "UPDATE", "INSERT", "REPLACE", "MERGE":
+		i := skipSQLModifiers(tokens, next)
+		if name, _ := readSQLName(tokens, i); name != "" {
+			addTable(name)
+		}
+		hasWhere := indexTopLevelWord(tokens, start+1, map[string]bool{"WHERE": true}) > 0
+		switch {
+		case verb == "DELETE" && !hasWhere:
+			stmt.Types = append(stmt.Types, sqlTypeDeleteWithoutWhere)
+		case verb == "UPDATE" && !hasWhere:
+			stmt.Types = append(stmt.Types, sqlTypeUpdateWithoutWhere)
+		}
+	}
+	for _, name := range readSQLQueryTables(tokens, start+1) {
+		addTable(name)
+	}
+	return stmt
+}
+
+// skipSQLModifiers 跳过 IF EXISTS、LOW_PRIORITY、TOP (n) 等修饰
+func skipSQLModifiers(tokens []sqlToken, i int) int {
+	for i < len(tokens) {
+		switch {
+		case tokens[i].kind == sqlTokenWord && sqlVerbModifiers[tokens[i].upper()]:
+			i++
+		case tokens[i].isWord("TOP"):
+			i++
+			if i < len(tokens) && tokens[i].isSymbol("(") {
+				i = skipSQLParentheses(tokens, i)
+			} else if i < len(tokens) {
+				i++
+			}
+			if i < len(tokens) && tokens[i].isWord("PERCENT") {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipSQLParentheses i 为左括号的位置, 返回匹配的右括号之后的位置
+func skipSQLParentheses(tokens []sqlToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch {
+		case tokens[i].isSymbol("("):
+			depth++
+		case tokens[i].isSymbol(")"):
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// indexTopLevelWord 查找不在括号中的关键字
+func indexTopLevelWord(tokens []sqlToken, start int, words map[string]bool) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch {
+		case tokens[i].isSymbol("("):
+			depth++
+		case tokens[i].isSymbol(")"):
+			depth--
+		case depth == 0 && tokens[i].kind == sqlTokenWord && words[tokens[i].upper()]:
+			return i
+		}
+	}
+	return -1
+}
+
+// readSQLName 读取 db.schema.table 形式的名称
+func readSQLName(tokens []sqlToken, i int) (string, int) {
+	var parts []string
+	for i < len(tokens) {
+		token := tokens[i]
+		if token.kind != sqlTokenWord && token.kind != sqlTokenIdent {
+			break
+		}
+		parts = append(parts, token.value)
+		i++
+		if i+1 < len(tokens) && tokens[i].isSymbol(".") {
+			i++
+			continue
+		}
+		break
+	}
+	return strings.Join(parts, "."), i
+}
+
+// readSQLNameList 读取逗号分隔的名称, 如 DROP TABLE a, b 或 RENAME TABLE a TO b
+func readSQLNameList(tokens []sqlToken, i int) []string {
+	var names []string
+	for i < len(tokens) {
+		name, next := readSQLName(tokens, i)
+		if name == "" {
+			break
+		}
+		names = append(names, name)
+		i = next
+		if i < len(tokens) && (tokens[i].isSymbol(",") || tokens[i].isWord("TO")) {
+			i++
+			continue
+		}
+		break
+	}
+	return names
+}
+
+/*
+	readSQLQueryTables 读取 FROM、JOIN 之后的表, 包括子查询中的表,
+	函数调用中的 FROM 如 EXTRACT(YEAR FROM d) 会被忽略
+*/
+
+func readSQLQueryTables(tokens []sqlToken, start int) []string {
+	var (
+		names []string
+		stack = []bool{true}
+	)
+	for i := start; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case token.isSymbol("("):
+			isQuery := i+1 < len(tokens) && tokens[i+1].isWord("SELECT", "WITH", "VALUES")
+			stack = append(stack, isQuery)
+		case token.isSymbol(")"):
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case stack[len(stack)-1] && token.kind == sqlTokenWord && sqlTableKeywords[token.upper()]:
+			for j := i + 1; j < len(tokens); {
+				j = skipSQLModifiers(tokens, j)
+				name, next := readSQLName(tokens, j)
+				if name == "" {
+					break
+				}
+				names = append(names, name)
+				// 跳过别名
+				for next < len(tokens) && (tokens[next].isWord("AS") ||
+					(tokens[next].kind != sqlTokenSymbol && !isSQLClauseKeyword(tokens[next]))) {
+					next++
+				}
+				if next < len(tokens) && tokens[next].isSymbol(",") {
+					j = next + 1
+					continue
+				}
+				break
+			}
+		}
+	}
+	return names
+}
+
+var sqlClauseKeywords = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true,
+	"CROSS": true, "OUTER": true, "NATURAL": true, "STRAIGHT_JOIN": true, "ON": true,
+	"USING": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true, "OFFSET": true,
+	"UNION": true, "EXCEPT": true, "INTERSECT": true, "SET": true, "VALUES": true,
+	"SELECT": true, "RETURNING": true, "OUTPUT": true, "WINDOW": true, "FOR": true,
+	"LOCK": true, "INTO": true, "WITH": true, "FETCH": true, "PARTITION": true, "OPTION": true,
+}
+
+func isSQLClauseKeyword(token sqlToken) bool {
+	return token.kind == sqlTokenWord && sqlClauseKeywords[token.upper()]
+}
+
+// formatSQLTokens 将 token 重新拼接为单行语句, 标识符的引号会被去掉
+func formatSQLTokens(tokens []sqlToken) string {
+	var (
+		b    strings.Builder
+		prev sqlToken
+	)
+	for i, token := range tokens {
+		if i > 0 && !prev.isSymbol(".") && !prev.isSymbol("(") &&
+			!token.isSymbol(".") && !token.isSymbol(",") && !token.isSymbol(")") {
+			b.WriteByte(' ')
+		}
+		switch token.kind {
+		case sqlTokenString:
+			b.WriteByte('\'')
+			b.WriteString(strings.ReplaceAll(token.value, "'", "''"))
+			b.WriteByte('\'')
+		default:
+			b.WriteString(token.value)
+		}
+		prev = token
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
+)
+
+func TestParseSQLStatements(t *testing.T) {
+	tests := []struct {
+		sql     string
+		dialect sqlDialect
+		types   [][]string
+		tables  [][]string
+	}{
+		{
+			sql:     "DROP /* comment */ TABLE IF EXISTS `db`.`users`, logs;\n-- drop table t\nselect 1",
+			dialect: sqlDialectMySQL,
+			types:   [][]string{{"DROP", "DROP_TABLE"}, {"SELECT"}},
+			tables:  [][]string{{"db.users", "logs"}, nil},
+		},
+		{
+			sql:     "/*!40101 DELETE FROM users */",
+			dialect: sqlDialectMySQL,
+			types:   [][]string{{"DELETE", sqlTypeDeleteWithoutWhere}},
+			tables:  [][]string{{"users"}},
+		},
+		{
+			sql:     "delete from users where id in (select id from t); truncate orders",
+			dialect: sqlDialectPostgreSQL,
+			types:   [][]string{{"DELETE"}, {"TRUNCATE"}},
+			tables:  [][]string{{"users", "t"}, {"orders"}},
+		},
+		{
+			sql:     "select $$;drop table x$$ from dual",
+			dialect: sqlDialectPostgreSQL,
+			types:   [][]string{{"SELECT"}},
+			tables:  [][]string{{"dual"}},
+		},
+		{
+			sql:     "BEGIN TRAN\nDELETE FROM [dbo].[users]\nSELECT * FROM t WHERE a = 1\nCOMMIT",
+			dialect: sqlDialectSQLServer,
+			types:   [][]string{{"BEGIN"}, {"DELETE", sqlTypeDeleteWithoutWhere}, {"SELECT"}},
+			tables:  [][]string{nil, {"dbo.users"}, {"t"}},
+		},
+		{
+			sql:     "ALTER TABLE t DROP COLUMN c\nDROP DATABASE prod",
+			dialect: sqlDialectSQLServer,
+			types:   [][]string{{"ALTER", "ALTER_TABLE"}, {"DROP", "DROP_DATABASE"}},
+			tables:  [][]string{{"t"}, {"prod.*"}},
+		},
+		{
+			sql:     "SELECT '\\g'; DROP TABLE t \\gx",
+			dialect: sqlDialectPostgreSQL,
+			types:   [][]string{{"SELECT"}, {"DROP", "DROP_TABLE"}},
+			tables:  [][]string{nil, {"t"}},
+		},
+	}
+	for _, tt := range tests {
+		stmts := parseSQLStatements(tt.sql, tt.dialect)
+		if len(stmts) != len(tt.types) {
+			t.Fatalf("%q: expected %d statements, got %+v", tt.sql, len(tt.types), stmts)
+		}
+		for i := range stmts {
+			if !reflect.DeepEqual(stmts[i].Types, tt.types[i]) {
+				t.Errorf("%q: expected types %v, got %v", tt.sql, tt.types[i], stmts[i].Types)
+			}
+			if !reflect.DeepEqual(stmts[i].Tables, tt.tables[i]) {
+				t.Errorf("%q: expected tables %v, got %v", tt.sql, tt.tables[i], stmts[i].Tables)
+			}
+		}
+	}
+}
+
+func TestParser_IsMatchStatementRule(t *testing.T) {
+	p := Parser{
+		protocolType: "mysql",
+		cmdFilterRules: []model.SystemUserFilterRule{
+			{ID: "1", Action: model.ActionDeny, StatementTypes: []string{sqlTypeDeleteWithoutWhere}},
+			{ID: "2", Action: model.ActionConfirm, StatementTypes: []string{"DROP"}, Tables: []string{"prod.*"}},
+			{ID: "3", Action: model.ActionDeny, RePattern: `\bshutdown\b`, IgnoreCase: true},
+		},
+	}
+	tests := []struct {
+		sql     string
+		ruleID  string
+		matched bool
+	}{
+		{sql: "delete\nfrom users", ruleID: "1", matched: true},
+		{sql: "delete from users where id = 1", matched: false},
+		{sql: "drop table prod.users", ruleID: "2", matched: true},
+		{sql: "drop table test.users", matched: false},
+		{sql: "select 1; drop table users; delete from t", ruleID: "1", matched: true},
+		{sql: "SHUT/* */DOWN", matched: false},
+		{sql: "/* x */ SHUTDOWN", ruleID: "3", matched: true},
+	}
+	for _, tt := range tests {
+		rule, _, ok := p.IsMatchStatementRule(tt.sql)
+		if ok != tt.matched || rule.ID != tt.ruleID {
+			t.Errorf("%q: expected rule %q matched %v, got %q %v", tt.sql, tt.ruleID, tt.matched, rule.ID, ok)
+		}
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/jumpserver/koko/pkg/audit"
 	"github.com/jumpserver/koko/pkg/exchange"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/common"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
@@ -30,6 +32,20 @@ type SwitchSession struct {
 	p *Server
 
 	terminateAdmin atomic.Value // 终断会话的管理员名称
+
+	readOnly int32 // 管理员设置只读后直到会话结束都不接受输入
+	paused   int32 // 管理员暂停输入, 可以恢复
+
+	// 管理员发给会话的提示, 由 Bridge 写入录像并广播到终端
+	noticeChan chan sessionNotice
+
+	roomLock sync.Mutex
+	room     *exchange.Room // Bridge 创建的会话房间, 所有者通过它授予和收回键盘控制
+}
+
+type sessionNotice struct {
+	msg   string
+	event string // 提示之后广播到房间的状态事件, 如冻结、解冻
 }
 
 func (s *SwitchSession) Terminate(username string) {
@@ -39,10 +55,120 @@ func (s *SwitchSession) Terminate(username string) {
 	default:
 		s.setTerminateAdmin(username)
 	}
+	audit.RecordSessionEvent(s.ID, audit.EventSessionTerminate, map[string]string{"user": username})
 	s.cancel()
 	logger.Infof("Session[%s] receive terminate task from admin %s", s.ID, username)
 }
 
+// LockReadOnly 设置会话只读, 之后的用户输入都被丢弃
+func (s *SwitchSession) LockReadOnly(username string) {
+	if !atomic.CompareAndSwapInt32(&s.readOnly, 0, 1) {
+		return
+	}
+	audit.RecordSessionEvent(s.ID, audit.EventSessionReadonly, map[string]string{"user": username})
+	lang := s.p.connOpts.getLang()
+	s.notify(fmt.Sprintf(lang.T("Session is set read-only by admin %s"), username), exchange.FreezeEvent)
+	logger.Infof("Session[%s] set read-only by admin %s", s.ID, username)
+}
+
+// Pause 暂停会话输入
+func (s *SwitchSession) Pause(username string) {
+	if !atomic.CompareAndSwapInt32(&s.paused, 0, 1) {
+		return
+	}
+	audit.RecordSessionEvent(s.ID, audit.EventSessionPause, map[string]string{"user": username})
+	lang := s.p.connOpts.getLang()
+	s.notify(fmt.Sprintf(lang.T("Session input is paused by admin %s"), username), exchange.FreezeEvent)
+	logger.Infof("Session[%s] input paused by admin %s", s.ID, username)
+}
+
+// Resume 恢复会话输入, 对已设置只读的会话无效
+func (s *SwitchSession) Resume(username string) {
+	if atomic.LoadInt32(&s.readOnly) == 1 || !atomic.CompareAndSwapInt32(&s.paused, 1, 0) {
+		return
+	}
+	audit.RecordSessionEvent(s.ID, audit.EventSessionResume, map[string]string{"user": username})
+	lang := s.p.connOpts.getLang()
+	s.notify(fmt.Sprintf(lang.T("Session input is resumed by admin %s"), username), exchange.UnFreezeEvent)
+	logger.Infof("Session[%s] input resumed by admin %s", s.ID, username)
+}
+
+// SendMessage 向会话终端发送管理员消息, 如断开会话前的提醒
+func (s *SwitchSession) SendMessage(username, message string) {
+	lang := s.p.connOpts.getLang()
+	s.notify(fmt.Sprintf(lang.T("Message from admin %s: %s"), username, message), "")
+	logger.Infof("Session[%s] receive message from admin %s", s.ID, username)
+}
+
+func (s *SwitchSession) getRoom() (*exchange.Room, error) {
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if s.room == nil {
+		return nil, ErrSessionNotReady
+	}
+	return s.room, nil
+}
+
+func (s *SwitchSession) setRoom(room *exchange.Room) {
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	s.room = room
+}
+
+// GrantControl 会话所有者把键盘交给申请控制的参与者
+func (s *SwitchSession) GrantControl(key string) error {
+	room, err := s.getRoom()
+	if err != nil {
+		return err
+	}
+	return room.GrantControl(key)
+}
+
+// RevokeControl 会话所有者撤销参与者的控制或拒绝其申请
+func (s *SwitchSession) RevokeControl(key string) error {
+	room, err := s.getRoom()
+	if err != nil {
+		return err
+	}
+	return room.RevokeControl(key)
+}
+
+// ReclaimControl 会话所有者收回键盘
+func (s *SwitchSession) ReclaimControl() error {
+	room, err := s.getRoom()
+	if err != nil {
+		return err
+	}
+	return room.ReclaimControl()
+}
+
+func (s *SwitchSession) isInputLocked() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1 || atomic.LoadInt32(&s.paused) == 1
+}
+
+// handleControlMessage 处理管理员在监控会话时发来的事件
+func (s *SwitchSession) handleControlMessage(msg *exchange.RoomMessage) {
+	username := msg.Meta.User
+	switch msg.Event {
+	case exchange.FreezeEvent:
+		s.Pause(username)
+	case exchange.UnFreezeEvent:
+		s.Resume(username)
+	case exchange.NoticeEvent:
+		if message := strings.TrimSpace(string(msg.Body)); message != "" {
+			s.SendMessage(username, message)
+		}
+	}
+}
+
+func (s *SwitchSession) notify(msg, event string) {
+	select {
+	case s.noticeChan <- sessionNotice{msg: msg, event: event}:
+	default:
+		logger.Errorf("Session[%s] too many pending notices, drop: %s", s.ID, msg)
+	}
+}
+
 func (s *SwitchSession) setTerminateAdmin(username string) {
 	s.terminateAdmin.Store(username)
 }
@@ -63,12 +189,27 @@ func (s *SwitchSession) recordCommand(cmdRecordChan chan *ExecutedCommand) {
 			continue
 		}
 		cmd := s.generateCommandResult(item)
+		// 先加入审计链, 命令推送时带上链的序号和哈希
+		audit.RecordCommand(cmd)
 		cmdRecorder.Record(cmd)
 	}
+	audit.RecordSessionEvent(s.ID, audit.EventSessionEnd, map[string]string{})
 	// 关闭命令记录
 	cmdRecorder.End()
 }
 
+// recordSessionStart 在审计日志中开始会话链
+func (s *SwitchSession) recordSessionStart(userConn UserConnection) {
+	asset, _ := s.p.getAssetInfo()
+	audit.RecordSessionEvent(s.ID, audit.EventSessionStart, map[string]string{
+		"user":        s.p.connOpts.user.String(),
+		"asset":       asset,
+		"system_user": s.p.systemUserAuthInfo.String(),
+		"protocol":    s.p.connOpts.ProtocolType,
+		"remote_addr": userConn.RemoteAddr(),
+	})
+}
+
 // generateCommandResult 生成命令结果
 func (s *SwitchSession) generateCommandResult(item *ExecutedCommand) *model.Command {
 	var (
@@ -105,6 +246,12 @@ func (s *SwitchSession) generateCommandResult(item *ExecutedCommand) *model.Comm
 func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerConnection) (err error) {
 
 	parser := s.p.GetFilterParser()
+	parser.SetInputLocked(s.isInputLocked)
+	parser.SetControlHandler(s.handleControlMessage)
+	if observer, ok := srvConn.(srvconn.StatementObserver); ok {
+		parser.EnableStatementMode()
+		observer.SetStatementHook(parser)
+	}
 	logger.Infof("Conn[%s] create ParseEngine success", userConn.ID())
 	replayRecorder := s.p.GetReplayRecorder()
 	logger.Infof("Conn[%s] create replay success", userConn.ID())
@@ -124,6 +271,7 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 	}()
 
 	// 记录命令
+	s.recordSessionStart(userConn)
 	cmdChan := parser.CommandRecordChan()
 	go s.recordCommand(cmdChan)
 
@@ -134,8 +282,13 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 	defer tick.Stop()
 
 	room := exchange.CreateRoom(s.ID, userInputMessageChan)
+	if s.p.agentForwarder != nil {
+		room.OnShared(s.disableAgentForwarding)
+	}
 	exchange.Register(room)
 	defer exchange.UnRegister(room)
+	s.setRoom(room)
+	defer s.setRoom(nil)
 	conn := exchange.WrapperUserCon(userConn)
 	room.Subscribe(conn)
 	defer room.UnSubscribe(conn)
@@ -176,6 +329,7 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 		Created:    common.NewNowUTCTime().String(),
 		RemoteAddr: userConn.RemoteAddr(),
 	}
+	room.EnableControl(meta)
 	room.Broadcast(&exchange.RoomMessage{
 		Event: exchange.ShareJoin,
 		Body:  nil,
@@ -251,6 +405,15 @@ func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerCo
 				return
 			}
 			continue
+			// 管理员发来的提示, 不算作会话活动
+		case notice := <-s.noticeChan:
+			msg := "\r\n" + utils.WrapperWarn(notice.msg) + "\r\n"
+			replayRecorder.Record([]byte(msg))
+			room.Broadcast(&exchange.RoomMessage{Event: exchange.DataEvent, Body: []byte(msg)})
+			if notice.event != "" {
+				room.Broadcast(&exchange.RoomMessage{Event: notice.event})
+			}
+			continue
 			// 手动结束
 		case <-s.ctx.Done():
 			adminUser := s.loadTerminateAdmin()
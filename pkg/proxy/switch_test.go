@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/jumpserver/koko/pkg/exchange"
+)
+
+func TestSwitchSessionInputLock(t *testing.T) {
+	sw := &SwitchSession{
+		ID:         "test",
+		p:          &Server{connOpts: &ConnectionOptions{}},
+		noticeChan: make(chan sessionNotice, 8),
+	}
+	if sw.isInputLocked() {
+		t.Fatal("new session should accept input")
+	}
+	sw.Pause("admin")
+	sw.Pause("admin")
+	if !sw.isInputLocked() {
+		t.Fatal("paused session should lock input")
+	}
+	sw.Resume("admin")
+	if sw.isInputLocked() {
+		t.Fatal("resumed session should accept input")
+	}
+	sw.LockReadOnly("admin")
+	sw.Resume("admin")
+	if !sw.isInputLocked() {
+		t.Fatal("read-only session should not be resumed")
+	}
+	sw.SendMessage("admin", "disconnect in 5 minutes")
+	// 重复暂停和无效的恢复不产生提示
+	if n := len(sw.noticeChan); n != 4 {
+		t.Fatalf("expect 4 notices, got %d", n)
+	}
+}
+
+func TestSwitchSessionControlMessage(t *testing.T) {
+	sw := &SwitchSession{
+		ID:         "test",
+		p:          &Server{connOpts: &ConnectionOptions{}},
+		noticeChan: make(chan sessionNotice, 8),
+	}
+	meta := exchange.MetaMessage{User: "admin(admin)"}
+	sw.handleControlMessage(&exchange.RoomMessage{Event: exchange.FreezeEvent, Meta: meta})
+	if !sw.isInputLocked() {
+		t.Fatal("freeze event should lock input")
+	}
+	if notice := <-sw.noticeChan; notice.event != exchange.FreezeEvent {
+		t.Fatalf("expect freeze event broadcast, got %q", notice.event)
+	}
+	sw.handleControlMessage(&exchange.RoomMessage{Event: exchange.NoticeEvent, Body: []byte("  "), Meta: meta})
+	sw.handleControlMessage(&exchange.RoomMessage{Event: exchange.NoticeEvent, Body: []byte("save your work"), Meta: meta})
+	if n := len(sw.noticeChan); n != 1 {
+		t.Fatalf("empty notice should be ignored, got %d notices", n)
+	}
+	<-sw.noticeChan
+	sw.handleControlMessage(&exchange.RoomMessage{Event: exchange.UnFreezeEvent, Meta: meta})
+	if sw.isInputLocked() {
+		t.Fatal("unfreeze event should unlock input")
+	}
+	if notice := <-sw.noticeChan; notice.event != exchange.UnFreezeEvent {
+		t.Fatalf("expect unfreeze event broadcast, got %q", notice.event)
+	}
+}
@@ -1,10 +1,17 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/hostkey"
+	"github.com/jumpserver/koko/pkg/i18n"
+	"github.com/jumpserver/koko/pkg/metrics"
 )
 
 const (
@@ -18,28 +25,90 @@ const (
 	networkUnreachable = "network is unreachable"
 )
 
+// 连接失败的原因, 用于监控指标的标签
+const (
+	reasonAuthFailed         = "auth_failed"
+	reasonConnectionRefused  = "connection_refused"
+	reasonIoTimeout          = "io_timeout"
+	reasonNoRoute            = "no_route"
+	reasonNetworkUnreachable = "network_unreachable"
+	reasonHostKeyMismatch    = "host_key_mismatch"
+	reasonHostKeyUnknown     = "host_key_unknown"
+	reasonOther              = "other"
+)
+
+// connectFailureReason 将连接错误归类, 与 ConvertErrorToReadableMsg 展示给用户的信息对应
+func connectFailureReason(e error) string {
+	switch {
+	case errors.Is(e, hostkey.ErrHostKeyMismatch):
+		return reasonHostKeyMismatch
+	case errors.Is(e, hostkey.ErrHostKeyUnknown):
+		return reasonHostKeyUnknown
+	}
+	errMsg := e.Error()
+	switch {
+	case strings.Contains(errMsg, UnAuth) || strings.Contains(errMsg, LoginFailed):
+		return reasonAuthFailed
+	case strings.Contains(errMsg, ConnectRefusedErr):
+		return reasonConnectionRefused
+	case strings.Contains(errMsg, IoTimeoutErr):
+		return reasonIoTimeout
+	case strings.Contains(errMsg, NoRouteErr):
+		return reasonNoRoute
+	case strings.Contains(errMsg, networkUnreachable):
+		return reasonNetworkUnreachable
+	}
+	return reasonOther
+}
+
 func (s *Server) ConvertErrorToReadableMsg(e error) string {
 	if e == nil {
 		return ""
 	}
-	errMsg := e.Error()
 	lang := s.connOpts.getLang()
-	if strings.Contains(errMsg, UnAuth) || strings.Contains(errMsg, LoginFailed) {
+	switch connectFailureReason(e) {
+	case reasonAuthFailed:
 		return lang.T("Authentication failed")
-	}
-	if strings.Contains(errMsg, ConnectRefusedErr) {
+	case reasonConnectionRefused:
 		return lang.T("Connection refused")
-	}
-	if strings.Contains(errMsg, IoTimeoutErr) {
+	case reasonIoTimeout:
 		return lang.T("i/o timeout")
-	}
-	if strings.Contains(errMsg, NoRouteErr) {
+	case reasonNoRoute:
 		return lang.T("No route to host")
-	}
-	if strings.Contains(errMsg, networkUnreachable) {
+	case reasonNetworkUnreachable:
 		return lang.T("network is unreachable")
+	case reasonHostKeyMismatch, reasonHostKeyUnknown:
+		return hostKeyErrorMsg(lang, e)
+	}
+	return e.Error()
+}
+
+/*
+	hostKeyErrorMsg 提示 host key 校验失败的地址和指纹。
+	资产合法重建后需要管理员确认新的指纹并重置记录, 不允许用户自行接受
+*/
+
+func hostKeyErrorMsg(lang i18n.LanguageCode, e error) string {
+	var keyErr *hostkey.KeyError
+	if !errors.As(e, &keyErr) {
+		return e.Error()
+	}
+	if errors.Is(keyErr, hostkey.ErrHostKeyUnknown) {
+		msg := lang.T("Host key of %s is not trusted (fingerprint %s), please contact the administrator")
+		return fmt.Sprintf(msg, keyErr.Addr, keyErr.Got)
+	}
+	msg := lang.T("Host key of %s has changed (expected %s, got %s), it may be spoofed, please contact the administrator")
+	return fmt.Sprintf(msg, keyErr.Addr, strings.Join(keyErr.Expected, ","), keyErr.Got)
+}
+
+func (s *Server) observeConnect(duration time.Duration, err error) {
+	protocol := s.connOpts.ProtocolType
+	if err != nil {
+		metrics.ConnectDuration.Observe(duration.Seconds(), protocol, metrics.ResultFailure)
+		metrics.ConnectFailures.Inc(protocol, connectFailureReason(err))
+		return
 	}
-	return errMsg
+	metrics.ConnectDuration.Observe(duration.Seconds(), protocol, metrics.ResultSuccess)
 }
 
 func ReplaceURLHostAndPort(originUrl *url.URL, ip string, port int) string {
@@ -1,8 +1,11 @@
 package proxy
 
 import (
+	"net"
+	"path/filepath"
 	"strings"
 
+	"github.com/jumpserver/koko/pkg/config"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	storage "github.com/jumpserver/koko/pkg/proxy/recorderstorage"
@@ -14,6 +17,13 @@ type StorageType interface {
 
 type ReplayStorage interface {
 	Upload(gZipFile, target string) error
+	// Delete 和 List 用于 koko 自行清理过期的录像, 不支持的存储返回 ErrNotSupported
+	Delete(target string) error
+	List(prefix string) ([]storage.ObjectInfo, error)
+	// ListDirs 列出顶层目录, 即录像的日期目录, 清理时只列出过期日期下的文件
+	ListDirs() ([]string, error)
+	// Download 用于在 koko 上直接查看录像
+	Download(target, localPath string) error
 	StorageType
 }
 
@@ -79,12 +89,23 @@ func NewReplayStorage(jmsService *service.JMService, conf *model.TerminalConfig)
 			AccessKey: accessKey,
 			SecretKey: secretKey,
 		}
-	case "s3", "swift":
+	case "local":
+		var directory string
+		if value, ok := cf["DIRECTORY"].(string); ok {
+			directory = value
+		}
+		if directory == "" {
+			directory = filepath.Join(config.GetConf().DataFolderPath, "replay_storage")
+		}
+		return storage.LocalReplayStorage{Directory: directory}
+	case "s3", "swift", "minio":
 		var region string
 		var endpoint string
 		var bucket string
 		var accessKey string
 		var secretKey string
+		var skipVerify bool
+		forcePathStyle := true
 		if value, ok := cf["BUCKET"].(string); ok {
 			bucket = value
 		}
@@ -100,12 +121,17 @@ func NewReplayStorage(jmsService *service.JMService, conf *model.TerminalConfig)
 		if value, ok := cf["SECRET_KEY"].(string); ok {
 			secretKey = value
 		}
-		if region == "" && endpoint != "" {
-			endpointArray := strings.Split(endpoint, ".")
-			if len(endpointArray) >= 2 {
-				region = endpointArray[1]
+		if value, ok := cf["FORCE_PATH_STYLE"].(bool); ok {
+			forcePathStyle = value
+		}
+		if otherMap, ok := cf["OTHER"].(map[string]interface{}); ok {
+			if value, ok := otherMap["IGNORE_VERIFY_CERTS"].(bool); ok {
+				skipVerify = value
 			}
 		}
+		if region == "" && endpoint != "" {
+			region = parseS3Region(endpoint)
+		}
 		if bucket == "" {
 			bucket = "jumpserver"
 		}
@@ -115,6 +141,9 @@ func NewReplayStorage(jmsService *service.JMService, conf *model.TerminalConfig)
 			AccessKey: accessKey,
 			SecretKey: secretKey,
 			Endpoint:  endpoint,
+
+			ForcePathStyle:     forcePathStyle,
+			InsecureSkipVerify: skipVerify,
 		}
 	case "obs":
 		var endpoint string
@@ -147,6 +176,32 @@ func NewReplayStorage(jmsService *service.JMService, conf *model.TerminalConfig)
 	}
 }
 
+const defaultS3Region = "us-east-1"
+
+/*
+	parseS3Region 从地址中解析 region, 如 https://s3.ap-east-1.amazonaws.com
+	MinIO 等自建存储的地址如 http://192.168.1.10:9000 无法解析, 使用默认的 region
+*/
+
+func parseS3Region(endpoint string) string {
+	host := endpoint
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if net.ParseIP(host) != nil {
+		return defaultS3Region
+	}
+	endpointArray := strings.Split(host, ".")
+	if len(endpointArray) >= 3 {
+		return endpointArray[1]
+	}
+	return defaultS3Region
+}
+
 func NewCommandStorage(jmsService *service.JMService, conf *model.TerminalConfig) CommandStorage {
 	cf := conf.CommandStorage
 	tp, ok := cf["TYPE"]
@@ -188,6 +243,137 @@ func NewCommandStorage(jmsService *service.JMService, conf *model.TerminalConfig
 			DocType:            docType,
 			InsecureSkipVerify: skipVerify,
 		}
+	case "file", "jsonl":
+		/*
+			{
+			  'FILE_PATH': '/opt/koko/data/commands/commands.jsonl',
+			  'MAX_SIZE': 100,  // MB
+			  'MAX_BACKUPS': 7,
+			  'TYPE': 'file'
+			}
+		*/
+		var filePath string
+		maxSize := 100
+		maxBackups := 7
+		if value, ok := cf["FILE_PATH"].(string); ok {
+			filePath = value
+		}
+		if value, ok := cf["MAX_SIZE"].(float64); ok {
+			maxSize = int(value)
+		}
+		if value, ok := cf["MAX_BACKUPS"].(float64); ok {
+			maxBackups = int(value)
+		}
+		if filePath == "" {
+			filePath = filepath.Join(config.GetConf().DataFolderPath, "commands", "commands.jsonl")
+		}
+		return storage.FileCommandStorage{
+			FilePath:   filePath,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+		}
+	case "kafka":
+		/*
+			{
+			  'HOSTS': ['172.16.10.122:9092'],
+			  'TOPIC': 'jumpserver-command',
+			  'USERNAME': '',
+			  'PASSWORD': '',
+			  'OTHER': {'USE_TLS': False, 'IGNORE_VERIFY_CERTS': True},
+			  'TYPE': 'kafka'
+			}
+		*/
+		var brokers []string
+		var topic string
+		var username string
+		var password string
+		var useTLS bool
+		var skipVerify bool
+		if hosts, ok := cf["HOSTS"].([]interface{}); ok {
+			for _, item := range hosts {
+				if host, ok := item.(string); ok {
+					brokers = append(brokers, host)
+				}
+			}
+		}
+		if value, ok := cf["TOPIC"].(string); ok {
+			topic = value
+		}
+		if value, ok := cf["USERNAME"].(string); ok {
+			username = value
+		}
+		if value, ok := cf["PASSWORD"].(string); ok {
+			password = value
+		}
+		if otherMap, ok := cf["OTHER"].(map[string]interface{}); ok {
+			if value, ok := otherMap["USE_TLS"].(bool); ok {
+				useTLS = value
+			}
+			if value, ok := otherMap["IGNORE_VERIFY_CERTS"].(bool); ok {
+				skipVerify = value
+			}
+		}
+		if topic == "" {
+			topic = "jumpserver-command"
+		}
+		return storage.KafkaCommandStorage{
+			Brokers:            brokers,
+			Topic:              topic,
+			Username:           username,
+			Password:           password,
+			UseTLS:             useTLS,
+			InsecureSkipVerify: skipVerify,
+		}
+	case "loki":
+		/*
+			{
+			  'URL': 'http://172.16.10.122:3100',
+			  'LABELS': {'env': 'prod'},
+			  'TENANT_ID': '',
+			  'USERNAME': '',
+			  'PASSWORD': '',
+			  'OTHER': {'IGNORE_VERIFY_CERTS': True},
+			  'TYPE': 'loki'
+			}
+		*/
+		var lokiURL string
+		var tenantID string
+		var username string
+		var password string
+		var skipVerify bool
+		labels := make(map[string]string)
+		if value, ok := cf["URL"].(string); ok {
+			lokiURL = value
+		}
+		if value, ok := cf["TENANT_ID"].(string); ok {
+			tenantID = value
+		}
+		if value, ok := cf["USERNAME"].(string); ok {
+			username = value
+		}
+		if value, ok := cf["PASSWORD"].(string); ok {
+			password = value
+		}
+		if labelMap, ok := cf["LABELS"].(map[string]interface{}); ok {
+			for k, v := range labelMap {
+				if value, ok := v.(string); ok {
+					labels[k] = value
+				}
+			}
+		}
+		if otherMap, ok := cf["OTHER"].(map[string]interface{}); ok {
+			if value, ok := otherMap["IGNORE_VERIFY_CERTS"].(bool); ok {
+				skipVerify = value
+			}
+		}
+		return storage.LokiCommandStorage{
+			URL:                lokiURL,
+			Labels:             labels,
+			TenantID:           tenantID,
+			Username:           username,
+			Password:           password,
+			InsecureSkipVerify: skipVerify,
+		}
 	case "null":
 		return storage.NewNullStorage()
 	default:
@@ -0,0 +1,151 @@
+package srvconn
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+const agentChannelType = "auth-agent@openssh.com"
+
+var (
+	ErrAgentForwardingDisabled = errors.New("agent forwarding disabled")
+	ErrAgentReadOnly           = errors.New("agent forwarding only allows list and sign")
+)
+
+// AgentSignEvent 是目标通过转发的 agent 发起的一次签名请求
+type AgentSignEvent struct {
+	Key     gossh.PublicKey
+	Flags   agent.SignatureFlags
+	DataLen int
+	Err     error
+}
+
+/*
+	AgentForwarder 把目标打开的 auth-agent@openssh.com 通道转发到用户的 agent。
+	koko 解析 agent 协议而不是直接转发字节流, 只允许列出密钥和签名, 每次签名通过 onSign 记录。
+	Disable 后拒绝新的 agent 通道和签名请求
+*/
+
+type AgentForwarder struct {
+	openUserAgent func() (io.ReadWriteCloser, error)
+	onSign        func(event AgentSignEvent)
+
+	disabled int32
+}
+
+func NewAgentForwarder(openUserAgent func() (io.ReadWriteCloser, error),
+	onSign func(event AgentSignEvent)) *AgentForwarder {
+	return &AgentForwarder{openUserAgent: openUserAgent, onSign: onSign}
+}
+
+func (f *AgentForwarder) Disable() {
+	atomic.StoreInt32(&f.disabled, 1)
+}
+
+func (f *AgentForwarder) Disabled() bool {
+	return atomic.LoadInt32(&f.disabled) == 1
+}
+
+// Forward 处理 client 上目标打开的 agent 通道, 每个 client 只能注册一次
+func (f *AgentForwarder) Forward(client *gossh.Client) error {
+	channels := client.HandleChannelOpen(agentChannelType)
+	if channels == nil {
+		return errors.New("agent channel handler already registered")
+	}
+	go func() {
+		for newChan := range channels {
+			if f.Disabled() {
+				_ = newChan.Reject(gossh.Prohibited, ErrAgentForwardingDisabled.Error())
+				continue
+			}
+			go f.serve(newChan)
+		}
+	}()
+	return nil
+}
+
+func (f *AgentForwarder) serve(newChan gossh.NewChannel) {
+	userAgent, err := f.openUserAgent()
+	if err != nil {
+		logger.Errorf("Open user agent channel err: %s", err)
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	defer userAgent.Close()
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		logger.Errorf("Accept target agent channel err: %s", err)
+		return
+	}
+	defer channel.Close()
+	go gossh.DiscardRequests(reqs)
+	keyring := &forwardedAgent{client: agent.NewClient(userAgent), forwarder: f}
+	if err = agent.ServeAgent(keyring, channel); err != nil && err != io.EOF {
+		logger.Debugf("Serve forwarded agent end: %s", err)
+	}
+}
+
+var _ agent.ExtendedAgent = (*forwardedAgent)(nil)
+
+type forwardedAgent struct {
+	client    agent.ExtendedAgent
+	forwarder *AgentForwarder
+}
+
+func (a *forwardedAgent) List() ([]*agent.Key, error) {
+	if a.forwarder.Disabled() {
+		return nil, ErrAgentForwardingDisabled
+	}
+	return a.client.List()
+}
+
+func (a *forwardedAgent) Sign(key gossh.PublicKey, data []byte) (*gossh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *forwardedAgent) SignWithFlags(key gossh.PublicKey, data []byte,
+	flags agent.SignatureFlags) (sig *gossh.Signature, err error) {
+	if a.forwarder.Disabled() {
+		err = ErrAgentForwardingDisabled
+	} else {
+		sig, err = a.client.SignWithFlags(key, data, flags)
+	}
+	if a.forwarder.onSign != nil {
+		a.forwarder.onSign(AgentSignEvent{Key: key, Flags: flags, DataLen: len(data), Err: err})
+	}
+	return sig, err
+}
+
+func (a *forwardedAgent) Add(key agent.AddedKey) error {
+	return ErrAgentReadOnly
+}
+
+func (a *forwardedAgent) Remove(key gossh.PublicKey) error {
+	return ErrAgentReadOnly
+}
+
+func (a *forwardedAgent) RemoveAll() error {
+	return ErrAgentReadOnly
+}
+
+func (a *forwardedAgent) Lock(passphrase []byte) error {
+	return ErrAgentReadOnly
+}
+
+func (a *forwardedAgent) Unlock(passphrase []byte) error {
+	return ErrAgentReadOnly
+}
+
+func (a *forwardedAgent) Signers() ([]gossh.Signer, error) {
+	return nil, ErrAgentReadOnly
+}
+
+func (a *forwardedAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
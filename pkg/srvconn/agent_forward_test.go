@@ -0,0 +1,51 @@
+package srvconn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestForwardedAgent(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	var events []AgentSignEvent
+	forwarder := NewAgentForwarder(nil, func(event AgentSignEvent) {
+		events = append(events, event)
+	})
+	forwarded := &forwardedAgent{client: keyring.(agent.ExtendedAgent), forwarder: forwarder}
+
+	keys, err := forwarded.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("list keys got %d, err %v", len(keys), err)
+	}
+	if _, err = forwarded.Sign(keys[0], []byte("session")); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Err != nil || events[0].DataLen != len("session") {
+		t.Fatalf("sign should be recorded, got %+v", events)
+	}
+	if err = forwarded.RemoveAll(); !errors.Is(err, ErrAgentReadOnly) {
+		t.Fatalf("remove keys should be refused, got %v", err)
+	}
+
+	forwarder.Disable()
+	if _, err = forwarded.List(); !errors.Is(err, ErrAgentForwardingDisabled) {
+		t.Fatalf("list after disabled got %v", err)
+	}
+	if _, err = forwarded.Sign(keys[0], []byte("session")); !errors.Is(err, ErrAgentForwardingDisabled) {
+		t.Fatalf("sign after disabled got %v", err)
+	}
+	if len(events) != 2 || events[1].Err == nil {
+		t.Fatalf("refused sign should be recorded, got %+v", events)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
-	"strings"
 )
 
 type ServerConnection interface {
@@ -30,6 +29,8 @@ const (
 	ProtocolMariadb   = "mariadb"
 	ProtocolSQLServer = "sqlserver"
 	ProtocolRedis     = "redis"
+
+	ProtocolPostgreSQL = "postgresql"
 )
 
 var (
@@ -37,11 +38,7 @@ var (
 
 	ErrKubectlClient = errors.New("not found Kubectl client")
 
-	ErrMySQLClient = errors.New("not found MySQL client")
-
-	ErrRedisClient = errors.New("not found Redis client")
-
-	ErrSQLServerClient = errors.New("not found SQLServer client")
+	ErrPostgreSQLClient = errors.New("not found PostgreSQL client")
 )
 
 type supportedChecker func() error
@@ -50,10 +47,12 @@ var supportedMap = map[string]supportedChecker{
 	ProtocolSSH:       builtinSupported,
 	ProtocolTELNET:    builtinSupported,
 	ProtocolK8s:       kubectlSupported,
-	ProtocolMySQL:     mySQLSupported,
-	ProtocolMariadb:   mySQLSupported,
-	ProtocolRedis:     redisSupported,
-	ProtocolSQLServer: sqlServerSupported,
+	ProtocolMySQL:     builtinSupported,
+	ProtocolMariadb:   builtinSupported,
+	ProtocolRedis:     builtinSupported,
+	ProtocolSQLServer: builtinSupported,
+
+	ProtocolPostgreSQL: postgresqlSupported,
 }
 
 func IsSupportedProtocol(p string) error {
@@ -85,41 +84,15 @@ func kubectlSupported() error {
 	return ErrKubectlClient
 }
 
-func mySQLSupported() error {
-	checkLine := "mysql -V"
-	cmd := exec.Command("bash", "-c", checkLine)
-	out, err := cmd.CombinedOutput()
-	if err != nil && len(out) == 0 {
-		return fmt.Errorf("%w: %s", ErrMySQLClient, err)
-	}
-	if bytes.HasPrefix(out, []byte("mysql")) {
-		return nil
-	}
-	return ErrMySQLClient
-}
-
-func redisSupported() error {
-	checkLine := "redis-cli -v"
-	cmd := exec.Command("bash", "-c", checkLine)
-	out, err := cmd.CombinedOutput()
-	if err != nil && len(out) == 0 {
-		return fmt.Errorf("%w: %s", ErrRedisClient, err)
-	}
-	if bytes.HasPrefix(out, []byte("redis-cli")) {
-		return nil
-	}
-	return ErrRedisClient
-}
-
-func sqlServerSupported() error {
-	checkLine := "tsql -C"
+func postgresqlSupported() error {
+	checkLine := "psql -V"
 	cmd := exec.Command("bash", "-c", checkLine)
 	out, err := cmd.CombinedOutput()
 	if err != nil && len(out) == 0 {
-		return fmt.Errorf("%w: %s", ErrSQLServerClient, err)
+		return fmt.Errorf("%w: %s", ErrPostgreSQLClient, err)
 	}
-	if strings.Contains(string(out), "freetds") {
+	if bytes.HasPrefix(out, []byte("psql")) {
 		return nil
 	}
-	return ErrSQLServerClient
+	return ErrPostgreSQLClient
 }
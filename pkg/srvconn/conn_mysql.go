@@ -1,51 +1,27 @@
 package srvconn
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"os"
-	"os/user"
-	"path/filepath"
-	"runtime"
 	"strconv"
-	"sync"
-	"syscall"
+	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 
-	"github.com/jumpserver/koko/pkg/localcommand"
 	"github.com/jumpserver/koko/pkg/logger"
 )
 
-const (
-	mysqlPrompt = "Enter password: "
-
-	mysqlShellFilename = "mysql"
-)
-
 var (
-	mysqlShellPath = ""
-
 	_ ServerConnection = (*MySQLConn)(nil)
-)
-
-const mysqlTemplate = `#!/bin/bash
-set -e
-mkdir -p /nonexistent
-mount -t tmpfs -o size=10M tmpfs /nonexistent
-cd /nonexistent
-export HOME=/nonexistent
-export TMPDIR=/nonexistent
-export LANG=en_US.UTF-8
-export TERM=xterm
-exec su -s /bin/bash --command="mysql --user=${USERNAME} --host=${HOSTNAME} --port=${PORT} --password ${DATABASE}" nobody
-`
 
-var mysqlOnce sync.Once
+	_ replDriver = (*mysqlDriver)(nil)
+)
 
 func NewMySQLConnection(ops ...SqlOption) (*MySQLConn, error) {
 	args := &sqlOption{
@@ -62,126 +38,237 @@ func NewMySQLConnection(ops ...SqlOption) (*MySQLConn, error) {
 	for _, setter := range ops {
 		setter(args)
 	}
-	if err := checkMySQLAccount(args); err != nil {
+	driver, err := newMySQLDriver(args)
+	if err != nil {
 		return nil, err
 	}
-	lCmd, err := startMySQLCommand(args)
+	return &MySQLConn{options: args, replConn: newReplConn(driver, args.win)}, nil
+}
+
+type MySQLConn struct {
+	options *sqlOption
+	*replConn
+}
+
+func newMySQLDriver(opt *sqlOption) (*mysqlDriver, error) {
+	db, err := openSQLDB("mysql", opt.DataSourceName())
 	if err != nil {
 		return nil, err
 	}
-	err = lCmd.SetWinSize(args.win.Width, args.win.Height)
+	ctx, cancel := context.WithTimeout(context.Background(), sqlConnectTimeout)
+	defer cancel()
+	conn, err := db.Conn(ctx)
 	if err != nil {
-		_ = lCmd.Close()
+		_ = db.Close()
 		return nil, err
 	}
-	return &MySQLConn{options: args, LocalCommand: lCmd}, nil
+	driver := &mysqlDriver{
+		opt:       opt,
+		db:        db,
+		conn:      conn,
+		splitter:  SQLSplitter{MySQLDialect: true},
+		currentDB: opt.DBName,
+	}
+	if err = conn.QueryRowContext(ctx, "SELECT VERSION()").Scan(&driver.version); err != nil {
+		logger.Errorf("MySQL get server version err: %s", err)
+	}
+	return driver, nil
 }
 
-type MySQLConn struct {
-	options *sqlOption
-	*localcommand.LocalCommand
-}
+// mysqlDriver 直接使用 MySQL 协议执行语句, 兼容 MariaDB
+type mysqlDriver struct {
+	opt  *sqlOption
+	db   *sql.DB
+	conn *sql.Conn
 
-func (conn *MySQLConn) KeepAlive() error {
-	return nil
+	splitter  SQLSplitter
+	currentDB string
+	version   string
 }
 
-func (conn *MySQLConn) Close() error {
-	_, _ = conn.Write([]byte("\r\nexit\r\n"))
-	return conn.LocalCommand.Close()
+func (d *mysqlDriver) Banner() string {
+	var banner strings.Builder
+	banner.WriteString("Welcome to the MySQL monitor.  Commands end with ; or \\g.\n")
+	banner.WriteString(fmt.Sprintf("Server version: %s\n\n", d.version))
+	banner.WriteString("Type 'help;' or '\\h' for help. Type '\\c' to clear the current input statement.\n\n")
+	return banner.String()
 }
 
-func startMySQLCommand(opt *sqlOption) (lcmd *localcommand.LocalCommand, err error) {
-	initOnceLinuxMySQLShellFile()
-	if mysqlShellPath != "" {
-		if lcmd, err = startMySQLNameSpaceCommand(opt); err == nil {
-			if lcmd, err = tryManualLoginMySQLServer(opt, lcmd); err == nil {
-				return lcmd, nil
-			}
-		}
+func (d *mysqlDriver) Prompt() string {
+	if d.splitter.Pending() {
+		return "    -> "
 	}
-	if lcmd, err = startMySQLNormalCommand(opt); err != nil {
-		return nil, err
+	name := "mysql"
+	if strings.Contains(strings.ToLower(d.version), "mariadb") {
+		name = "MariaDB"
 	}
-	return tryManualLoginMySQLServer(opt, lcmd)
+	db := d.currentDB
+	if db == "" {
+		db = "(none)"
+	}
+	return fmt.Sprintf("%s [%s]> ", name, db)
 }
 
-func startMySQLNameSpaceCommand(opt *sqlOption) (*localcommand.LocalCommand, error) {
-	argv := []string{
-		"--fork",
-		"--pid",
-		"--mount-proc",
-		mysqlShellPath,
+func (d *mysqlDriver) Feed(line string) (stmts []replStatement, quit bool) {
+	trimLine := strings.TrimSpace(line)
+	if !d.splitter.Pending() {
+		command := strings.ToLower(strings.TrimSuffix(trimLine, d.splitter.delimiter()))
+		fields := strings.Fields(command)
+		switch {
+		case command == "":
+			return nil, false
+		case command == "exit" || command == "quit" || command == "\\q":
+			return nil, true
+		case command == "help" || command == "\\h" || command == "?" || command == "\\?":
+			return []replStatement{{Text: trimLine, Terminator: mysqlHelpCommand}}, false
+		case len(fields) == 2 && fields[0] == "delimiter":
+			d.splitter.Delimiter = strings.Fields(trimLine)[1]
+			return nil, false
+		case len(fields) == 2 && fields[0] == "use":
+			// 与 mysql 客户端一致, use 无需结束符
+			text := strings.TrimSuffix(trimLine, d.splitter.delimiter())
+			return []replStatement{{Text: text, Terminator: d.splitter.delimiter()}}, false
+		}
+	}
+	if strings.HasSuffix(trimLine, "\\c") {
+		d.splitter.Reset()
+		return nil, false
+	}
+	for _, stmt := range d.splitter.Feed(line) {
+		stmts = append(stmts, replStatement{Text: stmt.Text, Terminator: stmt.Terminator})
 	}
-	return localcommand.New("unshare", argv, localcommand.WithEnv(opt.Envs()))
+	return stmts, false
 }
 
-func startMySQLNormalCommand(opt *sqlOption) (*localcommand.LocalCommand, error) {
-	// 使用 nobody 用户的权限
-	nobody, err := user.Lookup("nobody")
+const mysqlHelpCommand = "help"
+
+func (d *mysqlDriver) Execute(ctx context.Context, stmt replStatement, w io.Writer) error {
+	if stmt.Terminator == mysqlHelpCommand {
+		_, _ = io.WriteString(w, mysqlHelpText)
+		return nil
+	}
+	start := time.Now()
+	var (
+		summary string
+		err     error
+	)
+	if isSQLQueryStatement(stmt.Text) {
+		var rows *sql.Rows
+		if rows, err = d.conn.QueryContext(ctx, stmt.Text); err == nil {
+			var count int
+			count, err = writeSQLRows(w, rows, stmt.Terminator == mysqlVerticalTerminator)
+			_ = rows.Close()
+			summary = formatSQLRowsSummary(count, time.Since(start))
+		}
+	} else {
+		var result sql.Result
+		if result, err = d.conn.ExecContext(ctx, stmt.Text); err == nil {
+			summary = formatSQLAffectedSummary(result, time.Since(start))
+		}
+	}
 	if err != nil {
-		logger.Errorf("lookup nobody user err: %s", err)
-		return nil, err
+		return d.handleError(ctx, err, w)
+	}
+	_, _ = fmt.Fprintf(w, "%s\n\n", summary)
+	if sqlFirstKeyword(stmt.Text) == "USE" {
+		d.refreshCurrentDB(ctx)
 	}
-	uid, _ := strconv.Atoi(nobody.Uid)
-	gid, _ := strconv.Atoi(nobody.Gid)
+	return nil
+}
 
-	return localcommand.New("mysql", opt.CommandArgs(), localcommand.WithEnv(opt.Envs()),
-		localcommand.WithCmdCredential(&syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}))
+func (d *mysqlDriver) handleError(ctx context.Context, err error, w io.Writer) error {
+	var mysqlErr *mysql.MySQLError
+	switch {
+	case errors.As(err, &mysqlErr):
+		_, _ = fmt.Fprintf(w, "ERROR %d: %s\n\n", mysqlErr.Number, mysqlErr.Message)
+		return nil
+	case ctx.Err() != nil:
+		// 取消查询后 driver 会关闭连接, 需要重新建立
+		_, _ = io.WriteString(w, "Query aborted by Ctrl+C\n")
+		return d.reconnect(w)
+	case errors.Is(err, mysql.ErrInvalidConn), errors.Is(err, sql.ErrConnDone):
+		_, _ = fmt.Fprintf(w, "ERROR: %s\n", err)
+		return d.reconnect(w)
+	default:
+		_, _ = fmt.Fprintf(w, "ERROR: %s\n\n", err)
+		return nil
+	}
 }
 
-func tryManualLoginMySQLServer(opt *sqlOption, lcmd *localcommand.LocalCommand) (*localcommand.LocalCommand, error) {
-	var (
-		nr  int
-		err error
-	)
-	prompt := [len(mysqlPrompt)]byte{}
-	nr, err = lcmd.Read(prompt[:])
+func (d *mysqlDriver) reconnect(w io.Writer) error {
+	_ = d.conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), sqlConnectTimeout)
+	defer cancel()
+	conn, err := d.db.Conn(ctx)
 	if err != nil {
-		_ = lcmd.Close()
-		logger.Errorf("Mysql local pty fd read err: %s", err)
-		return lcmd, err
-
+		return err
 	}
-	if !bytes.Equal(prompt[:nr], []byte(mysqlPrompt)) {
-		_ = lcmd.Close()
-		logger.Errorf("Mysql login prompt characters did not match: %s", prompt[:nr])
-		err = fmt.Errorf("mysql login prompt characters did not match: %s", prompt[:nr])
-		return lcmd, err
+	d.conn = conn
+	if d.currentDB != "" {
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf("USE `%s`",
+			strings.ReplaceAll(d.currentDB, "`", "``"))); err != nil {
+			return err
+		}
 	}
+	_, _ = fmt.Fprintf(w, "Reconnected. Current database: %s\n\n", d.currentDB)
+	return nil
+}
 
-	// 输入密码, 登录 MySQL
-	_, err = lcmd.Write([]byte(opt.Password + "\r\n"))
-	if err != nil {
-		_ = lcmd.Close()
-		logger.Errorf("Mysql local pty write err: %s", err)
-		return lcmd, fmt.Errorf("mysql conn err: %s", err)
+func (d *mysqlDriver) refreshCurrentDB(ctx context.Context) {
+	var dbName sql.NullString
+	if err := d.conn.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&dbName); err != nil {
+		logger.Errorf("MySQL get current database err: %s", err)
+		return
 	}
-	return lcmd, nil
+	d.currentDB = dbName.String
 }
 
-func initOnceLinuxMySQLShellFile() {
-	mysqlOnce.Do(func() {
-		// Linux系统 初始化 MySQL 命令文件
-		switch runtime.GOOS {
-		case "linux":
-			if dir, err := os.Getwd(); err == nil {
-				TmpMysqlShellPath := filepath.Join(dir, mysqlShellFilename)
-				if _, err := os.Stat(TmpMysqlShellPath); err == nil {
-					mysqlShellPath = TmpMysqlShellPath
-					logger.Infof("Already init MySQL bash file: %s", TmpMysqlShellPath)
-					return
-				}
-				err = ioutil.WriteFile(TmpMysqlShellPath, []byte(mysqlTemplate), os.FileMode(0755))
-				if err != nil {
-					logger.Errorf("Init MySQL bash file failed: %s", err)
-					return
-				}
-				mysqlShellPath = TmpMysqlShellPath
-			}
-			logger.Infof("Init MySQL bash file: %s", mysqlShellPath)
-		}
-	})
+func (d *mysqlDriver) KeepAlive() error {
+	return d.conn.PingContext(context.Background())
+}
+
+func (d *mysqlDriver) Close() error {
+	_ = d.conn.Close()
+	return d.db.Close()
+}
+
+const mysqlHelpText = `List of all client commands:
+?         (\?) Synonym for 'help'.
+delimiter      Set statement delimiter.
+exit      (\q) Exit mysql. Same as quit.
+go        (\g) Send command to mysql server.
+ego       (\G) Send command to mysql server, display result vertically.
+help      (\h) Display this help.
+quit      (\q) Quit mysql.
+use            Use another database. Takes database name as argument.
+clear     (\c) Clear the current input statement.
+
+`
+
+var sqlQueryKeywords = map[string]bool{
+	"SELECT":   true,
+	"SHOW":     true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+	"WITH":     true,
+	"VALUES":   true,
+	"TABLE":    true,
+	"HELP":     true,
+	"CALL":     true,
+	"CHECK":    true,
+	"ANALYZE":  true,
+	"OPTIMIZE": true,
+	"REPAIR":   true,
+	"CHECKSUM": true,
+	"EXEC":     true,
+	"EXECUTE":  true,
+	"SP_HELP":  true,
+}
+
+// isSQLQueryStatement 语句是否会返回结果集
+func isSQLQueryStatement(stmt string) bool {
+	return sqlQueryKeywords[sqlFirstKeyword(stmt)]
 }
 
 type sqlOption struct {
@@ -194,34 +281,18 @@ type sqlOption struct {
 	win Windows
 }
 
-func (opt *sqlOption) CommandArgs() []string {
-	return []string{
-		fmt.Sprintf("--user=%s", opt.Username),
-		fmt.Sprintf("--host=%s", opt.Host),
-		fmt.Sprintf("--port=%d", opt.Port),
-		"--password",
-		opt.DBName,
-	}
-}
-
-func (opt *sqlOption) Envs() []string {
-	return []string{
-		fmt.Sprintf("USERNAME=%s", opt.Username),
-		fmt.Sprintf("HOSTNAME=%s", opt.Host),
-		fmt.Sprintf("PORT=%d", opt.Port),
-		fmt.Sprintf("DATABASE=%s", opt.DBName),
-	}
-}
-
 func (opt *sqlOption) DataSourceName() string {
 	// "user:password@tcp(127.0.0.1:3306)/hello"
-	addr := net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port))
-	return fmt.Sprintf("%s:%s@tcp(%s)/%s",
-		opt.Username,
-		opt.Password,
-		addr,
-		opt.DBName,
-	)
+	cfg := mysql.NewConfig()
+	cfg.User = opt.Username
+	cfg.Passwd = opt.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port))
+	cfg.DBName = opt.DBName
+	cfg.Timeout = sqlConnectTimeout
+	cfg.AllowNativePasswords = true
+	cfg.Params = map[string]string{"charset": "utf8mb4,utf8"}
+	return cfg.FormatDSN()
 }
 
 type SqlOption func(*sqlOption)
@@ -263,27 +334,17 @@ func SqlPtyWin(win Windows) SqlOption {
 }
 
 const (
-	mySQLMaxConnCount = 1
-	mySQLMaxIdleTime  = time.Second * 15
+	sqlMaxConnCount   = 1
+	sqlConnectTimeout = time.Second * 15
 )
 
-func checkMySQLAccount(args *sqlOption) error {
-	return checkDatabaseAccountValidate("mysql", args.DataSourceName())
-}
-
-func checkDatabaseAccountValidate(driveName, datasourceName string) error {
+func openSQLDB(driveName, datasourceName string) (*sql.DB, error) {
 	db, err := sql.Open(driveName, datasourceName)
 	if err != nil {
-		return err
-	}
-	db.SetMaxOpenConns(mySQLMaxConnCount)
-	db.SetMaxIdleConns(mySQLMaxConnCount)
-	db.SetConnMaxLifetime(mySQLMaxIdleTime)
-	db.SetConnMaxIdleTime(mySQLMaxIdleTime)
-	defer db.Close()
-	err = db.Ping()
-	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	// 内置客户端只使用一个连接, 保证会话状态 (use db、事务等) 一致
+	db.SetMaxOpenConns(sqlMaxConnCount)
+	db.SetMaxIdleConns(sqlMaxConnCount)
+	return db, nil
 }
@@ -0,0 +1,171 @@
+package srvconn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jumpserver/koko/pkg/localcommand"
+	"github.com/jumpserver/koko/pkg/logger"
+)
+
+const (
+	postgreSQLPromptPrefix = "Password for user "
+
+	postgreSQLCheckTimeout = time.Second * 15
+)
+
+var (
+	_ ServerConnection = (*PostgreSQLConn)(nil)
+)
+
+func NewPostgreSQLConnection(ops ...SqlOption) (*PostgreSQLConn, error) {
+	args := &sqlOption{
+		Username: os.Getenv("USER"),
+		Password: os.Getenv("PASSWORD"),
+		Host:     "127.0.0.1",
+		Port:     5432,
+		DBName:   "postgres",
+		win: Windows{
+			Width:  80,
+			Height: 120,
+		},
+	}
+	for _, setter := range ops {
+		setter(args)
+	}
+	if err := checkPostgreSQLAccount(args); err != nil {
+		return nil, err
+	}
+	lCmd, err := startPostgreSQLCommand(args)
+	if err != nil {
+		return nil, err
+	}
+	err = lCmd.SetWinSize(args.win.Width, args.win.Height)
+	if err != nil {
+		_ = lCmd.Close()
+		return nil, err
+	}
+	return &PostgreSQLConn{options: args, LocalCommand: lCmd}, nil
+}
+
+type PostgreSQLConn struct {
+	options *sqlOption
+	*localcommand.LocalCommand
+}
+
+func (conn *PostgreSQLConn) KeepAlive() error {
+	return nil
+}
+
+func (conn *PostgreSQLConn) Close() error {
+	_, _ = conn.Write([]byte("\r\n\\q\r\n"))
+	return conn.LocalCommand.Close()
+}
+
+func startPostgreSQLCommand(opt *sqlOption) (lcmd *localcommand.LocalCommand, err error) {
+	if lcmd, err = startPostgreSQLNormalCommand(opt); err != nil {
+		return nil, err
+	}
+	return tryManualLoginPostgreSQLServer(opt, lcmd)
+}
+
+func startPostgreSQLNormalCommand(opt *sqlOption) (*localcommand.LocalCommand, error) {
+	// 与 MySQL 一致, 使用 nobody 用户的权限
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		logger.Errorf("lookup nobody user err: %s", err)
+		return nil, err
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+
+	return localcommand.New("psql", opt.PostgreSQLCommandArgs(),
+		localcommand.WithEnv(opt.PostgreSQLEnvs()),
+		localcommand.WithPtyWin(opt.win.Width, opt.win.Height),
+		localcommand.WithCmdCredential(&syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}))
+}
+
+func tryManualLoginPostgreSQLServer(opt *sqlOption, lcmd *localcommand.LocalCommand) (*localcommand.LocalCommand, error) {
+	var (
+		nr  int
+		err error
+	)
+	// psql 的密码提示为: Password for user <username>:
+	expectPrompt := fmt.Sprintf("%s%s: ", postgreSQLPromptPrefix, opt.Username)
+	prompt := make([]byte, len(expectPrompt))
+	nr, err = lcmd.Read(prompt)
+	if err != nil {
+		_ = lcmd.Close()
+		logger.Errorf("PostgreSQL local pty fd read err: %s", err)
+		return lcmd, err
+	}
+	if !bytes.HasPrefix(prompt[:nr], []byte(postgreSQLPromptPrefix)) {
+		_ = lcmd.Close()
+		logger.Errorf("PostgreSQL login prompt characters did not match: %s", prompt[:nr])
+		err = fmt.Errorf("postgresql login prompt characters did not match: %s", prompt[:nr])
+		return lcmd, err
+	}
+
+	// 输入密码, 登录 PostgreSQL
+	_, err = lcmd.Write([]byte(opt.Password + "\r\n"))
+	if err != nil {
+		_ = lcmd.Close()
+		logger.Errorf("PostgreSQL local pty write err: %s", err)
+		return lcmd, fmt.Errorf("postgresql conn err: %s", err)
+	}
+	return lcmd, nil
+}
+
+func (opt *sqlOption) PostgreSQLCommandArgs() []string {
+	return []string{
+		fmt.Sprintf("--username=%s", opt.Username),
+		fmt.Sprintf("--host=%s", opt.Host),
+		fmt.Sprintf("--port=%d", opt.Port),
+		fmt.Sprintf("--dbname=%s", opt.DBName),
+		"--password",
+	}
+}
+
+func (opt *sqlOption) PostgreSQLEnvs() []string {
+	return []string{
+		"HOME=/nonexistent",
+		"LANG=en_US.UTF-8",
+		"TERM=xterm",
+		"PSQL_HISTORY=/dev/null",
+		"PGCONNECT_TIMEOUT=15",
+	}
+}
+
+func checkPostgreSQLAccount(args *sqlOption) error {
+	// 没有引入 PostgreSQL 驱动, 直接使用 psql 非交互方式校验账号
+	ctx, cancel := context.WithTimeout(context.Background(), postgreSQLCheckTimeout)
+	defer cancel()
+	checkArgs := []string{
+		fmt.Sprintf("--username=%s", args.Username),
+		fmt.Sprintf("--host=%s", args.Host),
+		fmt.Sprintf("--port=%d", args.Port),
+		fmt.Sprintf("--dbname=%s", args.DBName),
+		"--no-password",
+		"--no-psqlrc",
+		"--tuples-only",
+		"--command=SELECT 1",
+	}
+	cmd := exec.CommandContext(ctx, "psql", checkArgs...)
+	cmd.Env = append(args.PostgreSQLEnvs(), fmt.Sprintf("PGPASSWORD=%s", args.Password))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -1,30 +1,29 @@
 package srvconn
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
 
-	"github.com/jumpserver/koko/pkg/localcommand"
-	"github.com/jumpserver/koko/pkg/logger"
 	"github.com/mediocregopher/radix/v3"
-)
-
-const (
-	redisPrompt = "Please input password:"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
 )
 
 var (
 	_ ServerConnection = (*RedisConn)(nil)
+
+	_ replDriver = (*redisDriver)(nil)
+
+	ErrRedisInvalidArgs = errors.New("invalid argument(s)")
 )
 
 func NewRedisConnection(ops ...SqlOption) (*RedisConn, error) {
-	var (
-		lCmd *localcommand.LocalCommand
-		err  error
-	)
 	args := &sqlOption{
 		Username: os.Getenv("USER"),
 		Password: os.Getenv("PASSWORD"),
@@ -39,117 +38,290 @@ func NewRedisConnection(ops ...SqlOption) (*RedisConn, error) {
 	for _, setter := range ops {
 		setter(args)
 	}
-	if err := checkRedisAccount(args); err != nil {
+	driver, err := newRedisDriver(args)
+	if err != nil {
 		return nil, err
 	}
-	lCmd, err = startRedisCommand(args)
+	return &RedisConn{options: args, replConn: newReplConn(driver, args.win)}, nil
+}
 
-	if err != nil {
-		return nil, err
+type RedisConn struct {
+	options *sqlOption
+	*replConn
+}
+
+func newRedisDriver(opt *sqlOption) (*redisDriver, error) {
+	db := opt.DBName
+	if db == "" {
+		db = "0"
 	}
-	err = lCmd.SetWinSize(args.win.Width, args.win.Height)
+	d := &redisDriver{opt: opt, addr: net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port)), db: db}
+	conn, err := d.dial()
 	if err != nil {
-		_ = lCmd.Close()
 		return nil, err
 	}
-	return &RedisConn{options: args, LocalCommand: lCmd}, nil
+	d.conn = conn
+	return d, nil
 }
 
-type RedisConn struct {
-	options *sqlOption
-	*localcommand.LocalCommand
+// redisDriver 以 redis-cli 的风格执行命令并展示结果
+type redisDriver struct {
+	opt  *sqlOption
+	conn radix.Conn
+	lock sync.Mutex
+
+	addr string
+	db   string
 }
 
-func (conn *RedisConn) KeepAlive() error {
-	return nil
+// dial 连接 redis 并切换到当前的数据库
+func (d *redisDriver) dial() (radix.Conn, error) {
+	dialOptions := []radix.DialOpt{radix.DialTimeout(sqlConnectTimeout)}
+	switch {
+	case d.opt.Username != "":
+		dialOptions = append(dialOptions, radix.DialAuthUser(d.opt.Username, d.opt.Password))
+	case d.opt.Password != "":
+		dialOptions = append(dialOptions, radix.DialAuthPass(d.opt.Password))
+	}
+	if index, err := strconv.Atoi(d.db); err == nil && index != 0 {
+		dialOptions = append(dialOptions, radix.DialSelectDB(index))
+	}
+	return radix.Dial("tcp", d.addr, dialOptions...)
 }
 
-func (conn *RedisConn) Close() error {
-	_, _ = conn.Write([]byte("\r\nexit\r\n"))
-	return conn.LocalCommand.Close()
+// 会持续推送数据的命令, 交互式终端中不支持
+var redisUnsupportedCommands = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+	"MONITOR":    true,
+	"SYNC":       true,
+	"PSYNC":      true,
 }
 
-func startRedisCommand(opt *sqlOption) (lcmd *localcommand.LocalCommand, err error) {
-	cmd := opt.RedisCommandArgs()
-	lcmd, err = localcommand.New("redis-cli", cmd, localcommand.WithPtyWin(opt.win.Width, opt.win.Height))
-	if err != nil {
-		return nil, err
+func (d *redisDriver) Banner() string {
+	return "Type 'exit' or 'quit' to quit.\n"
+}
+
+func (d *redisDriver) Prompt() string {
+	if d.db == "0" {
+		return d.addr + "> "
 	}
-	if opt.Password != "" {
-		lcmd, err = matchLoginPrefix(redisPrompt, lcmd)
-		if err != nil {
-			return lcmd, err
-		}
-		lcmd, err = doLogin(opt, lcmd)
-		if err != nil {
-			return lcmd, err
-		}
+	return fmt.Sprintf("%s[%s]> ", d.addr, d.db)
+}
+
+func (d *redisDriver) Feed(line string) (stmts []replStatement, quit bool) {
+	text := strings.TrimSpace(line)
+	switch strings.ToLower(text) {
+	case "":
+		return nil, false
+	case "exit", "quit":
+		return nil, true
 	}
-	return lcmd, nil
+	return []replStatement{{Text: text}}, false
 }
 
-func (opt *sqlOption) RedisCommandArgs() []string {
-	params := []string{
-		"-h", opt.Host, "-p", strconv.Itoa(opt.Port),
-		"-n", opt.DBName,
+func (d *redisDriver) Execute(ctx context.Context, stmt replStatement, w io.Writer) error {
+	args, err := SplitRedisArgs(stmt.Text)
+	if err != nil || len(args) == 0 {
+		_, _ = fmt.Fprintf(w, "%s\n", ErrRedisInvalidArgs)
+		return nil
 	}
-	if opt.Username != "" {
-		params = append(params, "--user", opt.Username)
+	cmd := strings.ToUpper(args[0])
+	if redisUnsupportedCommands[cmd] {
+		_, _ = fmt.Fprintf(w, "(error) %s is not supported in the web terminal\n", cmd)
+		return nil
 	}
-	if opt.Password != "" {
-		params = append(params, "--askpass")
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var reply interface{}
+	done := make(chan error, 1)
+	go func() {
+		done <- d.conn.Do(radix.Cmd(&reply, args[0], args[1:]...))
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// BLPOP 等阻塞命令不会主动返回, 关闭连接中断命令后重新连接
+		_ = d.conn.Close()
+		<-done
+		_, _ = io.WriteString(w, "Command aborted by Ctrl+C\n")
+		return d.reconnect(w)
+	}
+	var respErr resp2.Error
+	switch {
+	case errors.As(err, &respErr):
+		_, _ = fmt.Fprintf(w, "(error) %s\n", respErr.E)
+		return nil
+	case err != nil:
+		return err
 	}
-	return params
+	if cmd == "SELECT" && len(args) == 2 {
+		d.db = args[1]
+	}
+	_, _ = io.WriteString(w, formatRedisReply(reply, ""))
+	return nil
 }
 
-func checkRedisAccount(args *sqlOption) error {
-	var dialOptions []radix.DialOpt
-	addr := fmt.Sprintf("%s:%s", args.Host, strconv.Itoa(args.Port))
-	if args.Username != "" {
-		dialOptions = append(dialOptions, radix.DialAuthUser(args.Username, args.Password))
-	} else {
-		dialOptions = append(dialOptions, radix.DialAuthPass(args.Password))
-	}
-	conn, err := radix.Dial("tcp", addr, dialOptions...)
-	if err != nil || conn == nil {
+func (d *redisDriver) reconnect(w io.Writer) error {
+	conn, err := d.dial()
+	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	d.conn = conn
+	_, _ = fmt.Fprintf(w, "Reconnected. Current database: %s\n", d.db)
 	return nil
 }
 
-func matchLoginPrefix(prefix string, lcmd *localcommand.LocalCommand) (*localcommand.LocalCommand, error) {
+func (d *redisDriver) KeepAlive() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.conn.Do(radix.Cmd(nil, "PING"))
+}
+
+func (d *redisDriver) Close() error {
+	return d.conn.Close()
+}
+
+// formatRedisReply 与 redis-cli 的输出格式保持一致
+func formatRedisReply(reply interface{}, indent string) string {
+	switch value := reply.(type) {
+	case nil:
+		return "(nil)\n"
+	case string:
+		return value + "\n"
+	case int64:
+		return fmt.Sprintf("(integer) %d\n", value)
+	case []byte:
+		if value == nil {
+			return "(nil)\n"
+		}
+		return strconv.Quote(string(value)) + "\n"
+	case []interface{}:
+		if value == nil {
+			return "(nil)\n"
+		}
+		if len(value) == 0 {
+			return "(empty array)\n"
+		}
+		var out strings.Builder
+		width := len(strconv.Itoa(len(value)))
+		for i := range value {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			if i > 0 {
+				out.WriteString(indent)
+			}
+			out.WriteString(prefix)
+			out.WriteString(formatRedisReply(value[i], indent+strings.Repeat(" ", len(prefix))))
+		}
+		return out.String()
+	default:
+		return fmt.Sprintf("%v\n", value)
+	}
+}
+
+// SplitRedisArgs 按照 redis-cli (sdssplitargs) 的规则切分命令行参数
+func SplitRedisArgs(line string) ([]string, error) {
 	var (
-		nr  int
-		err error
+		args []string
+		i    int
 	)
-	prompt := make([]byte, len(prefix))
-	nr, err = lcmd.Read(prompt[:])
-	if err != nil {
-		_ = lcmd.Close()
-		logger.Errorf("redis local pty fd read err: %s", err)
-		return lcmd, err
+	for {
+		for i < len(line) && isRedisSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var (
+			current []byte
+			inDQ    bool
+			inSQ    bool
+			done    bool
+		)
+		for !done {
+			if i >= len(line) {
+				if inDQ || inSQ {
+					// 引号未闭合
+					return nil, ErrRedisInvalidArgs
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDQ:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+					isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				case c == '"':
+					// 闭合的引号后必须是空白字符或结尾
+					if i+1 < len(line) && !isRedisSpace(line[i+1]) {
+						return nil, ErrRedisInvalidArgs
+					}
+					done = true
+				default:
+					current = append(current, c)
+				}
+			case inSQ:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					current = append(current, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isRedisSpace(line[i+1]) {
+						return nil, ErrRedisInvalidArgs
+					}
+					done = true
+				default:
+					current = append(current, c)
+				}
+			default:
+				switch c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDQ = true
+				case '\'':
+					inSQ = true
+				default:
+					current = append(current, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(current))
 	}
-	if !bytes.Equal(prompt[:nr], []byte(prefix)) {
-		_ = lcmd.Close()
-		logger.Errorf("redis login prompt characters did not match: %s", prompt[:nr])
-		err = fmt.Errorf("redis login prompt characters did not match: %s", prompt[:nr])
-		return lcmd, err
+}
+
+func isRedisSpace(c byte) bool {
+	switch c {
+	case ' ', '\n', '\r', '\t', '\v', '\f':
+		return true
 	}
-	return lcmd, nil
+	return false
 }
 
-func doLogin(opt *sqlOption, lcmd *localcommand.LocalCommand) (*localcommand.LocalCommand, error) {
-	//输入密码, 登录 redis
-	_, err := lcmd.Write([]byte(opt.Password + "\r\n"))
-	if err != nil {
-		_ = lcmd.Close()
-		logger.Errorf("Redis local pty write err: %s", err)
-		return lcmd, fmt.Errorf("redis conn err: %s", err)
-	}
-	// 清除掉输入密码后，界面上显示的星号
-	time.Sleep(time.Millisecond * 100)
-	clearPassword := make([]byte, len(opt.Password)+2)
-	_, _ = lcmd.Read(clearPassword)
-	return lcmd, nil
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
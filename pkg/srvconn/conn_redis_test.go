@@ -0,0 +1,171 @@
+package srvconn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedisServer 只实现测试用到的命令, BLPOP 永远阻塞
+type fakeRedisServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	dials   int
+	selects []string
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedisServer{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.dials++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPArray(reader)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			_, _ = conn.Write([]byte("+PONG\r\n"))
+		case "SELECT":
+			s.mu.Lock()
+			s.selects = append(s.selects, args[1])
+			s.mu.Unlock()
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		case "GET":
+			_, _ = conn.Write([]byte("$3\r\nbar\r\n"))
+		case "BLPOP":
+		default:
+			_, _ = fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func (s *fakeRedisServer) stats() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials, append([]string(nil), s.selects...)
+}
+
+func readRESPArray(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if _, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func newTestRedisDriver(t *testing.T, s *fakeRedisServer) *redisDriver {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	driver, err := newRedisDriver(&sqlOption{Host: addr.IP.String(), Port: addr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = driver.Close() })
+	return driver
+}
+
+func TestRedisDriverExecute(t *testing.T) {
+	driver := newTestRedisDriver(t, newFakeRedisServer(t))
+	var out bytes.Buffer
+	if err := driver.Execute(context.Background(), replStatement{Text: "GET foo"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "\"bar\"\n" {
+		t.Fatalf("got %q", out.String())
+	}
+	out.Reset()
+	if err := driver.Execute(context.Background(), replStatement{Text: "FOO"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "(error) ERR unknown command") {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestRedisDriverExecuteCancel(t *testing.T) {
+	server := newFakeRedisServer(t)
+	driver := newTestRedisDriver(t, server)
+	var out bytes.Buffer
+	if err := driver.Execute(context.Background(), replStatement{Text: "SELECT 2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- driver.Execute(ctx, replStatement{Text: "BLPOP list 0"}, &out)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("blocking command not interrupted by cancel")
+	}
+	if !strings.Contains(out.String(), "Command aborted by Ctrl+C") {
+		t.Fatalf("got %q", out.String())
+	}
+
+	// 重新连接后保留当前数据库, 保活和后续命令正常执行
+	if err := driver.KeepAlive(); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := driver.Execute(context.Background(), replStatement{Text: "GET foo"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "\"bar\"\n" {
+		t.Fatalf("got %q", out.String())
+	}
+	dials, selects := server.stats()
+	if dials != 2 || len(selects) != 2 || selects[1] != "2" {
+		t.Fatalf("got %d dials, selects %v", dials, selects)
+	}
+}
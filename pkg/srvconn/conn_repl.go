@@ -0,0 +1,311 @@
+package srvconn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/utils"
+)
+
+/*
+	内置客户端:
+		不再依赖 mysql、tsql、redis-cli 等外部命令,
+		由 koko 直接与数据库服务端通信, 使用 utils.Terminal 渲染交互界面。
+		每条语句在执行前后都会回调 StatementHook, 因此能准确知道用户执行了什么。
+*/
+
+// StatementHook 内置客户端执行语句前后的回调
+type StatementHook interface {
+	// BeforeExecute 返回非 nil 的 error 时, 该语句不会被执行, error 会展示给用户
+	BeforeExecute(stmt string) error
+	// AfterExecute 语句执行结束, output 为截断后的执行结果
+	AfterExecute(stmt string, output string)
+}
+
+// StatementObserver 由内置客户端实现
+type StatementObserver interface {
+	SetStatementHook(hook StatementHook)
+}
+
+type replStatement struct {
+	Text       string
+	Terminator string
+}
+
+type replDriver interface {
+	Banner() string
+	Prompt() string
+	// Feed 输入一行, 返回已经完整的语句, quit 为 true 表示用户退出
+	Feed(line string) (stmts []replStatement, quit bool)
+	// Execute 执行语句; 语句自身的错误由 driver 输出到 w, 返回的 error 表示连接已不可用
+	Execute(ctx context.Context, stmt replStatement, w io.Writer) error
+	KeepAlive() error
+	Close() error
+}
+
+const (
+	replOutputRecordSize = 1024
+
+	charCtrlC = '\x03'
+)
+
+var _ ServerConnection = (*replConn)(nil)
+
+func newReplConn(driver replDriver, win Windows) *replConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	outReader, outWriter := io.Pipe()
+	conn := &replConn{
+		driver:    driver,
+		input:     newInputBuffer(),
+		outReader: outReader,
+		outWriter: outWriter,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	conn.term = utils.NewTerminal(&replTermIO{conn: conn}, driver.Prompt())
+	_ = conn.term.SetSize(win.Width, win.Height)
+	go conn.run()
+	return conn
+}
+
+type replConn struct {
+	driver replDriver
+	term   *utils.Terminal
+
+	input     *inputBuffer
+	outReader *io.PipeReader
+	outWriter *io.PipeWriter
+
+	hook atomic.Value
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	execLock   sync.Mutex
+	execCancel context.CancelFunc
+
+	// driverLock 保证同一时间只有一个语句或者保活使用 driver,
+	// busy 为正在等待或执行的语句数, 此时无需保活
+	driverLock sync.Mutex
+	busy       int32
+
+	closeOnce sync.Once
+}
+
+func (c *replConn) SetStatementHook(hook StatementHook) {
+	c.hook.Store(&hook)
+}
+
+func (c *replConn) getStatementHook() StatementHook {
+	if hook, ok := c.hook.Load().(*StatementHook); ok {
+		return *hook
+	}
+	return nil
+}
+
+func (c *replConn) Read(p []byte) (int, error) {
+	return c.outReader.Read(p)
+}
+
+func (c *replConn) Write(p []byte) (int, error) {
+	// 语句执行中, 用户按下 CTRL+C 则取消当前语句
+	if bytes.IndexByte(p, charCtrlC) >= 0 && c.cancelExecuting() {
+		p = bytes.ReplaceAll(p, []byte{charCtrlC}, nil)
+	}
+	return c.input.Write(p)
+}
+
+func (c *replConn) SetWinSize(width, height int) error {
+	return c.term.SetSize(width, height)
+}
+
+func (c *replConn) KeepAlive() error {
+	// 正在执行语句时无需保活
+	if atomic.LoadInt32(&c.busy) > 0 {
+		return nil
+	}
+	c.driverLock.Lock()
+	defer c.driverLock.Unlock()
+	return c.driver.KeepAlive()
+}
+
+func (c *replConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		_ = c.input.Close()
+		_ = c.outWriter.Close()
+		_ = c.outReader.Close()
+		err = c.driver.Close()
+	})
+	return err
+}
+
+func (c *replConn) run() {
+	defer func() {
+		_ = c.outWriter.Close()
+	}()
+	c.writeString(c.driver.Banner())
+	for {
+		c.term.SetPrompt(c.driver.Prompt())
+		line, err := c.term.ReadLine()
+		if err != nil && !errors.Is(err, utils.ErrPasteIndicator) {
+			if !errors.Is(err, io.EOF) {
+				logger.Errorf("Native client read line err: %s", err)
+			}
+			return
+		}
+		stmts, quit := c.driver.Feed(line)
+		for i := range stmts {
+			if err = c.execute(stmts[i]); err != nil {
+				c.writeString(fmt.Sprintf("ERROR: %s\n", err))
+				return
+			}
+		}
+		if quit {
+			c.writeString("Bye\n")
+			return
+		}
+	}
+}
+
+func (c *replConn) execute(stmt replStatement) error {
+	hook := c.getStatementHook()
+	if hook != nil {
+		if err := hook.BeforeExecute(stmt.Text); err != nil {
+			c.writeString(err.Error() + "\n")
+			return nil
+		}
+	}
+	atomic.AddInt32(&c.busy, 1)
+	defer atomic.AddInt32(&c.busy, -1)
+	c.driverLock.Lock()
+	defer c.driverLock.Unlock()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.setExecCancel(cancel)
+	defer func() {
+		c.setExecCancel(nil)
+		cancel()
+	}()
+	record := limitedBuffer{limit: replOutputRecordSize}
+	w := io.MultiWriter(replWriter{conn: c}, &record)
+	err := c.driver.Execute(ctx, stmt, w)
+	if hook != nil {
+		output := strings.ReplaceAll(strings.TrimSpace(record.String()), "\n", "\r\n")
+		hook.AfterExecute(stmt.Text, output)
+	}
+	return err
+}
+
+func (c *replConn) setExecCancel(cancel context.CancelFunc) {
+	c.execLock.Lock()
+	defer c.execLock.Unlock()
+	c.execCancel = cancel
+}
+
+func (c *replConn) cancelExecuting() bool {
+	c.execLock.Lock()
+	defer c.execLock.Unlock()
+	if c.execCancel != nil {
+		c.execCancel()
+		return true
+	}
+	return false
+}
+
+func (c *replConn) writeString(s string) {
+	_, _ = c.term.Write([]byte(s))
+}
+
+// replTermIO 作为 utils.Terminal 的读写端, 读取用户输入, 输出写入 pipe
+type replTermIO struct {
+	conn *replConn
+}
+
+func (r *replTermIO) Read(p []byte) (int, error) {
+	return r.conn.input.Read(p)
+}
+
+func (r *replTermIO) Write(p []byte) (int, error) {
+	return r.conn.outWriter.Write(p)
+}
+
+// replWriter 通过 Terminal 输出, 保证换行转换为 \r\n
+type replWriter struct {
+	conn *replConn
+}
+
+func (w replWriter) Write(p []byte) (int, error) {
+	return w.conn.term.Write(p)
+}
+
+// inputBuffer 写入不阻塞, 读取在没有数据时阻塞
+type inputBuffer struct {
+	buf    bytes.Buffer
+	cond   *sync.Cond
+	closed bool
+}
+
+func newInputBuffer() *inputBuffer {
+	return &inputBuffer{cond: sync.NewCond(&sync.Mutex{})}
+}
+
+func (b *inputBuffer) Write(p []byte) (int, error) {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.buf.Write(p)
+	b.cond.Signal()
+	return n, err
+}
+
+func (b *inputBuffer) Read(p []byte) (int, error) {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 && b.closed {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *inputBuffer) Close() error {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+	return nil
+}
+
+// limitedBuffer 只保留前 limit 个字节, 用于命令记录
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remain := b.limit - b.buf.Len(); remain > 0 {
+		if len(p) > remain {
+			b.buf.Write(p[:remain])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -1,22 +1,29 @@
 package srvconn
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
 
-	_ "github.com/denisenkom/go-mssqldb"
-	"github.com/jumpserver/koko/pkg/localcommand"
 	"github.com/jumpserver/koko/pkg/logger"
 )
 
 const (
-	sqlServerPrompt = "Password:"
+	sqlServerBatchSeparator = "go"
 )
 
 var (
 	_ ServerConnection = (*SQLServerConn)(nil)
+
+	_ replDriver = (*sqlServerDriver)(nil)
 )
 
 func NewSQLServerConnection(ops ...SqlOption) (*SQLServerConn, error) {
@@ -34,95 +41,161 @@ func NewSQLServerConnection(ops ...SqlOption) (*SQLServerConn, error) {
 	for _, setter := range ops {
 		setter(args)
 	}
-	if err := checkSQLServerAccount(args); err != nil {
+	driver, err := newSQLServerDriver(args)
+	if err != nil {
 		return nil, err
 	}
-	lCmd, err := startSQLServerCommand(args)
+	return &SQLServerConn{options: args, replConn: newReplConn(driver, args.win)}, nil
+}
+
+type SQLServerConn struct {
+	options *sqlOption
+	*replConn
+}
+
+func newSQLServerDriver(opt *sqlOption) (*sqlServerDriver, error) {
+	db, err := openSQLDB("mssql", opt.SQLServerSourceName())
 	if err != nil {
 		return nil, err
 	}
-	err = lCmd.SetWinSize(args.win.Width, args.win.Height)
+	ctx, cancel := context.WithTimeout(context.Background(), sqlConnectTimeout)
+	defer cancel()
+	conn, err := db.Conn(ctx)
 	if err != nil {
-		_ = lCmd.Close()
+		_ = db.Close()
+		return nil, err
+	}
+	if err = conn.PingContext(ctx); err != nil {
+		_ = conn.Close()
+		_ = db.Close()
 		return nil, err
 	}
-	return &SQLServerConn{options: args, LocalCommand: lCmd}, nil
+	driver := &sqlServerDriver{opt: opt, db: db, conn: conn}
+	if err = conn.QueryRowContext(ctx, "SELECT @@VERSION").Scan(&driver.version); err != nil {
+		logger.Errorf("SQLServer get server version err: %s", err)
+	}
+	return driver, nil
 }
 
-type SQLServerConn struct {
-	options *sqlOption
-	*localcommand.LocalCommand
-}
+// sqlServerDriver 与 tsql 一致, 语句以单独一行的 GO 提交执行
+type sqlServerDriver struct {
+	opt  *sqlOption
+	db   *sql.DB
+	conn *sql.Conn
 
-func (conn *SQLServerConn) KeepAlive() error {
-	return nil
+	batch   []string
+	version string
 }
 
-func (conn *SQLServerConn) Close() error {
-	_, _ = conn.Write([]byte("\r\nexit\r\n"))
-	return conn.LocalCommand.Close()
+func (d *sqlServerDriver) Banner() string {
+	var banner strings.Builder
+	if line := strings.SplitN(d.version, "\n", 2)[0]; line != "" {
+		banner.WriteString(strings.TrimSpace(line))
+		banner.WriteString("\n")
+	}
+	banner.WriteString("Statements are executed by a line containing only 'go'. ")
+	banner.WriteString("Type 'reset' to clear the current batch, 'exit' to quit.\n")
+	return banner.String()
 }
 
-func startSQLServerCommand(opt *sqlOption) (lcmd *localcommand.LocalCommand, err error) {
-	if lcmd, err = startSQLServerNormalCommand(opt); err != nil {
-		return nil, err
-	}
-	return tryManualLoginSQLServerServer(opt, lcmd)
+func (d *sqlServerDriver) Prompt() string {
+	return strconv.Itoa(len(d.batch)+1) + "> "
 }
 
-func startSQLServerNormalCommand(opt *sqlOption) (lcmd *localcommand.LocalCommand, err error) {
-	//tsql 是启动sqlserver的客户端
-	return localcommand.New("tsql", opt.SQLServerCommandArgs())
+func (d *sqlServerDriver) Feed(line string) (stmts []replStatement, quit bool) {
+	command := strings.ToLower(strings.TrimSpace(line))
+	switch {
+	case command == sqlServerBatchSeparator:
+		text := strings.TrimSpace(strings.Join(d.batch, "\n"))
+		d.batch = nil
+		if text != "" {
+			stmts = append(stmts, replStatement{Text: text, Terminator: sqlServerBatchSeparator})
+		}
+		return stmts, false
+	case command == "reset":
+		d.batch = nil
+		return nil, false
+	case command == "exit" || command == "quit" || command == "bye":
+		return nil, true
+	}
+	d.batch = append(d.batch, line)
+	return nil, false
 }
 
-func tryManualLoginSQLServerServer(opt *sqlOption, lcmd *localcommand.LocalCommand) (*localcommand.LocalCommand, error) {
-	var (
-		nr  int
-		err error
-	)
-	prompt := [len(sqlServerPrompt)]byte{}
-	nr, err = lcmd.Read(prompt[:])
+func (d *sqlServerDriver) Execute(ctx context.Context, stmt replStatement, w io.Writer) error {
+	start := time.Now()
+	if !isSQLQueryStatement(stmt.Text) {
+		result, err := d.conn.ExecContext(ctx, stmt.Text)
+		if err != nil {
+			return d.handleError(ctx, err, w)
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected >= 0 {
+			_, _ = fmt.Fprintf(w, "(%d rows affected)\n", affected)
+		}
+		return nil
+	}
+	rows, err := d.conn.QueryContext(ctx, stmt.Text)
 	if err != nil {
-		_ = lcmd.Close()
-		logger.Errorf("sqlserver local pty fd read err: %s", err)
-		return lcmd, err
+		return d.handleError(ctx, err, w)
 	}
-	if !bytes.Equal(prompt[:nr], []byte(sqlServerPrompt)) {
-		_ = lcmd.Close()
-		logger.Errorf("sqlserver login prompt characters did not match: %s", prompt[:nr])
-		err = fmt.Errorf("sqlserver login prompt characters did not match: %s", prompt[:nr])
-		return lcmd, err
+	defer rows.Close()
+	for {
+		columns, err := rows.Columns()
+		if err != nil {
+			return d.handleError(ctx, err, w)
+		}
+		if len(columns) > 0 {
+			count, err := writeSQLRows(w, rows, false)
+			if err != nil {
+				return d.handleError(ctx, err, w)
+			}
+			_, _ = fmt.Fprintf(w, "(%d rows affected)\n", count)
+		}
+		if !rows.NextResultSet() {
+			break
+		}
 	}
-	// 输入密码, 登录 sqlserver
-	_, err = lcmd.Write([]byte(opt.Password + "\r\n"))
-	if err != nil {
-		_ = lcmd.Close()
-		logger.Errorf("sqlserver local pty write err: %s", err)
-		return lcmd, fmt.Errorf("sqlserver conn err: %s", err)
+	if err = rows.Err(); err != nil {
+		return d.handleError(ctx, err, w)
 	}
-	return lcmd, nil
+	logger.Debugf("SQLServer batch cost %s", time.Since(start))
+	return nil
 }
 
-func (opt *sqlOption) SQLServerCommandArgs() []string {
-	return []string{
-		"-U", opt.Username,
-		"-H", opt.Host,
-		"-p", strconv.Itoa(opt.Port),
-		"-J", "UTF-8",
-		"-D", opt.DBName,
+func (d *sqlServerDriver) handleError(ctx context.Context, err error, w io.Writer) error {
+	var msErr mssql.Error
+	switch {
+	case errors.As(err, &msErr):
+		_, _ = fmt.Fprintf(w, "Msg %d, Level %d, State %d\n%s\n", msErr.Number, msErr.Class,
+			msErr.State, msErr.Message)
+		return nil
+	case ctx.Err() != nil:
+		_, _ = io.WriteString(w, "Query aborted by Ctrl+C\n")
+		return nil
+	case errors.Is(err, sql.ErrConnDone):
+		return err
+	default:
+		_, _ = fmt.Fprintf(w, "ERROR: %s\n", err)
+		return nil
 	}
 }
 
+func (d *sqlServerDriver) KeepAlive() error {
+	return d.conn.PingContext(context.Background())
+}
+
+func (d *sqlServerDriver) Close() error {
+	_ = d.conn.Close()
+	return d.db.Close()
+}
+
 func (opt *sqlOption) SQLServerSourceName() string {
-	return fmt.Sprintf("server=%s;port=%s;database=%s;user id=%s;password=%s",
+	return fmt.Sprintf("server=%s;port=%s;database=%s;user id=%s;password=%s;dial timeout=%d",
 		opt.Host,
 		strconv.Itoa(opt.Port),
 		opt.DBName,
 		opt.Username,
 		opt.Password,
+		int(sqlConnectTimeout.Seconds()),
 	)
 }
-
-func checkSQLServerAccount(args *sqlOption) error {
-	return checkDatabaseAccountValidate("mssql", args.SQLServerSourceName())
-}
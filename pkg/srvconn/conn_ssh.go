@@ -5,9 +5,11 @@ import (
 	"io"
 
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/text/transform"
 
 	"github.com/jumpserver/koko/pkg/common"
+	"github.com/jumpserver/koko/pkg/logger"
 )
 
 func NewSSHConnection(sess *gossh.Session, opts ...SSHOption) (*SSHConnection, error) {
@@ -34,6 +36,11 @@ func NewSSHConnection(sess *gossh.Session, opts ...SSHOption) (*SSHConnection, e
 	if err != nil {
 		return nil, err
 	}
+	if options.agentForwarding {
+		if err = agent.RequestAgentForwarding(sess); err != nil {
+			logger.Errorf("Request agent forwarding on target session err: %s", err)
+		}
+	}
 	stdin, err := sess.StdinPipe()
 	if err != nil {
 		return nil, err
@@ -107,6 +114,15 @@ type SSHOptions struct {
 	sudoCommand  string
 	sudoUsername string
 	sudoPassword string
+
+	agentForwarding bool
+}
+
+// SSHAgentForwarding 在目标会话上请求 agent 转发, 需要先通过 AgentForwarder 处理 agent 通道
+func SSHAgentForwarding(ok bool) SSHOption {
+	return func(opt *SSHOptions) {
+		opt.agentForwarding = ok
+	}
 }
 
 func SSHCharset(charset string) SSHOption {
@@ -1,6 +1,7 @@
 package srvconn
 
 import (
+	"context"
 	"io"
 	"net"
 	"regexp"
@@ -37,7 +38,7 @@ func NewTelnetConnection(opts ...TelnetOption) (*TelnetConnection, error) {
 	)
 	dstAddr := net.JoinHostPort(cfg.Host, cfg.Port)
 	if cfg.proxySSHClientOptions != nil {
-		if proxyClient, err = getAvailableProxyClient(cfg.proxySSHClientOptions...); err != nil {
+		if proxyClient, err = getAvailableProxyClient(context.Background(), cfg.proxySSHClientOptions...); err != nil {
 			return nil, err
 		}
 		if conn, err = proxyClient.Dial("tcp", dstAddr); err != nil {
@@ -14,10 +14,13 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/jumpserver/koko/pkg/config"
+	"github.com/jumpserver/koko/pkg/filerecord"
+	"github.com/jumpserver/koko/pkg/hostkey"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/common"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/model"
 	"github.com/jumpserver/koko/pkg/jms-sdk-go/service"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/sshca"
 )
 
 type AssetDir struct {
@@ -31,6 +34,8 @@ type AssetDir struct {
 	domain      *model.Domain
 
 	suMaps map[string]*model.SystemUser
+	// 不为空时只使用该系统用户
+	suID string
 
 	logChan chan<- *model.FTPLog
 
@@ -80,6 +85,9 @@ func (ad *AssetDir) loadSystemUsers() {
 			return ok
 		}
 		for i := 0; i < len(SystemUsers); i++ {
+			if ad.suID != "" && SystemUsers[i].ID != ad.suID {
+				continue
+			}
 			if SystemUsers[i].IsProtocol(ProtocolSSH) && !SystemUsers[i].SuEnabled {
 				folderName := cleanFolderName(SystemUsers[i].Name)
 				folderName = findAvailableKeyByPaddingSuffix(matchFunc, folderName, paddingCharacter)
@@ -106,7 +114,7 @@ func (ad *AssetDir) loadSystemUsers() {
 	})
 }
 
-func (ad *AssetDir) Create(path string) (*sftp.File, error) {
+func (ad *AssetDir) Create(path string) (*SftpFile, error) {
 	pathData := ad.parsePath(path)
 	folderName, ok := ad.IsUniqueSu()
 	if !ok {
@@ -130,13 +138,14 @@ func (ad *AssetDir) Create(path string) (*sftp.File, error) {
 	}
 	sf, err := con.client.Create(realPath)
 	filename := realPath
-	isSuccess := false
 	operate := model.OperateUpload
-	if err == nil {
-		isSuccess = true
+	if err != nil {
+		ad.CreateFTPLog(su, operate, filename, false)
+		return nil, err
 	}
-	ad.CreateFTPLog(su, operate, filename, isSuccess)
-	return sf, err
+	recorder := ad.newFileRecorder(su, operate, filename)
+	ad.createFTPLog(su, operate, filename, true, recorder.Target())
+	return &SftpFile{File: sf, recorder: recorder}, nil
 }
 
 func (ad *AssetDir) MkdirAll(path string) (err error) {
@@ -172,7 +181,7 @@ func (ad *AssetDir) MkdirAll(path string) (err error) {
 	return
 }
 
-func (ad *AssetDir) Open(path string) (*sftp.File, error) {
+func (ad *AssetDir) Open(path string) (*SftpFile, error) {
 	pathData := ad.parsePath(path)
 	folderName, ok := ad.IsUniqueSu()
 	if !ok {
@@ -195,13 +204,14 @@ func (ad *AssetDir) Open(path string) (*sftp.File, error) {
 	}
 	sf, err := con.client.Open(realPath)
 	filename := realPath
-	isSuccess := false
 	operate := model.OperateDownload
-	if err == nil {
-		isSuccess = true
+	if err != nil {
+		ad.CreateFTPLog(su, operate, filename, false)
+		return nil, err
 	}
-	ad.CreateFTPLog(su, operate, filename, isSuccess)
-	return sf, err
+	recorder := ad.newFileRecorder(su, operate, filename)
+	ad.createFTPLog(su, operate, filename, true, recorder.Target())
+	return &SftpFile{File: sf, recorder: recorder}, nil
 }
 
 func (ad *AssetDir) ReadDir(path string) (res []os.FileInfo, err error) {
@@ -594,6 +604,9 @@ func (ad *AssetDir) getNewSftpConn(su *model.SystemUser) (conn *SftpConn, err er
 	sshAuthOpts = append(sshAuthOpts, SSHClientPort(ad.detailAsset.ProtocolPort(su.Protocol)))
 	sshAuthOpts = append(sshAuthOpts, SSHClientPassword(su.Password))
 	sshAuthOpts = append(sshAuthOpts, SSHClientTimeout(timeout))
+	sshAuthOpts = append(sshAuthOpts, SSHClientHostKeyCallback(hostkey.HostKeyCallback(ad.detailAsset.ID)))
+	sshAuthOpts = append(sshAuthOpts, SSHClientCertAuthority(sshca.Default(),
+		fmt.Sprintf("koko:%s:sftp", ad.user.Username)))
 	if su.PrivateKey != "" {
 		// 先使用 password 解析 PrivateKey
 		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(su.PrivateKey),
@@ -674,6 +687,10 @@ func (ad *AssetDir) close() {
 }
 
 func (ad *AssetDir) CreateFTPLog(su *model.SystemUser, operate, filename string, isSuccess bool) {
+	ad.createFTPLog(su, operate, filename, isSuccess, "")
+}
+
+func (ad *AssetDir) createFTPLog(su *model.SystemUser, operate, filename string, isSuccess bool, contentRecord string) {
 	data := model.FTPLog{
 		User:       ad.user.String(),
 		Hostname:   ad.detailAsset.String(),
@@ -684,6 +701,21 @@ func (ad *AssetDir) CreateFTPLog(su *model.SystemUser, operate, filename string,
 		Path:       filename,
 		DateStart:  common.NewNowUTCTime(),
 		IsSuccess:  isSuccess,
+
+		ContentRecord: contentRecord,
 	}
 	ad.logChan <- &data
 }
+
+// newFileRecorder 未启用文件内容录制时返回 nil
+func (ad *AssetDir) newFileRecorder(su *model.SystemUser, operate, filename string) *filerecord.Recorder {
+	return filerecord.New(filerecord.Info{
+		User:       ad.user.String(),
+		Asset:      ad.detailAsset.String(),
+		OrgID:      ad.detailAsset.OrgID,
+		SystemUser: su.String(),
+		RemoteAddr: ad.addr,
+		Operate:    operate,
+		Filename:   filename,
+	})
+}
@@ -0,0 +1,72 @@
+package srvconn
+
+import (
+	"io"
+
+	"github.com/pkg/sftp"
+
+	"github.com/jumpserver/koko/pkg/filerecord"
+)
+
+/*
+	SftpFile 包装资产上的 sftp 文件, 启用文件内容录制时记录读写的数据,
+	未启用时 recorder 为 nil, 直接使用 sftp.File 的方法
+*/
+
+type SftpFile struct {
+	*sftp.File
+	recorder *filerecord.Recorder
+}
+
+func (f *SftpFile) offset() int64 {
+	// SeekCurrent 只读取本地记录的偏移, 不请求远端
+	off, _ := f.File.Seek(0, io.SeekCurrent)
+	return off
+}
+
+func (f *SftpFile) Read(p []byte) (int, error) {
+	if f.recorder == nil {
+		return f.File.Read(p)
+	}
+	off := f.offset()
+	n, err := f.File.Read(p)
+	f.recorder.WriteAt(p[:n], off)
+	return n, err
+}
+
+func (f *SftpFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.recorder.WriteAt(p[:n], off)
+	return n, err
+}
+
+func (f *SftpFile) Write(p []byte) (int, error) {
+	if f.recorder == nil {
+		return f.File.Write(p)
+	}
+	off := f.offset()
+	n, err := f.File.Write(p)
+	f.recorder.WriteAt(p[:n], off)
+	return n, err
+}
+
+// ReadFrom 录制时逐块写入, 否则 io.Copy 会使用 sftp.File 的 ReadFrom 绕过录制
+func (f *SftpFile) ReadFrom(r io.Reader) (int64, error) {
+	if f.recorder == nil {
+		return f.File.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *SftpFile) WriteTo(w io.Writer) (int64, error) {
+	if f.recorder == nil {
+		return f.File.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{f})
+}
+
+func (f *SftpFile) Close() error {
+	err := f.File.Close()
+	f.recorder.Close()
+	return err
+}
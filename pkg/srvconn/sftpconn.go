@@ -27,6 +27,8 @@ type UserSftpConn struct {
 
 	closed    chan struct{}
 	searchDir *SearchResultDir
+	// 直连格式 (user@systemuser@asset) 的资产目录, 不为空时作为根目录
+	directDir *AssetDir
 
 	jmsService *service.JMService
 }
@@ -151,7 +153,7 @@ func (u *UserSftpConn) Symlink(oldNamePath, newNamePath string) (err error) {
 	return sftp.ErrSshFxPermissionDenied
 }
 
-func (u *UserSftpConn) Create(path string) (*sftp.File, error) {
+func (u *UserSftpConn) Create(path string) (*SftpFile, error) {
 	fi, restPath := u.ParsePath(path)
 	if _, ok := fi.(*UserSftpConn); ok {
 		return nil, sftp.ErrSshFxPermissionDenied
@@ -167,7 +169,7 @@ func (u *UserSftpConn) Create(path string) (*sftp.File, error) {
 	return nil, errNoSelectAsset
 }
 
-func (u *UserSftpConn) Open(path string) (*sftp.File, error) {
+func (u *UserSftpConn) Open(path string) (*SftpFile, error) {
 	fi, restPath := u.ParsePath(path)
 	if _, ok := fi.(*UserSftpConn); ok {
 		return nil, sftp.ErrSshFxPermissionDenied
@@ -227,6 +229,10 @@ func (u *UserSftpConn) List() (res []os.FileInfo, err error) {
 
 func (u *UserSftpConn) ParsePath(path string) (fi os.FileInfo, restPath string) {
 	path = strings.TrimPrefix(path, "/")
+	if u.directDir != nil {
+		u.directDir.loadSystemUsers()
+		return u.directDir, path
+	}
 	data := strings.Split(path, "/")
 	if len(data) == 1 && data[0] == "" {
 		fi = u
@@ -445,6 +451,32 @@ func NewUserSftpConnWithAssets(jmsService *service.JMService, user *model.User,
 	return &u
 }
 
+/*
+	NewUserSftpConnWithDirectAsset 直连格式的 sftp 请求 (OpenSSH 9 之后 scp 默认使用 sftp 协议),
+	根目录即为资产上系统用户的 sftp 根目录, 上传下载权限和文件操作日志与普通 sftp 相同
+*/
+
+func NewUserSftpConnWithDirectAsset(jmsService *service.JMService, user *model.User, addr string,
+	asset model.Asset, systemUser model.SystemUser) *UserSftpConn {
+	u := UserSftpConn{
+		User:       user,
+		Addr:       addr,
+		Dirs:       map[string]os.FileInfo{},
+		modeTime:   time.Now().UTC(),
+		LogChan:    make(chan *model.FTPLog, 1024),
+		closed:     make(chan struct{}),
+		jmsService: jmsService,
+	}
+	folderName := cleanFolderName(asset.Hostname)
+	assetDir := NewAssetDir(jmsService, user, u.LogChan, WithFolderID(asset.ID),
+		WithFolderName(folderName), WitRemoteAddr(addr), WithSystemUserID(systemUser.ID))
+	assetDir.detailAsset = &asset
+	u.directDir = &assetDir
+	u.Dirs[folderName] = &assetDir
+	go u.loopPushFTPLog()
+	return &u
+}
+
 func NewUserContainerWithPod(jmsService *service.JMService, user *model.User, addr string, containerOptions *ContainerOptions) *UserSftpConn {
 	u := UserSftpConn{
 		User:       user,
@@ -90,10 +90,11 @@ type FolderBuilderFunc func(info *folderConfiguration)
 type SubFoldersLoadFunc func() map[string]os.FileInfo
 
 type folderConfiguration struct {
-	ID          string
-	Name        string
-	RemoteAddr  string
-	loadSubFunc SubFoldersLoadFunc
+	ID           string
+	Name         string
+	RemoteAddr   string
+	SystemUserID string
+	loadSubFunc  SubFoldersLoadFunc
 }
 
 func WithFolderName(name string) FolderBuilderFunc {
@@ -114,6 +115,13 @@ func WitRemoteAddr(addr string) FolderBuilderFunc {
 	}
 }
 
+// WithSystemUserID 资产目录只使用指定的系统用户, 用于直连格式
+func WithSystemUserID(id string) FolderBuilderFunc {
+	return func(info *folderConfiguration) {
+		info.SystemUserID = id
+	}
+}
+
 func WithSubFoldersLoadFunc(loadFunc SubFoldersLoadFunc) FolderBuilderFunc {
 	return func(info *folderConfiguration) {
 		info.loadSubFunc = loadFunc
@@ -131,6 +139,7 @@ func NewAssetDir(jmsService *service.JMService, user *model.User, logChan chan<-
 		ID:          dirConf.ID,
 		folderName:  dirConf.Name,
 		addr:        dirConf.RemoteAddr,
+		suID:        dirConf.SystemUserID,
 		user:        user,
 		modeTime:    time.Now().UTC(),
 		suMaps:      nil,
@@ -0,0 +1,304 @@
+package srvconn
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SQLDialect 决定引号、注释和结束符的解析方式
+type SQLDialect int
+
+const (
+	SQLDialectStandard SQLDialect = iota
+	SQLDialectMySQL
+	SQLDialectSQLServer
+	SQLDialectPostgreSQL
+)
+
+type SQLTokenKind int
+
+const (
+	SQLTokenWord      SQLTokenKind = iota // 关键字或者未加引号的标识符
+	SQLTokenIdent                         // 加引号的标识符
+	SQLTokenString                        // 字符串
+	SQLTokenSymbol                        // 单个符号
+	SQLTokenDelimiter                     // 语句结束符, 包括 MySQL 的 \G \g 和 psql 的 \g \gx 等元命令
+)
+
+type SQLToken struct {
+	Kind SQLTokenKind
+	// Value 字符串和加引号的标识符为去掉引号和转义之后的内容
+	Value string
+	// Start End 为 token 在输入中的位置, psql 元命令的结束位置包括其参数
+	Start int
+	End   int
+}
+
+/*
+	SQLLexer 跳过空白和注释将 SQL 切分为 token, 引号、注释和 $tag$ 字符串中的结束符不会被识别。
+	MySQL 以 /*! 开始的可执行注释会被服务端执行, 视为语句的一部分;
+	psql 的元命令不属于语句, 其中发送查询缓冲区的 \g \gx 等视为结束符
+*/
+
+type SQLLexer struct {
+	Dialect SQLDialect
+	// Delimiter 为空时使用 ;
+	Delimiter string
+}
+
+func (l SQLLexer) delimiter() string {
+	if l.Delimiter == "" {
+		return SQLDefaultDelimiter
+	}
+	return l.Delimiter
+}
+
+// Tokenize 返回 token 以及输入是否结束在未闭合的引号、注释或 $tag$ 字符串中
+func (l SQLLexer) Tokenize(text string) (tokens []SQLToken, open bool) {
+	var (
+		commentDepth int
+		inExecution  bool
+	)
+	delimiter := l.delimiter()
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case commentDepth > 0:
+			switch {
+			case strings.HasPrefix(text[i:], "*/"):
+				commentDepth--
+				i += 2
+			case l.Dialect == SQLDialectPostgreSQL && strings.HasPrefix(text[i:], "/*"):
+				// PostgreSQL 支持嵌套注释
+				commentDepth++
+				i += 2
+			default:
+				i++
+			}
+			continue
+		case inExecution && strings.HasPrefix(text[i:], "*/"):
+			inExecution = false
+			i += 2
+			continue
+		case isSQLSpace(c):
+			i++
+			continue
+		case !inExecution && strings.HasPrefix(text[i:], delimiter):
+			// 可执行注释中的分号由服务端处理, 客户端不会在此切分
+			tokens = append(tokens, SQLToken{Kind: SQLTokenDelimiter, Value: delimiter,
+				Start: i, End: i + len(delimiter)})
+			i += len(delimiter)
+			continue
+		case strings.HasPrefix(text[i:], "--") && isSQLDashComment(text[i:], l.Dialect):
+			i = skipSQLLine(text, i)
+			continue
+		case c == '#' && l.Dialect == SQLDialectMySQL:
+			i = skipSQLLine(text, i)
+			continue
+		case strings.HasPrefix(text[i:], "/*!") && l.Dialect == SQLDialectMySQL && !inExecution:
+			// 带版本号的可执行注释, 如 /*!50001 DROP TABLE t */
+			inExecution = true
+			i += 3
+			for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(text[i:], "/*"):
+			commentDepth++
+			i += 2
+			continue
+		case c == '\\' && l.Dialect == SQLDialectPostgreSQL:
+			var token SQLToken
+			if token, i = psqlMetaCommand(text, i); token.Kind == SQLTokenDelimiter {
+				tokens = append(tokens, token)
+			}
+			continue
+		case c == '\\' && l.Dialect == SQLDialectMySQL && i+1 < len(text) &&
+			(text[i+1] == 'G' || text[i+1] == 'g'):
+			tokens = append(tokens, SQLToken{Kind: SQLTokenDelimiter, Value: text[i : i+2],
+				Start: i, End: i + 2})
+			i += 2
+			continue
+		}
+		token := SQLToken{Start: i}
+		closed := true
+		switch {
+		case c == '\'':
+			// 去掉字符串前缀, 如 N'' E'' X''
+			escape := l.Dialect == SQLDialectMySQL
+			if n := len(tokens); n > 0 && tokens[n-1].End == i &&
+				tokens[n-1].isWord("N", "E", "X", "B") {
+				escape = escape || tokens[n-1].isWord("E")
+				token.Start = tokens[n-1].Start
+				tokens = tokens[:n-1]
+			}
+			token.Kind = SQLTokenString
+			token.Value, i, closed = readSQLQuoted(text, i, '\'', escape)
+		case c == '"' && l.Dialect == SQLDialectMySQL:
+			token.Kind = SQLTokenString
+			token.Value, i, closed = readSQLQuoted(text, i, '"', true)
+		case c == '"':
+			token.Kind = SQLTokenIdent
+			token.Value, i, closed = readSQLQuoted(text, i, '"', false)
+		case c == '`' && l.Dialect == SQLDialectMySQL:
+			token.Kind = SQLTokenIdent
+			token.Value, i, closed = readSQLQuoted(text, i, '`', false)
+		case c == '[' && l.Dialect == SQLDialectSQLServer:
+			token.Kind = SQLTokenIdent
+			token.Value, i, closed = readSQLQuoted(text, i, ']', false)
+		case c == '$' && l.Dialect == SQLDialectPostgreSQL && sqlDollarTag(text, i) != "":
+			tag := sqlDollarTag(text, i)
+			start := i + len(tag)
+			end := strings.Index(text[start:], tag)
+			if end < 0 {
+				end = len(text) - start
+				i = len(text)
+				closed = false
+			} else {
+				i = start + end + len(tag)
+			}
+			token.Kind = SQLTokenString
+			token.Value = text[start : start+end]
+		case isSQLIdentByte(c):
+			// 自定义的结束符可能由标识符字符组成, 如 $$
+			for i < len(text) && isSQLIdentByte(text[i]) && !strings.HasPrefix(text[i:], delimiter) {
+				i++
+			}
+			token.Kind = SQLTokenWord
+			token.Value = text[token.Start:i]
+		default:
+			_, size := utf8.DecodeRuneInString(text[i:])
+			token.Kind = SQLTokenSymbol
+			token.Value = text[i : i+size]
+			i += size
+		}
+		token.End = i
+		tokens = append(tokens, token)
+		if !closed {
+			return tokens, true
+		}
+	}
+	return tokens, commentDepth > 0 || inExecution
+}
+
+func (t SQLToken) isWord(words ...string) bool {
+	if t.Kind != SQLTokenWord {
+		return false
+	}
+	for i := range words {
+		if strings.EqualFold(t.Value, words[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// psqlSendCommands 发送查询缓冲区的 psql 元命令
+var psqlSendCommands = map[string]bool{
+	"g": true, "gx": true, "gset": true, "gexec": true, "gdesc": true,
+	"watch": true, "crosstabview": true,
+}
+
+/*
+	psqlMetaCommand 解析 i 处的 psql 元命令, 返回之后的位置。
+	元命令的参数到行尾或者 \\ 为止; \; 不发送缓冲区, 但分隔了两条语句, 同样视为结束符
+*/
+
+func psqlMetaCommand(text string, i int) (SQLToken, int) {
+	start := i
+	i++
+	if i < len(text) && text[i] == ';' {
+		return SQLToken{Kind: SQLTokenDelimiter, Value: text[start : i+1], Start: start, End: i + 1}, i + 1
+	}
+	if i < len(text) && text[i] == '\\' {
+		// \\ 分隔元命令和之后的 SQL
+		return SQLToken{Kind: SQLTokenSymbol, Value: text[start : i+1], Start: start, End: i + 1}, i + 1
+	}
+	for i < len(text) && (text[i] >= 'a' && text[i] <= 'z' || text[i] >= 'A' && text[i] <= 'Z') {
+		i++
+	}
+	name := text[start+1 : i]
+	for i < len(text) && text[i] != '\n' && !strings.HasPrefix(text[i:], "\\\\") {
+		i++
+	}
+	if strings.HasPrefix(text[i:], "\\\\") {
+		i += 2
+	}
+	kind := SQLTokenSymbol
+	if psqlSendCommands[name] {
+		kind = SQLTokenDelimiter
+	}
+	return SQLToken{Kind: kind, Value: "\\" + name, Start: start, End: i}, i
+}
+
+func isSQLSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+// isSQLIdentByte 非 ASCII 字符按标识符处理, 与 PostgreSQL 和 MySQL 一致
+func isSQLIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c == '@' || c >= utf8.RuneSelf ||
+		(c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isSQLDashComment(s string, dialect SQLDialect) bool {
+	// MySQL 要求 -- 之后必须是空白字符
+	if dialect == SQLDialectMySQL && len(s) > 2 {
+		return isSQLSpace(s[2]) || unicode.IsControl(rune(s[2]))
+	}
+	return true
+}
+
+func skipSQLLine(text string, i int) int {
+	if end := strings.IndexByte(text[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(text)
+}
+
+// readSQLQuoted 读取引号中的内容, 返回内容、结束引号之后的位置以及引号是否闭合
+func readSQLQuoted(text string, i int, quote byte, escape bool) (string, int, bool) {
+	var value strings.Builder
+	for i++; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escape && c == '\\' && i+1 < len(text):
+			i++
+			value.WriteByte(text[i])
+		case c == quote && i+1 < len(text) && text[i+1] == quote:
+			i++
+			value.WriteByte(c)
+		case c == quote:
+			return value.String(), i + 1, true
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String(), len(text), false
+}
+
+// sqlDollarTag 获取 PostgreSQL 的 $tag$ 开始标记, 不是开始标记则返回空
+func sqlDollarTag(text string, i int) string {
+	if i > 0 && isSQLIdentByte(text[i-1]) {
+		// 如 a$1$ 属于标识符的一部分
+		return ""
+	}
+	for j := i + 1; j < len(text); j++ {
+		c := text[j]
+		switch {
+		case c == '$':
+			return text[i : j+1]
+		case c >= '0' && c <= '9' && j == i+1:
+			// $1 是参数占位符
+			return ""
+		case !isSQLIdentByte(c) || c == '$':
+			return ""
+		}
+	}
+	return ""
+}
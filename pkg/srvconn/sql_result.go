@@ -0,0 +1,109 @@
+package srvconn
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+const sqlNullValue = "NULL"
+
+// writeSQLRows 以 mysql 客户端的风格输出查询结果, 返回结果行数
+func writeSQLRows(w io.Writer, rows *sql.Rows, vertical bool) (int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	data := make([][]string, 0, 16)
+	for rows.Next() {
+		if err = rows.Scan(scanArgs...); err != nil {
+			return 0, err
+		}
+		row := make([]string, len(columns))
+		for i := range values {
+			row[i] = formatSQLValue(values[i])
+		}
+		data = append(data, row)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if vertical {
+		writeSQLVertical(w, columns, data)
+		return len(data), nil
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetAutoFormatHeaders(false)
+	table.SetAutoWrapText(false)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader(columns)
+	table.AppendBulk(data)
+	table.Render()
+	return len(data), nil
+}
+
+func writeSQLVertical(w io.Writer, columns []string, data [][]string) {
+	width := 0
+	for i := range columns {
+		if n := utf8.RuneCountInString(columns[i]); n > width {
+			width = n
+		}
+	}
+	stars := strings.Repeat("*", 27)
+	for i := range data {
+		_, _ = fmt.Fprintf(w, "%s %d. row %s\n", stars, i+1, stars)
+		for j := range columns {
+			_, _ = fmt.Fprintf(w, "%*s: %s\n", width, columns[j], data[i][j])
+		}
+	}
+}
+
+func formatSQLValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return sqlNullValue
+	case []byte:
+		return string(value)
+	case time.Time:
+		return value.Format("2006-01-02 15:04:05")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func formatSQLRowsSummary(count int, cost time.Duration) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("Empty set (%.2f sec)", cost.Seconds())
+	case 1:
+		return fmt.Sprintf("1 row in set (%.2f sec)", cost.Seconds())
+	default:
+		return fmt.Sprintf("%d rows in set (%.2f sec)", count, cost.Seconds())
+	}
+}
+
+func formatSQLAffectedSummary(result sql.Result, cost time.Duration) string {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Sprintf("Query OK (%.2f sec)", cost.Seconds())
+	}
+	unit := "rows"
+	if affected == 1 {
+		unit = "row"
+	}
+	return fmt.Sprintf("Query OK, %d %s affected (%.2f sec)", affected, unit, cost.Seconds())
+}
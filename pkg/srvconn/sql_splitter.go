@@ -0,0 +1,104 @@
+package srvconn
+
+import "strings"
+
+const (
+	SQLDefaultDelimiter = ";"
+
+	mysqlVerticalTerminator = "\\G"
+)
+
+// SQLStatement 一条完整的 SQL 语句, Text 不包含结束符
+type SQLStatement struct {
+	Text       string
+	Terminator string
+}
+
+// SQLSplitter 按分隔符将多行输入切分为完整的语句, 引号和注释中的分隔符会被忽略
+type SQLSplitter struct {
+	Delimiter string
+
+	// MySQLDialect 支持 # 注释、反斜杠转义、反引号标识符以及 \G \g 结束符
+	MySQLDialect bool
+
+	// PostgreSQLDialect 支持 $tag$ 形式的字符串
+	PostgreSQLDialect bool
+
+	pending string
+}
+
+// Feed 追加一行输入, 返回已经完整的语句
+func (s *SQLSplitter) Feed(line string) []SQLStatement {
+	text := s.pending + line + "\n"
+	stmts, rest := s.split(text)
+	if strings.TrimSpace(rest) == "" {
+		rest = ""
+	}
+	s.pending = rest
+	return stmts
+}
+
+// Pending 是否还有未结束的语句
+func (s *SQLSplitter) Pending() bool {
+	return s.pending != ""
+}
+
+func (s *SQLSplitter) Reset() {
+	s.pending = ""
+}
+
+func (s *SQLSplitter) delimiter() string {
+	return s.lexer().delimiter()
+}
+
+func (s *SQLSplitter) lexer() SQLLexer {
+	lexer := SQLLexer{Delimiter: s.Delimiter}
+	switch {
+	case s.MySQLDialect:
+		lexer.Dialect = SQLDialectMySQL
+	case s.PostgreSQLDialect:
+		lexer.Dialect = SQLDialectPostgreSQL
+	}
+	return lexer
+}
+
+/*
+	split 在结束符处切分语句, 结束符由 SQLLexer 识别, 因此引号、注释中的结束符会被忽略。
+	最后一个结束符之后只有注释或者 psql 元命令时, 不再视为未结束的语句
+*/
+
+func (s *SQLSplitter) split(text string) (stmts []SQLStatement, rest string) {
+	tokens, open := s.lexer().Tokenize(text)
+	start := 0
+	pending := false
+	for i := range tokens {
+		if tokens[i].Kind != SQLTokenDelimiter {
+			pending = pending || tokens[i].Kind != SQLTokenSymbol || tokens[i].Value[0] != '\\'
+			continue
+		}
+		if stmt := strings.TrimSpace(text[start:tokens[i].Start]); stmt != "" && pending {
+			stmts = append(stmts, SQLStatement{Text: stmt, Terminator: tokens[i].Value})
+		}
+		start = tokens[i].End
+		pending = false
+	}
+	if !pending && !open {
+		return stmts, ""
+	}
+	return stmts, text[start:]
+}
+
+// sqlFirstKeyword 获取语句的第一个关键字(大写), 忽略开头的注释和括号
+func sqlFirstKeyword(stmt string) string {
+	tokens, _ := SQLLexer{Dialect: SQLDialectMySQL}.Tokenize(stmt)
+	for i := range tokens {
+		switch {
+		case tokens[i].Kind == SQLTokenSymbol && tokens[i].Value == "(":
+			continue
+		case tokens[i].Kind == SQLTokenWord:
+			return strings.ToUpper(tokens[i].Value)
+		}
+		break
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package srvconn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLSplitter_Feed(t *testing.T) {
+	s := SQLSplitter{MySQLDialect: true}
+	stmts := s.Feed("select 1; select ';' as a")
+	if len(stmts) != 1 || stmts[0].Text != "select 1" {
+		t.Fatalf("unexpected statements: %v", stmts)
+	}
+	if !s.Pending() {
+		t.Fatal("splitter should have pending statement")
+	}
+	stmts = s.Feed("from dual\\G")
+	if len(stmts) != 1 || stmts[0].Terminator != mysqlVerticalTerminator {
+		t.Fatalf("unexpected statements: %v", stmts)
+	}
+	if s.Pending() {
+		t.Fatal("splitter should not have pending statement")
+	}
+
+	s = SQLSplitter{Delimiter: "$$"}
+	stmts = s.Feed("create procedure p() begin select 1; end$$")
+	if len(stmts) != 1 || stmts[0].Text != "create procedure p() begin select 1; end" {
+		t.Fatalf("unexpected statements: %v", stmts)
+	}
+
+	s = SQLSplitter{PostgreSQLDialect: true}
+	stmts = s.Feed("create function f() returns int as $body$ begin; return 1; end $body$ language plpgsql;")
+	if len(stmts) != 1 || s.Pending() {
+		t.Fatalf("unexpected statements: %v", stmts)
+	}
+}
+
+func TestSQLSplitter_FeedPsqlMetaCommand(t *testing.T) {
+	tests := []struct {
+		lines   []string
+		stmts   []string
+		pending bool
+	}{
+		{[]string{`SELECT '\g'; DROP TABLE t;`}, []string{`SELECT '\g'`, "DROP TABLE t"}, false},
+		{[]string{`SELECT E'it\'s \g'`, "from t \\gx"}, []string{"SELECT E'it\\'s \\g'\nfrom t"}, false},
+		{[]string{"select 1 \\; drop table t"}, []string{"select 1"}, true},
+		{[]string{"select 1 -- \\g", "\\g"}, []string{"select 1 -- \\g"}, false},
+		{[]string{"\\d users"}, nil, false},
+		{[]string{"select 1 \\gset prefix_ \\\\ select 2;"}, []string{"select 1", "select 2"}, false},
+		{[]string{"select $$ \\g $$"}, nil, true},
+	}
+	for _, tt := range tests {
+		s := SQLSplitter{PostgreSQLDialect: true}
+		var texts []string
+		for _, line := range tt.lines {
+			for _, stmt := range s.Feed(line) {
+				texts = append(texts, stmt.Text)
+			}
+		}
+		if !reflect.DeepEqual(texts, tt.stmts) || s.Pending() != tt.pending {
+			t.Fatalf("%q: unexpected statements %q, pending %v", tt.lines, texts, s.Pending())
+		}
+	}
+}
+
+func TestSplitRedisArgs(t *testing.T) {
+	args, err := SplitRedisArgs(`set "hello world" 'it\'s' "\x41\n"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"set", "hello world", "it's", "A\n"}
+	if len(args) != len(expected) {
+		t.Fatalf("unexpected args: %q", args)
+	}
+	for i := range expected {
+		if args[i] != expected[i] {
+			t.Fatalf("unexpected args: %q", args)
+		}
+	}
+	if _, err = SplitRedisArgs(`get "key`); err == nil {
+		t.Fatal("unbalanced quotes should be invalid")
+	}
+}
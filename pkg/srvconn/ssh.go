@@ -1,6 +1,7 @@
 package srvconn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -11,7 +12,10 @@ import (
 
 	gossh "golang.org/x/crypto/ssh"
 
+	"github.com/jumpserver/koko/pkg/hostkey"
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/sshca"
+	"github.com/jumpserver/koko/pkg/tracing"
 )
 
 type SSHClientOption func(conf *SSHClientOptions)
@@ -27,11 +31,29 @@ type SSHClientOptions struct {
 	keyboardAuth gossh.KeyboardInteractiveChallenge
 	PrivateAuth  gossh.Signer
 
+	// 配置时签发短期证书认证, 证书的 principal 为 Username
+	certAuthority *sshca.Authority
+	certKeyID     string
+	certOpts      []sshca.CertOption
+
+	// HostKeyCallback 校验目标的 host key, 为空时使用全局 host key 存储按网关校验
+	HostKeyCallback gossh.HostKeyCallback
+
 	proxySSHClientOptions []SSHClientOptions
+
+	ctx context.Context
 }
 
 func (cfg *SSHClientOptions) AuthMethods() []gossh.AuthMethod {
-	authMethods := make([]gossh.AuthMethod, 0, 3)
+	authMethods := make([]gossh.AuthMethod, 0, 4)
+	if cfg.certAuthority != nil {
+		// 证书优先, 资产不信任 CA 时继续使用系统用户的凭据
+		if certSigner, err := cfg.certAuthority.NewCertSigner(cfg.Username, cfg.certKeyID, cfg.certOpts...); err == nil {
+			authMethods = append(authMethods, gossh.PublicKeys(certSigner))
+		} else {
+			logger.Errorf("Sign certificate for %s@%s err: %s", cfg.Username, cfg.Host, err)
+		}
+	}
 	if cfg.Password != "" {
 		authMethods = append(authMethods, gossh.Password(cfg.Password))
 	}
@@ -129,12 +151,34 @@ func SSHClientProxyClient(proxyArgs ...SSHClientOptions) SSHClientOption {
 	}
 }
 
+// SSHClientCertAuthority 使用 ca 签发的短期证书认证, keyID 记录在证书中便于资产审计, ca 为空时不签发
+func SSHClientCertAuthority(ca *sshca.Authority, keyID string, opts ...sshca.CertOption) SSHClientOption {
+	return func(conf *SSHClientOptions) {
+		conf.certAuthority = ca
+		conf.certKeyID = keyID
+		conf.certOpts = opts
+	}
+}
+
+func SSHClientHostKeyCallback(callback gossh.HostKeyCallback) SSHClientOption {
+	return func(conf *SSHClientOptions) {
+		conf.HostKeyCallback = callback
+	}
+}
+
 func SSHClientKeyboardAuth(keyboardAuth gossh.KeyboardInteractiveChallenge) SSHClientOption {
 	return func(conf *SSHClientOptions) {
 		conf.keyboardAuth = keyboardAuth
 	}
 }
 
+// SSHClientContext 设置链路追踪的上下文, 握手过程记录为 ctx 中 span 的子 span
+func SSHClientContext(ctx context.Context) SSHClientOption {
+	return func(conf *SSHClientOptions) {
+		conf.ctx = ctx
+	}
+}
+
 func NewSSHClient(opts ...SSHClientOption) (*SSHClient, error) {
 	cfg := &SSHClientOptions{
 		Host: "127.0.0.1",
@@ -152,21 +196,56 @@ var (
 	ErrSSHClient   = errors.New("new ssh client failed")
 )
 
-func getAvailableProxyClient(cfgs ...SSHClientOptions) (*SSHClient, error) {
+// GetAvailableGatewayClient 依次连接网关, 返回第一个可用网关的 client
+func GetAvailableGatewayClient(ctx context.Context, cfgs ...SSHClientOptions) (*SSHClient, error) {
+	return getAvailableProxyClient(ctx, cfgs...)
+}
+
+func getAvailableProxyClient(ctx context.Context, cfgs ...SSHClientOptions) (*SSHClient, error) {
+	var hostKeyErr error
 	for i := range cfgs {
-		if proxyClient, err := NewSSHClientWithCfg(&cfgs[i]); err == nil {
+		proxyCfg := cfgs[i]
+		proxyCfg.ctx = ctx
+		proxyClient, err := NewSSHClientWithCfg(&proxyCfg)
+		if err == nil {
 			return proxyClient, nil
 		}
+		if errors.Is(err, hostkey.ErrHostKeyMismatch) || errors.Is(err, hostkey.ErrHostKeyUnknown) {
+			hostKeyErr = err
+		}
+	}
+	// 网关的 host key 校验失败时返回具体原因, 方便管理员排查
+	if hostKeyErr != nil {
+		return nil, hostKeyErr
 	}
 	return nil, ErrNoAvailable
 }
 
-func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
+func NewSSHClientWithCfg(cfg *SSHClientOptions) (client *SSHClient, err error) {
+	traceCtx, span := tracing.Start(cfg.ctx, "ssh.handshake",
+		tracing.String("net.peer.name", cfg.Host),
+		tracing.String("net.peer.port", cfg.Port),
+		tracing.String("ssh.user", cfg.Username),
+		tracing.Bool("koko.via_gateway", len(cfg.proxySSHClientOptions) > 0))
+	span.SetKind(tracing.SpanKindClient)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	hostKeyCallback := cfg.HostKeyCallback
+	if hostKeyCallback == nil {
+		hostKeyCallback = hostkey.HostKeyCallback("")
+	}
+	// gossh 握手失败时丢失了错误类型, 保存 host key 校验的错误直接返回
+	var hostKeyErr error
 	gosshCfg := gossh.ClientConfig{
-		User:              cfg.Username,
-		Auth:              cfg.AuthMethods(),
-		Timeout:           time.Duration(cfg.Timeout) * time.Second,
-		HostKeyCallback:   gossh.InsecureIgnoreHostKey(),
+		User:    cfg.Username,
+		Auth:    cfg.AuthMethods(),
+		Timeout: time.Duration(cfg.Timeout) * time.Second,
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			hostKeyErr = hostKeyCallback(hostname, remote, key)
+			return hostKeyErr
+		},
 		HostKeyAlgorithms: supportedHostKeyAlgos,
 		Config: gossh.Config{
 			KeyExchanges: supportedKexAlgos,
@@ -175,7 +254,7 @@ func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
 	}
 	destAddr := net.JoinHostPort(cfg.Host, cfg.Port)
 	if len(cfg.proxySSHClientOptions) > 0 {
-		proxyClient, err := getAvailableProxyClient(cfg.proxySSHClientOptions...)
+		proxyClient, err := getAvailableProxyClient(traceCtx, cfg.proxySSHClientOptions...)
 		if err != nil {
 			logger.Errorf("Get gateway client err: %s", err)
 			return nil, err
@@ -190,6 +269,9 @@ func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
 		if err != nil {
 			_ = proxyClient.Close()
 			_ = destConn.Close()
+			if hostKeyErr != nil {
+				return nil, hostKeyErr
+			}
 			return nil, fmt.Errorf("%w: %s", ErrSSHClient, err)
 		}
 		gosshClient := gossh.NewClient(proxyConn, chans, reqs)
@@ -199,6 +281,9 @@ func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
 	}
 	gosshClient, err := gossh.Dial("tcp", destAddr, &gosshCfg)
 	if err != nil {
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
 		return nil, err
 	}
 	return &SSHClient{Client: gosshClient, Cfg: cfg,
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/metrics"
 )
 
 type UserSSHClient struct {
@@ -139,6 +140,7 @@ func (s *SSHManager) run() {
 func (s *SSHManager) getClientFromCache(key string) (*SSHClient, bool) {
 	s.reqChan <- key
 	client := <-s.resultChan
+	observeClientCache(client != nil)
 	return client, client != nil
 }
 
@@ -152,9 +154,18 @@ func (s *SSHManager) AddClientCache(key string, client *SSHClient) {
 func (s *SSHManager) searchSSHClientFromCache(prefixKey string) (client *SSHClient, ok bool) {
 	s.searchChan <- prefixKey
 	client = <-s.resultChan
+	observeClientCache(client != nil)
 	return client, client != nil
 }
 
+func observeClientCache(hit bool) {
+	if hit {
+		metrics.SSHClientCacheRequests.Inc(metrics.ResultHit)
+		return
+	}
+	metrics.SSHClientCacheRequests.Inc(metrics.ResultMiss)
+}
+
 type storeClient struct {
 	reqId string
 	*SSHClient
@@ -0,0 +1,200 @@
+package sshca
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+/*
+	OpenSSH 证书:
+	UserChecker 校验用户登录 koko 时使用的证书, 证书需要由配置的 CA 签发, 登录用户名必须在证书的 principals 中。
+	Authority 使用本地的签名密钥为连接资产签发短期证书, 每次连接生成新的临时密钥,
+	资产只需要信任 CA 公钥 (TrustedUserCAKeys), 不再依赖系统用户的密码或私钥。
+*/
+
+var (
+	ErrNotUserCert      = errors.New("not a user certificate")
+	ErrUnknownAuthority = errors.New("certificate signed by unknown authority")
+	ErrSourceAddress    = errors.New("source address not allowed by certificate")
+)
+
+const sourceAddressOption = "source-address"
+
+// LoadPublicKeys 读取 authorized_keys 格式的 CA 公钥文件, 忽略空行和注释
+func LoadPublicKeys(path string) ([]gossh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []gossh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse ca keys %s: %w", path, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no ca key found in %s", path)
+	}
+	return keys, nil
+}
+
+type UserChecker struct {
+	authorities map[string]bool
+
+	checker gossh.CertChecker
+}
+
+func NewUserChecker(caKeys []gossh.PublicKey) *UserChecker {
+	c := &UserChecker{authorities: make(map[string]bool, len(caKeys))}
+	for _, key := range caKeys {
+		c.authorities[string(key.Marshal())] = true
+	}
+	c.checker.IsUserAuthority = c.IsUserAuthority
+	return c
+}
+
+func (c *UserChecker) IsUserAuthority(auth gossh.PublicKey) bool {
+	return c.authorities[string(auth.Marshal())]
+}
+
+/*
+	Check 校验证书的签发 CA、类型、有效期、签名和 principals,
+	证书限制了 source-address 时同时校验客户端地址
+*/
+
+func (c *UserChecker) Check(username string, cert *gossh.Certificate, remoteAddr net.Addr) error {
+	if cert.CertType != gossh.UserCert {
+		return ErrNotUserCert
+	}
+	if !c.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("%w: %s", ErrUnknownAuthority, gossh.FingerprintSHA256(cert.SignatureKey))
+	}
+	if err := c.checker.CheckCert(username, cert); err != nil {
+		return err
+	}
+	if sourceAddrs, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		return checkSourceAddress(remoteAddr, sourceAddrs)
+	}
+	return nil
+}
+
+func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s", ErrSourceAddress, host)
+	}
+	for _, sourceAddr := range strings.Split(sourceAddrs, ",") {
+		sourceAddr = strings.TrimSpace(sourceAddr)
+		if allowedIP := net.ParseIP(sourceAddr); allowedIP != nil && allowedIP.Equal(ip) {
+			return nil
+		}
+		if _, ipNet, err := net.ParseCIDR(sourceAddr); err == nil && ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSourceAddress, host)
+}
+
+// Authority 为连接资产签发短期用户证书
+type Authority struct {
+	signer gossh.Signer
+	ttl    time.Duration
+}
+
+var defaultAuthority *Authority
+
+// Setup 启用资产的证书认证, ttl 为签发证书的有效期
+func Setup(signer gossh.Signer, ttl time.Duration) *Authority {
+	defaultAuthority = NewAuthority(signer, ttl)
+	return defaultAuthority
+}
+
+// Default 返回全局的证书签发者, 未启用时为 nil
+func Default() *Authority {
+	return defaultAuthority
+}
+
+func NewAuthority(signer gossh.Signer, ttl time.Duration) *Authority {
+	return &Authority{signer: signer, ttl: ttl}
+}
+
+// LoadSigner 读取签发证书使用的 CA 私钥
+func LoadSigner(path, passphrase string) (gossh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return gossh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	return gossh.ParsePrivateKey(data)
+}
+
+// CertOption 设置签发证书的扩展权限
+type CertOption func(extensions map[string]string)
+
+// CertPermitAgentForwarding 会话开启 agent 转发时允许资产使用转发的 agent
+func CertPermitAgentForwarding() CertOption {
+	return func(extensions map[string]string) {
+		extensions["permit-agent-forwarding"] = ""
+	}
+}
+
+/*
+	NewCertSigner 为 principal 签发证书并返回使用临时密钥和证书的 Signer,
+	有效期从一分钟前开始以容忍资产的时钟偏差。
+	证书默认只允许分配 pty, 其他权限由 opts 按会话开启
+*/
+
+func (a *Authority) NewCertSigner(principal, keyID string, opts ...CertOption) (gossh.Signer, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	var serial [8]byte
+	if _, err = rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	extensions := map[string]string{"permit-pty": ""}
+	for _, setter := range opts {
+		setter(extensions)
+	}
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        gossh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(a.ttl).Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: extensions,
+		},
+	}
+	if err = cert.SignCert(rand.Reader, a.signer); err != nil {
+		return nil, err
+	}
+	return gossh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,84 @@
+package sshca
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) gossh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestAuthorityAndUserChecker(t *testing.T) {
+	caSigner := newSigner(t)
+	authority := NewAuthority(caSigner, 5*time.Minute)
+	certSigner, err := authority.NewCertSigner("admin", "koko-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := certSigner.PublicKey().(*gossh.Certificate)
+	if !ok {
+		t.Fatal("signer should use certificate")
+	}
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 50022}
+	checker := NewUserChecker([]gossh.PublicKey{caSigner.PublicKey()})
+	if err = checker.Check("admin", cert, remoteAddr); err != nil {
+		t.Fatalf("valid certificate refused: %s", err)
+	}
+	if err = checker.Check("root", cert, remoteAddr); err == nil {
+		t.Fatal("principal not in certificate should be refused")
+	}
+	otherChecker := NewUserChecker([]gossh.PublicKey{newSigner(t).PublicKey()})
+	if err = otherChecker.Check("admin", cert, remoteAddr); !errors.Is(err, ErrUnknownAuthority) {
+		t.Fatalf("unknown authority should be refused, got %v", err)
+	}
+
+	cert.CriticalOptions = map[string]string{sourceAddressOption: "192.168.0.0/16,10.0.0.6"}
+	if err = cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	if err = checker.Check("admin", cert, remoteAddr); !errors.Is(err, ErrSourceAddress) {
+		t.Fatalf("source address should be refused, got %v", err)
+	}
+	if err = checker.Check("admin", cert, &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}); err != nil {
+		t.Fatalf("allowed source address refused: %s", err)
+	}
+}
+
+func TestCertSignerExtensions(t *testing.T) {
+	authority := NewAuthority(newSigner(t), 5*time.Minute)
+	certSigner, err := authority.NewCertSigner("admin", "koko-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensions := certSigner.PublicKey().(*gossh.Certificate).Extensions
+	if len(extensions) != 1 {
+		t.Fatalf("default certificate should only permit pty, got %v", extensions)
+	}
+	if _, ok := extensions["permit-pty"]; !ok {
+		t.Fatalf("default certificate should permit pty, got %v", extensions)
+	}
+
+	certSigner, err = authority.NewCertSigner("admin", "koko-test", CertPermitAgentForwarding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensions = certSigner.PublicKey().(*gossh.Certificate).Extensions
+	if _, ok := extensions["permit-agent-forwarding"]; !ok || len(extensions) != 2 {
+		t.Fatalf("certificate should permit agent forwarding, got %v", extensions)
+	}
+}
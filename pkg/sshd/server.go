@@ -11,12 +11,16 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/jumpserver/koko/pkg/logger"
+	"github.com/jumpserver/koko/pkg/tracing"
 )
 
 const (
 	sshChannelSession     = "session"
 	sshChannelDirectTCPIP = "direct-tcpip"
 	sshSubSystemSFTP      = "sftp"
+
+	sshRequestTCPIPForward       = "tcpip-forward"
+	sshRequestCancelTCPIPForward = "cancel-tcpip-forward"
 )
 
 type Server struct {
@@ -50,6 +54,9 @@ type SSHHandler interface {
 	SFTPHandler(ssh.Session)
 	LocalPortForwardingPermission(ctx ssh.Context, destinationHost string, destinationPort uint32) bool
 	DirectTCPIPChannelHandler(ctx ssh.Context, newChan gossh.NewChannel, destAddr string)
+	ReversePortForwardingPermission(ctx ssh.Context, bindHost string, bindPort uint32) bool
+	RemotePortForwardHandler(ctx ssh.Context, bindHost string, bindPort uint32) error
+	CancelRemotePortForwardHandler(ctx ssh.Context, bindHost string, bindPort uint32)
 }
 
 type AuthStatus ssh.AuthResult
@@ -65,6 +72,9 @@ func NewSSHServer(handler SSHHandler) *Server {
 		LocalPortForwardingCallback: func(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
 			return handler.LocalPortForwardingPermission(ctx, destinationHost, destinationPort)
 		},
+		ReversePortForwardingCallback: func(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+			return handler.ReversePortForwardingPermission(ctx, bindHost, bindPort)
+		},
 		Addr: handler.GetSSHAddr(),
 		KeyboardInteractiveHandler: func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) ssh.AuthResult {
 			return ssh.AuthResult(handler.KeyboardInteractiveAuth(ctx, challenger))
@@ -78,8 +88,9 @@ func NewSSHServer(handler SSHHandler) *Server {
 		NextAuthMethodsHandler: func(ctx ssh.Context) []string {
 			return handler.NextAuthMethodsHandler(ctx)
 		},
-		HostSigners: []ssh.Signer{handler.GetSSHSigner()},
-		Handler:     handler.SessionHandler,
+		ConnCallback: traceConnection,
+		HostSigners:  []ssh.Signer{handler.GetSSHSigner()},
+		Handler:      handler.SessionHandler,
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			sshSubSystemSFTP: handler.SFTPHandler,
 		},
@@ -100,10 +111,60 @@ func NewSSHServer(handler SSHHandler) *Server {
 				handler.DirectTCPIPChannelHandler(ctx, newChan, dest)
 			},
 		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			sshRequestTCPIPForward: func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+				remoteD := remoteForwardRequest{}
+				if err := gossh.Unmarshal(req.Payload, &remoteD); err != nil {
+					logger.Errorf("Parse tcpip-forward request err: %s", err)
+					return false, nil
+				}
+				if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, remoteD.BindAddr, remoteD.BindPort) {
+					return false, []byte("port forwarding is disabled")
+				}
+				if err := handler.RemotePortForwardHandler(ctx, remoteD.BindAddr, remoteD.BindPort); err != nil {
+					return false, []byte(err.Error())
+				}
+				return true, nil
+			},
+			sshRequestCancelTCPIPForward: func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+				remoteD := remoteForwardRequest{}
+				if err := gossh.Unmarshal(req.Payload, &remoteD); err != nil {
+					logger.Errorf("Parse cancel-tcpip-forward request err: %s", err)
+					return false, nil
+				}
+				handler.CancelRemotePortForwardHandler(ctx, remoteD.BindAddr, remoteD.BindPort)
+				return true, nil
+			},
+		},
 	}
 	return &Server{srv}
 }
 
+/*
+	每个 SSH 连接创建一条链路的根 span, 存入 ssh.Context 供认证和会话流程使用,
+	连接关闭时结束
+*/
+
+func traceConnection(ctx ssh.Context, conn net.Conn) net.Conn {
+	_, span := tracing.Start(ctx, "ssh.connection",
+		tracing.String("net.peer.addr", conn.RemoteAddr().String()))
+	if span == nil {
+		return conn
+	}
+	span.SetKind(tracing.SpanKindServer)
+	ctx.SetValue(tracing.ContextKey, span)
+	go func() {
+		<-ctx.Done()
+		span.End()
+	}()
+	return conn
+}
+
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
 type localForwardChannelData struct {
 	DestAddr string
 	DestPort uint32
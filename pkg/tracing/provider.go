@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	queueSize     = 2048
+	maxBatchSize  = 512
+	flushInterval = 5 * time.Second
+)
+
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Close() error
+}
+
+// ErrorHandler 处理导出失败, 由调用方决定如何记录日志
+type ErrorHandler func(err error)
+
+type provider struct {
+	exporter Exporter
+	onError  ErrorHandler
+	queue    chan *Span
+	flushReq chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+var (
+	providerLock   sync.RWMutex
+	globalProvider *provider
+)
+
+func currentProvider() *provider {
+	providerLock.RLock()
+	defer providerLock.RUnlock()
+	return globalProvider
+}
+
+/*
+	Setup 启用追踪, 结束的 span 在后台按批次交给 exporter,
+	队列满时直接丢弃, 不阻塞业务流程
+*/
+
+func Setup(exporter Exporter, onError ErrorHandler) {
+	p := &provider{
+		exporter: exporter,
+		onError:  onError,
+		queue:    make(chan *Span, queueSize),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	providerLock.Lock()
+	old := globalProvider
+	globalProvider = p
+	providerLock.Unlock()
+	if old != nil {
+		old.shutdown(context.Background())
+	}
+	go p.run()
+}
+
+// Shutdown 导出剩余的 span 并关闭 exporter
+func Shutdown(ctx context.Context) {
+	providerLock.Lock()
+	p := globalProvider
+	globalProvider = nil
+	providerLock.Unlock()
+	if p != nil {
+		p.shutdown(ctx)
+	}
+}
+
+// Flush 等待当前队列中的 span 导出完成
+func Flush(ctx context.Context) {
+	if p := currentProvider(); p != nil {
+		p.flush(ctx)
+	}
+}
+
+func (p *provider) enqueue(span *Span) {
+	select {
+	case p.queue <- span:
+	default:
+	}
+}
+
+func (p *provider) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, maxBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := p.exporter.Export(ctx, batch); err != nil && p.onError != nil {
+			p.onError(err)
+		}
+		cancel()
+		batch = make([]*Span, 0, maxBatchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-p.queue:
+				batch = append(batch, span)
+				if len(batch) >= maxBatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-p.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ch := <-p.flushReq:
+			drain()
+			close(ch)
+		case <-p.done:
+			drain()
+			if err := p.exporter.Close(); err != nil && p.onError != nil {
+				p.onError(err)
+			}
+			close(p.stopped)
+			return
+		}
+	}
+}
+
+func (p *provider) flush(ctx context.Context) {
+	ch := make(chan struct{})
+	select {
+	case p.flushReq <- ch:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+}
+
+func (p *provider) shutdown(ctx context.Context) {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		select {
+		case <-p.stopped:
+		case <-ctx.Done():
+		}
+	})
+}
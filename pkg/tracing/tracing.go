@@ -0,0 +1,206 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+	轻量的链路追踪实现, span 结构与 OpenTelemetry 一致, 以 OTLP JSON 格式导出。
+	未调用 Setup 时 Start 返回 nil span, span 的方法都可以安全地在 nil 上调用。
+*/
+
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+type SpanKind int
+
+// 与 OTLP 的 SpanKind 取值一致
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+type Span struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID
+	Name     string
+	Kind     SpanKind
+
+	lock          sync.Mutex
+	start         time.Time
+	end           time.Time
+	attributes    []Attribute
+	statusCode    StatusCode
+	statusMessage string
+	ended         bool
+
+	provider *provider
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes = append(s.attributes, attrs...)
+}
+
+func (s *Span) SetKind(kind SpanKind) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Kind = kind
+}
+
+// RecordError 记录错误并将 span 状态置为 error, err 为 nil 时忽略
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+func (s *Span) SetStatus(code StatusCode, msg string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusCode = code
+	s.statusMessage = msg
+}
+
+// End 结束 span 并交给导出队列, 重复调用只生效一次
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.lock.Unlock()
+	s.provider.enqueue(s)
+}
+
+// TraceParent 返回 W3C traceparent 头, 用于将链路传递给 core
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+type contextKey struct{}
+
+// ContextKey 用于把 span 存入 ssh.Context 这类可以直接设置值的上下文
+var ContextKey = contextKey{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ContextKey, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(ContextKey).(*Span)
+	return span
+}
+
+/*
+	Detach 返回只携带 ctx 中 span 的新 context, 不随 ctx 取消,
+	用于连接断开后仍需完成的 API 请求(如取消工单、更新会话状态)
+*/
+
+func Detach(ctx context.Context) context.Context {
+	return ContextWithSpan(context.Background(), SpanFromContext(ctx))
+}
+
+/*
+	Start 创建新的 span, ctx 中已有 span 时作为其子 span, 否则开始一条新的链路。
+	未启用追踪时返回原 ctx 和 nil span。
+*/
+
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	p := currentProvider()
+	if p == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{
+		Name:       name,
+		Kind:       SpanKindInternal,
+		start:      time.Now(),
+		attributes: attrs,
+		provider:   p,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.TraceID[:])
+	}
+	_, _ = rand.Read(span.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop")
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("expected nil span when tracing is disabled")
+	}
+	span.SetAttributes(String("k", "v"))
+	span.RecordError(errors.New("err"))
+	span.End()
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Setup(exporter, func(err error) { t.Error(err) })
+
+	ctx, root := Start(context.Background(), "ssh.connection", String("user", "admin"))
+	_, child := Start(ctx, "core.api", Int("http.status_code", 500))
+	child.RecordError(errors.New("api failed"))
+	child.End()
+	root.End()
+	Shutdown(context.Background())
+
+	if child.TraceID != root.TraceID || child.ParentID != root.SpanID || root.ParentID.IsValid() {
+		t.Fatalf("unexpected span linkage: root %s/%s child %s/%s parent %s",
+			root.TraceID, root.SpanID, child.TraceID, child.SpanID, child.ParentID)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req otlpRequest
+	if err = json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("invalid otlp json %s: %s", data, err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "core.api" || spans[0].ParentSpanID != root.SpanID.String() ||
+		spans[0].Status.Code != StatusError || spans[0].Attributes[0].Value["intValue"] != "500" {
+		t.Errorf("unexpected child span: %+v", spans[0])
+	}
+	if spans[1].TraceID != root.TraceID.String() || spans[1].ParentSpanID != "" {
+		t.Errorf("unexpected root span: %+v", spans[1])
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers := ParseHeaders("Authorization=Bearer a=b, x-org = 1,invalid")
+	if len(headers) != 2 || headers["Authorization"] != "Bearer a=b" || headers["x-org"] != "1" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+}
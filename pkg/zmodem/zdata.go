@@ -0,0 +1,71 @@
+package zmodem
+
+/*
+	zdataDecoder 解码 ZDATA 头之后的数据子包:
+	数据中的 ZDLE 转义字节还原, 未转义的 XON/XOFF 忽略,
+	ZDLE ZCRCx 结束一个子包, 之后是 crcLen 字节的 CRC (可能被转义),
+	ZCRCG、ZCRCQ 之后继续下一个子包, ZCRCE、ZCRCW 之后数据帧结束, 后面是新的头部。
+*/
+
+type zdataDecoder struct {
+	crcLen    int
+	gotZDLE   bool
+	crcRemain int
+	frameEnd  bool
+}
+
+// decode 返回解码的数据和已处理的字节数, done 表示数据帧已结束
+func (d *zdataDecoder) decode(p []byte) (data []byte, n int, done bool) {
+	data = make([]byte, 0, len(p))
+	for i, b := range p {
+		if d.crcRemain > 0 {
+			switch {
+			case d.gotZDLE:
+				d.gotZDLE = false
+				d.crcRemain--
+			case b == ZDLE:
+				d.gotZDLE = true
+			case isFlowControl(b):
+			default:
+				d.crcRemain--
+			}
+			if d.crcRemain == 0 && d.frameEnd {
+				return data, i + 1, true
+			}
+			continue
+		}
+		if d.gotZDLE {
+			d.gotZDLE = false
+			switch b {
+			case ZCRCE, ZCRCW:
+				d.crcRemain = d.crcLen
+				d.frameEnd = true
+			case ZCRCG, ZCRCQ:
+				d.crcRemain = d.crcLen
+			case ZRUB0:
+				data = append(data, 0x7f)
+			case ZRUB1:
+				data = append(data, 0xff)
+			default:
+				data = append(data, b^0x40)
+			}
+			continue
+		}
+		switch {
+		case b == ZDLE:
+			d.gotZDLE = true
+		case isFlowControl(b):
+		default:
+			data = append(data, b)
+		}
+	}
+	return data, len(p), false
+}
+
+func isFlowControl(b byte) bool {
+	switch b {
+	case 0x11, 0x13, 0x91, 0x93:
+		return true
+	}
+	return false
+}
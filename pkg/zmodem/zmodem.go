@@ -28,6 +28,9 @@ type ZmodemParser struct {
 
 	FileEventCallback func(zinfo *ZFileInfo, status bool)
 
+	// FileDataCallback 收到文件数据时调用, offset 是数据在文件中的偏移
+	FileDataCallback func(zinfo *ZFileInfo, offset int64, p []byte)
+
 	currentZFileInfo *ZFileInfo
 
 	currentHeader *ZmodemHeader
@@ -91,6 +94,7 @@ func (z *ZmodemParser) Parse(p []byte) {
 			},
 			ZFileHeaderCallback: z.zFileFrameCallback,
 			zOnHeader:           z.OnHeader,
+			zDataCallback:       z.zDataCallback,
 		}
 		z.setStatus(ZParserStatusSend)
 		if z.FireStatusEvent != nil {
@@ -108,6 +112,7 @@ func (z *ZmodemParser) Parse(p []byte) {
 			},
 			ZFileHeaderCallback: z.zFileFrameCallback,
 			zOnHeader:           z.OnHeader,
+			zDataCallback:       z.zDataCallback,
 		}
 		z.setStatus(ZParserStatusReceive)
 		if z.FireStatusEvent != nil {
@@ -178,6 +183,12 @@ func (z *ZmodemParser) zFileFrameCallback(info *ZFileInfo) {
 	logger.Infof("Zmodem parser got filename: %s siz: %d", info.filename, info.size)
 }
 
+func (z *ZmodemParser) zDataCallback(offset int64, p []byte) {
+	if z.FileDataCallback != nil && z.currentZFileInfo != nil && !z.abortMark {
+		z.FileDataCallback(z.currentZFileInfo, offset, p)
+	}
+}
+
 func (z *ZmodemParser) IsZFilePacket() bool {
 	return z.currentHeader != nil && z.currentHeader.Type == ZFILE
 }
@@ -1,6 +1,7 @@
 package zmodem
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -22,3 +23,31 @@ func TestDecodeB16FrameHeader(t *testing.T) {
 	}
 	t.Logf("frame len: %d, parse offset: %d\n", len(jsFileFrame), offset)
 }
+
+func TestZSessionFileData(t *testing.T) {
+	var (
+		data    []byte
+		offsets []int64
+	)
+	s := &ZSession{Type: TypeUpload, zDataCallback: func(offset int64, p []byte) {
+		offsets = append(offsets, offset)
+		data = append(data, p...)
+	}}
+	// ZDATA 头部, 偏移 2
+	frame := []byte{ZPAD, ZDLE, ZBIN, ZDATA, 0x02, 0x00, 0x00, 0x00, 0x12, 0x34}
+	// 子包 "he" ZDLE(转义) 0x7f(ZRUB0) "lo", ZCRCG 继续
+	frame = append(frame, 'h', 'e', ZDLE, ZDLE^0x40, ZDLE, ZRUB0, 0x11, 'l', 'o', ZDLE, ZCRCG, 0x01, ZDLE, 0x51)
+	// 子包 "world", ZCRCE 结束
+	frame = append(frame, 'w', 'o', 'r', 'l', 'd', ZDLE, ZCRCE, 0x03, 0x04)
+	frame = append(frame, ZPAD, ZDLE, ZBIN, ZEOF, 0x0c, 0x00, 0x00, 0x00, 0x56, 0x78)
+	s.consume(frame[:10])
+	s.consume(frame[10:16])
+	s.consume(frame[16:])
+	expected := []byte{'h', 'e', ZDLE, 0x7f, 'l', 'o', 'w', 'o', 'r', 'l', 'd'}
+	if !bytes.Equal(data, expected) || offsets[0] != 2 {
+		t.Fatalf("decode zdata got %q offsets %v", data, offsets)
+	}
+	if s.dataDecoder != nil || s.currentHd == nil || s.currentHd.Type != ZEOF {
+		t.Fatal("zdata frame should end before ZEOF header")
+	}
+}
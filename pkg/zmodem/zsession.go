@@ -184,6 +184,11 @@ type ZSession struct {
 	ZFileHeaderCallback func(zInfo *ZFileInfo)
 
 	zOnHeader func(hd *ZmodemHeader)
+
+	// ZDATA 之后的数据子包
+	dataDecoder   *zdataDecoder
+	dataOffset    int64
+	zDataCallback func(offset int64, p []byte)
 }
 
 // zsession 入口
@@ -205,6 +210,10 @@ func (s *ZSession) consume(p []byte) {
 		s.transferStatus = TransferStatusAbort
 		return
 	}
+	if s.dataDecoder != nil {
+		s.consumeData(p)
+		return
+	}
 	if s.IsNeedSubPacket() {
 		s.subPacketBuf.Write(p)
 		s.consumeSubPacket()
@@ -317,6 +326,8 @@ func (s *ZSession) getHexHeader(p []byte) {
 		if s.IsNeedSubPacket() {
 			s.subPacketBuf.Write(p[offset:])
 		}
+		// hex 头部的 offset 是结尾换行符的位置
+		s.startData(&hd, 2, p[offset+1:])
 	}
 }
 
@@ -326,6 +337,7 @@ func (s *ZSession) getB16Header(p []byte) {
 		if s.IsNeedSubPacket() {
 			s.subPacketBuf.Write(p[offset:])
 		}
+		s.startData(&hd, 2, p[offset:])
 	}
 }
 
@@ -335,6 +347,7 @@ func (s *ZSession) getB32Header(p []byte) {
 		if s.IsNeedSubPacket() {
 			s.subPacketBuf.Write(p[offset:])
 		}
+		s.startData(&hd, 4, p[offset:])
 	}
 }
 
@@ -360,6 +373,31 @@ func (s *ZSession) onHeader(hd *ZmodemHeader) {
 	logger.Debugf("Zmodem Session type: %s receive header type: %s", s.Type, FrameType(hd.Type))
 }
 
+// startData 在 ZDATA 头之后开始解码数据子包, 数据的偏移由头部的 P0-P3 给出
+func (s *ZSession) startData(hd *ZmodemHeader, crcLen int, remain []byte) {
+	if hd.Type != ZDATA || s.zDataCallback == nil {
+		return
+	}
+	s.dataDecoder = &zdataDecoder{crcLen: crcLen}
+	s.dataOffset = int64(hd.ZF0) | int64(hd.ZF1)<<8 | int64(hd.ZF2)<<16 | int64(hd.ZF3)<<24
+	s.consumeData(remain)
+}
+
+func (s *ZSession) consumeData(p []byte) {
+	data, n, done := s.dataDecoder.decode(p)
+	if len(data) > 0 {
+		s.zDataCallback(s.dataOffset, data)
+		s.dataOffset += int64(len(data))
+	}
+	if !done {
+		return
+	}
+	s.dataDecoder = nil
+	if n < len(p) {
+		s.consume(p[n:])
+	}
+}
+
 func (s *ZSession) IsEnd() bool {
 	return s.haveEnd || s.transferStatus == TransferStatusAbort
 }